@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type fieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type planChange struct {
+	Kind    string        `json:"kind"`
+	Action  string        `json:"action"`
+	Name    string        `json:"name"`
+	Changes []fieldChange `json:"changes"`
+	Status  string        `json:"status"`
+	Error   string        `json:"error"`
+}
+
+type applyResult struct {
+	DryRun  bool         `json:"dry_run"`
+	Prune   bool         `json:"prune"`
+	Plan    []planChange `json:"plan"`
+	Applied int          `json:"applied"`
+	Failed  int          `json:"failed"`
+}
+
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	c := clientFlags(fs)
+	file := fs.String("f", "", "desired state document, - for stdin")
+	prune := fs.Bool("prune", false, "disable replicas the document does not list")
+	dryRun := fs.Bool("dry-run", false, "only show the plan")
+	fs.Parse(args)
+
+	if *file == "" {
+		return usagef("-f is required")
+	}
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+	var document []byte
+	var err error
+	if *file == "-" {
+		document, err = io.ReadAll(os.Stdin)
+	} else {
+		document, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("prune", fmt.Sprint(*prune))
+	query.Set("dry_run", fmt.Sprint(*dryRun))
+
+	var raw json.RawMessage
+	if err := c.do(http.MethodPost, "/admin/apply?"+query.Encode(), "application/yaml", bytes.NewReader(document), &raw); err != nil {
+		return err
+	}
+	var result applyResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return err
+	}
+
+	if c.output == outputTable {
+		printPlan(result)
+	} else if err := c.render(raw, nil); err != nil {
+		return err
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d changes failed", result.Failed)
+	}
+	return nil
+}
+
+func printPlan(result applyResult) {
+	if len(result.Plan) == 0 {
+		fmt.Println("No changes, the load balancer matches the desired state.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tKIND\tNAME\tCHANGES\tSTATUS")
+	for _, change := range result.Plan {
+		fields := make([]string, 0, len(change.Changes))
+		for _, f := range change.Changes {
+			fields = append(fields, fmt.Sprintf("%s: %v -> %v", f.Field, f.From, f.To))
+		}
+		status := change.Status
+		if change.Error != "" {
+			status += " (" + change.Error + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", change.Action, change.Kind, change.Name, strings.Join(fields, ", "), status)
+	}
+	tw.Flush()
+
+	if result.DryRun {
+		fmt.Printf("\n%d changes planned, run without -dry-run to apply them.\n", len(result.Plan))
+		return
+	}
+	fmt.Printf("\n%d applied, %d failed.\n", result.Applied, result.Failed)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a cached login, kept in the user's config directory
+type credentials struct {
+	Server    string    `json:"server"`
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (c *credentials) expired() bool {
+	return !c.ExpiresAt.IsZero() && time.Now().After(c.ExpiresAt)
+}
+
+func credentialsPath() (string, error) {
+	if path := os.Getenv("LBADMIN_CREDENTIALS"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lbadmin", "credentials.json"), nil
+}
+
+func loadCredentials() (*credentials, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cached credentials
+	if err := json.Unmarshal(raw, &cached); err != nil {
+		return nil, fmt.Errorf("corrupt credentials file %s: %v", path, err)
+	}
+	return &cached, nil
+}
+
+func saveCredentials(cached *credentials) error {
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0600)
+}
+
+// reads the expiry from the token's claims, the signature is the server's business
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+func runLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	c := clientFlags(fs)
+	username := fs.String("u", os.Getenv("LBADMIN_USERNAME"), "username (LBADMIN_USERNAME)")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of LBADMIN_PASSWORD")
+	fs.Parse(args)
+
+	if err := c.resolve(false); err != nil {
+		return err
+	}
+	if *username == "" {
+		return usagef("a username is required, use -u or LBADMIN_USERNAME")
+	}
+
+	password := os.Getenv("LBADMIN_PASSWORD")
+	if *passwordStdin || password == "" {
+		if !*passwordStdin {
+			fmt.Fprint(os.Stderr, "Password: ")
+		}
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return usagef("no password given")
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	body, err := json.Marshal(map[string]string{"username": *username, "password": password})
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Post(strings.TrimSuffix(c.server, "/")+"/admin/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return &connectionError{err}
+	}
+	defer resp.Body.Close()
+
+	// login answers with the token next to success instead of under data
+	var result struct {
+		Success bool     `json:"success"`
+		Token   string   `json:"token"`
+		Message []string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return &apiError{Status: resp.StatusCode}
+	}
+	if resp.StatusCode != http.StatusOK || !result.Success || result.Token == "" {
+		return &apiError{Status: resp.StatusCode, Messages: result.Message}
+	}
+
+	cached := &credentials{
+		Server:    c.server,
+		Username:  *username,
+		Token:     result.Token,
+		ExpiresAt: tokenExpiry(result.Token),
+	}
+	if err := saveCredentials(cached); err != nil {
+		return fmt.Errorf("logged in but failed to cache the token: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Logged in to %s as %s", c.server, *username)
+	if !cached.ExpiresAt.IsZero() {
+		fmt.Fprintf(os.Stderr, " until %s", cached.ExpiresAt.Format(time.RFC3339))
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
+
+func runLogout(args []string) error {
+	fs := flag.NewFlagSet("logout", flag.ExitOnError)
+	fs.Parse(args)
+
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Logged out")
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultServer = "http://localhost:8080"
+
+var errNotLoggedIn = errors.New("not logged in, run 'lbadmin login' or set LBADMIN_TOKEN")
+
+type client struct {
+	server string
+	token  string
+	output string
+	http   *http.Client
+}
+
+// registers the flags every command that talks to the API understands
+func clientFlags(fs *flag.FlagSet) *client {
+	c := &client{http: &http.Client{Timeout: 2 * time.Minute}}
+	fs.StringVar(&c.server, "server", "", "admin API address (LBADMIN_SERVER, defaults to the server logged in to)")
+	fs.StringVar(&c.token, "token", os.Getenv("LBADMIN_TOKEN"), "bearer token (LBADMIN_TOKEN, defaults to the cached login)")
+	fs.StringVar(&c.output, "o", envOr("LBADMIN_OUTPUT", outputTable), "output format: table, json or yaml (LBADMIN_OUTPUT)")
+	return c
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// fills in the server and token from the environment and the credentials cache
+func (c *client) resolve(requireToken bool) error {
+	if c.output != outputTable && c.output != outputJSON && c.output != outputYAML {
+		return usagef("unknown output format %q, expected table, json or yaml", c.output)
+	}
+
+	cached, _ := loadCredentials()
+	if c.server == "" {
+		c.server = os.Getenv("LBADMIN_SERVER")
+	}
+	if c.server == "" && cached != nil {
+		c.server = cached.Server
+	}
+	if c.server == "" {
+		c.server = defaultServer
+	}
+
+	if c.token == "" && cached != nil && cached.Server == c.server && !cached.expired() {
+		c.token = cached.Token
+	}
+	if requireToken && c.token == "" {
+		return errNotLoggedIn
+	}
+	return nil
+}
+
+// the envelope every API response is wrapped in
+type apiResponse struct {
+	Success bool            `json:"success"`
+	Message json.RawMessage `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type apiError struct {
+	Status   int
+	Messages []string
+}
+
+func (e *apiError) Error() string {
+	if len(e.Messages) == 0 {
+		return fmt.Sprintf("request failed with status %d", e.Status)
+	}
+	return strings.Join(e.Messages, "; ")
+}
+
+type connectionError struct{ err error }
+
+func (e *connectionError) Error() string { return e.err.Error() }
+func (e *connectionError) Unwrap() error { return e.err }
+
+// sends a request and decodes the data of the response into out
+func (c *client) do(method, path, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.server, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return &connectionError{err}
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &connectionError{err}
+	}
+
+	var envelope apiResponse
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		// the auth middleware answers in plain text
+		return &apiError{Status: resp.StatusCode, Messages: []string{strings.TrimSpace(string(raw))}}
+	}
+	if resp.StatusCode >= 300 || !envelope.Success {
+		apiErr := &apiError{Status: resp.StatusCode}
+		if err := json.Unmarshal(envelope.Message, &apiErr.Messages); err != nil && len(envelope.Message) > 0 {
+			apiErr.Messages = []string{string(envelope.Message)}
+		}
+		return apiErr
+	}
+
+	if out != nil && len(envelope.Data) > 0 {
+		return json.Unmarshal(envelope.Data, out)
+	}
+	return nil
+}
+
+func (c *client) get(path string, out interface{}) error {
+	return c.do(http.MethodGet, path, "", nil, out)
+}
+
+func (c *client) send(method, path string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.do(method, path, "application/json", bytes.NewReader(body), out)
+}
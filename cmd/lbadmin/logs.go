@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type activityLog struct {
+	Id        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+	ReplicaId *int64    `json:"replica_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// the most logs fetched per poll while following
+const followBatch = 500
+
+func runLogs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	c := clientFlags(fs)
+	limit := fs.Int("n", 20, "number of recent entries to show")
+	follow := fs.Bool("f", false, "keep printing new entries as they are logged")
+	interval := fs.Duration("interval", 2*time.Second, "how often to poll while following")
+	fs.Parse(args)
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return usagef("-interval must be positive")
+	}
+
+	lastId, err := printLogs(c, 0, *limit)
+	if err != nil || !*follow {
+		return err
+	}
+
+	for {
+		time.Sleep(*interval)
+		newest, err := printLogs(c, lastId, followBatch)
+		if err != nil {
+			return err
+		}
+		if newest > lastId {
+			lastId = newest
+		}
+	}
+}
+
+// prints entries newer than afterId oldest first and returns the newest id printed
+func printLogs(c *client, afterId int64, limit int) (int64, error) {
+	var logs []activityLog
+	if err := c.get(fmt.Sprintf("/admin/activity-logs?after_id=%d&limit=%d", afterId, limit), &logs); err != nil {
+		return afterId, err
+	}
+
+	newest := afterId
+	for i := len(logs) - 1; i >= 0; i-- {
+		entry := logs[i]
+		if entry.Id > newest {
+			newest = entry.Id
+		}
+
+		// one document per entry so followed output can be streamed into other tools
+		switch c.output {
+		case outputJSON:
+			if err := json.NewEncoder(os.Stdout).Encode(entry); err != nil {
+				return newest, err
+			}
+		case outputYAML:
+			fmt.Println("---")
+			if err := yaml.NewEncoder(os.Stdout).Encode(entry); err != nil {
+				return newest, err
+			}
+		default:
+			fmt.Printf("%s  %-8s %s\n", entry.CreatedAt.Local().Format(time.DateTime), entry.Type, entry.Message)
+		}
+	}
+	return newest, nil
+}
@@ -0,0 +1,135 @@
+// lbadmin is a command line client for the load balancer admin API.
+//
+// Exit codes: 0 success, 1 failure, 2 usage error, 3 not logged in or unauthorized,
+// 4 not found, 5 rejected by validation or a conflict, 6 server unreachable or failing.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitAuth        = 3
+	exitNotFound    = 4
+	exitInvalid     = 5
+	exitUnavailable = 6
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"login", "log in and cache the token", runLogin},
+	{"logout", "forget the cached token", runLogout},
+	{"replica", "list, add, remove replicas and change their status", runReplica},
+	{"params", "get, set and show the history of Prequal parameters", runParams},
+	{"logs", "show or follow the activity log", runLogs},
+	{"stats", "show request statistics per replica", runStats},
+	{"apply", "apply a desired state document (pools, replicas, parameters)", runApply},
+}
+
+// usageError is returned for bad invocations, it exits with exitUsage
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: lbadmin <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "run 'lbadmin <command> -h' for the flags of a command")
+}
+
+// maps an error to the exit code pipelines can act on
+func exitCode(err error) int {
+	var usageErr usageError
+	if errors.As(err, &usageErr) {
+		return exitUsage
+	}
+	if errors.Is(err, errNotLoggedIn) {
+		return exitAuth
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Status == 401 || apiErr.Status == 403:
+			return exitAuth
+		case apiErr.Status == 404:
+			return exitNotFound
+		case apiErr.Status == 400 || apiErr.Status == 409:
+			return exitInvalid
+		case apiErr.Status >= 500:
+			return exitUnavailable
+		}
+		return exitFailure
+	}
+
+	var connErr *connectionError
+	if errors.As(err, &connErr) {
+		return exitUnavailable
+	}
+	return exitFailure
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		if err := c.run(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(exitOK)
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(exitUsage)
+}
+
+// subcommand dispatch for command groups such as 'lbadmin replica list'
+func runSubcommand(group string, subcommands []command, args []string) error {
+	if len(args) == 0 {
+		return usagef("%s needs a subcommand: %s", group, subcommandNames(subcommands))
+	}
+	for _, c := range subcommands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	return usagef("unknown %s subcommand %q, expected one of: %s", group, args[0], subcommandNames(subcommands))
+}
+
+func subcommandNames(subcommands []command) string {
+	names := ""
+	for i, c := range subcommands {
+		if i > 0 {
+			names += ", "
+		}
+		names += c.name
+	}
+	return names
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+type table struct {
+	headers []string
+	rows    [][]string
+}
+
+func (t *table) add(cells ...interface{}) {
+	row := make([]string, len(cells))
+	for i, cell := range cells {
+		row[i] = fmt.Sprint(cell)
+	}
+	t.rows = append(t.rows, row)
+}
+
+func (t *table) print() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.headers, "\t"))
+	for _, row := range t.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+// prints the raw API data as JSON or YAML, or as the table built from it
+func (c *client) render(raw json.RawMessage, build func() (*table, error)) error {
+	switch c.output {
+	case outputJSON:
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case outputYAML:
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		return yaml.NewEncoder(os.Stdout).Encode(value)
+	}
+
+	t, err := build()
+	if err != nil {
+		return err
+	}
+	t.print()
+	return nil
+}
+
+// prints a plain message, or wraps it so JSON and YAML output stay machine readable
+func (c *client) message(msg string) error {
+	raw, err := json.Marshal(map[string]string{"message": msg})
+	if err != nil {
+		return err
+	}
+	if c.output == outputTable {
+		fmt.Println(msg)
+		return nil
+	}
+	return c.render(raw, nil)
+}
+
+// labels as key=value pairs sorted by key
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type parameters struct {
+	Id                int       `json:"id"`
+	MaxLifeTime       int       `json:"max_life_time"`
+	PoolSize          int       `json:"pool_size"`
+	ProbeFactor       float64   `json:"probe_factor"`
+	ProbeRemoveFactor int       `json:"probe_remove_factor"`
+	Mu                int       `json:"mu"`
+	Status            string    `json:"status"`
+	PoolId            *int64    `json:"pool_id"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+func runParams(args []string) error {
+	return runSubcommand("params", []command{
+		{"get", "show the active parameters", runParamsGet},
+		{"set", "store and publish new parameters", runParamsSet},
+		{"history", "list every stored parameter set", runParamsHistory},
+	}, args)
+}
+
+func parametersTable(sets []parameters) *table {
+	t := &table{headers: []string{"ID", "MAX_LIFE_TIME", "POOL_SIZE", "PROBE_FACTOR", "PROBE_REMOVE_FACTOR", "MU", "STATUS", "CREATED"}}
+	for _, p := range sets {
+		t.add(p.Id, p.MaxLifeTime, p.PoolSize, p.ProbeFactor, p.ProbeRemoveFactor, p.Mu, p.Status, p.CreatedAt.Format(time.RFC3339))
+	}
+	return t
+}
+
+// the parameters endpoints of a pool, or the global ones without a pool
+func parametersPath(pool int64, global, pooled string) string {
+	if pool == 0 {
+		return global
+	}
+	return fmt.Sprintf("/admin/pools/%d/prequal-parameters%s", pool, pooled)
+}
+
+func runParamsGet(args []string) error {
+	fs := flag.NewFlagSet("params get", flag.ExitOnError)
+	c := clientFlags(fs)
+	pool := fs.Int64("pool", 0, "pool id, the global parameters without it")
+	fs.Parse(args)
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+
+	var raw json.RawMessage
+	if err := c.get(parametersPath(*pool, "/admin/get-prequal-parameters", ""), &raw); err != nil {
+		return err
+	}
+	return c.render(raw, func() (*table, error) {
+		var active parameters
+		if err := json.Unmarshal(raw, &active); err != nil {
+			return nil, err
+		}
+		return parametersTable([]parameters{active}), nil
+	})
+}
+
+func runParamsSet(args []string) error {
+	fs := flag.NewFlagSet("params set", flag.ExitOnError)
+	c := clientFlags(fs)
+	pool := fs.Int64("pool", 0, "pool id, the global parameters without it")
+	maxLifeTime := fs.Int("max-life-time", 0, "max_life_time")
+	poolSize := fs.Int("pool-size", 0, "pool_size")
+	probeFactor := fs.Float64("probe-factor", 0, "probe_factor")
+	probeRemoveFactor := fs.Int("probe-remove-factor", 0, "probe_remove_factor")
+	mu := fs.Int("mu", 0, "mu")
+	fs.Parse(args)
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"max_life_time":       *maxLifeTime,
+		"pool_size":           *poolSize,
+		"probe_factor":        *probeFactor,
+		"probe_remove_factor": *probeRemoveFactor,
+		"mu":                  *mu,
+	}
+
+	var raw json.RawMessage
+	path := parametersPath(*pool, "/admin/update-prequal-parameters", "")
+	if err := c.send(http.MethodPost, path, payload, &raw); err != nil {
+		return err
+	}
+
+	// the global endpoint answers with a message, the pool one with the stored parameters
+	var msg string
+	if json.Unmarshal(raw, &msg) == nil {
+		return c.message(msg)
+	}
+	return c.render(raw, func() (*table, error) {
+		var saved parameters
+		if err := json.Unmarshal(raw, &saved); err != nil {
+			return nil, err
+		}
+		return parametersTable([]parameters{saved}), nil
+	})
+}
+
+func runParamsHistory(args []string) error {
+	fs := flag.NewFlagSet("params history", flag.ExitOnError)
+	c := clientFlags(fs)
+	pool := fs.Int64("pool", 0, "pool id, the global parameters without it")
+	limit := fs.Int("n", 20, "number of parameter sets to show, 0 for all")
+	fs.Parse(args)
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s?limit=%d", parametersPath(*pool, "/admin/prequal-parameters/history", "/history"), *limit)
+	var raw json.RawMessage
+	if err := c.get(path, &raw); err != nil {
+		return err
+	}
+	return c.render(raw, func() (*table, error) {
+		var history []parameters
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, err
+		}
+		return parametersTable(history), nil
+	})
+}
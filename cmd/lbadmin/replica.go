@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type replica struct {
+	Id                  int64             `json:"id"`
+	Name                string            `json:"name"`
+	URL                 string            `json:"url"`
+	Status              string            `json:"status"`
+	HealthCheckEndpoint string            `json:"health_check_point"`
+	Weight              int               `json:"weight"`
+	MaxConcurrent       int               `json:"max_concurrent_requests"`
+	CapacityClass       string            `json:"capacity_class"`
+	PoolId              *int64            `json:"pool_id"`
+	Labels              map[string]string `json:"labels"`
+}
+
+// collects repeated -label key=value flags
+type labelFlag map[string]string
+
+func (l labelFlag) String() string { return formatLabels(l) }
+
+func (l labelFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	l[key] = val
+	return nil
+}
+
+func runReplica(args []string) error {
+	return runSubcommand("replica", []command{
+		{"list", "list replicas", runReplicaList},
+		{"add", "add a replica", runReplicaAdd},
+		{"remove", "disable a replica, draining it first unless forced", runReplicaRemove},
+		{"status", "change the status of a replica", runReplicaStatus},
+	}, args)
+}
+
+func replicaTable(replicas []replica) *table {
+	t := &table{headers: []string{"ID", "NAME", "URL", "STATUS", "WEIGHT", "POOL", "LABELS"}}
+	for _, r := range replicas {
+		pool := "-"
+		if r.PoolId != nil {
+			pool = fmt.Sprint(*r.PoolId)
+		}
+		t.add(r.Id, r.Name, r.URL, r.Status, r.Weight, pool, formatLabels(r.Labels))
+	}
+	return t
+}
+
+func runReplicaList(args []string) error {
+	fs := flag.NewFlagSet("replica list", flag.ExitOnError)
+	c := clientFlags(fs)
+	selector := fs.String("selector", "", "label selector, e.g. zone=a,!canary")
+	fs.Parse(args)
+	if err := c.resolve(false); err != nil {
+		return err
+	}
+
+	path := "/admin/get-replica"
+	if *selector != "" {
+		path += "?selector=" + url.QueryEscape(*selector)
+	}
+	var raw json.RawMessage
+	if err := c.get(path, &raw); err != nil {
+		return err
+	}
+
+	return c.render(raw, func() (*table, error) {
+		var replicas []replica
+		if err := json.Unmarshal(raw, &replicas); err != nil {
+			return nil, err
+		}
+		return replicaTable(replicas), nil
+	})
+}
+
+func runReplicaAdd(args []string) error {
+	fs := flag.NewFlagSet("replica add", flag.ExitOnError)
+	c := clientFlags(fs)
+	name := fs.String("name", "", "replica name")
+	rawUrl := fs.String("url", "", "replica url")
+	healthCheck := fs.String("health-check", "", "health check endpoint, defaults to the pool's")
+	weight := fs.Int("weight", 0, "relative weight, defaults to 1")
+	maxConcurrent := fs.Int("max-concurrent", 0, "max concurrent requests, 0 for unlimited")
+	capacityClass := fs.String("capacity-class", "", "small, standard or large")
+	pool := fs.Int64("pool", 0, "id of the pool to add the replica to")
+	labels := labelFlag{}
+	fs.Var(labels, "label", "label as key=value, can be repeated")
+	fs.Parse(args)
+
+	if *name == "" || *rawUrl == "" {
+		return usagef("-name and -url are required")
+	}
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"name":                    *name,
+		"url":                     *rawUrl,
+		"health_check_endpoint":   *healthCheck,
+		"weight":                  *weight,
+		"max_concurrent_requests": *maxConcurrent,
+		"capacity_class":          *capacityClass,
+		"labels":                  map[string]string(labels),
+	}
+	path := "/admin/add-replica"
+	if *pool != 0 {
+		path = fmt.Sprintf("/admin/pools/%d/replicas", *pool)
+	}
+
+	var raw json.RawMessage
+	if err := c.send(http.MethodPost, path, payload, &raw); err != nil {
+		return err
+	}
+	return c.render(raw, func() (*table, error) {
+		var added replica
+		if err := json.Unmarshal(raw, &added); err != nil {
+			return nil, err
+		}
+		return replicaTable([]replica{added}), nil
+	})
+}
+
+// flags of commands that may take a replica out of rotation
+func drainFlags(fs *flag.FlagSet) (*bool, *time.Duration) {
+	force := fs.Bool("force", false, "disable right away instead of draining")
+	timeout := fs.Duration("drain-timeout", 0, "how long to drain at most, defaults to the server's")
+	return force, timeout
+}
+
+func drainPayload(payload map[string]interface{}, force bool, timeout time.Duration) {
+	if force {
+		payload["force"] = true
+	}
+	if timeout > 0 {
+		payload["drain_timeout_seconds"] = int(timeout.Seconds())
+	}
+}
+
+func runReplicaRemove(args []string) error {
+	fs := flag.NewFlagSet("replica remove", flag.ExitOnError)
+	c := clientFlags(fs)
+	id := fs.Int64("id", 0, "replica id")
+	rawUrl := fs.String("url", "", "replica url, instead of -id")
+	force, timeout := drainFlags(fs)
+	fs.Parse(args)
+
+	if (*id == 0) == (*rawUrl == "") {
+		return usagef("exactly one of -id or -url is required")
+	}
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{}
+	if *id != 0 {
+		payload["id"] = *id
+	} else {
+		payload["url"] = *rawUrl
+	}
+	drainPayload(payload, *force, *timeout)
+
+	var msg string
+	if err := c.send(http.MethodDelete, "/admin/remove-replica", payload, &msg); err != nil {
+		return err
+	}
+	return c.message(msg)
+}
+
+func runReplicaStatus(args []string) error {
+	fs := flag.NewFlagSet("replica status", flag.ExitOnError)
+	c := clientFlags(fs)
+	id := fs.Int64("id", 0, "replica id")
+	status := fs.String("status", "", "active, inactive, draining or disabled")
+	force, timeout := drainFlags(fs)
+	fs.Parse(args)
+
+	if *id == 0 || *status == "" {
+		return usagef("-id and -status are required")
+	}
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{"id": *id, "status": *status}
+	drainPayload(payload, *force, *timeout)
+
+	var msg string
+	if err := c.send(http.MethodPatch, "/admin/change-status", payload, &msg); err != nil {
+		return err
+	}
+	return c.message(msg)
+}
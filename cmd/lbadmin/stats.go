@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+)
+
+type replicaStatistics struct {
+	URL                string `json:"url"`
+	SuccessfulRequests int64  `json:"successful_requests"`
+	FailedRequests     int64  `json:"failed_requests"`
+	Replica            *struct {
+		Name string `json:"name"`
+	} `json:"Replica"`
+}
+
+type statisticsAggregate struct {
+	Replicas           int   `json:"replicas"`
+	SuccessfulRequests int64 `json:"successful_requests"`
+	FailedRequests     int64 `json:"failed_requests"`
+	Groups             []struct {
+		Value              string `json:"value"`
+		Replicas           int    `json:"replicas"`
+		SuccessfulRequests int64  `json:"successful_requests"`
+		FailedRequests     int64  `json:"failed_requests"`
+	} `json:"groups"`
+}
+
+func errorRate(successful, failed int64) string {
+	if successful+failed == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", float64(failed)/float64(successful+failed)*100)
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	c := clientFlags(fs)
+	selector := fs.String("selector", "", "label selector, e.g. zone=a")
+	groupBy := fs.String("group-by", "", "aggregate by the value of this label")
+	fs.Parse(args)
+	if err := c.resolve(true); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *selector != "" {
+		query.Set("selector", *selector)
+	}
+
+	if *groupBy != "" {
+		query.Set("group_by", *groupBy)
+		var raw json.RawMessage
+		if err := c.get("/admin/statistics/aggregate?"+query.Encode(), &raw); err != nil {
+			return err
+		}
+		return c.render(raw, func() (*table, error) {
+			var aggregate statisticsAggregate
+			if err := json.Unmarshal(raw, &aggregate); err != nil {
+				return nil, err
+			}
+			t := &table{headers: []string{*groupBy, "REPLICAS", "SUCCESSFUL", "FAILED", "ERROR_RATE"}}
+			for _, g := range aggregate.Groups {
+				t.add(g.Value, g.Replicas, g.SuccessfulRequests, g.FailedRequests, errorRate(g.SuccessfulRequests, g.FailedRequests))
+			}
+			t.add("TOTAL", aggregate.Replicas, aggregate.SuccessfulRequests, aggregate.FailedRequests, errorRate(aggregate.SuccessfulRequests, aggregate.FailedRequests))
+			return t, nil
+		})
+	}
+
+	var raw json.RawMessage
+	if err := c.get("/admin/get-statistics?"+query.Encode(), &raw); err != nil {
+		return err
+	}
+	return c.render(raw, func() (*table, error) {
+		var stats []replicaStatistics
+		if err := json.Unmarshal(raw, &stats); err != nil {
+			return nil, err
+		}
+		t := &table{headers: []string{"REPLICA", "URL", "SUCCESSFUL", "FAILED", "ERROR_RATE"}}
+		var successful, failed int64
+		for _, s := range stats {
+			name := "-"
+			if s.Replica != nil {
+				name = s.Replica.Name
+			}
+			t.add(name, s.URL, s.SuccessfulRequests, s.FailedRequests, errorRate(s.SuccessfulRequests, s.FailedRequests))
+			successful += s.SuccessfulRequests
+			failed += s.FailedRequests
+		}
+		t.add("TOTAL", "", successful, failed, errorRate(successful, failed))
+		return t, nil
+	})
+}
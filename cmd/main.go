@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
 	"github.com/AshimKoirala/load-balancer-admin/pkg/handlers"
 	"github.com/joho/godotenv"
 )
@@ -28,6 +29,10 @@ func main() {
 	// 	log.Println("Email sent successfully!")
 	//    }
 
+	if !db.ParameterApprovalRequired() {
+		log.Println("PARAMETER_APPROVAL_REQUIRED is false, parameters can be changed without an approved draft")
+	}
+
 	messaging.InitializePublisher()
 	defer messaging.CleanupPublisher()
 
@@ -35,5 +40,14 @@ func main() {
 		messaging.SetupConsumer()
 	}()
 
+	go messaging.StartDrainMonitor()
+	go messaging.StartMaintenanceScheduler()
+	go messaging.StartStateSync()
+	go messaging.StartProxyLivenessMonitor()
+	go messaging.StartProcessedMessagesCleanup()
+	go messaging.StartParameterDraftExpiry()
+	go messaging.StartRolloutController()
+	go messaging.StartAutoTuner()
+
 	handlers.Handler()
 }
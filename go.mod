@@ -11,6 +11,7 @@ require (
 	github.com/uptrace/bun v1.2.5
 	github.com/uptrace/bun/dialect/pgdialect v1.2.5
 	golang.org/x/crypto v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
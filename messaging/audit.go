@@ -0,0 +1,133 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+// urls of the replicas a message is about, looked up in the body of the envelope: a url
+// string, an object with a url, or a list of objects with a url or replica_name
+func messageReplicas(envelope []byte) []string {
+	var msg struct {
+		Body json.RawMessage `json:"body"`
+	}
+	if err := json.Unmarshal(envelope, &msg); err != nil || len(msg.Body) == 0 {
+		return nil
+	}
+
+	var url string
+	if err := json.Unmarshal(msg.Body, &url); err == nil {
+		if strings.Contains(url, "://") {
+			return []string{url}
+		}
+		return nil
+	}
+
+	type replicaRef struct {
+		URL         string `json:"url"`
+		ReplicaName string `json:"replica_name"`
+	}
+	var single replicaRef
+	if err := json.Unmarshal(msg.Body, &single); err == nil {
+		if single.URL != "" {
+			return []string{single.URL}
+		}
+		return nil
+	}
+
+	var list []replicaRef
+	if err := json.Unmarshal(msg.Body, &list); err != nil {
+		return nil
+	}
+	var urls []string
+	for _, ref := range list {
+		if ref.URL != "" {
+			urls = append(urls, ref.URL)
+		} else if ref.ReplicaName != "" {
+			urls = append(urls, ref.ReplicaName)
+		}
+	}
+	return urls
+}
+
+func recordMessageAudit(entry *db.MessageAudit) {
+	if err := db.RecordMessageAudit(context.Background(), entry); err != nil {
+		log.Print(err)
+	}
+}
+
+// ReplayMessage runs an audited inbound message through processMessage again, or sends
+// an audited outbound command again under a new message id. The replay is audited as a
+// new message. Inbound messages that were already processed are skipped unless forced.
+func ReplayMessage(entry *db.MessageAudit, force bool) (*db.MessageAudit, error) {
+	switch entry.Direction {
+	case db.MESSAGE_INBOUND:
+		return processInbound(entry.Body, entry.MessageId, &entry.Id, force), nil
+	case db.MESSAGE_OUTBOUND:
+		return publish(entry.Queue, entry.Name, entry.Body, &entry.Id)
+	default:
+		return nil, fmt.Errorf("unknown message direction %q", entry.Direction)
+	}
+}
+
+// processes a message from the proxy and audits it with its outcome. A message whose id
+// was processed before is skipped unless forced, the id falls back to the one in the envelope.
+func processInbound(body []byte, messageId string, replayedFrom *int64, force bool) *db.MessageAudit {
+	start := time.Now()
+	ctx := context.Background()
+
+	// a broken envelope is reported by dispatchMessage
+	var envelope Message
+	_ = json.Unmarshal(body, &envelope)
+	if messageId == "" {
+		messageId = envelope.Id
+	}
+
+	if !force && alreadyProcessed(ctx, messageId) {
+		log.Printf("Skipping duplicate %s message %s", envelope.Name, messageId)
+		entry := &db.MessageAudit{
+			Direction:    db.MESSAGE_INBOUND,
+			MessageId:    messageId,
+			Name:         envelope.Name,
+			Instance:     envelope.Instance,
+			Queue:        CONSUMING_QUEUE,
+			Body:         body,
+			Replicas:     messageReplicas(body),
+			Outcome:      db.MESSAGE_DUPLICATE,
+			ReplayedFrom: replayedFrom,
+		}
+		recordMessageAudit(entry)
+		return entry
+	}
+
+	msg, err := dispatchMessage(withMessageId(ctx, messageId), body)
+
+	entry := &db.MessageAudit{
+		Direction:    db.MESSAGE_INBOUND,
+		MessageId:    messageId,
+		Name:         msg.Name,
+		Instance:     msg.Instance,
+		Queue:        CONSUMING_QUEUE,
+		Body:         body,
+		Replicas:     messageReplicas(body),
+		Outcome:      db.MESSAGE_PROCESSED,
+		DurationMs:   int(time.Since(start).Milliseconds()),
+		ReplayedFrom: replayedFrom,
+	}
+	if err != nil {
+		log.Printf("Failed to process %s message: %v", msg.Name, err)
+		entry.Outcome = db.MESSAGE_FAILED
+		entry.Error = err.Error()
+	} else {
+		markProcessed(ctx, messageId, msg.Name)
+	}
+
+	recordMessageAudit(entry)
+	return entry
+}
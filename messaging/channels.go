@@ -0,0 +1,167 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const DEFAULT_PUBLISHER_CHANNELS = 4
+const DEFAULT_PUBLISH_CONFIRM_TIMEOUT = 5 * time.Second
+
+var errUnroutable = errors.New("message was unroutable")
+
+// PublisherChannels is how many channels publish at once, configured with PUBLISHER_CHANNELS.
+func PublisherChannels() int {
+	return envInt("PUBLISHER_CHANNELS", DEFAULT_PUBLISHER_CHANNELS)
+}
+
+// PublishConfirmTimeout is how long a publish waits for RabbitMQ to confirm the message,
+// configured with PUBLISH_CONFIRM_TIMEOUT (e.g. 2s, 500ms).
+func PublishConfirmTimeout() time.Duration {
+	raw := os.Getenv("PUBLISH_CONFIRM_TIMEOUT")
+	if raw == "" {
+		return DEFAULT_PUBLISH_CONFIRM_TIMEOUT
+	}
+
+	timeout, err := time.ParseDuration(raw)
+	if err != nil || timeout <= 0 {
+		log.Printf("Invalid PUBLISH_CONFIRM_TIMEOUT %q, using %s", raw, DEFAULT_PUBLISH_CONFIRM_TIMEOUT)
+		return DEFAULT_PUBLISH_CONFIRM_TIMEOUT
+	}
+	return timeout
+}
+
+// a channel in confirm mode with the messages RabbitMQ returned as unroutable
+type publisherChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+// channels are handed to one caller at a time, a slot holds nil until its channel is
+// (re)opened, so a broken channel never shrinks the pool
+type channelPool struct {
+	conn  *amqp.Connection
+	slots chan *publisherChannel
+}
+
+func newChannelPool(conn *amqp.Connection, size int) *channelPool {
+	pool := &channelPool{
+		conn:  conn,
+		slots: make(chan *publisherChannel, size),
+	}
+	for i := 0; i < size; i++ {
+		pool.slots <- nil
+	}
+	return pool
+}
+
+func (p *channelPool) open() (*publisherChannel, error) {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to put the channel in confirm mode: %v", err)
+	}
+
+	return &publisherChannel{
+		ch:      ch,
+		returns: ch.NotifyReturn(make(chan amqp.Return, 8)),
+	}, nil
+}
+
+// waits for a free channel, opening it if its slot is empty or it was closed
+func (p *channelPool) acquire(ctx context.Context) (*publisherChannel, error) {
+	select {
+	case pc := <-p.slots:
+		if pc != nil && !pc.ch.IsClosed() {
+			return pc, nil
+		}
+		fresh, err := p.open()
+		if err != nil {
+			p.slots <- nil
+			return nil, err
+		}
+		return fresh, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no publisher channel available: %v", ctx.Err())
+	}
+}
+
+// gives the channel back, one that RabbitMQ closed after an error is reopened on next use
+func (p *channelPool) release(pc *publisherChannel) {
+	if pc.ch.IsClosed() {
+		pc = nil
+	}
+	p.slots <- pc
+}
+
+// runs fn on a channel of the pool
+func (p *channelPool) with(fn func(ch *amqp.Channel) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishConfirmTimeout())
+	defer cancel()
+
+	pc, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.release(pc)
+
+	return fn(pc.ch)
+}
+
+func (p *channelPool) close() {
+	for i := 0; i < cap(p.slots); i++ {
+		if pc := <-p.slots; pc != nil {
+			pc.ch.Close()
+		}
+	}
+}
+
+// publishes a persistent, mandatory message and waits until RabbitMQ confirms it. A message
+// that reaches no queue is returned by RabbitMQ before the confirm, and reported as an error.
+func (pc *publisherChannel) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	// returns of earlier publishes that timed out
+	for drained := false; !drained; {
+		select {
+		case <-pc.returns:
+		default:
+			drained = true
+		}
+	}
+
+	confirmation, err := pc.ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,
+		routingKey,
+		true,  // mandatory
+		false, // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("message was not confirmed: %v", err)
+	}
+	if !acked {
+		return errors.New("message was rejected by RabbitMQ")
+	}
+
+	select {
+	case ret := <-pc.returns:
+		if ret.MessageId == msg.MessageId {
+			return fmt.Errorf("%w: %d %s", errUnroutable, ret.ReplyCode, ret.ReplyText)
+		}
+	default:
+	}
+	return nil
+}
@@ -3,10 +3,22 @@ package messaging
 const CONSUMING_QUEUE string = "reverseproxy-to-admin"
 const PUBLISHING_QUEUE string = "admin-to-reverseproxy"
 
+// commands for every proxy go through a fanout exchange, each instance consumes its own
+// queue named PROXY_QUEUE_PREFIX + instance id
+const PUBLISHING_EXCHANGE string = "admin-to-reverseproxy-fanout"
+const PROXY_QUEUE_PREFIX string = "admin-to-reverseproxy."
+
 // for publishing
 const ADD_REPLICA string = "add-replica"
 const REMOVE_REPLICA string = "remove-replica"
+const UPDATE_REPLICA string = "update-replica"
+const UPDATE_REPLICA_CAPACITY string = "update-replica-capacity"
+const DRAIN_REPLICA string = "drain-replica"
 const NEW_PARAMETERS string = "new-parameters"
+const CLEAR_POOL_PARAMETERS string = "clear-pool-parameters"
+const UPDATE_POOL string = "update-pool"
+const REMOVE_POOL string = "remove-pool"
+const STATE_SNAPSHOT string = "state-snapshot"
 
 // for consuming
 const ADDED_REPLICA string = "replica-added"
@@ -15,3 +27,9 @@ const STATISTICS string = "statistics"
 const PARAMETERS_UPDATED = "parameters-updated"
 const PARAMETERS_UPDATE_FAILED = "parameters-update-failed"
 const REPLICA_FAILED = "replica-failed"
+const REPLICA_DRAINING = "replica-draining"
+const SYNC_REQUEST = "sync-request"
+const ACTUAL_STATE = "actual-state"
+const PROXY_REGISTER = "proxy-register"
+const PROXY_HEARTBEAT = "proxy-heartbeat"
+const PROXY_DEREGISTER = "proxy-deregister"
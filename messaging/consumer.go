@@ -4,11 +4,20 @@ import (
 	"log"
 	"os"
 
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-
+// SetupConsumer consumes messages from the proxy with a pool of workers. Deliveries are
+// acknowledged once handled, prefetch bounds how many are unacknowledged at a time. With
+// the http transport the proxy posts its messages instead, see HandleProxyMessage.
 func SetupConsumer() {
+	if Transport() == TRANSPORT_HTTP {
+		consumerPool = newWorkerPool(ConsumerWorkers(), ConsumerQueueSize())
+		log.Printf(" [*] Waiting for messages over http with %d workers", ConsumerWorkers())
+		return
+	}
+
 	conn, err := amqp.Dial(os.Getenv("RABBITMQ_URL"))
 	failOnError(err, "Failed to connect to RabbitMQ")
 	defer conn.Close()
@@ -18,19 +27,26 @@ func SetupConsumer() {
 	defer ch.Close()
 
 	q, err := ch.QueueDeclare(
-		"reverseproxy-to-admin", // name
-		true,                    // durable
-		false,                   // delete when unused
-		false,                   // exclusive
-		false,                   // no-wait
-		nil,                     // arguments
+		CONSUMING_QUEUE, // name
+		true,            // durable
+		false,           // delete when unused
+		false,           // exclusive
+		false,           // no-wait
+		nil,             // arguments
 	)
 	failOnError(err, "Failed to declare a queue")
 
+	err = ch.Qos(
+		ConsumerPrefetch(), // prefetch count
+		0,                  // prefetch size
+		false,              // global
+	)
+	failOnError(err, "Failed to set QoS")
+
 	msgs, err := ch.Consume(
 		q.Name, // queue
 		"",     // consumer
-		true,   // auto-ack
+		false,  // auto-ack
 		false,  // exclusive
 		false,  // no-local
 		false,  // no-wait
@@ -40,12 +56,20 @@ func SetupConsumer() {
 
 	var forever chan struct{}
 
+	workers := ConsumerWorkers()
+	consumerPool = newWorkerPool(workers, ConsumerQueueSize())
+
 	go func() {
 		for d := range msgs {
-			processMessage(d.Body)
+			consumerPool.submit(d.Body, d.MessageId, func(entry *db.MessageAudit) {
+				// failed messages stay in the audit log for replay, redelivering them would only fail again
+				if err := d.Ack(false); err != nil {
+					log.Printf("Failed to acknowledge message: %v", err)
+				}
+			})
 		}
 	}()
 
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
+	log.Printf(" [*] Waiting for messages with %d workers. To exit press CTRL+C", workers)
 	<-forever
 }
@@ -0,0 +1,126 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CheckContracts compares the message contract with the golden example of every message in
+// dir, one <name>.json each. A golden example that no longer matches its schema means the
+// schema broke the contract, one that changes when decoded and encoded again with the
+// admin's types means the types did. With update the golden examples are rewritten from
+// the admin's encoding instead, for intended changes.
+func CheckContracts(dir string, update bool) []error {
+	var problems []error
+
+	schemas, err := loadSchemas()
+	if err != nil {
+		return []error{err}
+	}
+
+	files, err := fs.Glob(schemaFiles, "schemas/*.json")
+	if err != nil {
+		return []error{err}
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if _, ok := messageContracts[name]; !ok {
+			problems = append(problems, fmt.Errorf("%s: schema of a message that doesn't exist", name))
+		}
+	}
+
+	names := make([]string, 0, len(messageContracts))
+	for name := range messageContracts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(dir, name+".json")
+		golden, err := os.ReadFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: no golden example: %v", name, err))
+			continue
+		}
+
+		for _, violation := range schemas[name].validate(golden) {
+			problems = append(problems, fmt.Errorf("%s: golden example violates the schema: %s", name, violation))
+		}
+
+		encoded, err := reencodeMessage(name, golden)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		for _, violation := range schemas[name].validate(encoded) {
+			problems = append(problems, fmt.Errorf("%s: admin encoding violates the schema: %s", name, violation))
+		}
+
+		if update {
+			if err := os.WriteFile(path, encoded, 0644); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %v", name, err))
+			}
+			continue
+		}
+		if !sameJSON(golden, encoded) {
+			problems = append(problems, fmt.Errorf("%s: admin encoding differs from the golden example:\n%s", name, encoded))
+		}
+	}
+
+	return problems
+}
+
+// decodes a message with the body type of its contract and encodes it again, indented
+func reencodeMessage(name string, message []byte) ([]byte, error) {
+	var envelope struct {
+		Id       string          `json:"id"`
+		Name     string          `json:"name"`
+		Instance string          `json:"instance"`
+		Body     json.RawMessage `json:"body"`
+	}
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid golden example: %v", err)
+	}
+
+	body := messageContracts[name].body()
+	if len(envelope.Body) > 0 {
+		if err := json.Unmarshal(envelope.Body, body); err != nil {
+			return nil, fmt.Errorf("admin can't decode the body: %v", err)
+		}
+	}
+
+	encoded, err := json.Marshal(Message{
+		Id:       envelope.Id,
+		Name:     envelope.Name,
+		Instance: envelope.Instance,
+		Body:     body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// through a map, so keys come out sorted like in the golden examples
+	var normalized interface{}
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return nil, err
+	}
+	indented, err := json.MarshalIndent(normalized, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(indented, '\n'), nil
+}
+
+func sameJSON(a, b []byte) bool {
+	var left, right interface{}
+	if json.Unmarshal(a, &left) != nil || json.Unmarshal(b, &right) != nil {
+		return false
+	}
+	return reflect.DeepEqual(left, right)
+}
@@ -0,0 +1,16 @@
+package messaging
+
+import (
+	"flag"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden examples from the admin's encoding")
+
+// go test ./messaging fails on a breaking change, go test ./messaging -update accepts an
+// intended one
+func TestMessageContracts(t *testing.T) {
+	for _, problem := range CheckContracts("schemas/golden", *update) {
+		t.Error(problem)
+	}
+}
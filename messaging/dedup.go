@@ -0,0 +1,92 @@
+package messaging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const DEFAULT_MESSAGE_DEDUP_TTL = 24 * time.Hour
+const PROCESSED_MESSAGES_CLEANUP_INTERVAL = time.Hour
+
+type messageIdKey struct{}
+
+// MessageDedupTTL is how long a processed message id is remembered, configured with
+// MESSAGE_DEDUP_TTL (e.g. 1h, 48h).
+func MessageDedupTTL() time.Duration {
+	raw := os.Getenv("MESSAGE_DEDUP_TTL")
+	if raw == "" {
+		return DEFAULT_MESSAGE_DEDUP_TTL
+	}
+
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid MESSAGE_DEDUP_TTL %q, using %s", raw, DEFAULT_MESSAGE_DEDUP_TTL)
+		return DEFAULT_MESSAGE_DEDUP_TTL
+	}
+	return ttl
+}
+
+func withMessageId(ctx context.Context, messageId string) context.Context {
+	return context.WithValue(ctx, messageIdKey{}, messageId)
+}
+
+// id of the message being handled, empty when the proxy did not send one
+func messageIdFrom(ctx context.Context) string {
+	messageId, _ := ctx.Value(messageIdKey{}).(string)
+	return messageId
+}
+
+func newMessageId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// reports whether the message was already handled, messages without an id never are
+func alreadyProcessed(ctx context.Context, messageId string) bool {
+	if messageId == "" {
+		return false
+	}
+
+	processed, err := db.IsMessageProcessed(ctx, messageId)
+	if err != nil {
+		// handling a message twice beats dropping it
+		log.Print(err)
+		return false
+	}
+	return processed
+}
+
+func markProcessed(ctx context.Context, messageId, name string) {
+	if messageId == "" {
+		return
+	}
+	if err := db.MarkMessageProcessed(ctx, messageId, name, MessageDedupTTL()); err != nil {
+		log.Print(err)
+	}
+}
+
+// StartProcessedMessagesCleanup periodically forgets processed messages past their ttl.
+func StartProcessedMessagesCleanup() {
+	ticker := time.NewTicker(PROCESSED_MESSAGES_CLEANUP_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := db.DeleteExpiredProcessedMessages(context.Background())
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if deleted > 0 {
+			log.Printf("Forgot %d expired processed messages", deleted)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const DEFAULT_DRAIN_TIMEOUT = 5 * time.Minute
+const DRAIN_CHECK_INTERVAL = 15 * time.Second
+
+type DrainProgress struct {
+	URL      string `json:"url"`
+	InFlight int    `json:"in_flight"`
+}
+
+type DrainMessage struct {
+	Name string        `json:"name"`
+	Body DrainProgress `json:"body"`
+}
+
+// DrainTimeout is how long a replica may drain before it is disabled regardless
+// of its in-flight requests, configured with DRAIN_TIMEOUT (e.g. 90s, 10m).
+func DrainTimeout() time.Duration {
+	raw := os.Getenv("DRAIN_TIMEOUT")
+	if raw == "" {
+		return DEFAULT_DRAIN_TIMEOUT
+	}
+
+	timeout, err := time.ParseDuration(raw)
+	if err != nil || timeout <= 0 {
+		log.Printf("Invalid DRAIN_TIMEOUT %q, using %s", raw, DEFAULT_DRAIN_TIMEOUT)
+		return DEFAULT_DRAIN_TIMEOUT
+	}
+	return timeout
+}
+
+func handleReplicaDraining(ctx context.Context, proxy *db.ProxyInstance, progress DrainProgress) error {
+	replica, err := recordProxyReplicaState(ctx, proxy, progress.URL, db.DRAINING, "", &progress.InFlight)
+	if err != nil {
+		return err
+	}
+
+	if replica.Status != db.DRAINING {
+		log.Printf("Ignoring drain progress for replica %s in status %s", replica.Name, replica.Status)
+		return nil
+	}
+
+	// with several instances the replica is drained once none of them has requests in flight
+	inFlight := progress.InFlight
+	if proxy != nil && replica.DrainStartedAt != nil {
+		total, reported, err := db.SumProxyInFlight(ctx, replica.Id, *replica.DrainStartedAt, time.Now().Add(-ProxyHeartbeatTimeout()))
+		if err != nil {
+			return err
+		}
+		if reported {
+			inFlight = total
+		}
+		if inFlight == 0 && servedByOtherProxy(ctx, proxy, replica) {
+			log.Printf("Replica %s is drained on %s, waiting for the other proxy instances", replica.Name, proxyName(proxy))
+			return nil
+		}
+	}
+
+	if inFlight > 0 {
+		if err := db.UpdateDrainProgress(ctx, replica, inFlight); err != nil {
+			return fmt.Errorf("failed to update drain progress: %v", err)
+		}
+		return nil
+	}
+
+	if err := db.FinalizeDrain(ctx, replica, "no requests in flight"); err != nil {
+		return fmt.Errorf("failed to finalize drain: %v", err)
+	}
+	return nil
+}
+
+// StartDrainMonitor periodically disables replicas whose drain timeout expired.
+func StartDrainMonitor() {
+	ticker := time.NewTicker(DRAIN_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		replicas, err := db.GetExpiredDrains(ctx)
+		if err != nil {
+			log.Printf("Failed to fetch expired drains: %s", err)
+			continue
+		}
+
+		for i := range replicas {
+			if err := db.FinalizeDrain(ctx, &replicas[i], "drain timeout expired"); err != nil {
+				log.Printf("Failed to finalize drain: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const DEFAULT_PROXY_HEARTBEAT_TIMEOUT = 90 * time.Second
+const PROXY_LIVENESS_CHECK_INTERVAL = 15 * time.Second
+
+// heartbeats from a proxy without an instance id are recorded under this one
+const DEFAULT_PROXY_INSTANCE = "default"
+
+// body of proxy-heartbeat messages
+type ProxyHeartbeat struct {
+	Version           string `json:"version"`
+	UptimeSeconds     int64  `json:"uptime_seconds"`
+	ParametersVersion *int   `json:"parameters_version"`
+	ReplicaCount      int    `json:"replica_count"`
+}
+
+type ProxyHeartbeatMessage struct {
+	Name     string         `json:"name"`
+	Instance string         `json:"instance"`
+	Body     ProxyHeartbeat `json:"body"`
+}
+
+// ProxyHeartbeatTimeout is how long a proxy may stay silent before it is marked stale,
+// configured with PROXY_HEARTBEAT_TIMEOUT (e.g. 30s, 2m).
+func ProxyHeartbeatTimeout() time.Duration {
+	raw := os.Getenv("PROXY_HEARTBEAT_TIMEOUT")
+	if raw == "" {
+		return DEFAULT_PROXY_HEARTBEAT_TIMEOUT
+	}
+
+	timeout, err := time.ParseDuration(raw)
+	if err != nil || timeout <= 0 {
+		log.Printf("Invalid PROXY_HEARTBEAT_TIMEOUT %q, using %s", raw, DEFAULT_PROXY_HEARTBEAT_TIMEOUT)
+		return DEFAULT_PROXY_HEARTBEAT_TIMEOUT
+	}
+	return timeout
+}
+
+func handleProxyHeartbeat(ctx context.Context, proxy *db.ProxyInstance, heartbeat ProxyHeartbeat) error {
+	if proxy == nil {
+		var err error
+		proxy, err = db.TouchProxyInstance(ctx, DEFAULT_PROXY_INSTANCE, PUBLISHING_QUEUE)
+		if err != nil {
+			return fmt.Errorf("failed to update proxy instance %s: %v", DEFAULT_PROXY_INSTANCE, err)
+		}
+	}
+
+	if heartbeat.Version != "" {
+		proxy.Version = heartbeat.Version
+	}
+	proxy.UptimeSeconds = &heartbeat.UptimeSeconds
+	proxy.ParametersVersion = heartbeat.ParametersVersion
+	proxy.ReplicaCount = &heartbeat.ReplicaCount
+
+	wasStale, err := db.RecordProxyHeartbeat(ctx, proxy)
+	if err != nil {
+		return err
+	}
+
+	if wasStale {
+		message := fmt.Sprintf("Proxy %s is sending heartbeats again (up %s)", proxy.InstanceId,
+			time.Duration(heartbeat.UptimeSeconds)*time.Second)
+		if err := db.LogActivity(ctx, "success", message, nil); err != nil {
+			log.Printf("Failed to log activity: %v", err)
+		}
+	}
+	return nil
+}
+
+// StartProxyLivenessMonitor periodically marks proxies without a recent heartbeat as stale.
+func StartProxyLivenessMonitor() {
+	ticker := time.NewTicker(PROXY_LIVENESS_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		timeout := ProxyHeartbeatTimeout()
+		proxies, err := db.MarkStaleProxies(ctx, time.Now().Add(-timeout))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		for _, proxy := range proxies {
+			message := fmt.Sprintf("Proxy %s is stale, no heartbeat for more than %s", proxy.InstanceId, timeout)
+			if err := db.LogActivity(ctx, "warning", message, nil); err != nil {
+				log.Printf("Failed to log activity: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// jsonSchema is the part of JSON Schema (draft 2020-12) the message contracts use: type,
+// enum, const, properties, required, additionalProperties, items, minimum, maximum,
+// minLength, minItems, anyOf, format date-time and $ref to the schema's own $defs.
+// Other keywords are ignored.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Const                json.RawMessage        `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MinItems             *int                   `json:"minItems"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	Format               string                 `json:"format"`
+
+	// set for the schema false, which nothing matches
+	never bool
+}
+
+// a schema may also be true (anything) or false (nothing)
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "true":
+		*s = jsonSchema{}
+		return nil
+	case "false":
+		*s = jsonSchema{never: true}
+		return nil
+	}
+
+	type plain jsonSchema
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// the type keyword takes a name or a list of names
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+func parseJSONSchema(raw []byte) (*jsonSchema, error) {
+	var schema jsonSchema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// validate reports every violation of the schema in the document, with its path
+func (s *jsonSchema) validate(document []byte) []string {
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+
+	var violations []string
+	s.check(s, value, "$", &violations)
+	return violations
+}
+
+func (s *jsonSchema) check(root *jsonSchema, value interface{}, path string, violations *[]string) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.never {
+		report("not allowed")
+		return
+	}
+
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+		def, found := root.Defs[name]
+		if !ok || !found {
+			report("unresolved $ref %s", s.Ref)
+			return
+		}
+		def.check(root, value, path, violations)
+	}
+
+	if len(s.Type) > 0 && !matchesType(s.Type, value) {
+		report("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeOf(value))
+		return
+	}
+
+	if len(s.Const) > 0 {
+		var expected interface{}
+		if err := json.Unmarshal(s.Const, &expected); err == nil && !reflect.DeepEqual(expected, value) {
+			report("expected %s", string(s.Const))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		allowed := false
+		for _, option := range s.Enum {
+			if reflect.DeepEqual(option, value) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			report("must be one of %v", s.Enum)
+		}
+	}
+
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, option := range s.AnyOf {
+			var optionViolations []string
+			option.check(root, value, path, &optionViolations)
+			if len(optionViolations) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			report("matches none of the allowed schemas")
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				report("missing required property %q", name)
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := s.Properties[name]; ok {
+				property.check(root, v[name], path+"."+name, violations)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.check(root, v[name], path+"."+name, violations)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			report("must have at least %d items", *s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.check(root, item, fmt.Sprintf("%s[%d]", path, i), violations)
+			}
+		}
+	case string:
+		if s.MinLength != nil && len([]rune(v)) < *s.MinLength {
+			report("must be at least %d characters", *s.MinLength)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				report("must be an RFC 3339 date-time")
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			report("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			report("must be at most %v", *s.Maximum)
+		}
+	}
+}
+
+func matchesType(types schemaTypes, value interface{}) bool {
+	actual := jsonTypeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// the JSON Schema type of a decoded value, whole numbers are integers
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,122 @@
+package messaging
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["name", "status"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"status": {"enum": ["ACTIVE", "DISABLED"]},
+		"weight": {"type": "integer", "minimum": 0, "maximum": 100},
+		"ratio": {"type": "number"},
+		"tags": {"type": "array", "items": {"type": "string"}},
+		"url": {"type": ["string", "null"]},
+		"updated_at": {"type": "string", "format": "date-time"},
+		"body": {"$ref": "#/$defs/body"}
+	},
+	"$defs": {
+		"body": {"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}
+	}
+}`
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema, err := parseJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		document   string
+		violations []string
+	}{
+		{
+			name:     "valid",
+			document: `{"name": "a", "status": "ACTIVE", "weight": 5, "ratio": 0.5, "tags": ["x"], "url": null, "updated_at": "2024-01-02T03:04:05Z", "body": {"id": 1}}`,
+		},
+		{
+			name:       "missing required",
+			document:   `{"name": "a"}`,
+			violations: []string{`$: missing required property "status"`},
+		},
+		{
+			name:       "wrong type",
+			document:   `{"name": 1, "status": "ACTIVE"}`,
+			violations: []string{"$.name: expected string, got integer"},
+		},
+		{
+			name:     "integer is a number",
+			document: `{"name": "a", "status": "ACTIVE", "ratio": 1}`,
+		},
+		{
+			name:       "fraction is not an integer",
+			document:   `{"name": "a", "status": "ACTIVE", "weight": 1.5}`,
+			violations: []string{"$.weight: expected integer, got number"},
+		},
+		{
+			name:       "one of several types",
+			document:   `{"name": "a", "status": "ACTIVE", "url": false}`,
+			violations: []string{"$.url: expected string or null, got boolean"},
+		},
+		{
+			name:       "not in enum",
+			document:   `{"name": "a", "status": "DRAINING"}`,
+			violations: []string{"$.status: must be one of [ACTIVE DISABLED]"},
+		},
+		{
+			name:       "additional property",
+			document:   `{"name": "a", "status": "ACTIVE", "extra": 1}`,
+			violations: []string{"$.extra: not allowed"},
+		},
+		{
+			name:       "array item",
+			document:   `{"name": "a", "status": "ACTIVE", "tags": ["x", 2]}`,
+			violations: []string{"$.tags[1]: expected string, got integer"},
+		},
+		{
+			name:       "out of range",
+			document:   `{"name": "", "status": "ACTIVE", "weight": 101}`,
+			violations: []string{"$.name: must be at least 1 characters", "$.weight: must be at most 100"},
+		},
+		{
+			name:       "date-time",
+			document:   `{"name": "a", "status": "ACTIVE", "updated_at": "yesterday"}`,
+			violations: []string{"$.updated_at: must be an RFC 3339 date-time"},
+		},
+		{
+			name:       "ref",
+			document:   `{"name": "a", "status": "ACTIVE", "body": {}}`,
+			violations: []string{`$.body: missing required property "id"`},
+		},
+		{
+			name:       "not an object",
+			document:   `[]`,
+			violations: []string{"$: expected object, got array"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := schema.validate([]byte(test.document))
+			if strings.Join(violations, "\n") != strings.Join(test.violations, "\n") {
+				t.Errorf("violations\n%s\nwant\n%s", strings.Join(violations, "\n"), strings.Join(test.violations, "\n"))
+			}
+		})
+	}
+}
+
+func TestJSONSchemaInvalidDocument(t *testing.T) {
+	schema, err := parseJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+	violations := schema.validate([]byte(`{"name":`))
+	if len(violations) != 1 || !strings.HasPrefix(violations[0], "invalid JSON") {
+		t.Errorf("violations %v, want invalid JSON", violations)
+	}
+}
@@ -0,0 +1,23 @@
+package messaging
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const MAINTENANCE_CHECK_INTERVAL = 30 * time.Second
+
+// StartMaintenanceScheduler periodically starts and ends scheduled maintenance windows.
+func StartMaintenanceScheduler() {
+	ticker := time.NewTicker(MAINTENANCE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := db.RunMaintenanceSchedule(context.Background(), time.Now(), DrainTimeout()); err != nil {
+			log.Printf("Failed to run maintenance schedule: %s", err)
+		}
+	}
+}
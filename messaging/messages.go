@@ -9,18 +9,70 @@ import (
 	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
 )
 
+// instance is set by proxies running as one of several instances, id by proxies that
+// can't set the message id of the delivery
 type Message struct {
-	Name string      `json:"name"`
-	Body interface{} `json:"body"`
+	Id       string      `json:"id,omitempty"`
+	Name     string      `json:"name"`
+	Instance string      `json:"instance,omitempty"`
+	Body     interface{} `json:"body"`
+}
+
+// body of add-replica and update-replica-capacity messages
+type ReplicaBody struct {
+	Name                  string `json:"name"`
+	URL                   string `json:"url"`
+	Weight                int    `json:"weight"`
+	MaxConcurrentRequests int    `json:"max_concurrent_requests"`
+	CapacityClass         string `json:"capacity_class"`
+	Pool                  string `json:"pool,omitempty"`
+}
+
+func NewReplicaBody(ctx context.Context, replica *db.Replica) ReplicaBody {
+	pool, err := db.GetPoolName(ctx, replica.PoolId)
+	if err != nil {
+		log.Printf("Failed to get pool of replica %s: %v", replica.Name, err)
+	}
+
+	return ReplicaBody{
+		Name:                  replica.Name,
+		URL:                   replica.URL,
+		Weight:                replica.Weight,
+		MaxConcurrentRequests: replica.MaxConcurrent,
+		CapacityClass:         replica.CapacityClass,
+		Pool:                  pool,
+	}
+}
+
+// body of update-pool messages
+type PoolBody struct {
+	Name                string `json:"name"`
+	HealthCheckEndpoint string `json:"health_check_endpoint"`
+	HealthCheckInterval int    `json:"health_check_interval_seconds"`
+}
+
+func NewPoolBody(pool *db.Pool) PoolBody {
+	return PoolBody{
+		Name:                pool.Name,
+		HealthCheckEndpoint: pool.HealthCheckEndpoint,
+		HealthCheckInterval: pool.HealthCheckInterval,
+	}
+}
+
+// body of new-parameters messages, parameters without a pool apply to every replica
+type ParametersBody struct {
+	Pool       string                       `json:"pool,omitempty"`
+	Parameters db.PrequalParametersResponse `json:"parameters"`
 }
 
 type ReplicaAdded struct {
 	URL string `json:"url"`
 }
 
+// named as the proxy sends them, see schemas/statistics.json
 type ReplicaStatisticsParameters struct {
-	SuccessfulRequests int
-	FailedRequests     int
+	SuccessfulRequests int `json:"SuccessfulRequests"`
+	FailedRequests     int `json:"FailedRequests"`
 }
 
 type statDataArr struct {
@@ -38,97 +90,82 @@ type Messages struct {
 	Body interface{} `json:"body"`
 }
 
-func handleReplicaAdded(body string) {
-	log.Print("Replica added: ", body)
-	db.UpdateStatusByUrl(body, "active")
-	ctx := context.Background()
-	replica, err := db.GetReplicaByUrl(ctx, body)
-
-	if err != nil {
-		log.Printf("Failed to get replica by URL: %s", err)
-		return
-	}
-
-	err = db.LogActivity(ctx, "success", fmt.Sprintf("Replica %v is now active", replica.Name), &replica.Id)
-
-	if err != nil {
-		log.Printf("Failed to log activity: %s", err)
-		return
+func handleReplicaAdded(ctx context.Context, proxy *db.ProxyInstance, body string) error {
+	log.Printf("Replica added on %s: %s", proxyName(proxy), body)
+	if _, err := recordProxyReplicaState(ctx, proxy, body, db.ACTIVE, ADDED_REPLICA, nil); err != nil {
+		return err
 	}
-	// log.Printf("Replica added: Name=%s, URL=%s", data.Name, data.URL)
+	return transitionReplica(ctx, body, db.ACTIVE)
 }
 
-func handleReplicaFailed(body string) {
-	log.Print("Replica removed: ", body)
-	db.UpdateStatusByUrl(body, "inactive")
-	ctx := context.Background()
-	replica, err := db.GetReplicaByUrl(ctx, body)
-
+func handleReplicaFailed(ctx context.Context, proxy *db.ProxyInstance, body string) error {
+	log.Printf("Replica failed on %s: %s", proxyName(proxy), body)
+	replica, err := recordProxyReplicaState(ctx, proxy, body, db.INACTIVE, REPLICA_FAILED, nil)
 	if err != nil {
-		log.Printf("Failed to get replica by URL: %s", err)
-		return
+		return err
 	}
-
-	err = db.LogActivity(ctx, "error", fmt.Sprintf("Replica %v is unavailable and set to inactive", replica.Name), &replica.Id)
-
-	if err != nil {
-		log.Printf("Failed to log activity: %s", err)
-		return
+	if servedByOtherProxy(ctx, proxy, replica) {
+		log.Printf("Replica %s is still active on other proxy instances", body)
+		return nil
 	}
+	return transitionReplica(ctx, body, db.INACTIVE)
 }
 
-func handleReplicaRemoved(body string) {
-	log.Print("Replica removed: ", body)
-	db.UpdateStatusByUrl(body, "disabled")
-	ctx := context.Background()
-	replica, err := db.GetReplicaByUrl(ctx, body)
-
+func handleReplicaRemoved(ctx context.Context, proxy *db.ProxyInstance, body string) error {
+	log.Printf("Replica removed on %s: %s", proxyName(proxy), body)
+	replica, err := recordProxyReplicaState(ctx, proxy, body, db.DISABLED, REMOVED_REPLICA, nil)
 	if err != nil {
-		log.Printf("Failed to get replica by URL: %s", err)
-		return
+		return err
 	}
+	if servedByOtherProxy(ctx, proxy, replica) {
+		log.Printf("Replica %s is still active on other proxy instances", body)
+		return nil
+	}
+	return transitionReplica(ctx, body, db.DISABLED)
+}
 
-	err = db.LogActivity(ctx, "error", fmt.Sprintf("Replica %v is disabled", replica.Name), &replica.Id)
-
+// applies a status change reported by the proxy, the state machine logs the activity
+func transitionReplica(ctx context.Context, url, status string) error {
+	_, err := db.TransitionReplicaByUrl(ctx, url, status, db.SOURCE_PROXY, db.TransitionOptions{})
 	if err != nil {
-		log.Printf("Failed to log activity: %s", err)
-		return
+		return fmt.Errorf("failed to move replica %s to %s: %v", url, status, err)
 	}
+	return nil
 }
 
-func handleParametersUpdated(body []byte) {
+func handleParametersUpdated(ctx context.Context, proxy *db.ProxyInstance, body []byte) error {
 	var msg Message
 	if err := json.Unmarshal(body, &msg); err != nil {
-		log.Printf("Failed to unmarshal message: %v", err)
-		return
+		return fmt.Errorf("failed to unmarshal message: %v", err)
 	}
 
 	updatedFields, ok := msg.Body.([]interface{})
 	if !ok {
-		log.Printf("Invalid message body for parameters-updated: %v", msg.Body)
-		return
+		return fmt.Errorf("invalid message body for parameters-updated: %v", msg.Body)
 	}
 
-	log.Printf("Parameters updated successfully: %v", updatedFields)
+	log.Printf("Parameters updated successfully on %s: %v", proxyName(proxy), updatedFields)
+	recordProxyAcknowledgement(ctx, proxy, PARAMETERS_UPDATED, "parameters", true, fmt.Sprintf("%v", updatedFields))
+	return nil
 }
 
-func handleParametersUpdateFailed(body []byte) {
+func handleParametersUpdateFailed(ctx context.Context, proxy *db.ProxyInstance, body []byte) error {
 	var msg Message
 	if err := json.Unmarshal(body, &msg); err != nil {
-		log.Printf("Failed to unmarshal message: %v", err)
-		return
+		return fmt.Errorf("failed to unmarshal message: %v", err)
 	}
 
 	errorMessage, ok := msg.Body.(string)
 	if !ok {
-		log.Printf("Invalid error message for parameters-update-failed: %v", msg.Body)
-		return
+		return fmt.Errorf("invalid error message for parameters-update-failed: %v", msg.Body)
 	}
 
-	log.Printf("Failed to update parameters: %s", errorMessage)
+	log.Printf("Failed to update parameters on %s: %s", proxyName(proxy), errorMessage)
+	recordProxyAcknowledgement(ctx, proxy, PARAMETERS_UPDATE_FAILED, "parameters", false, errorMessage)
+	return nil
 }
 
-func handleStatistics(body []statDataArr) {
+func handleStatistics(body []statDataArr) error {
 	var statisticsDatum []db.StatisticsData
 
 	for _, replica := range body {
@@ -141,12 +178,10 @@ func handleStatistics(body []statDataArr) {
 		statisticsDatum = append(statisticsDatum, data)
 	}
 
-	err := db.BatchAddStatistics(&statisticsDatum)
-
-	if err != nil {
-		log.Printf("Failed to update statistics: %s", err)
-		return
+	if err := db.BatchAddStatistics(&statisticsDatum); err != nil {
+		return fmt.Errorf("failed to update statistics: %v", err)
 	}
+	return nil
 }
 
 func messageDemo() {
@@ -0,0 +1,51 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+func init() {
+	db.SetProxyNotifier(notifyProxy)
+}
+
+// delivers the proxy command of a replica status transition
+func notifyProxy(ctx context.Context, command db.ProxyCommand, replica *db.Replica) error {
+	var message *Message
+
+	switch command {
+	case db.PROXY_ADD:
+		message = &Message{
+			Name: ADD_REPLICA,
+			Body: NewReplicaBody(ctx, replica),
+		}
+	case db.PROXY_REMOVE:
+		message = &Message{
+			Name: REMOVE_REPLICA,
+			Body: map[string]string{
+				"name": replica.Name,
+				"url":  replica.URL,
+			},
+		}
+	case db.PROXY_DRAIN:
+		timeout := DrainTimeout()
+		if replica.DrainDeadline != nil {
+			timeout = time.Until(*replica.DrainDeadline)
+		}
+		message = &Message{
+			Name: DRAIN_REPLICA,
+			Body: map[string]interface{}{
+				"name":            replica.Name,
+				"url":             replica.URL,
+				"timeout_seconds": int(timeout.Seconds()),
+			},
+		}
+	default:
+		return fmt.Errorf("unknown proxy command: %s", command)
+	}
+
+	return PublishMessage(PUBLISHING_QUEUE, message)
+}
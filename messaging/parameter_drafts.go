@@ -0,0 +1,28 @@
+package messaging
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const PARAMETER_DRAFT_EXPIRY_INTERVAL = time.Minute
+
+// StartParameterDraftExpiry periodically expires parameter drafts nobody applied in time.
+func StartParameterDraftExpiry() {
+	ticker := time.NewTicker(PARAMETER_DRAFT_EXPIRY_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := db.ExpireParameterDrafts(context.Background(), time.Now())
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("Expired %d parameter drafts", expired)
+		}
+	}
+}
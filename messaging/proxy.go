@@ -0,0 +1,169 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+// body of proxy-register messages
+type ProxyRegistration struct {
+	Hostname string `json:"hostname"`
+	Version  string `json:"version"`
+}
+
+type ProxyRegistrationMessage struct {
+	Name     string            `json:"name"`
+	Instance string            `json:"instance"`
+	Body     ProxyRegistration `json:"body"`
+}
+
+func ProxyQueueName(instanceId string) string {
+	return PROXY_QUEUE_PREFIX + instanceId
+}
+
+// queue that reaches the given proxy instance, or every instance when there is none
+func proxyQueue(proxy *db.ProxyInstance) string {
+	if proxy == nil {
+		return PUBLISHING_QUEUE
+	}
+	return proxy.Queue
+}
+
+func proxyName(proxy *db.ProxyInstance) string {
+	if proxy == nil {
+		return "proxy"
+	}
+	return fmt.Sprintf("proxy %s", proxy.InstanceId)
+}
+
+// marks the instance that sent a message as seen, nil for proxies without an instance id
+func seenProxy(ctx context.Context, instanceId string) *db.ProxyInstance {
+	if instanceId == "" {
+		return nil
+	}
+
+	proxy, err := db.TouchProxyInstance(ctx, instanceId, ProxyQueueName(instanceId))
+	if err != nil {
+		log.Printf("Failed to update proxy instance %s: %v", instanceId, err)
+		return nil
+	}
+	return proxy
+}
+
+func handleProxyRegister(ctx context.Context, instanceId string, registration ProxyRegistration) error {
+	if instanceId == "" {
+		return fmt.Errorf("proxy registration without an instance id")
+	}
+
+	proxy := &db.ProxyInstance{
+		InstanceId: instanceId,
+		Hostname:   registration.Hostname,
+		Version:    registration.Version,
+		Queue:      ProxyQueueName(instanceId),
+	}
+	if err := DeclareProxyQueue(proxy.Queue); err != nil {
+		return fmt.Errorf("failed to declare queue of proxy %s: %v", instanceId, err)
+	}
+
+	created, err := db.RegisterProxyInstance(ctx, proxy)
+	if err != nil {
+		return fmt.Errorf("failed to register proxy %s: %v", instanceId, err)
+	}
+
+	message := fmt.Sprintf("Proxy %s re-registered from %s (version %s)", instanceId, proxy.Hostname, proxy.Version)
+	if created {
+		message = fmt.Sprintf("Proxy %s registered from %s (version %s)", instanceId, proxy.Hostname, proxy.Version)
+	}
+	if err := db.LogActivity(ctx, "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+
+	// a fresh instance knows nothing yet, send it the full desired state
+	if _, err := PublishStateSnapshotTo(ctx, proxy); err != nil {
+		return fmt.Errorf("failed to publish state snapshot to proxy %s: %v", instanceId, err)
+	}
+	return nil
+}
+
+func handleProxyDeregister(ctx context.Context, proxy *db.ProxyInstance) error {
+	if proxy == nil {
+		return fmt.Errorf("proxy deregistration without an instance id")
+	}
+
+	if err := DeregisterProxy(ctx, proxy); err != nil {
+		return fmt.Errorf("failed to deregister proxy %s: %v", proxy.InstanceId, err)
+	}
+
+	message := fmt.Sprintf("Proxy %s deregistered", proxy.InstanceId)
+	if err := db.LogActivity(ctx, "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+	return nil
+}
+
+// DeregisterProxy deletes the command queue and every record of the instance, the shared
+// queue is kept for proxies that don't register.
+func DeregisterProxy(ctx context.Context, proxy *db.ProxyInstance) error {
+	if proxy.Queue != PUBLISHING_QUEUE {
+		if err := DeleteProxyQueue(proxy.Queue); err != nil {
+			return err
+		}
+	}
+	return db.DeleteProxyInstance(ctx, proxy)
+}
+
+// records how the instance sees the replica and what it acknowledged, returns the replica
+func recordProxyReplicaState(ctx context.Context, proxy *db.ProxyInstance, url, status, event string, inFlight *int) (*db.Replica, error) {
+	replica, err := db.GetReplicaByUrl(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get replica %s: %v", url, err)
+	}
+	if proxy == nil {
+		return replica, nil
+	}
+
+	if err := db.SetProxyReplicaState(ctx, proxy.Id, replica.Id, status, inFlight); err != nil {
+		log.Print(err)
+	}
+	if event != "" {
+		recordProxyAcknowledgement(ctx, proxy, event, url, status != db.INACTIVE, "")
+	}
+	return replica, nil
+}
+
+func recordProxyAcknowledgement(ctx context.Context, proxy *db.ProxyInstance, event, subject string, success bool, detail string) {
+	if proxy == nil {
+		return
+	}
+
+	ack := &db.ProxyAcknowledgement{
+		ProxyId:   proxy.Id,
+		Event:     event,
+		Subject:   subject,
+		Success:   success,
+		Detail:    detail,
+		MessageId: messageIdFrom(ctx),
+	}
+	if err := db.RecordProxyAcknowledgement(ctx, ack); err != nil {
+		log.Print(err)
+	}
+}
+
+// reports whether another instance that is not stale still serves the replica, in which
+// case one instance losing it does not change the status of the replica
+func servedByOtherProxy(ctx context.Context, proxy *db.ProxyInstance, replica *db.Replica) bool {
+	if proxy == nil || replica == nil {
+		return false
+	}
+
+	count, err := db.CountOtherProxiesWithReplicaStatus(ctx, replica.Id, proxy.Id, db.ACTIVE, time.Now().Add(-ProxyHeartbeatTimeout()))
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	return count > 0
+}
@@ -3,36 +3,93 @@ package messaging
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 var conn *amqp.Connection
-var ch *amqp.Channel
+var channels *channelPool
 
-// InitializePublisher sets up the connection and channel for the publisher.
+// queues declared since startup, so publishing doesn't declare them every time
+var declaredQueues sync.Map
+
+// InitializePublisher sets up the connection and channel pool for the publisher, and the
+// fanout exchange that delivers commands to every proxy instance.
 func InitializePublisher() {
 	var err error
 
-	conn, err = amqp.Dial(os.Getenv("RABBITMQ_URL"))
-	failOnError(err, "Failed to connect to RabbitMQ")
+	if Transport() == TRANSPORT_RABBITMQ {
+		conn, err = amqp.Dial(os.Getenv("RABBITMQ_URL"))
+		failOnError(err, "Failed to connect to RabbitMQ")
+
+		channels = newChannelPool(conn, PublisherChannels())
 
-	ch, err = conn.Channel()
-	failOnError(err, "Failed to open a channel")
+		err = channels.with(func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclare(
+				PUBLISHING_EXCHANGE, // name
+				"fanout",            // type
+				true,                // durable
+				false,               // auto-deleted
+				false,               // internal
+				false,               // no-wait
+				nil,                 // arguments
+			)
+		})
+		failOnError(err, "Failed to declare the publishing exchange")
+	}
+
+	// proxies that don't register an instance keep consuming the shared queue
+	if legacy, err := strconv.ParseBool(os.Getenv("PROXY_LEGACY_QUEUE")); err != nil || legacy {
+		err = DeclareProxyQueue(PUBLISHING_QUEUE)
+		failOnError(err, "Failed to bind the shared proxy queue")
+	}
 }
 
-// PublishMessage publishes a message to the specified queue.
-func PublishMessage(queueName string, message *Message) error {
-	messageBytes, err := json.Marshal(message)
+// DeclareProxyQueue declares the command queue of a proxy instance and binds it to the
+// fanout exchange, so it receives every command published to PUBLISHING_QUEUE.
+func DeclareProxyQueue(queueName string) error {
+	if Transport() == TRANSPORT_HTTP {
+		outboxes.declare(queueName, true)
+		return nil
+	}
+
+	err := channels.with(func(ch *amqp.Channel) error {
+		if err := declareQueue(ch, queueName); err != nil {
+			return err
+		}
+		return ch.QueueBind(queueName, "", PUBLISHING_EXCHANGE, false, nil)
+	})
 	if err != nil {
 		return err
 	}
 
-	// Ensure the queue exists
-	q, err := ch.QueueDeclare(
+	declaredQueues.Store(queueName, true)
+	return nil
+}
+
+// DeleteProxyQueue removes the command queue of a proxy instance that left for good.
+func DeleteProxyQueue(queueName string) error {
+	if Transport() == TRANSPORT_HTTP {
+		outboxes.delete(queueName)
+		return nil
+	}
+
+	declaredQueues.Delete(queueName)
+	return channels.with(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDelete(queueName, false, false, false)
+		return err
+	})
+}
+
+func declareQueue(ch *amqp.Channel, queueName string) error {
+	_, err := ch.QueueDeclare(
 		queueName, // name
 		true,      // durable
 		false,     // delete when unused
@@ -40,26 +97,90 @@ func PublishMessage(queueName string, message *Message) error {
 		false,     // no-wait
 		nil,       // arguments
 	)
+	return err
+}
+
+// PublishMessage publishes a message to the specified queue. Messages for PUBLISHING_QUEUE
+// go to every proxy instance through the fanout exchange.
+func PublishMessage(queueName string, message *Message) error {
+	messageBytes, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	_, err = publish(queueName, message.Name, messageBytes, nil)
+	return err
+}
+
+// publishes an encoded message and audits it with its outcome
+func publish(queueName, name string, messageBytes []byte, replayedFrom *int64) (*db.MessageAudit, error) {
+	start := time.Now()
+	messageId := newMessageId()
+	err := checkSchema(messageBytes)
+	if err == nil {
+		err = publishBytes(queueName, messageId, messageBytes)
+	}
+
+	entry := &db.MessageAudit{
+		Direction:    db.MESSAGE_OUTBOUND,
+		MessageId:    messageId,
+		Name:         name,
+		Queue:        queueName,
+		Body:         messageBytes,
+		Replicas:     messageReplicas(messageBytes),
+		Outcome:      db.MESSAGE_PUBLISHED,
+		DurationMs:   int(time.Since(start).Milliseconds()),
+		ReplayedFrom: replayedFrom,
+	}
+	if err != nil {
+		entry.Outcome = db.MESSAGE_PUBLISH_FAILED
+		entry.Error = err.Error()
+	}
+	recordMessageAudit(entry)
+
+	return entry, err
+}
+
+// every delivery carries a message id so the proxy can recognize redeliveries, and is
+// persisted by RabbitMQ before the publish returns
+func publishBytes(queueName, messageId string, messageBytes []byte) error {
+	if Transport() == TRANSPORT_HTTP {
+		return outboxes.publish(queueName, messageId, messageBytes)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PublishConfirmTimeout())
 	defer cancel()
 
-	// Publish the message
-	err = ch.PublishWithContext(ctx,
-		"",
-		q.Name,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        messageBytes,
-		},
-	)
+	pc, err := channels.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer channels.release(pc)
+
+	exchange, routingKey := PUBLISHING_EXCHANGE, ""
+	if queueName != PUBLISHING_QUEUE {
+		// Ensure the queue exists
+		if _, declared := declaredQueues.Load(queueName); !declared {
+			if err := declareQueue(pc.ch, queueName); err != nil {
+				return err
+			}
+			declaredQueues.Store(queueName, true)
+		}
+		exchange, routingKey = "", queueName
+	}
 
+	err = pc.publish(ctx, exchange, routingKey, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    messageId,
+		Body:         messageBytes,
+	})
 	if err != nil {
+		// the queue was deleted behind our back, declare it again next time
+		if errors.Is(err, errUnroutable) {
+			declaredQueues.Delete(queueName)
+		}
+		log.Printf("Failed to publish to %s: %v", queueName, err)
 		return err
 	}
 
@@ -67,10 +188,10 @@ func PublishMessage(queueName string, message *Message) error {
 	return nil
 }
 
-// CleanupPublisher closes the channel and connection.
+// CleanupPublisher closes the channels and connection.
 func CleanupPublisher() {
-	if ch != nil {
-		ch.Close()
+	if channels != nil {
+		channels.close()
 	}
 	if conn != nil {
 		conn.Close()
@@ -0,0 +1,507 @@
+package messaging
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const ROLLOUT_CHECK_INTERVAL = 15 * time.Second
+
+// StartRolloutController periodically starts scheduled parameter rollouts and judges the
+// running canaries.
+func StartRolloutController() {
+	ticker := time.NewTicker(ROLLOUT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := RunRollouts(context.Background(), time.Now()); err != nil {
+			log.Printf("Failed to run parameter rollouts: %s", err)
+		}
+	}
+}
+
+// RunRollouts starts the rollouts that are due and moves every canary on as far as its
+// statistics allow.
+func RunRollouts(ctx context.Context, now time.Time) error {
+	rollouts, err := db.GetOpenParameterRollouts(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range rollouts {
+		rollout := &rollouts[i]
+		var err error
+		switch rollout.Status {
+		case db.ROLLOUT_SCHEDULED:
+			if !now.Before(rollout.StartsAt) {
+				err = StartParameterRollout(ctx, rollout, now)
+			}
+		case db.ROLLOUT_CANARY:
+			err = evaluateRollout(ctx, rollout, now)
+		}
+		if err != nil && !errors.Is(err, db.ErrRolloutStateChanged) {
+			log.Printf("Failed to run parameter rollout %d: %v", rollout.Id, err)
+		}
+	}
+	return nil
+}
+
+func parametersMessage(pool string, parameters db.PrequalParametersResponse) *Message {
+	return &Message{
+		Name: NEW_PARAMETERS,
+		Body: ParametersBody{
+			Pool:       pool,
+			Parameters: parameters,
+		},
+	}
+}
+
+func rolloutCandidate(rollout *db.ParameterRollout) db.PrequalParametersResponse {
+	return db.PrequalParametersResponse{
+		MaxLifeTime:       rollout.MaxLifeTime,
+		PoolSize:          rollout.PoolSize,
+		ProbeFactor:       rollout.ProbeFactor,
+		ProbeRemoveFactor: rollout.ProbeRemoveFactor,
+		Mu:                rollout.Mu,
+		Status:            db.PARAMETERS_ACTIVE,
+		PoolId:            rollout.PoolId,
+	}
+}
+
+// the parameters in use where the rollout applies, what a rollback goes back to
+func stableParameters(ctx context.Context, rollout *db.ParameterRollout) (db.PrequalParametersResponse, error) {
+	if rollout.PoolId != nil {
+		return db.GetPoolPrequalParameters(ctx, *rollout.PoolId)
+	}
+	return db.GetPrequalParametersResponse(ctx)
+}
+
+// sends the parameters to the canary instances and pools of the rollout. Canary pools
+// take global parameters as parameters of their own.
+func publishToCanary(ctx context.Context, rollout *db.ParameterRollout, parameters db.PrequalParametersResponse) error {
+	var errs []error
+	if err := publishToCanaryInstances(ctx, rollout, parameters); err != nil {
+		errs = append(errs, err)
+	}
+	for _, poolId := range rollout.CanaryPoolIds {
+		pool, err := db.GetPoolName(ctx, &poolId)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := PublishMessage(PUBLISHING_QUEUE, parametersMessage(pool, parameters)); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %v", pool, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func publishToCanaryInstances(ctx context.Context, rollout *db.ParameterRollout, parameters db.PrequalParametersResponse) error {
+	scope, err := db.GetPoolName(ctx, rollout.PoolId)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, instance := range rollout.CanaryInstances {
+		if err := PublishMessage(ProxyQueueName(instance), parametersMessage(scope, parameters)); err != nil {
+			errs = append(errs, fmt.Errorf("proxy %s: %v", instance, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gives the canary pools of a finished rollout their own parameters back, or clears the
+// parameters they took as their own during the canary so the global ones apply again
+func releaseCanaryPools(ctx context.Context, rollout *db.ParameterRollout) error {
+	var errs []error
+	for _, poolId := range rollout.CanaryPoolIds {
+		pool, err := db.GetPoolName(ctx, &poolId)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		message := &Message{Name: CLEAR_POOL_PARAMETERS, Body: map[string]string{"pool": pool}}
+		own, err := db.GetPoolPrequalParameters(ctx, poolId)
+		if err != nil && err != sql.ErrNoRows {
+			errs = append(errs, err)
+			continue
+		}
+		if err == nil && own.PoolId != nil {
+			message = parametersMessage(pool, own)
+		}
+		if err := PublishMessage(PUBLISHING_QUEUE, message); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %v", pool, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// urls of the replicas whose statistics judge the canary: those of the canary pools, or
+// else every replica the parameters apply to. Statistics are not kept per proxy instance,
+// so instance canaries are judged by the error rate of the whole scope.
+func watchedReplicaUrls(ctx context.Context, rollout *db.ParameterRollout) ([]string, error) {
+	replicas, err := db.GetReplicas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, replica := range replicas {
+		switch {
+		case len(rollout.CanaryPoolIds) > 0:
+			if replica.PoolId == nil || !slices.Contains(rollout.CanaryPoolIds, *replica.PoolId) {
+				continue
+			}
+		case rollout.PoolId != nil:
+			if replica.PoolId == nil || *replica.PoolId != *rollout.PoolId {
+				continue
+			}
+		}
+		urls = append(urls, replica.URL)
+	}
+	return urls, nil
+}
+
+// StartParameterRollout puts the rollout live: on its canary while it has one, on every
+// proxy right away otherwise.
+func StartParameterRollout(ctx context.Context, rollout *db.ParameterRollout, now time.Time) error {
+	if !rollout.HasCanary() {
+		return PromoteParameterRollout(ctx, rollout, db.ROLLOUT_SYSTEM_ACTOR, "scheduled time reached")
+	}
+
+	urls, err := watchedReplicaUrls(ctx, rollout)
+	if err != nil {
+		return err
+	}
+	counts, err := db.GetRequestCounts(ctx)
+	if err != nil {
+		return err
+	}
+	baseline := make(map[string]db.RequestCounts, len(urls))
+	for _, url := range urls {
+		baseline[url] = counts[url]
+	}
+
+	rollout.Status = db.ROLLOUT_CANARY
+	rollout.Baseline = baseline
+	rollout.CanaryStartedAt = &now
+	if err := db.UpdateParameterRollout(ctx, rollout, db.ROLLOUT_SCHEDULED); err != nil {
+		return err
+	}
+
+	if err := publishToCanary(ctx, rollout, rolloutCandidate(rollout)); err != nil {
+		log.Printf("Failed to publish parameters of rollout %d to its canary: %v", rollout.Id, err)
+	}
+
+	message := fmt.Sprintf("Parameter rollout #%d started its canary on %d proxies and %d pools, watching %d replicas for %s",
+		rollout.Id, len(rollout.CanaryInstances), len(rollout.CanaryPoolIds), len(baseline), rollout.ObserveDuration())
+	if err := db.LogActivity(ctx, "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+	return nil
+}
+
+func errorRate(requests, failed int64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(failed) / float64(requests)
+}
+
+// EvaluateCanary judges the canary by the requests the watched replicas served since it
+// started. A counter below its baseline was reset by the proxy and counts from zero.
+func EvaluateCanary(rollout *db.ParameterRollout, counts map[string]db.RequestCounts, now time.Time) db.RolloutEvaluation {
+	evaluation := db.RolloutEvaluation{EvaluatedAt: now, Verdict: db.ROLLOUT_OBSERVE}
+
+	var baselineFailed int64
+	for url, base := range rollout.Baseline {
+		evaluation.BaselineRequests += base.Successful + base.Failed
+		baselineFailed += base.Failed
+
+		current := counts[url]
+		if current.Successful < base.Successful || current.Failed < base.Failed {
+			base = db.RequestCounts{}
+		}
+		evaluation.Requests += current.Successful - base.Successful + current.Failed - base.Failed
+		evaluation.FailedRequests += current.Failed - base.Failed
+	}
+	evaluation.ErrorRate = errorRate(evaluation.Requests, evaluation.FailedRequests)
+	evaluation.BaselineErrorRate = errorRate(evaluation.BaselineRequests, baselineFailed)
+
+	observed := rollout.CanaryStartedAt != nil && !now.Before(rollout.CanaryStartedAt.Add(rollout.ObserveDuration()))
+
+	if evaluation.Requests < rollout.MinRequests {
+		evaluation.Detail = fmt.Sprintf("%d of %d requests needed to judge the canary", evaluation.Requests, rollout.MinRequests)
+		if observed {
+			evaluation.Verdict = db.ROLLOUT_ROLLBACK
+			evaluation.Detail = fmt.Sprintf("only %d of %d requests needed to judge the canary were served in %s",
+				evaluation.Requests, rollout.MinRequests, rollout.ObserveDuration())
+		}
+		return evaluation
+	}
+
+	if rollout.MaxErrorRate != nil && evaluation.ErrorRate > *rollout.MaxErrorRate {
+		evaluation.Verdict = db.ROLLOUT_ROLLBACK
+		evaluation.Detail = fmt.Sprintf("error rate %.2f%% is above the maximum of %.2f%%", evaluation.ErrorRate*100, *rollout.MaxErrorRate*100)
+		return evaluation
+	}
+	if rollout.MaxErrorRateIncrease != nil && evaluation.ErrorRate > evaluation.BaselineErrorRate+*rollout.MaxErrorRateIncrease {
+		evaluation.Verdict = db.ROLLOUT_ROLLBACK
+		evaluation.Detail = fmt.Sprintf("error rate %.2f%% is more than %.2f points above the %.2f%% before the canary",
+			evaluation.ErrorRate*100, *rollout.MaxErrorRateIncrease*100, evaluation.BaselineErrorRate*100)
+		return evaluation
+	}
+
+	evaluation.Detail = fmt.Sprintf("error rate %.2f%% over %d requests is within limits", evaluation.ErrorRate*100, evaluation.Requests)
+	if observed {
+		evaluation.Verdict = db.ROLLOUT_PROMOTE
+	}
+	return evaluation
+}
+
+func evaluateRollout(ctx context.Context, rollout *db.ParameterRollout, now time.Time) error {
+	counts, err := db.GetRequestCounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	evaluation := EvaluateCanary(rollout, counts, now)
+	rollout.Evaluation = &evaluation
+	if err := db.UpdateParameterRollout(ctx, rollout, db.ROLLOUT_CANARY); err != nil {
+		return err
+	}
+
+	switch evaluation.Verdict {
+	case db.ROLLOUT_PROMOTE:
+		return PromoteParameterRollout(ctx, rollout, db.ROLLOUT_SYSTEM_ACTOR, evaluation.Detail)
+	case db.ROLLOUT_ROLLBACK:
+		return RollbackParameterRollout(ctx, rollout, db.ROLLOUT_SYSTEM_ACTOR, evaluation.Detail)
+	}
+	return nil
+}
+
+// PromoteParameterRollout stores the parameters of the rollout as the active ones and sends
+// them to every proxy.
+func PromoteParameterRollout(ctx context.Context, rollout *db.ParameterRollout, actor, reason string) error {
+	from := rollout.Status
+	now := time.Now()
+	rollout.Status = db.ROLLOUT_PROMOTED
+	rollout.Reason = reason
+	rollout.FinishedAt = &now
+	// claimed first, so a rollout is never promoted twice
+	if err := db.UpdateParameterRollout(ctx, rollout, from); err != nil {
+		rollout.Status = from
+		return err
+	}
+
+	scope, err := db.GetPoolName(ctx, rollout.PoolId)
+	if err == nil {
+		var saved *db.PrequalParametersResponse
+		if saved, err = db.AddPrequalParametersResponse(ctx, rollout.Parameters()); err == nil {
+			if err := PublishMessage(PUBLISHING_QUEUE, parametersMessage(scope, *saved)); err != nil {
+				log.Printf("Failed to publish change parameters message: %v", err)
+			}
+
+			id := int64(saved.Id)
+			rollout.ParametersId = &id
+			if err := db.UpdateParameterRollout(ctx, rollout, db.ROLLOUT_PROMOTED); err != nil {
+				log.Print(err)
+			}
+			if rollout.DraftId != nil {
+				comment := fmt.Sprintf("parameter rollout #%d promoted", rollout.Id)
+				if err := finishRolloutDraft(ctx, rollout, db.DRAFT_APPLY, actor, comment); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+	if err != nil {
+		// the canary must not keep parameters that were never stored
+		rollbackErr := RollbackParameterRollout(ctx, rollout, actor, fmt.Sprintf("failed to store the parameters: %v", err))
+		if rollbackErr != nil {
+			log.Print(rollbackErr)
+		}
+		return err
+	}
+
+	if rollout.CanaryStartedAt != nil {
+		if err := releaseCanaryPools(ctx, rollout); err != nil {
+			log.Printf("Failed to release the canary pools of rollout %d: %v", rollout.Id, err)
+		}
+	}
+
+	message := fmt.Sprintf("Parameter rollout #%d promoted by %s", rollout.Id, actor)
+	if reason != "" {
+		message += ": " + reason
+	}
+	if err := db.LogActivity(ctx, "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+	return nil
+}
+
+// RollbackParameterRollout cancels a scheduled rollout, or sends the parameters in use back
+// to the canary of a running one. A rollout that failed to promote is rolled back too.
+func RollbackParameterRollout(ctx context.Context, rollout *db.ParameterRollout, actor, reason string) error {
+	from := rollout.Status
+	now := time.Now()
+	rollout.Status = db.ROLLOUT_ROLLED_BACK
+	if from == db.ROLLOUT_SCHEDULED {
+		rollout.Status = db.ROLLOUT_CANCELLED
+	}
+	rollout.Reason = reason
+	rollout.FinishedAt = &now
+	if err := db.UpdateParameterRollout(ctx, rollout, from); err != nil {
+		rollout.Status = from
+		return err
+	}
+
+	if rollout.CanaryStartedAt != nil {
+		stable, err := stableParameters(ctx, rollout)
+		if err != nil {
+			log.Printf("Failed to fetch the parameters to roll rollout %d back to: %v", rollout.Id, err)
+		} else if err := publishToCanaryInstances(ctx, rollout, stable); err != nil {
+			log.Printf("Failed to publish parameters of rollout %d back to its canary: %v", rollout.Id, err)
+		}
+		if err := releaseCanaryPools(ctx, rollout); err != nil {
+			log.Printf("Failed to release the canary pools of rollout %d: %v", rollout.Id, err)
+		}
+	}
+
+	if rollout.DraftId != nil {
+		comment := fmt.Sprintf("parameter rollout #%d %s", rollout.Id, strings.ReplaceAll(rollout.Status, "_", " "))
+		if reason != "" {
+			comment += ": " + reason
+		}
+		if err := finishRolloutDraft(ctx, rollout, db.DRAFT_UNSCHEDULE, actor, comment); err != nil {
+			log.Print(err)
+		}
+	}
+
+	message := fmt.Sprintf("Parameter rollout #%d %s by %s", rollout.Id, rollout.Status, actor)
+	if rollout.Status == db.ROLLOUT_ROLLED_BACK {
+		message = fmt.Sprintf("Parameter rollout #%d rolled back by %s", rollout.Id, actor)
+	}
+	if reason != "" {
+		message += ": " + reason
+	}
+	if err := db.LogActivity(ctx, "warning", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+	return nil
+}
+
+// records the end of the rollout on its draft: applied with the stored parameters once
+// promoted, approved and free to use again otherwise
+func finishRolloutDraft(ctx context.Context, rollout *db.ParameterRollout, action, actor, comment string) error {
+	draft, err := db.GetParameterDraftById(ctx, *rollout.DraftId)
+	if err != nil {
+		return fmt.Errorf("error fetching parameter draft: %v", err)
+	}
+	if err := db.TransitionParameterDraft(ctx, draft, db.DRAFT_APPROVED, action, actor, comment); err != nil {
+		return err
+	}
+	if action == db.DRAFT_APPLY && rollout.ParametersId != nil {
+		return db.SetParameterDraftParameters(ctx, draft, *rollout.ParametersId)
+	}
+	return nil
+}
+
+// parameters the canary pools of running rollouts take instead of the global ones
+func canaryPoolParameters(ctx context.Context) (map[string]ParameterValues, error) {
+	rollouts, err := db.GetParameterRollouts(ctx, db.ROLLOUT_CANARY)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters := map[string]ParameterValues{}
+	for i := range rollouts {
+		for _, poolId := range rollouts[i].CanaryPoolIds {
+			pool, err := db.GetPoolName(ctx, &poolId)
+			if err != nil {
+				return nil, err
+			}
+			parameters[pool] = parameterValues(rolloutCandidate(&rollouts[i]))
+		}
+	}
+	return parameters, nil
+}
+
+// running rollouts with the proxy in their canary, every running rollout without a proxy
+func instanceCanaries(ctx context.Context, proxy *db.ProxyInstance) ([]db.ParameterRollout, error) {
+	rollouts, err := db.GetParameterRollouts(ctx, db.ROLLOUT_CANARY)
+	if err != nil {
+		return nil, err
+	}
+
+	var canaries []db.ParameterRollout
+	for _, rollout := range rollouts {
+		if proxy == nil || slices.Contains(rollout.CanaryInstances, proxy.InstanceId) {
+			canaries = append(canaries, rollout)
+		}
+	}
+	return canaries, nil
+}
+
+// the desired state of a proxy in the canary of running rollouts has their parameters
+func applyInstanceCanaries(ctx context.Context, content *StateContent, proxy *db.ProxyInstance) error {
+	if proxy == nil {
+		return nil
+	}
+	canaries, err := instanceCanaries(ctx, proxy)
+	if err != nil {
+		return err
+	}
+
+	for i := range canaries {
+		values := parameterValues(rolloutCandidate(&canaries[i]))
+		if canaries[i].PoolId == nil {
+			content.Parameters = &values
+			continue
+		}
+		pool, err := db.GetPoolName(ctx, canaries[i].PoolId)
+		if err != nil {
+			return err
+		}
+		content.PoolParameters[pool] = values
+	}
+	return nil
+}
+
+// snapshots go to every instance alike, instances in a canary get its parameters again
+// right after, to the given proxy only unless it is nil
+func republishInstanceCanaries(ctx context.Context, proxy *db.ProxyInstance) error {
+	canaries, err := instanceCanaries(ctx, proxy)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range canaries {
+		rollout := &canaries[i]
+		scope, err := db.GetPoolName(ctx, rollout.PoolId)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, instance := range rollout.CanaryInstances {
+			if proxy != nil && instance != proxy.InstanceId {
+				continue
+			}
+			if err := PublishMessage(ProxyQueueName(instance), parametersMessage(scope, rolloutCandidate(rollout))); err != nil {
+				errs = append(errs, fmt.Errorf("proxy %s: %v", instance, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
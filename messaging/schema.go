@@ -0,0 +1,161 @@
+package messaging
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const SCHEMA_MODE_OFF = "off"
+const SCHEMA_MODE_WARN = "warn"
+const SCHEMA_MODE_ENFORCE = "enforce"
+
+// the JSON Schema of every message, named after it
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// who sends a message and the type the admin encodes or decodes its body as
+type messageContract struct {
+	direction string
+	body      func() interface{}
+}
+
+var messageContracts = map[string]messageContract{
+	ADD_REPLICA:              {db.MESSAGE_OUTBOUND, func() interface{} { return &ReplicaBody{} }},
+	REMOVE_REPLICA:           {db.MESSAGE_OUTBOUND, func() interface{} { return &map[string]string{} }},
+	UPDATE_REPLICA:           {db.MESSAGE_OUTBOUND, func() interface{} { return &map[string]string{} }},
+	UPDATE_REPLICA_CAPACITY:  {db.MESSAGE_OUTBOUND, func() interface{} { return &ReplicaBody{} }},
+	DRAIN_REPLICA:            {db.MESSAGE_OUTBOUND, func() interface{} { return &map[string]interface{}{} }},
+	NEW_PARAMETERS:           {db.MESSAGE_OUTBOUND, func() interface{} { return &ParametersBody{} }},
+	CLEAR_POOL_PARAMETERS:    {db.MESSAGE_OUTBOUND, func() interface{} { return &map[string]string{} }},
+	UPDATE_POOL:              {db.MESSAGE_OUTBOUND, func() interface{} { return &PoolBody{} }},
+	REMOVE_POOL:              {db.MESSAGE_OUTBOUND, func() interface{} { return &map[string]string{} }},
+	STATE_SNAPSHOT:           {db.MESSAGE_OUTBOUND, func() interface{} { return &StateSnapshotBody{} }},
+	ADDED_REPLICA:            {db.MESSAGE_INBOUND, func() interface{} { return new(string) }},
+	REMOVED_REPLICA:          {db.MESSAGE_INBOUND, func() interface{} { return new(string) }},
+	REPLICA_FAILED:           {db.MESSAGE_INBOUND, func() interface{} { return new(string) }},
+	STATISTICS:               {db.MESSAGE_INBOUND, func() interface{} { return &[]statDataArr{} }},
+	PARAMETERS_UPDATED:       {db.MESSAGE_INBOUND, func() interface{} { return &[]interface{}{} }},
+	PARAMETERS_UPDATE_FAILED: {db.MESSAGE_INBOUND, func() interface{} { return new(string) }},
+	REPLICA_DRAINING:         {db.MESSAGE_INBOUND, func() interface{} { return &DrainProgress{} }},
+	SYNC_REQUEST:             {db.MESSAGE_INBOUND, func() interface{} { return new(interface{}) }},
+	ACTUAL_STATE:             {db.MESSAGE_INBOUND, func() interface{} { return &ActualState{} }},
+	PROXY_REGISTER:           {db.MESSAGE_INBOUND, func() interface{} { return &ProxyRegistration{} }},
+	PROXY_HEARTBEAT:          {db.MESSAGE_INBOUND, func() interface{} { return &ProxyHeartbeat{} }},
+	PROXY_DEREGISTER:         {db.MESSAGE_INBOUND, func() interface{} { return new(interface{}) }},
+}
+
+type MessageSchema struct {
+	Name      string          `json:"name"`
+	Direction string          `json:"direction"`
+	Schema    json.RawMessage `json:"schema"`
+}
+
+var loadSchemas = sync.OnceValues(func() (map[string]*jsonSchema, error) {
+	schemas := map[string]*jsonSchema{}
+	for name := range messageContracts {
+		raw, err := schemaFiles.ReadFile("schemas/" + name + ".json")
+		if err != nil {
+			return nil, fmt.Errorf("no schema for %s message", name)
+		}
+		schema, err := parseJSONSchema(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema for %s message: %v", name, err)
+		}
+		schemas[name] = schema
+	}
+	return schemas, nil
+})
+
+// SchemaMode is what happens to a message that violates its schema, configured with
+// MESSAGE_SCHEMA_MODE: off, warn (log it, the default) or enforce (reject it).
+func SchemaMode() string {
+	raw := strings.ToLower(os.Getenv("MESSAGE_SCHEMA_MODE"))
+	switch raw {
+	case "":
+		return SCHEMA_MODE_WARN
+	case SCHEMA_MODE_OFF, SCHEMA_MODE_WARN, SCHEMA_MODE_ENFORCE:
+		return raw
+	default:
+		log.Printf("Invalid MESSAGE_SCHEMA_MODE %q, using %s", raw, SCHEMA_MODE_WARN)
+		return SCHEMA_MODE_WARN
+	}
+}
+
+// MessageSchemas lists the schema of every message, sorted by name.
+func MessageSchemas() []MessageSchema {
+	schemas := []MessageSchema{}
+	for name := range messageContracts {
+		if schema, ok := GetMessageSchema(name); ok {
+			schemas = append(schemas, schema)
+		}
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Name < schemas[j].Name })
+	return schemas
+}
+
+// GetMessageSchema returns the schema of the named message.
+func GetMessageSchema(name string) (MessageSchema, bool) {
+	contract, ok := messageContracts[name]
+	if !ok {
+		return MessageSchema{}, false
+	}
+	raw, err := schemaFiles.ReadFile("schemas/" + name + ".json")
+	if err != nil {
+		return MessageSchema{}, false
+	}
+	return MessageSchema{Name: name, Direction: contract.direction, Schema: raw}, true
+}
+
+// ValidateMessage checks an encoded message against the schema of its name, and returns
+// the violations. Messages without a schema have none.
+func ValidateMessage(message []byte) (string, []string, error) {
+	var envelope struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return "", []string{fmt.Sprintf("invalid JSON: %v", err)}, nil
+	}
+
+	schemas, err := loadSchemas()
+	if err != nil {
+		return envelope.Name, nil, err
+	}
+	schema, ok := schemas[envelope.Name]
+	if !ok {
+		return envelope.Name, nil, nil
+	}
+	return envelope.Name, schema.validate(message), nil
+}
+
+// checks a message on publish or consume, an error only when the schema mode is enforce
+func checkSchema(message []byte) error {
+	mode := SchemaMode()
+	if mode == SCHEMA_MODE_OFF {
+		return nil
+	}
+
+	name, violations, err := ValidateMessage(message)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("%s message violates its schema: %s", name, strings.Join(violations, "; "))
+	if mode == SCHEMA_MODE_ENFORCE {
+		return err
+	}
+	log.Print(err)
+	return nil
+}
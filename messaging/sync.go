@@ -0,0 +1,517 @@
+package messaging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const DEFAULT_STATE_SYNC_INTERVAL = 5 * time.Minute
+
+// kinds of drift between the desired and the actual state
+const (
+	DRIFT_MISSING_REPLICA     = "missing-replica"
+	DRIFT_UNEXPECTED_REPLICA  = "unexpected-replica"
+	DRIFT_REPLICA_MISMATCH    = "replica-mismatch"
+	DRIFT_MISSING_POOL        = "missing-pool"
+	DRIFT_UNEXPECTED_POOL     = "unexpected-pool"
+	DRIFT_POOL_MISMATCH       = "pool-mismatch"
+	DRIFT_PARAMETERS_MISMATCH = "parameters-mismatch"
+	// parameters of a pool that should use the global ones
+	DRIFT_UNEXPECTED_PARAMETERS = "unexpected-parameters"
+)
+
+// a replica as the proxy should be running it
+type SnapshotReplica struct {
+	ReplicaBody
+	Status string `json:"status,omitempty"`
+}
+
+type ParameterValues struct {
+	MaxLifeTime       int     `json:"max_life_time"`
+	PoolSize          int     `json:"pool_size"`
+	ProbeFactor       float64 `json:"probe_factor"`
+	ProbeRemoveFactor int     `json:"probe_remove_factor"`
+	Mu                int     `json:"mu"`
+}
+
+func parameterValues(parameters db.PrequalParametersResponse) ParameterValues {
+	return ParameterValues{
+		MaxLifeTime:       parameters.MaxLifeTime,
+		PoolSize:          parameters.PoolSize,
+		ProbeFactor:       parameters.ProbeFactor,
+		ProbeRemoveFactor: parameters.ProbeRemoveFactor,
+		Mu:                parameters.Mu,
+	}
+}
+
+// everything the proxy needs to know, shared by snapshots and actual state reports
+type StateContent struct {
+	Replicas       []SnapshotReplica          `json:"replicas"`
+	Pools          []PoolBody                 `json:"pools"`
+	Parameters     *ParameterValues           `json:"parameters"`
+	PoolParameters map[string]ParameterValues `json:"pool_parameters"`
+}
+
+// body of state-snapshot messages
+type StateSnapshotBody struct {
+	Version     int64     `json:"version"`
+	GeneratedAt time.Time `json:"generated_at"`
+	StateContent
+}
+
+// body of actual-state messages, version is the last snapshot the proxy applied
+type ActualState struct {
+	Version int64 `json:"version"`
+	StateContent
+}
+
+type ActualStateMessage struct {
+	Name string      `json:"name"`
+	Body ActualState `json:"body"`
+}
+
+// StateSyncInterval is how often the desired state is published, configured with
+// STATE_SYNC_INTERVAL (e.g. 1m, 10m).
+func StateSyncInterval() time.Duration {
+	raw := os.Getenv("STATE_SYNC_INTERVAL")
+	if raw == "" {
+		return DEFAULT_STATE_SYNC_INTERVAL
+	}
+
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval <= 0 {
+		log.Printf("Invalid STATE_SYNC_INTERVAL %q, using %s", raw, DEFAULT_STATE_SYNC_INTERVAL)
+		return DEFAULT_STATE_SYNC_INTERVAL
+	}
+	return interval
+}
+
+// AutoCorrectDrift reports whether drift is corrected by re-sending the desired state,
+// enabled with STATE_AUTO_CORRECT=true.
+func AutoCorrectDrift() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("STATE_AUTO_CORRECT"))
+	return enabled
+}
+
+// builds the desired state from the tables, sorted so equal states serialize equally
+func buildStateContent(ctx context.Context) (StateContent, error) {
+	content := StateContent{
+		Replicas:       []SnapshotReplica{},
+		Pools:          []PoolBody{},
+		PoolParameters: map[string]ParameterValues{},
+	}
+
+	pools, err := db.GetPools(ctx)
+	if err != nil {
+		return content, err
+	}
+	poolNames := map[int64]string{}
+	for i := range pools {
+		pool := &pools[i]
+		poolNames[pool.Id] = pool.Name
+		content.Pools = append(content.Pools, NewPoolBody(pool))
+
+		parameters, err := db.GetPoolPrequalParameters(ctx, pool.Id)
+		if err == nil && parameters.PoolId != nil {
+			content.PoolParameters[pool.Name] = parameterValues(parameters)
+		}
+	}
+	sort.Slice(content.Pools, func(i, j int) bool { return content.Pools[i].Name < content.Pools[j].Name })
+
+	canaryPools, err := canaryPoolParameters(ctx)
+	if err != nil {
+		return content, err
+	}
+	for pool, parameters := range canaryPools {
+		content.PoolParameters[pool] = parameters
+	}
+
+	replicas, err := db.GetReplicas(ctx)
+	if err != nil {
+		return content, err
+	}
+	for _, replica := range replicas {
+		// the proxy does not know about disabled replicas
+		if replica.Status == db.DISABLED {
+			continue
+		}
+		body := ReplicaBody{
+			Name:                  replica.Name,
+			URL:                   replica.URL,
+			Weight:                replica.Weight,
+			MaxConcurrentRequests: replica.MaxConcurrent,
+			CapacityClass:         replica.CapacityClass,
+		}
+		if replica.PoolId != nil {
+			body.Pool = poolNames[*replica.PoolId]
+		}
+		content.Replicas = append(content.Replicas, SnapshotReplica{ReplicaBody: body, Status: replica.Status})
+	}
+	sort.Slice(content.Replicas, func(i, j int) bool { return content.Replicas[i].URL < content.Replicas[j].URL })
+
+	if parameters, err := db.GetPrequalParametersResponse(ctx); err == nil {
+		values := parameterValues(parameters)
+		content.Parameters = &values
+	}
+
+	return content, nil
+}
+
+// CurrentStateSnapshot builds the desired state and versions it, the version only moves
+// when the state changed since the last snapshot.
+func CurrentStateSnapshot(ctx context.Context) (*StateSnapshotBody, error) {
+	content, err := buildStateContent(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error building desired state: %v", err)
+	}
+
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+
+	snapshot, created, err := db.SaveStateSnapshot(ctx, hex.EncodeToString(sum[:]), raw)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		log.Printf("Desired state is now at version %d", snapshot.Version)
+	}
+
+	return &StateSnapshotBody{
+		Version:      snapshot.Version,
+		GeneratedAt:  time.Now(),
+		StateContent: content,
+	}, nil
+}
+
+// PublishStateSnapshot sends the full desired state to every proxy instance.
+func PublishStateSnapshot(ctx context.Context) (*StateSnapshotBody, error) {
+	return PublishStateSnapshotTo(ctx, nil)
+}
+
+// PublishStateSnapshotTo sends the full desired state to one proxy instance, or to every
+// instance when proxy is nil.
+func PublishStateSnapshotTo(ctx context.Context, proxy *db.ProxyInstance) (*StateSnapshotBody, error) {
+	snapshot, err := CurrentStateSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{
+		Name: STATE_SNAPSHOT,
+		Body: snapshot,
+	}
+	if err := PublishMessage(proxyQueue(proxy), message); err != nil {
+		return nil, err
+	}
+	if err := republishInstanceCanaries(ctx, proxy); err != nil {
+		log.Printf("Failed to publish canary parameters after the state snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+func handleSyncRequest(ctx context.Context, proxy *db.ProxyInstance) error {
+	snapshot, err := PublishStateSnapshotTo(ctx, proxy)
+	if err != nil {
+		return fmt.Errorf("failed to publish state snapshot: %v", err)
+	}
+
+	message := fmt.Sprintf("Full state sync requested by %s, sent version %d", proxyName(proxy), snapshot.Version)
+	if err := db.LogActivity(ctx, "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+	return nil
+}
+
+func handleActualState(ctx context.Context, proxy *db.ProxyInstance, actual ActualState) error {
+	desired, err := CurrentStateSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to build desired state: %v", err)
+	}
+	if err := applyInstanceCanaries(ctx, &desired.StateContent, proxy); err != nil {
+		return fmt.Errorf("failed to build desired state: %v", err)
+	}
+
+	drift := DetectDrift(desired.StateContent, actual.StateContent)
+	report := &db.StateReport{
+		DesiredVersion:  &desired.Version,
+		ReportedVersion: actual.Version,
+		InSync:          len(drift) == 0,
+		Drift:           drift,
+	}
+	if proxy != nil {
+		report.ProxyId = &proxy.Id
+	}
+
+	if len(drift) > 0 {
+		message := fmt.Sprintf("State of %s drifted from desired version %d (proxy at version %d): %s",
+			proxyName(proxy), desired.Version, actual.Version, summarizeDrift(drift))
+		if err := db.LogActivity(ctx, "warning", message, nil); err != nil {
+			log.Printf("Failed to log activity: %v", err)
+		}
+
+		if AutoCorrectDrift() {
+			if err := CorrectDrift(proxy, desired.StateContent, drift); err != nil {
+				log.Printf("Failed to correct drift: %v", err)
+			} else {
+				report.Corrected = true
+				message := fmt.Sprintf("Corrected %d differences in the state of %s", len(drift), proxyName(proxy))
+				if err := db.LogActivity(ctx, "success", message, nil); err != nil {
+					log.Printf("Failed to log activity: %v", err)
+				}
+			}
+		}
+	}
+
+	if err := db.RecordStateReport(ctx, report); err != nil {
+		return fmt.Errorf("failed to record state report: %v", err)
+	}
+	return nil
+}
+
+// counts the drift by kind, e.g. "2 missing-replica, 1 parameters-mismatch"
+func summarizeDrift(drift []db.StateDrift) string {
+	counts := map[string]int{}
+	var kinds []string
+	for _, d := range drift {
+		if counts[d.Kind] == 0 {
+			kinds = append(kinds, d.Kind)
+		}
+		counts[d.Kind]++
+	}
+
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DetectDrift lists every difference between the desired and the actual state.
+// Replicas are matched by url, pools and pool parameters by name.
+func DetectDrift(desired, actual StateContent) []db.StateDrift {
+	var drift []db.StateDrift
+
+	actualPools := map[string]PoolBody{}
+	for _, pool := range actual.Pools {
+		actualPools[pool.Name] = pool
+	}
+	desiredPools := map[string]bool{}
+	for _, pool := range desired.Pools {
+		desiredPools[pool.Name] = true
+		running, ok := actualPools[pool.Name]
+		if !ok {
+			drift = append(drift, db.StateDrift{Kind: DRIFT_MISSING_POOL, Name: pool.Name, Desired: pool})
+			continue
+		}
+		if running != pool {
+			drift = append(drift, db.StateDrift{Kind: DRIFT_POOL_MISMATCH, Name: pool.Name, Desired: pool, Actual: running})
+		}
+	}
+	for _, pool := range actual.Pools {
+		if !desiredPools[pool.Name] {
+			drift = append(drift, db.StateDrift{Kind: DRIFT_UNEXPECTED_POOL, Name: pool.Name, Actual: pool})
+		}
+	}
+
+	actualReplicas := map[string]SnapshotReplica{}
+	for _, replica := range actual.Replicas {
+		actualReplicas[replica.URL] = replica
+	}
+	desiredUrls := map[string]bool{}
+	for _, replica := range desired.Replicas {
+		desiredUrls[replica.URL] = true
+		running, ok := actualReplicas[replica.URL]
+		if !ok {
+			drift = append(drift, db.StateDrift{Kind: DRIFT_MISSING_REPLICA, Name: replica.Name, Desired: replica})
+			continue
+		}
+		if fields := replicaDriftFields(replica, running); len(fields) > 0 {
+			drift = append(drift, db.StateDrift{Kind: DRIFT_REPLICA_MISMATCH, Name: replica.Name, Fields: fields, Desired: replica, Actual: running})
+		}
+	}
+	for _, replica := range actual.Replicas {
+		if !desiredUrls[replica.URL] {
+			drift = append(drift, db.StateDrift{Kind: DRIFT_UNEXPECTED_REPLICA, Name: replica.Name, Actual: replica})
+		}
+	}
+
+	if desired.Parameters != nil && (actual.Parameters == nil || *desired.Parameters != *actual.Parameters) {
+		drift = append(drift, db.StateDrift{Kind: DRIFT_PARAMETERS_MISMATCH, Name: "global", Desired: desired.Parameters, Actual: actual.Parameters})
+	}
+	poolNames := make([]string, 0, len(desired.PoolParameters))
+	for name := range desired.PoolParameters {
+		poolNames = append(poolNames, name)
+	}
+	sort.Strings(poolNames)
+	for _, name := range poolNames {
+		parameters := desired.PoolParameters[name]
+		running, ok := actual.PoolParameters[name]
+		if !ok || running != parameters {
+			var current interface{}
+			if ok {
+				current = running
+			}
+			drift = append(drift, db.StateDrift{Kind: DRIFT_PARAMETERS_MISMATCH, Name: name, Desired: parameters, Actual: current})
+		}
+	}
+	// pools that are not desired at all are removed with their parameters
+	unexpectedNames := make([]string, 0, len(actual.PoolParameters))
+	for name := range actual.PoolParameters {
+		if _, ok := desired.PoolParameters[name]; !ok && desiredPools[name] {
+			unexpectedNames = append(unexpectedNames, name)
+		}
+	}
+	sort.Strings(unexpectedNames)
+	for _, name := range unexpectedNames {
+		drift = append(drift, db.StateDrift{Kind: DRIFT_UNEXPECTED_PARAMETERS, Name: name, Actual: actual.PoolParameters[name]})
+	}
+
+	return drift
+}
+
+func replicaDriftFields(desired, actual SnapshotReplica) []string {
+	var fields []string
+	if desired.Name != actual.Name {
+		fields = append(fields, "name")
+	}
+	if desired.Pool != actual.Pool {
+		fields = append(fields, "pool")
+	}
+	if desired.Weight != actual.Weight {
+		fields = append(fields, "weight")
+	}
+	if desired.MaxConcurrentRequests != actual.MaxConcurrentRequests {
+		fields = append(fields, "max_concurrent_requests")
+	}
+	if desired.CapacityClass != actual.CapacityClass {
+		fields = append(fields, "capacity_class")
+	}
+	// only a drain has to be mirrored, the proxy decides when a replica is healthy
+	if actual.Status != "" && (desired.Status == db.DRAINING) != (actual.Status == db.DRAINING) {
+		fields = append(fields, "status")
+	}
+	return fields
+}
+
+// CorrectDrift sends the messages that bring the proxy back to the desired state, only to
+// the given instance unless it is nil.
+func CorrectDrift(proxy *db.ProxyInstance, desired StateContent, drift []db.StateDrift) error {
+	pools := map[string]PoolBody{}
+	for _, pool := range desired.Pools {
+		pools[pool.Name] = pool
+	}
+	replicas := map[string]SnapshotReplica{}
+	for _, replica := range desired.Replicas {
+		replicas[replica.Name] = replica
+	}
+
+	var messages []*Message
+	for _, d := range drift {
+		switch d.Kind {
+		case DRIFT_MISSING_POOL, DRIFT_POOL_MISMATCH:
+			messages = append(messages, &Message{Name: UPDATE_POOL, Body: pools[d.Name]})
+		case DRIFT_UNEXPECTED_POOL:
+			messages = append(messages, &Message{Name: REMOVE_POOL, Body: map[string]string{"name": d.Name}})
+		}
+	}
+
+	for _, d := range drift {
+		switch d.Kind {
+		case DRIFT_MISSING_REPLICA:
+			messages = append(messages, &Message{Name: ADD_REPLICA, Body: replicas[d.Name].ReplicaBody})
+		case DRIFT_UNEXPECTED_REPLICA:
+			actual, _ := d.Actual.(SnapshotReplica)
+			messages = append(messages, &Message{Name: REMOVE_REPLICA, Body: map[string]string{"name": actual.Name, "url": actual.URL}})
+		case DRIFT_REPLICA_MISMATCH:
+			replica := replicas[d.Name]
+			if slices.Contains(d.Fields, "name") || slices.Contains(d.Fields, "pool") {
+				messages = append(messages, &Message{Name: UPDATE_REPLICA, Body: map[string]string{
+					"name": replica.Name,
+					"url":  replica.URL,
+					"pool": replica.Pool,
+				}})
+			}
+			if slices.Contains(d.Fields, "weight") || slices.Contains(d.Fields, "max_concurrent_requests") || slices.Contains(d.Fields, "capacity_class") {
+				messages = append(messages, &Message{Name: UPDATE_REPLICA_CAPACITY, Body: replica.ReplicaBody})
+			}
+			if slices.Contains(d.Fields, "status") {
+				if replica.Status == db.DRAINING {
+					messages = append(messages, &Message{Name: DRAIN_REPLICA, Body: map[string]interface{}{
+						"name":            replica.Name,
+						"url":             replica.URL,
+						"timeout_seconds": int(DrainTimeout().Seconds()),
+					}})
+				} else {
+					messages = append(messages, &Message{Name: ADD_REPLICA, Body: replica.ReplicaBody})
+				}
+			}
+		}
+	}
+
+	for _, d := range drift {
+		if d.Kind == DRIFT_UNEXPECTED_PARAMETERS {
+			messages = append(messages, &Message{Name: CLEAR_POOL_PARAMETERS, Body: map[string]string{"pool": d.Name}})
+			continue
+		}
+		if d.Kind != DRIFT_PARAMETERS_MISMATCH {
+			continue
+		}
+		values := desired.Parameters
+		pool := ""
+		if d.Name != "global" {
+			poolValues := desired.PoolParameters[d.Name]
+			values = &poolValues
+			pool = d.Name
+		}
+		if values == nil {
+			continue
+		}
+		messages = append(messages, &Message{Name: NEW_PARAMETERS, Body: ParametersBody{
+			Pool: pool,
+			Parameters: db.PrequalParametersResponse{
+				MaxLifeTime:       values.MaxLifeTime,
+				PoolSize:          values.PoolSize,
+				ProbeFactor:       values.ProbeFactor,
+				ProbeRemoveFactor: values.ProbeRemoveFactor,
+				Mu:                values.Mu,
+				Status:            "active",
+			},
+		}})
+	}
+
+	for _, message := range messages {
+		if err := PublishMessage(proxyQueue(proxy), message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartStateSync publishes the desired state right away and then periodically.
+func StartStateSync() {
+	interval := StateSyncInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := PublishStateSnapshot(context.Background()); err != nil {
+			log.Printf("Failed to publish state snapshot: %s", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,190 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const TRANSPORT_RABBITMQ = "rabbitmq"
+const TRANSPORT_HTTP = "http"
+
+// commands kept for a proxy that stopped polling, before publishing to it fails
+const HTTP_OUTBOX_LIMIT = 1000
+
+var ErrUnknownQueue = errors.New("unknown proxy queue")
+
+// Transport is how the admin and the proxies exchange messages, configured with
+// MESSAGING_TRANSPORT: rabbitmq (the default) or http, where the proxy long-polls the
+// admin for its commands and posts its events.
+func Transport() string {
+	raw := strings.ToLower(os.Getenv("MESSAGING_TRANSPORT"))
+	switch raw {
+	case "", TRANSPORT_RABBITMQ:
+		return TRANSPORT_RABBITMQ
+	case TRANSPORT_HTTP:
+		return TRANSPORT_HTTP
+	default:
+		log.Printf("Invalid MESSAGING_TRANSPORT %q, using %s", raw, TRANSPORT_RABBITMQ)
+		return TRANSPORT_RABBITMQ
+	}
+}
+
+// a command waiting to be polled, seq increases with every command published
+type OutboxMessage struct {
+	Seq       int64           `json:"seq"`
+	MessageId string          `json:"message_id"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// the http counterpart of a queue. Bound outboxes receive what is published to
+// PUBLISHING_QUEUE, like queues bound to the fanout exchange.
+type outbox struct {
+	bound    bool
+	messages []OutboxMessage
+	// closed and replaced when a command arrives, wakes up the pollers
+	arrived chan struct{}
+}
+
+// outboxes live in memory, a proxy that reconnects after a restart of the admin
+// registers again and gets a full state snapshot
+type httpOutboxes struct {
+	mu     sync.Mutex
+	seq    int64
+	queues map[string]*outbox
+}
+
+var outboxes = &httpOutboxes{queues: map[string]*outbox{}}
+
+func (o *httpOutboxes) declare(queueName string, bound bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if box, ok := o.queues[queueName]; ok {
+		box.bound = box.bound || bound
+		return
+	}
+	o.queues[queueName] = &outbox{bound: bound, arrived: make(chan struct{})}
+}
+
+func (o *httpOutboxes) delete(queueName string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if box, ok := o.queues[queueName]; ok {
+		close(box.arrived)
+		delete(o.queues, queueName)
+	}
+}
+
+// appends the command to the outbox of the queue, or to every bound outbox for PUBLISHING_QUEUE
+func (o *httpOutboxes) publish(queueName, messageId string, messageBytes []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var targets []*outbox
+	if queueName == PUBLISHING_QUEUE {
+		for _, box := range o.queues {
+			if box.bound {
+				targets = append(targets, box)
+			}
+		}
+	} else {
+		box, ok := o.queues[queueName]
+		if !ok {
+			box = &outbox{arrived: make(chan struct{})}
+			o.queues[queueName] = box
+		}
+		targets = append(targets, box)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("%w: no proxy is polling", errUnroutable)
+	}
+
+	o.seq++
+	delivered := 0
+	for _, box := range targets {
+		// a proxy that stopped polling doesn't hold up the others
+		if len(box.messages) >= HTTP_OUTBOX_LIMIT {
+			continue
+		}
+		delivered++
+		box.messages = append(box.messages, OutboxMessage{
+			Seq:       o.seq,
+			MessageId: messageId,
+			Message:   messageBytes,
+		})
+		close(box.arrived)
+		box.arrived = make(chan struct{})
+	}
+	if delivered < len(targets) {
+		log.Printf("Outbox full, %d of %d proxies missed %s", len(targets)-delivered, len(targets), messageId)
+	}
+	if delivered == 0 {
+		return fmt.Errorf("outbox of %s is full", queueName)
+	}
+	return nil
+}
+
+// PollCommands returns up to limit commands of the queue published after seq after, waiting
+// until one arrives or wait passes. Polling with after acknowledges the commands up to it,
+// commands after it are delivered again until acknowledged.
+func PollCommands(ctx context.Context, queueName string, after int64, wait time.Duration, limit int) ([]OutboxMessage, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		outboxes.mu.Lock()
+		box, ok := outboxes.queues[queueName]
+		if !ok {
+			outboxes.mu.Unlock()
+			return nil, ErrUnknownQueue
+		}
+
+		acknowledged := 0
+		for acknowledged < len(box.messages) && box.messages[acknowledged].Seq <= after {
+			acknowledged++
+		}
+		box.messages = box.messages[acknowledged:]
+
+		if len(box.messages) > 0 {
+			n := min(limit, len(box.messages))
+			messages := make([]OutboxMessage, n)
+			copy(messages, box.messages[:n])
+			outboxes.mu.Unlock()
+			return messages, nil
+		}
+		arrived := box.arrived
+		outboxes.mu.Unlock()
+
+		select {
+		case <-arrived:
+		case <-timer.C:
+			return []OutboxMessage{}, nil
+		case <-ctx.Done():
+			return []OutboxMessage{}, nil
+		}
+	}
+}
+
+// HandleProxyMessage handles a message the proxy posted over the http transport on the
+// consumer's workers, and returns its outcome once handled.
+func HandleProxyMessage(body []byte, messageId string) (*db.MessageAudit, error) {
+	if consumerPool == nil {
+		return nil, errors.New("consumer is not running")
+	}
+
+	handled := make(chan *db.MessageAudit, 1)
+	consumerPool.submit(body, messageId, func(entry *db.MessageAudit) {
+		handled <- entry
+	})
+	return <-handled, nil
+}
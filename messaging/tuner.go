@@ -0,0 +1,286 @@
+package messaging
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/tuner"
+)
+
+const TUNER_CHECK_INTERVAL = time.Minute
+const STATISTICS_SAMPLE_RETENTION = 7 * 24 * time.Hour
+
+// what the auto-tuner makes of the statistics right now
+type TunerEvaluation struct {
+	EvaluatedAt time.Time                    `json:"evaluated_at"`
+	Metrics     *db.TunerMetrics             `json:"metrics,omitempty"`
+	Current     db.PrequalParametersResponse `json:"current_parameters"`
+	Proposal    *tuner.Proposal              `json:"proposal,omitempty"`
+	// the proposal is acted on when ready, Detail says why not otherwise
+	Ready  bool   `json:"ready"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// StartAutoTuner periodically samples the statistics and, while the auto-tuner is enabled,
+// lets its rules adjust the global Prequal parameters.
+func StartAutoTuner() {
+	ticker := time.NewTicker(TUNER_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := RunAutoTuner(context.Background(), time.Now()); err != nil {
+			log.Printf("Failed to run auto-tuner: %s", err)
+		}
+	}
+}
+
+// RunAutoTuner records a statistics sample, samples are kept whether or not the auto-tuner
+// is enabled so it has history to judge by once it is. Enabled, it acts on what its rules
+// propose.
+func RunAutoTuner(ctx context.Context, now time.Time) error {
+	sample, err := SampleStatistics(ctx, now)
+	if err != nil {
+		return err
+	}
+	if err := db.AddStatisticsSample(ctx, sample); err != nil {
+		return err
+	}
+	if _, err := db.DeleteStatisticsSamplesBefore(ctx, now.Add(-STATISTICS_SAMPLE_RETENTION)); err != nil {
+		log.Print(err)
+	}
+
+	settings, err := db.GetTunerSettings(ctx)
+	if err != nil {
+		return err
+	}
+	if !settings.Enabled {
+		return nil
+	}
+
+	evaluation, err := EvaluateTuner(ctx, settings, sample)
+	if err != nil {
+		return err
+	}
+	if !evaluation.Ready {
+		return nil
+	}
+	return actOnTunerProposal(ctx, evaluation)
+}
+
+// SampleStatistics reads the request counters of every replica as of now, without storing them.
+func SampleStatistics(ctx context.Context, now time.Time) (*db.StatisticsSample, error) {
+	counts, err := db.GetRequestCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &db.StatisticsSample{SampledAt: now, Counts: counts}, nil
+}
+
+// urls of the replicas the global parameters apply to, those outside pools with parameters
+// of their own
+func globalReplicaUrls(ctx context.Context) ([]string, error) {
+	replicas, err := db.GetReplicas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ownParameters := map[int64]bool{}
+	var urls []string
+	for _, replica := range replicas {
+		if replica.PoolId != nil {
+			own, found := ownParameters[*replica.PoolId]
+			if !found {
+				parameters, err := db.GetPoolPrequalParameters(ctx, *replica.PoolId)
+				if err != nil {
+					return nil, err
+				}
+				own = parameters.PoolId != nil
+				ownParameters[*replica.PoolId] = own
+			}
+			if own {
+				continue
+			}
+		}
+		urls = append(urls, replica.URL)
+	}
+	return urls, nil
+}
+
+func addParameters(parameters db.PrequalParametersResponse) db.AddPrequalParametersType {
+	return db.AddPrequalParametersType{
+		MaxLifeTime:       parameters.MaxLifeTime,
+		PoolSize:          parameters.PoolSize,
+		ProbeFactor:       parameters.ProbeFactor,
+		ProbeRemoveFactor: parameters.ProbeRemoveFactor,
+		Mu:                parameters.Mu,
+		Status:            parameters.Status,
+	}
+}
+
+// EvaluateTuner measures the window of statistics ending at the sample and runs the rules of
+// the auto-tuner on it. A proposal is held back while the last decision cools down or waits
+// for review, while a rollout changes the parameters, or when the parameters changed within
+// the window.
+func EvaluateTuner(ctx context.Context, settings *db.TunerSettings, sample *db.StatisticsSample) (*TunerEvaluation, error) {
+	now := sample.SampledAt
+	evaluation := &TunerEvaluation{EvaluatedAt: now}
+
+	current, err := db.GetPrequalParametersResponse(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		evaluation.Detail = "no global parameters stored yet"
+		return evaluation, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	evaluation.Current = current
+
+	windowStart, err := db.GetStatisticsSampleAt(ctx, now.Add(-settings.Window()))
+	if err == sql.ErrNoRows {
+		evaluation.Detail = fmt.Sprintf("no statistics sample from %s ago yet", settings.Window())
+		return evaluation, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching statistics sample: %v", err)
+	}
+	previousStart, err := db.GetStatisticsSampleAt(ctx, now.Add(-2*settings.Window()))
+	if err == sql.ErrNoRows {
+		previousStart = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching statistics sample: %v", err)
+	}
+
+	urls, err := globalReplicaUrls(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics := tuner.Measure(sample, windowStart, previousStart, urls)
+	evaluation.Metrics = &metrics
+
+	proposal, detail := tuner.Evaluate(settings, metrics, addParameters(current))
+	evaluation.Proposal = proposal
+	evaluation.Detail = detail
+	if proposal == nil {
+		return evaluation, nil
+	}
+
+	held, err := tunerHold(ctx, settings, current, now)
+	if err != nil {
+		return nil, err
+	}
+	evaluation.Detail = held
+	evaluation.Ready = held == ""
+	return evaluation, nil
+}
+
+// why a proposal has to wait, empty when it does not
+func tunerHold(ctx context.Context, settings *db.TunerSettings, current db.PrequalParametersResponse, now time.Time) (string, error) {
+	if current.CreatedAt.After(now.Add(-settings.Window())) {
+		return fmt.Sprintf("parameters #%d were stored at %s, the window has to measure them alone", current.Id, current.CreatedAt.Format(time.RFC3339)), nil
+	}
+
+	latest, err := db.GetLatestTunerDecision(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("error fetching tuner decision: %v", err)
+	}
+	if latest != nil {
+		if until := latest.CreatedAt.Add(settings.Cooldown()); now.Before(until) {
+			return fmt.Sprintf("decision #%d cools down until %s", latest.Id, until.Format(time.RFC3339)), nil
+		}
+		if latest.Status == db.TUNER_PROPOSED && latest.DraftId != nil {
+			draft, err := db.GetParameterDraftById(ctx, *latest.DraftId)
+			if err != nil && err != sql.ErrNoRows {
+				return "", fmt.Errorf("error fetching parameter draft: %v", err)
+			}
+			if draft != nil && draft.Open() && !draft.Expired(now) {
+				return fmt.Sprintf("parameter draft #%d of decision #%d is still %s", draft.Id, latest.Id, draft.Status), nil
+			}
+		}
+	}
+
+	rollout, err := db.GetOpenParameterRollout(ctx, nil)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("error fetching parameter rollout: %v", err)
+	}
+	if rollout != nil {
+		return fmt.Sprintf("parameter rollout #%d is %s", rollout.Id, rollout.Status), nil
+	}
+	return "", nil
+}
+
+// stores the proposal as the active parameters in apply mode, or as a draft for review in
+// propose mode and whenever parameter changes need approval. The settings are read again,
+// so disabling the auto-tuner stops a decision that was about to be made.
+func actOnTunerProposal(ctx context.Context, evaluation *TunerEvaluation) error {
+	settings, err := db.GetTunerSettings(ctx)
+	if err != nil {
+		return err
+	}
+	if !settings.Enabled {
+		return nil
+	}
+
+	proposal := evaluation.Proposal
+	decision := &db.TunerDecision{
+		Rule:               proposal.Rule,
+		Metrics:            *evaluation.Metrics,
+		CurrentParameters:  addParameters(evaluation.Current),
+		ProposedParameters: proposal.Parameters,
+		Changes:            proposal.Changes,
+		Explanation:        proposal.Explanation,
+	}
+
+	// the parameter limits may be narrower than the bounds of the auto-tuner
+	if violations := db.ValidatePrequalParameters(db.PrequalParameterSchema(), proposal.Parameters); len(violations) > 0 {
+		messages := make([]string, len(violations))
+		for i, violation := range violations {
+			messages[i] = violation.String()
+		}
+		decision.Status = db.TUNER_FAILED
+		decision.Explanation += "; outside the parameter limits: " + strings.Join(messages, ", ")
+		return db.CreateTunerDecision(ctx, decision)
+	}
+
+	if settings.Mode == db.TUNER_APPLY && !db.ParameterApprovalRequired() {
+		saved, err := db.AddPrequalParametersResponse(ctx, proposal.Parameters)
+		if err != nil {
+			decision.Status = db.TUNER_FAILED
+			decision.Explanation += fmt.Sprintf("; failed to store the parameters: %v", err)
+			return errors.Join(err, db.CreateTunerDecision(ctx, decision))
+		}
+		if err := PublishMessage(PUBLISHING_QUEUE, parametersMessage("", *saved)); err != nil {
+			log.Printf("Failed to publish change parameters message: %v", err)
+		}
+
+		id := int64(saved.Id)
+		decision.Status = db.TUNER_APPLIED
+		decision.ParametersId = &id
+		return db.CreateTunerDecision(ctx, decision)
+	}
+
+	draft := &db.ParameterDraft{
+		MaxLifeTime:       proposal.Parameters.MaxLifeTime,
+		PoolSize:          proposal.Parameters.PoolSize,
+		ProbeFactor:       proposal.Parameters.ProbeFactor,
+		ProbeRemoveFactor: proposal.Parameters.ProbeRemoveFactor,
+		Mu:                proposal.Parameters.Mu,
+		Comment:           fmt.Sprintf("auto-tuner rule %s: %s", proposal.Rule, proposal.Explanation),
+		CreatedBy:         db.TUNER_ACTOR,
+		ExpiresAt:         time.Now().Add(db.ParameterDraftTTL()),
+	}
+	if err := db.CreateParameterDraft(ctx, draft); err != nil {
+		decision.Status = db.TUNER_FAILED
+		decision.Explanation += fmt.Sprintf("; failed to create the parameter draft: %v", err)
+		return errors.Join(err, db.CreateTunerDecision(ctx, decision))
+	}
+
+	decision.Status = db.TUNER_PROPOSED
+	decision.DraftId = &draft.Id
+	return db.CreateTunerDecision(ctx, decision)
+}
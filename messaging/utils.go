@@ -1,8 +1,12 @@
 package messaging
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
 )
 
 func failOnError(err error, msg string) {
@@ -11,33 +15,76 @@ func failOnError(err error, msg string) {
 	}
 }
 
-func processMessage(body []byte) {
+// hands the message to its handler, returns the envelope and what went wrong
+func dispatchMessage(ctx context.Context, body []byte) (Message, error) {
 	var msg Message
 
 	if err := json.Unmarshal(body, &msg); err != nil {
-		log.Printf("Failed to unmarshal message: %v", err)
-		return
+		return msg, fmt.Errorf("failed to unmarshal message: %v", err)
+	}
+	if err := checkSchema(body); err != nil {
+		return msg, err
+	}
+
+	// registration creates the instance, every other message marks its sender as seen
+	var proxy *db.ProxyInstance
+	if msg.Name != PROXY_REGISTER {
+		proxy = seenProxy(ctx, msg.Instance)
 	}
 
 	switch msg.Name {
-	case ADDED_REPLICA:
-		handleReplicaAdded(msg.Body.(string))
-	case REMOVED_REPLICA:
-		handleReplicaRemoved(msg.Body.(string))
-	case REPLICA_FAILED:
-		handleReplicaFailed(msg.Body.(string))
+	case ADDED_REPLICA, REMOVED_REPLICA, REPLICA_FAILED:
+		url, ok := msg.Body.(string)
+		if !ok {
+			return msg, fmt.Errorf("invalid message body for %s: %v", msg.Name, msg.Body)
+		}
+		switch msg.Name {
+		case ADDED_REPLICA:
+			return msg, handleReplicaAdded(ctx, proxy, url)
+		case REMOVED_REPLICA:
+			return msg, handleReplicaRemoved(ctx, proxy, url)
+		default:
+			return msg, handleReplicaFailed(ctx, proxy, url)
+		}
 	case PARAMETERS_UPDATED:
-		handleParametersUpdated(body)
+		return msg, handleParametersUpdated(ctx, proxy, body)
 	case PARAMETERS_UPDATE_FAILED:
-		handleParametersUpdateFailed(body)
+		return msg, handleParametersUpdateFailed(ctx, proxy, body)
+	case REPLICA_DRAINING:
+		var drainMsg DrainMessage
+		if err := json.Unmarshal(body, &drainMsg); err != nil {
+			return msg, fmt.Errorf("failed to unmarshal drain message: %v", err)
+		}
+		return msg, handleReplicaDraining(ctx, proxy, drainMsg.Body)
 	case STATISTICS:
 		var stmsg StatMessage
 		if err := json.Unmarshal(body, &stmsg); err != nil {
-			log.Printf("Failed to unmarshal stat message: %v", err)
-			return
+			return msg, fmt.Errorf("failed to unmarshal stat message: %v", err)
+		}
+		return msg, handleStatistics(stmsg.Body)
+	case SYNC_REQUEST:
+		return msg, handleSyncRequest(ctx, proxy)
+	case ACTUAL_STATE:
+		var stateMsg ActualStateMessage
+		if err := json.Unmarshal(body, &stateMsg); err != nil {
+			return msg, fmt.Errorf("failed to unmarshal actual state message: %v", err)
+		}
+		return msg, handleActualState(ctx, proxy, stateMsg.Body)
+	case PROXY_REGISTER:
+		var registrationMsg ProxyRegistrationMessage
+		if err := json.Unmarshal(body, &registrationMsg); err != nil {
+			return msg, fmt.Errorf("failed to unmarshal proxy registration message: %v", err)
+		}
+		return msg, handleProxyRegister(ctx, msg.Instance, registrationMsg.Body)
+	case PROXY_HEARTBEAT:
+		var heartbeatMsg ProxyHeartbeatMessage
+		if err := json.Unmarshal(body, &heartbeatMsg); err != nil {
+			return msg, fmt.Errorf("failed to unmarshal heartbeat message: %v", err)
 		}
-		handleStatistics(stmsg.Body)
+		return msg, handleProxyHeartbeat(ctx, proxy, heartbeatMsg.Body)
+	case PROXY_DEREGISTER:
+		return msg, handleProxyDeregister(ctx, proxy)
 	default:
-		log.Printf("Unknown message type: %s", msg.Name)
+		return msg, fmt.Errorf("unknown message type: %s", msg.Name)
 	}
 }
@@ -0,0 +1,242 @@
+package messaging
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+const DEFAULT_CONSUMER_WORKERS = 8
+const DEFAULT_CONSUMER_PREFETCH = 64
+const DEFAULT_CONSUMER_QUEUE_SIZE = 32
+
+// positive integer from the environment, or the default
+func envInt(name string, fallback int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", name, raw, fallback)
+		return fallback
+	}
+	return n
+}
+
+// ConsumerWorkers is how many messages are handled at once, configured with CONSUMER_WORKERS.
+func ConsumerWorkers() int {
+	return envInt("CONSUMER_WORKERS", DEFAULT_CONSUMER_WORKERS)
+}
+
+// ConsumerPrefetch is how many unacknowledged deliveries RabbitMQ hands out, configured
+// with CONSUMER_PREFETCH.
+func ConsumerPrefetch() int {
+	return envInt("CONSUMER_PREFETCH", DEFAULT_CONSUMER_PREFETCH)
+}
+
+// ConsumerQueueSize is how many messages may wait for each worker, configured with
+// CONSUMER_QUEUE_SIZE. A full queue stops the consumer from taking more deliveries.
+func ConsumerQueueSize() int {
+	return envInt("CONSUMER_QUEUE_SIZE", DEFAULT_CONSUMER_QUEUE_SIZE)
+}
+
+// orderingKey decides which messages must be handled in the order they arrived: those about
+// the same replica, statistics among themselves, and otherwise those of the same proxy instance.
+func orderingKey(body []byte) string {
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return ""
+	}
+
+	if msg.Name == STATISTICS {
+		return STATISTICS
+	}
+	if replicas := messageReplicas(body); len(replicas) == 1 {
+		return "replica:" + replicas[0]
+	}
+	if msg.Instance != "" {
+		return "proxy:" + msg.Instance
+	}
+	return msg.Name
+}
+
+// a message from the proxy waiting for its worker, done is called with the outcome once handled
+type queuedMessage struct {
+	body      []byte
+	messageId string
+	done      func(entry *db.MessageAudit)
+	queuedAt  time.Time
+}
+
+type handlerStats struct {
+	count      int64
+	failed     int64
+	duplicates int64
+	totalMs    int64
+	maxMs      int64
+	lastMs     int64
+}
+
+// a fixed set of workers, each with a bounded queue. Messages with the same ordering key
+// always go to the same worker, so they are handled one after another.
+type workerPool struct {
+	queues []chan queuedMessage
+
+	mu        sync.Mutex
+	processed []int64
+	inFlight  int64
+	waitMs    int64
+	handlers  map[string]*handlerStats
+}
+
+var consumerPool *workerPool
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	pool := &workerPool{
+		queues:    make([]chan queuedMessage, workers),
+		processed: make([]int64, workers),
+		handlers:  map[string]*handlerStats{},
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan queuedMessage, queueSize)
+		go pool.work(i)
+	}
+	return pool
+}
+
+// hands the message to the worker of its ordering key, blocks while that worker's queue is full
+func (p *workerPool) submit(body []byte, messageId string, done func(entry *db.MessageAudit)) {
+	hash := fnv.New32a()
+	hash.Write([]byte(orderingKey(body)))
+	worker := int(hash.Sum32() % uint32(len(p.queues)))
+
+	p.mu.Lock()
+	p.inFlight++
+	p.mu.Unlock()
+
+	p.queues[worker] <- queuedMessage{body: body, messageId: messageId, done: done, queuedAt: time.Now()}
+}
+
+func (p *workerPool) work(worker int) {
+	for queued := range p.queues[worker] {
+		started := time.Now()
+		entry := processInbound(queued.body, queued.messageId, nil, false)
+		elapsed := time.Since(started)
+
+		queued.done(entry)
+		p.record(worker, entry, started.Sub(queued.queuedAt), elapsed)
+	}
+}
+
+func (p *workerPool) record(worker int, entry *db.MessageAudit, wait, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight--
+	p.processed[worker]++
+	p.waitMs += wait.Milliseconds()
+
+	stats, ok := p.handlers[entry.Name]
+	if !ok {
+		stats = &handlerStats{}
+		p.handlers[entry.Name] = stats
+	}
+	ms := elapsed.Milliseconds()
+	stats.count++
+	stats.totalMs += ms
+	stats.lastMs = ms
+	if ms > stats.maxMs {
+		stats.maxMs = ms
+	}
+	switch entry.Outcome {
+	case db.MESSAGE_FAILED:
+		stats.failed++
+	case db.MESSAGE_DUPLICATE:
+		stats.duplicates++
+	}
+}
+
+type WorkerMetrics struct {
+	Worker        int   `json:"worker"`
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	Processed     int64 `json:"processed"`
+}
+
+type HandlerMetrics struct {
+	Name       string  `json:"name"`
+	Count      int64   `json:"count"`
+	Failed     int64   `json:"failed"`
+	Duplicates int64   `json:"duplicates"`
+	AvgMs      float64 `json:"avg_ms"`
+	MaxMs      int64   `json:"max_ms"`
+	LastMs     int64   `json:"last_ms"`
+}
+
+type ConsumerMetricsSnapshot struct {
+	Running    bool             `json:"running"`
+	Prefetch   int              `json:"prefetch"`
+	QueueDepth int              `json:"queue_depth"`
+	InFlight   int64            `json:"in_flight"`
+	Processed  int64            `json:"processed"`
+	AvgWaitMs  float64          `json:"avg_wait_ms"`
+	Workers    []WorkerMetrics  `json:"workers"`
+	Handlers   []HandlerMetrics `json:"handlers"`
+}
+
+// ConsumerMetrics reports queue depths and handler latencies since the consumer started.
+func ConsumerMetrics() ConsumerMetricsSnapshot {
+	snapshot := ConsumerMetricsSnapshot{
+		Prefetch: ConsumerPrefetch(),
+		Workers:  []WorkerMetrics{},
+		Handlers: []HandlerMetrics{},
+	}
+	pool := consumerPool
+	if pool == nil {
+		return snapshot
+	}
+	snapshot.Running = true
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for i, queue := range pool.queues {
+		depth := len(queue)
+		snapshot.QueueDepth += depth
+		snapshot.Processed += pool.processed[i]
+		snapshot.Workers = append(snapshot.Workers, WorkerMetrics{
+			Worker:        i,
+			QueueDepth:    depth,
+			QueueCapacity: cap(queue),
+			Processed:     pool.processed[i],
+		})
+	}
+	snapshot.InFlight = pool.inFlight
+	if snapshot.Processed > 0 {
+		snapshot.AvgWaitMs = float64(pool.waitMs) / float64(snapshot.Processed)
+	}
+
+	for name, stats := range pool.handlers {
+		snapshot.Handlers = append(snapshot.Handlers, HandlerMetrics{
+			Name:       name,
+			Count:      stats.count,
+			Failed:     stats.failed,
+			Duplicates: stats.duplicates,
+			AvgMs:      float64(stats.totalMs) / float64(stats.count),
+			MaxMs:      stats.maxMs,
+			LastMs:     stats.lastMs,
+		})
+	}
+	sort.Slice(snapshot.Handlers, func(i, j int) bool { return snapshot.Handlers[i].Name < snapshot.Handlers[j].Name })
+
+	return snapshot
+}
@@ -2,9 +2,11 @@ package middleware
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/AshimKoirala/load-balancer-admin/utils"
@@ -38,6 +40,20 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// ProxyAuthMiddleware lets through reverse proxies that present PROXY_API_TOKEN as bearer token.
+func ProxyAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := os.Getenv("PROXY_API_TOKEN")
+		token, err := extractBearerToken(r)
+		if err != nil || expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func extractBearerToken(r *http.Request) (string, error) {
 	// Retrieve the Authorization header
 	authHeader := r.Header.Get("Authorization")
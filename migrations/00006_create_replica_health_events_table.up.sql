@@ -0,0 +1,14 @@
+CREATE TABLE replica_health_events (
+    id SERIAL PRIMARY KEY,
+    replica_id INT NOT NULL REFERENCES replicas(id),
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('transition', 'probe')),
+    from_status VARCHAR(50),
+    to_status VARCHAR(50),
+    healthy BOOLEAN,
+    latency_ms BIGINT,
+    source VARCHAR(50) NOT NULL,
+    detail TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX replica_health_events_replica_created_idx ON replica_health_events (replica_id, created_at);
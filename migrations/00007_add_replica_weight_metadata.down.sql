@@ -0,0 +1,3 @@
+ALTER TABLE replicas
+    DROP COLUMN IF EXISTS weight,
+    DROP COLUMN IF EXISTS metadata;
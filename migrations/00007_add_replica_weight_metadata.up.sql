@@ -0,0 +1,3 @@
+ALTER TABLE replicas
+    ADD COLUMN weight INT NOT NULL DEFAULT 1 CHECK (weight > 0),
+    ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
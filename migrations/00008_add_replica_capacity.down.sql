@@ -0,0 +1,3 @@
+ALTER TABLE replicas
+    DROP COLUMN IF EXISTS max_concurrent_requests,
+    DROP COLUMN IF EXISTS capacity_class;
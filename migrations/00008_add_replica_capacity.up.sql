@@ -0,0 +1,3 @@
+ALTER TABLE replicas
+    ADD COLUMN max_concurrent_requests INT NOT NULL DEFAULT 0 CHECK (max_concurrent_requests >= 0),
+    ADD COLUMN capacity_class VARCHAR(20) NOT NULL DEFAULT 'standard' CHECK (capacity_class IN ('small', 'standard', 'large'));
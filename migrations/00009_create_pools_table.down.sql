@@ -0,0 +1,3 @@
+ALTER TABLE prequal_parameters_response DROP COLUMN IF EXISTS pool_id;
+ALTER TABLE replicas DROP COLUMN IF EXISTS pool_id;
+DROP TABLE IF EXISTS pools;
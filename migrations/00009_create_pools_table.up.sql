@@ -0,0 +1,12 @@
+CREATE TABLE pools (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    health_check_endpoint VARCHAR(255) NOT NULL DEFAULT '',
+    health_check_interval_seconds INT NOT NULL DEFAULT 0 CHECK (health_check_interval_seconds >= 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE replicas ADD COLUMN pool_id INT NULL REFERENCES pools(id) ON DELETE SET NULL;
+ALTER TABLE prequal_parameters_response ADD COLUMN pool_id INT NULL REFERENCES pools(id) ON DELETE CASCADE;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS replicas_labels_idx;
+ALTER TABLE replicas DROP COLUMN IF EXISTS labels;
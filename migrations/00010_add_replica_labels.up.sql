@@ -0,0 +1,3 @@
+ALTER TABLE replicas ADD COLUMN labels JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX replicas_labels_idx ON replicas USING GIN (labels);
@@ -0,0 +1,8 @@
+ALTER TABLE replicas
+    DROP COLUMN IF EXISTS drain_started_at,
+    DROP COLUMN IF EXISTS drain_deadline,
+    DROP COLUMN IF EXISTS in_flight;
+
+UPDATE replicas SET status = 'disabled' WHERE status = 'draining';
+ALTER TABLE replicas DROP CONSTRAINT IF EXISTS replicas_status_check;
+ALTER TABLE replicas ADD CONSTRAINT replicas_status_check CHECK (status IN ('active', 'disabled', 'inactive'));
@@ -0,0 +1,7 @@
+ALTER TABLE replicas DROP CONSTRAINT IF EXISTS replicas_status_check;
+ALTER TABLE replicas ADD CONSTRAINT replicas_status_check CHECK (status IN ('active', 'disabled', 'inactive', 'draining'));
+
+ALTER TABLE replicas
+    ADD COLUMN drain_started_at TIMESTAMP NULL,
+    ADD COLUMN drain_deadline TIMESTAMP NULL,
+    ADD COLUMN in_flight INT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS maintenance_runs;
+DROP TABLE IF EXISTS maintenance_windows;
@@ -0,0 +1,29 @@
+CREATE TABLE maintenance_windows (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    target_type VARCHAR(20) NOT NULL CHECK (target_type IN ('replica', 'selector', 'pool')),
+    replica_id INT NULL REFERENCES replicas(id) ON DELETE CASCADE,
+    selector TEXT NOT NULL DEFAULT '',
+    pool_id INT NULL REFERENCES pools(id) ON DELETE CASCADE,
+    starts_at TIMESTAMP NOT NULL,
+    duration_seconds INT NOT NULL CHECK (duration_seconds > 0),
+    schedule VARCHAR(255) NOT NULL DEFAULT '',
+    recurrence_until TIMESTAMP NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE maintenance_runs (
+    id SERIAL PRIMARY KEY,
+    window_id INT NOT NULL REFERENCES maintenance_windows(id) ON DELETE CASCADE,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    replica_ids JSONB NOT NULL DEFAULT '[]',
+    ended_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (window_id, starts_at)
+);
+
+CREATE INDEX maintenance_runs_open_idx ON maintenance_runs (ends_at) WHERE ended_at IS NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS state_reports;
+DROP TABLE IF EXISTS state_snapshots;
@@ -0,0 +1,18 @@
+CREATE TABLE state_snapshots (
+    version SERIAL PRIMARY KEY,
+    checksum VARCHAR(64) NOT NULL,
+    snapshot JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE state_reports (
+    id SERIAL PRIMARY KEY,
+    desired_version INT NULL REFERENCES state_snapshots(version) ON DELETE SET NULL,
+    reported_version INT NOT NULL DEFAULT 0,
+    in_sync BOOLEAN NOT NULL,
+    drift JSONB NOT NULL DEFAULT '[]',
+    corrected BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX state_reports_created_at_idx ON state_reports (created_at);
@@ -0,0 +1,5 @@
+ALTER TABLE state_reports DROP COLUMN IF EXISTS proxy_id;
+
+DROP TABLE IF EXISTS proxy_acknowledgements;
+DROP TABLE IF EXISTS proxy_replica_states;
+DROP TABLE IF EXISTS proxy_instances;
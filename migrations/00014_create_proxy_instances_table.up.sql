@@ -0,0 +1,32 @@
+CREATE TABLE proxy_instances (
+    id SERIAL PRIMARY KEY,
+    instance_id VARCHAR(255) NOT NULL UNIQUE,
+    hostname VARCHAR(255) NOT NULL DEFAULT '',
+    version VARCHAR(100) NOT NULL DEFAULT '',
+    queue VARCHAR(255) NOT NULL,
+    registered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE proxy_replica_states (
+    proxy_id INT NOT NULL REFERENCES proxy_instances(id) ON DELETE CASCADE,
+    replica_id INT NOT NULL REFERENCES replicas(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL,
+    in_flight INT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (proxy_id, replica_id)
+);
+
+CREATE TABLE proxy_acknowledgements (
+    id SERIAL PRIMARY KEY,
+    proxy_id INT NOT NULL REFERENCES proxy_instances(id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX proxy_acknowledgements_proxy_id_created_at_idx ON proxy_acknowledgements (proxy_id, created_at);
+
+ALTER TABLE state_reports ADD COLUMN proxy_id INT NULL REFERENCES proxy_instances(id) ON DELETE SET NULL;
@@ -0,0 +1,6 @@
+ALTER TABLE proxy_instances
+    DROP COLUMN IF EXISTS last_heartbeat_at,
+    DROP COLUMN IF EXISTS uptime_seconds,
+    DROP COLUMN IF EXISTS parameters_version,
+    DROP COLUMN IF EXISTS replica_count,
+    DROP COLUMN IF EXISTS stale;
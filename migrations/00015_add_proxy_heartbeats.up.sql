@@ -0,0 +1,6 @@
+ALTER TABLE proxy_instances
+    ADD COLUMN last_heartbeat_at TIMESTAMP NULL,
+    ADD COLUMN uptime_seconds BIGINT NULL,
+    ADD COLUMN parameters_version INT NULL,
+    ADD COLUMN replica_count INT NULL,
+    ADD COLUMN stale BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,18 @@
+CREATE TABLE message_audit (
+    id SERIAL PRIMARY KEY,
+    direction VARCHAR(10) NOT NULL CHECK (direction IN ('inbound', 'outbound')),
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    instance VARCHAR(255) NOT NULL DEFAULT '',
+    queue VARCHAR(255) NOT NULL DEFAULT '',
+    body JSONB NOT NULL,
+    replicas TEXT[] NOT NULL DEFAULT '{}',
+    outcome VARCHAR(20) NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    duration_ms INT NOT NULL DEFAULT 0,
+    replayed_from INT NULL REFERENCES message_audit(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX message_audit_created_at_idx ON message_audit (created_at);
+CREATE INDEX message_audit_name_idx ON message_audit (name);
+CREATE INDEX message_audit_replicas_idx ON message_audit USING GIN (replicas);
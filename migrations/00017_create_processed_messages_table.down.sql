@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS proxy_acknowledgements_message_idx;
+ALTER TABLE proxy_acknowledgements DROP COLUMN IF EXISTS message_id;
+
+DROP INDEX IF EXISTS message_audit_message_id_idx;
+ALTER TABLE message_audit DROP COLUMN IF EXISTS message_id;
+
+DROP TABLE IF EXISTS processed_messages;
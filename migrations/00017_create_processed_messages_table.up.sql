@@ -0,0 +1,14 @@
+CREATE TABLE processed_messages (
+    message_id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX processed_messages_expires_at_idx ON processed_messages (expires_at);
+
+ALTER TABLE message_audit ADD COLUMN message_id VARCHAR(255) NOT NULL DEFAULT '';
+CREATE INDEX message_audit_message_id_idx ON message_audit (message_id);
+
+ALTER TABLE proxy_acknowledgements ADD COLUMN message_id VARCHAR(255) NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX proxy_acknowledgements_message_idx ON proxy_acknowledgements (proxy_id, event, subject, message_id) WHERE message_id <> '';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS parameter_draft_events;
+DROP TABLE IF EXISTS parameter_drafts;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
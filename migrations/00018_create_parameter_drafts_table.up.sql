@@ -0,0 +1,35 @@
+ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'operator';
+-- someone has to be able to hand out roles
+UPDATE users SET role = 'admin' WHERE id = (SELECT MIN(id) FROM users);
+
+CREATE TABLE parameter_drafts (
+    id SERIAL PRIMARY KEY,
+    pool_id INT REFERENCES pools(id) ON DELETE CASCADE,
+    max_life_time INT NOT NULL,
+    pool_size INT NOT NULL,
+    probe_factor FLOAT NOT NULL,
+    probe_remove_factor INT NOT NULL,
+    mu INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    comment TEXT NOT NULL DEFAULT '',
+    created_by VARCHAR(255) NOT NULL,
+    reviewed_by VARCHAR(255) NOT NULL DEFAULT '',
+    applied_by VARCHAR(255) NOT NULL DEFAULT '',
+    parameters_id INT REFERENCES prequal_parameters_response(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX parameter_drafts_status_idx ON parameter_drafts (status, expires_at);
+
+CREATE TABLE parameter_draft_events (
+    id SERIAL PRIMARY KEY,
+    draft_id INT NOT NULL REFERENCES parameter_drafts(id) ON DELETE CASCADE,
+    action VARCHAR(20) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    comment TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX parameter_draft_events_draft_id_idx ON parameter_draft_events (draft_id);
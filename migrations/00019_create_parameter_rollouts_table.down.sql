@@ -0,0 +1 @@
+DROP TABLE IF EXISTS parameter_rollouts;
@@ -0,0 +1,30 @@
+CREATE TABLE parameter_rollouts (
+    id SERIAL PRIMARY KEY,
+    pool_id INT REFERENCES pools(id) ON DELETE CASCADE,
+    draft_id INT REFERENCES parameter_drafts(id) ON DELETE SET NULL,
+    max_life_time INT NOT NULL,
+    pool_size INT NOT NULL,
+    probe_factor FLOAT NOT NULL,
+    probe_remove_factor INT NOT NULL,
+    mu INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'scheduled',
+    starts_at TIMESTAMP NOT NULL,
+    canary_instances JSONB NOT NULL DEFAULT '[]',
+    canary_pool_ids JSONB NOT NULL DEFAULT '[]',
+    observe_seconds INT NOT NULL DEFAULT 0 CHECK (observe_seconds >= 0),
+    min_requests BIGINT NOT NULL DEFAULT 0,
+    max_error_rate FLOAT,
+    max_error_rate_increase FLOAT,
+    baseline JSONB NOT NULL DEFAULT '{}',
+    evaluation JSONB,
+    reason TEXT NOT NULL DEFAULT '',
+    comment TEXT NOT NULL DEFAULT '',
+    parameters_id INT REFERENCES prequal_parameters_response(id) ON DELETE SET NULL,
+    created_by VARCHAR(255) NOT NULL,
+    canary_started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX parameter_rollouts_status_idx ON parameter_rollouts (status, starts_at);
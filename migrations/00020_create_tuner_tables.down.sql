@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS tuner_decisions;
+DROP TABLE IF EXISTS tuner_settings;
+DROP TABLE IF EXISTS statistics_samples;
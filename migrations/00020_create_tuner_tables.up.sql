@@ -0,0 +1,42 @@
+CREATE TABLE statistics_samples (
+    id SERIAL PRIMARY KEY,
+    sampled_at TIMESTAMP NOT NULL,
+    counts JSONB NOT NULL
+);
+
+CREATE INDEX statistics_samples_sampled_at_idx ON statistics_samples (sampled_at);
+
+CREATE TABLE tuner_settings (
+    id INT PRIMARY KEY,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    mode VARCHAR(20) NOT NULL DEFAULT 'propose',
+    window_seconds INT NOT NULL,
+    cooldown_seconds INT NOT NULL,
+    min_requests BIGINT NOT NULL,
+    high_error_ratio FLOAT NOT NULL,
+    low_error_ratio FLOAT NOT NULL,
+    probe_factor_step FLOAT NOT NULL,
+    bounds JSONB NOT NULL DEFAULT '{}',
+    updated_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO tuner_settings (id, window_seconds, cooldown_seconds, min_requests, high_error_ratio, low_error_ratio, probe_factor_step, bounds)
+VALUES (1, 900, 1800, 1000, 0.05, 0.01, 0.5, '{"probe_factor": {"min": 1, "max": 4}, "mu": {"min": 1, "max": 20}}');
+
+CREATE TABLE tuner_decisions (
+    id SERIAL PRIMARY KEY,
+    rule VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    metrics JSONB NOT NULL,
+    current_parameters JSONB NOT NULL,
+    proposed_parameters JSONB NOT NULL,
+    changes JSONB NOT NULL DEFAULT '[]',
+    explanation TEXT NOT NULL,
+    draft_id INT REFERENCES parameter_drafts(id) ON DELETE SET NULL,
+    parameters_id INT REFERENCES prequal_parameters_response(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX tuner_decisions_created_at_idx ON tuner_decisions (created_at);
@@ -41,6 +41,24 @@ func FetchActivityLogs(ctx context.Context) ([]ActivityLog, error) {
 	return logs, nil
 }
 
+// retrieves the newest activity logs with an id above afterId, newest first.
+// A limit of 0 returns all of them.
+func FetchActivityLogsAfter(ctx context.Context, afterId int64, limit int) ([]ActivityLog, error) {
+	var logs []ActivityLog
+	query := db.NewSelect().
+		Model(&logs).
+		Relation("Replica").
+		Where("activity_log.id > ?", afterId).
+		Order("activity_log.id DESC")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching activity logs: %v", err)
+	}
+	return logs, nil
+}
+
 // reusable function to log activity
 func LogActivity(ctx context.Context, activityType, message string, replicaId *int64) error {
 	log := ActivityLog{
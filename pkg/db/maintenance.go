@@ -0,0 +1,589 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/schedule"
+	"github.com/uptrace/bun"
+)
+
+type MaintenanceWindow struct {
+	bun.BaseModel `bun:"table:maintenance_windows"`
+
+	Id              int64      `json:"id" bun:"id,pk,autoincrement"`
+	Name            string     `json:"name" bun:"name,notnull"`
+	Description     string     `json:"description" bun:"description,notnull"`
+	TargetType      string     `json:"target_type" bun:"target_type,notnull"`
+	ReplicaId       *int64     `json:"replica_id,omitempty" bun:"replica_id"`
+	Selector        string     `json:"selector,omitempty" bun:"selector,notnull"`
+	PoolId          *int64     `json:"pool_id,omitempty" bun:"pool_id"`
+	StartsAt        time.Time  `json:"starts_at" bun:"starts_at,notnull"`
+	DurationSeconds int        `json:"duration_seconds" bun:"duration_seconds,notnull"`
+	Schedule        string     `json:"schedule,omitempty" bun:"schedule,notnull"`
+	RecurrenceUntil *time.Time `json:"recurrence_until,omitempty" bun:"recurrence_until"`
+	Enabled         bool       `json:"enabled" bun:"enabled,notnull"`
+	CreatedAt       time.Time  `json:"created_at" bun:"created_at,default:current_timestamp"`
+	UpdatedAt       time.Time  `json:"updated_at" bun:"updated_at,default:current_timestamp"`
+}
+
+// a single occurrence of a maintenance window that has been started
+type MaintenanceRun struct {
+	bun.BaseModel `bun:"table:maintenance_runs"`
+
+	Id       int64     `json:"id" bun:"id,pk,autoincrement"`
+	WindowId int64     `json:"window_id" bun:"window_id,notnull"`
+	StartsAt time.Time `json:"starts_at" bun:"starts_at,notnull"`
+	EndsAt   time.Time `json:"ends_at" bun:"ends_at,notnull"`
+	// replicas taken down by the run or handed over by a run that ended while this one held
+	// them, only these are re-activated when it ends
+	ReplicaIds []int64    `json:"replica_ids" bun:"replica_ids,type:jsonb,notnull"`
+	EndedAt    *time.Time `json:"ended_at,omitempty" bun:"ended_at"`
+	CreatedAt  time.Time  `json:"created_at" bun:"created_at,default:current_timestamp"`
+
+	Window *MaintenanceWindow `json:"-" bun:"rel:belongs-to,join:window_id=id"`
+}
+
+// what a maintenance window applies to
+const (
+	MAINTENANCE_TARGET_REPLICA  = "replica"
+	MAINTENANCE_TARGET_SELECTOR = "selector"
+	MAINTENANCE_TARGET_POOL     = "pool"
+)
+
+// how far ahead overlapping windows are looked for
+const MAINTENANCE_OVERLAP_HORIZON = 90 * 24 * time.Hour
+
+// upper bound of occurrences expanded for a single window and range
+const maxMaintenanceOccurrences = 5000
+
+var ErrMaintenanceOverlap = errors.New("maintenance window overlaps another window")
+
+func (w *MaintenanceWindow) Duration() time.Duration {
+	return time.Duration(w.DurationSeconds) * time.Second
+}
+
+func (w *MaintenanceWindow) Recurring() bool {
+	return w.Schedule != ""
+}
+
+// Occurrences returns the start of every occurrence of the window that overlaps [from, to).
+// One-off windows occur once at StartsAt, recurring ones at every cron match from StartsAt
+// until RecurrenceUntil.
+func (w *MaintenanceWindow) Occurrences(from, to time.Time) ([]time.Time, error) {
+	duration := w.Duration()
+
+	if !w.Recurring() {
+		if w.StartsAt.Before(to) && w.StartsAt.Add(duration).After(from) {
+			return []time.Time{w.StartsAt}, nil
+		}
+		return nil, nil
+	}
+
+	cron, err := schedule.ParseCron(w.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := from.Add(-duration)
+	if w.StartsAt.After(cursor) {
+		cursor = w.StartsAt
+	}
+	// Next is exclusive, step back so a match right at the cursor is included
+	cursor = cursor.Add(-time.Second)
+
+	var starts []time.Time
+	for len(starts) < maxMaintenanceOccurrences {
+		next := cron.Next(cursor)
+		if next.IsZero() || !next.Before(to) {
+			break
+		}
+		if w.RecurrenceUntil != nil && next.After(*w.RecurrenceUntil) {
+			break
+		}
+		if next.Add(duration).After(from) {
+			starts = append(starts, next)
+		}
+		cursor = next
+	}
+	return starts, nil
+}
+
+func CreateMaintenanceWindow(ctx context.Context, window *MaintenanceWindow) error {
+	window.CreatedAt = time.Now()
+	window.UpdatedAt = time.Now()
+	if _, err := db.NewInsert().Model(window).Exec(ctx); err != nil {
+		return fmt.Errorf("error creating maintenance window: %v", err)
+	}
+
+	if err := LogActivity(ctx, "success", fmt.Sprintf("Maintenance window '%s' is scheduled", window.Name), window.ReplicaId); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+func GetMaintenanceWindows(ctx context.Context) ([]MaintenanceWindow, error) {
+	var windows []MaintenanceWindow
+	err := db.NewSelect().Model(&windows).Order("starts_at ASC", "id ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching maintenance windows: %v", err)
+	}
+	return windows, nil
+}
+
+func GetMaintenanceWindowById(ctx context.Context, id int64) (*MaintenanceWindow, error) {
+	var window MaintenanceWindow
+	err := db.NewSelect().Model(&window).Where("id = ?", id).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &window, nil
+}
+
+// saves the window, a disabled window ends its run in progress right away
+func UpdateMaintenanceWindow(ctx context.Context, window *MaintenanceWindow) error {
+	window.UpdatedAt = time.Now()
+	_, err := db.NewUpdate().
+		Model(window).
+		Column("name", "description", "target_type", "replica_id", "selector", "pool_id", "starts_at",
+			"duration_seconds", "schedule", "recurrence_until", "enabled", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error updating maintenance window: %v", err)
+	}
+
+	if err := LogActivity(ctx, "success", fmt.Sprintf("Maintenance window '%s' is updated", window.Name), window.ReplicaId); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+
+	if !window.Enabled {
+		return endOpenMaintenanceRuns(ctx, window.Id, "maintenance window disabled")
+	}
+	return nil
+}
+
+// deletes the window, replicas it currently holds down are re-activated first
+func DeleteMaintenanceWindow(ctx context.Context, window *MaintenanceWindow) error {
+	if err := endOpenMaintenanceRuns(ctx, window.Id, "maintenance window deleted"); err != nil {
+		return err
+	}
+
+	if _, err := db.NewDelete().Model((*MaintenanceWindow)(nil)).Where("id = ?", window.Id).Exec(ctx); err != nil {
+		return fmt.Errorf("error deleting maintenance window: %v", err)
+	}
+
+	if err := LogActivity(ctx, "warning", fmt.Sprintf("Maintenance window '%s' is deleted", window.Name), window.ReplicaId); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+func GetMaintenanceRuns(ctx context.Context, windowId int64) ([]MaintenanceRun, error) {
+	var runs []MaintenanceRun
+	err := db.NewSelect().Model(&runs).Where("window_id = ?", windowId).Order("starts_at DESC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching maintenance runs: %v", err)
+	}
+	return runs, nil
+}
+
+// replicas a maintenance window applies to, resolved at the time of the call
+func ResolveMaintenanceTargets(ctx context.Context, window *MaintenanceWindow) ([]Replica, error) {
+	switch window.TargetType {
+	case MAINTENANCE_TARGET_REPLICA:
+		if window.ReplicaId == nil {
+			return nil, nil
+		}
+		replica, err := GetReplicaById(ctx, *window.ReplicaId)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching replica: %v", err)
+		}
+		return []Replica{*replica}, nil
+	case MAINTENANCE_TARGET_POOL:
+		if window.PoolId == nil {
+			return nil, nil
+		}
+		return GetPoolReplicas(ctx, *window.PoolId)
+	case MAINTENANCE_TARGET_SELECTOR:
+		selector, err := ParseSelector(window.Selector)
+		if err != nil {
+			return nil, err
+		}
+		return GetReplicasBySelector(ctx, selector)
+	}
+	return nil, fmt.Errorf("unknown maintenance target type: %s", window.TargetType)
+}
+
+type MaintenanceConflict struct {
+	WindowId   int64     `json:"window_id"`
+	WindowName string    `json:"window_name"`
+	StartsAt   time.Time `json:"starts_at"`
+	ReplicaIds []int64   `json:"replica_ids"`
+}
+
+// FindMaintenanceConflicts looks for enabled windows that take down any of the same
+// replicas at the same time as the given window within the overlap horizon.
+func FindMaintenanceConflicts(ctx context.Context, window *MaintenanceWindow) ([]MaintenanceConflict, error) {
+	from := time.Now()
+	to := from.Add(MAINTENANCE_OVERLAP_HORIZON)
+
+	starts, err := window.Occurrences(from, to)
+	if err != nil || len(starts) == 0 {
+		return nil, err
+	}
+
+	targets, err := ResolveMaintenanceTargets(ctx, window)
+	if err != nil {
+		return nil, err
+	}
+	targetIds := replicaIds(targets)
+
+	var others []MaintenanceWindow
+	err = db.NewSelect().Model(&others).Where("enabled = TRUE").Where("id != ?", window.Id).Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching maintenance windows: %v", err)
+	}
+
+	var conflicts []MaintenanceConflict
+	for i := range others {
+		other := &others[i]
+
+		otherTargets, err := ResolveMaintenanceTargets(ctx, other)
+		if err != nil {
+			return nil, err
+		}
+		var shared []int64
+		for _, id := range replicaIds(otherTargets) {
+			if slices.Contains(targetIds, id) {
+				shared = append(shared, id)
+			}
+		}
+		if len(shared) == 0 {
+			continue
+		}
+
+		otherStarts, err := other.Occurrences(from, to)
+		if err != nil {
+			return nil, err
+		}
+		if at, ok := firstOverlap(starts, window.Duration(), otherStarts, other.Duration()); ok {
+			conflicts = append(conflicts, MaintenanceConflict{
+				WindowId:   other.Id,
+				WindowName: other.Name,
+				StartsAt:   at,
+				ReplicaIds: shared,
+			})
+		}
+	}
+	return conflicts, nil
+}
+
+// start of the first occurrence in b that overlaps an occurrence in a, both sorted
+func firstOverlap(a []time.Time, aDuration time.Duration, b []time.Time, bDuration time.Duration) (time.Time, bool) {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		aEnd, bEnd := a[i].Add(aDuration), b[j].Add(bDuration)
+		if a[i].Before(bEnd) && b[j].Before(aEnd) {
+			return b[j], true
+		}
+		if aEnd.Before(bEnd) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return time.Time{}, false
+}
+
+func replicaIds(replicas []Replica) []int64 {
+	ids := make([]int64, 0, len(replicas))
+	for _, replica := range replicas {
+		ids = append(ids, replica.Id)
+	}
+	return ids
+}
+
+type MaintenanceOccurrence struct {
+	WindowId int64     `json:"window_id"`
+	Name     string    `json:"name"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Replicas []string  `json:"replicas"`
+}
+
+// every occurrence of an enabled window overlapping [from, to), soonest first
+func GetUpcomingMaintenance(ctx context.Context, from, to time.Time) ([]MaintenanceOccurrence, error) {
+	var windows []MaintenanceWindow
+	if err := db.NewSelect().Model(&windows).Where("enabled = TRUE").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching maintenance windows: %v", err)
+	}
+
+	var occurrences []MaintenanceOccurrence
+	for i := range windows {
+		window := &windows[i]
+
+		starts, err := window.Occurrences(from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(starts) == 0 {
+			continue
+		}
+
+		targets, err := ResolveMaintenanceTargets(ctx, window)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(targets))
+		for _, replica := range targets {
+			names = append(names, replica.Name)
+		}
+
+		for _, start := range starts {
+			occurrences = append(occurrences, MaintenanceOccurrence{
+				WindowId: window.Id,
+				Name:     window.Name,
+				StartsAt: start,
+				EndsAt:   start.Add(window.Duration()),
+				Replicas: names,
+			})
+		}
+	}
+
+	sort.Slice(occurrences, func(i, j int) bool {
+		return occurrences[i].StartsAt.Before(occurrences[j].StartsAt)
+	})
+	return occurrences, nil
+}
+
+// RunMaintenanceSchedule ends runs that are over and starts occurrences that are due.
+// Active replicas are drained for at most drainTimeout, inactive ones are disabled right away.
+func RunMaintenanceSchedule(ctx context.Context, now time.Time, drainTimeout time.Duration) error {
+	var due []MaintenanceRun
+	err := db.NewSelect().
+		Model(&due).
+		Relation("Window").
+		Where("maintenance_run.ended_at IS NULL").
+		Where("maintenance_run.ends_at <= ?", now).
+		Scan(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching due maintenance runs: %v", err)
+	}
+	for i := range due {
+		if err := endMaintenanceRun(ctx, &due[i], "maintenance window ended"); err != nil {
+			log.Printf("Failed to end maintenance run %d: %v", due[i].Id, err)
+		}
+	}
+
+	var windows []MaintenanceWindow
+	if err := db.NewSelect().Model(&windows).Where("enabled = TRUE").Scan(ctx); err != nil {
+		return fmt.Errorf("error fetching maintenance windows: %v", err)
+	}
+	for i := range windows {
+		starts, err := windows[i].Occurrences(now, now.Add(time.Second))
+		if err != nil {
+			log.Printf("Invalid schedule of maintenance window %d: %v", windows[i].Id, err)
+			continue
+		}
+		for _, start := range starts {
+			if err := startMaintenanceRun(ctx, &windows[i], start, drainTimeout); err != nil {
+				log.Printf("Failed to start maintenance window %d: %v", windows[i].Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+func startMaintenanceRun(ctx context.Context, window *MaintenanceWindow, start time.Time, drainTimeout time.Duration) error {
+	run := &MaintenanceRun{
+		WindowId:   window.Id,
+		StartsAt:   start,
+		EndsAt:     start.Add(window.Duration()),
+		ReplicaIds: []int64{},
+		CreatedAt:  time.Now(),
+	}
+
+	// the unique occurrence keeps an occurrence from being started twice
+	result, err := db.NewInsert().Model(run).On("CONFLICT (window_id, starts_at) DO NOTHING").Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error creating maintenance run: %v", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return nil
+	}
+
+	targets, err := ResolveMaintenanceTargets(ctx, window)
+	if err != nil {
+		return err
+	}
+
+	timeout := drainTimeout
+	if window.Duration() < timeout {
+		timeout = window.Duration()
+	}
+	detail := fmt.Sprintf("maintenance window '%s'", window.Name)
+
+	for i := range targets {
+		replica := &targets[i]
+
+		switch replica.Status {
+		case ACTIVE:
+			err = StartDrain(ctx, replica, timeout, SOURCE_SCHEDULER)
+		case INACTIVE:
+			err = TransitionReplica(ctx, replica, DISABLED, SOURCE_SCHEDULER, TransitionOptions{Detail: detail})
+		default:
+			// already draining or disabled by someone else, leave it to them
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrProxyNotify) {
+			log.Printf("Failed to take down replica %s for maintenance: %v", replica.Name, err)
+			continue
+		}
+		run.ReplicaIds = append(run.ReplicaIds, replica.Id)
+	}
+
+	if _, err := db.NewUpdate().Model(run).Column("replica_ids").WherePK().Exec(ctx); err != nil {
+		return fmt.Errorf("error updating maintenance run: %v", err)
+	}
+
+	message := fmt.Sprintf("Maintenance window '%s' started, %d replicas taken down until %s", window.Name, len(run.ReplicaIds), run.EndsAt.Format(time.RFC3339))
+	if err := LogActivity(ctx, "warning", message, window.ReplicaId); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// handOverReplicas adds each of ids that a run in holders holds to the ReplicaIds of that
+// run. It returns the ids nothing holds anymore and the runs that took over any.
+func handOverReplicas(ids []int64, holders map[int64]*MaintenanceRun) ([]int64, []*MaintenanceRun) {
+	var released []int64
+	var takenOver []*MaintenanceRun
+	for _, id := range ids {
+		holder, held := holders[id]
+		if !held {
+			released = append(released, id)
+			continue
+		}
+		if slices.Contains(holder.ReplicaIds, id) {
+			continue
+		}
+		holder.ReplicaIds = append(holder.ReplicaIds, id)
+		if !slices.Contains(takenOver, holder) {
+			takenOver = append(takenOver, holder)
+		}
+	}
+	return released, takenOver
+}
+
+func endOpenMaintenanceRuns(ctx context.Context, windowId int64, reason string) error {
+	var runs []MaintenanceRun
+	err := db.NewSelect().
+		Model(&runs).
+		Relation("Window").
+		Where("maintenance_run.window_id = ?", windowId).
+		Where("maintenance_run.ended_at IS NULL").
+		Scan(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching maintenance runs: %v", err)
+	}
+
+	for i := range runs {
+		if err := endMaintenanceRun(ctx, &runs[i], reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// re-activates the replicas the run took down, unless another run still holds them. A run
+// holds every replica its window targets, including those that were already down when it
+// started and so are not among its ReplicaIds. Held replicas are handed over to the run
+// holding them, which re-activates them when it ends.
+func endMaintenanceRun(ctx context.Context, run *MaintenanceRun, reason string) error {
+	var open []MaintenanceRun
+	err := db.NewSelect().
+		Model(&open).
+		Relation("Window").
+		Where("maintenance_run.ended_at IS NULL").
+		Where("maintenance_run.id != ?", run.Id).
+		Where("maintenance_run.ends_at > ?", time.Now()).
+		Order("maintenance_run.ends_at DESC").
+		Scan(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching maintenance runs: %v", err)
+	}
+
+	holders := map[int64]*MaintenanceRun{}
+	for i := range open {
+		held := open[i].ReplicaIds
+		if open[i].Window != nil {
+			targets, err := ResolveMaintenanceTargets(ctx, open[i].Window)
+			if err != nil {
+				return err
+			}
+			held = append(slices.Clone(held), replicaIds(targets)...)
+		}
+		// the run that ends last holds the replica, the open runs are ordered by their end
+		for _, id := range held {
+			if _, found := holders[id]; !found {
+				holders[id] = &open[i]
+			}
+		}
+	}
+
+	released, takenOver := handOverReplicas(run.ReplicaIds, holders)
+	for _, holder := range takenOver {
+		if _, err := db.NewUpdate().Model(holder).Column("replica_ids").WherePK().Exec(ctx); err != nil {
+			return fmt.Errorf("error updating maintenance run: %v", err)
+		}
+	}
+
+	reactivated := 0
+	for _, id := range released {
+		replica, err := GetReplicaById(ctx, id)
+		if err != nil {
+			log.Printf("Failed to fetch replica %d after maintenance: %v", id, err)
+			continue
+		}
+
+		var target string
+		switch replica.Status {
+		case DRAINING:
+			target = ACTIVE
+		case DISABLED:
+			target = INACTIVE
+		default:
+			continue
+		}
+		err = TransitionReplica(ctx, replica, target, SOURCE_SCHEDULER, TransitionOptions{Detail: reason})
+		if err != nil && !errors.Is(err, ErrProxyNotify) {
+			log.Printf("Failed to re-activate replica %s after maintenance: %v", replica.Name, err)
+			continue
+		}
+		reactivated++
+	}
+
+	now := time.Now()
+	run.EndedAt = &now
+	if _, err := db.NewUpdate().Model(run).Column("ended_at").WherePK().Exec(ctx); err != nil {
+		return fmt.Errorf("error updating maintenance run: %v", err)
+	}
+
+	name := fmt.Sprintf("%d", run.WindowId)
+	var replicaId *int64
+	if run.Window != nil {
+		name = run.Window.Name
+		replicaId = run.Window.ReplicaId
+	}
+	message := fmt.Sprintf("Maintenance window '%s' ended (%s), %d replicas re-activated", name, reason, reactivated)
+	if err := LogActivity(ctx, "success", message, replicaId); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"slices"
+	"testing"
+)
+
+// replica 1 is taken down by run a. Run b starts while a is open and targets it too, but
+// leaves it out of its ReplicaIds since it is already down.
+func TestHandOverReplicasOfOverlappingRuns(t *testing.T) {
+	a := &MaintenanceRun{Id: 1, ReplicaIds: []int64{1, 2}}
+	b := &MaintenanceRun{Id: 2, ReplicaIds: []int64{3}}
+
+	// a ends first, b still holds replica 1 and 3
+	released, takenOver := handOverReplicas(a.ReplicaIds, map[int64]*MaintenanceRun{1: b, 3: b})
+	if !slices.Equal(released, []int64{2}) {
+		t.Errorf("a released %v, want [2]", released)
+	}
+	if len(takenOver) != 1 || takenOver[0] != b {
+		t.Errorf("taken over by %v, want run b", takenOver)
+	}
+	if !slices.Equal(b.ReplicaIds, []int64{3, 1}) {
+		t.Errorf("b holds %v, want [3 1]", b.ReplicaIds)
+	}
+
+	// b ends last and brings replica 1 back with its own
+	released, takenOver = handOverReplicas(b.ReplicaIds, map[int64]*MaintenanceRun{})
+	if !slices.Equal(released, []int64{3, 1}) {
+		t.Errorf("b released %v, want [3 1]", released)
+	}
+	if len(takenOver) != 0 {
+		t.Errorf("taken over by %v, want none", takenOver)
+	}
+}
+
+func TestHandOverReplicasAlreadyHeld(t *testing.T) {
+	holder := &MaintenanceRun{Id: 2, ReplicaIds: []int64{1}}
+
+	released, takenOver := handOverReplicas([]int64{1}, map[int64]*MaintenanceRun{1: holder})
+	if len(released) != 0 {
+		t.Errorf("released %v, want none", released)
+	}
+	if len(takenOver) != 0 {
+		t.Errorf("taken over by %v, want none", takenOver)
+	}
+	if !slices.Equal(holder.ReplicaIds, []int64{1}) {
+		t.Errorf("holder holds %v, want [1]", holder.ReplicaIds)
+	}
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+// directions of audited messages
+const (
+	MESSAGE_INBOUND  = "inbound"
+	MESSAGE_OUTBOUND = "outbound"
+)
+
+// outcomes of audited messages
+const (
+	MESSAGE_PROCESSED      = "processed"
+	MESSAGE_FAILED         = "failed"
+	MESSAGE_PUBLISHED      = "published"
+	MESSAGE_PUBLISH_FAILED = "publish-failed"
+	MESSAGE_DUPLICATE      = "duplicate"
+)
+
+// a message exchanged with the proxy and what became of it
+type MessageAudit struct {
+	bun.BaseModel `bun:"table:message_audit"`
+
+	Id           int64           `json:"id" bun:"id,pk,autoincrement"`
+	Direction    string          `json:"direction" bun:"direction,notnull"`
+	MessageId    string          `json:"message_id,omitempty" bun:"message_id,notnull"`
+	Name         string          `json:"name" bun:"name,notnull"`
+	Instance     string          `json:"instance,omitempty" bun:"instance,notnull"`
+	Queue        string          `json:"queue" bun:"queue,notnull"`
+	Body         json.RawMessage `json:"body" bun:"body,type:jsonb,notnull"`
+	Replicas     []string        `json:"replicas" bun:"replicas,array,notnull"`
+	Outcome      string          `json:"outcome" bun:"outcome,notnull"`
+	Error        string          `json:"error,omitempty" bun:"error,notnull"`
+	DurationMs   int             `json:"duration_ms" bun:"duration_ms,notnull"`
+	ReplayedFrom *int64          `json:"replayed_from,omitempty" bun:"replayed_from"`
+	CreatedAt    time.Time       `json:"created_at" bun:"created_at,default:current_timestamp"`
+}
+
+// filters for searching the message audit, zero values match everything
+type MessageAuditFilter struct {
+	Direction string
+	Name      string
+	Instance  string
+	Outcome   string
+	Replica   string // url of a replica the message is about
+	From      *time.Time
+	To        *time.Time
+	BeforeId  int64
+	Limit     int
+}
+
+func RecordMessageAudit(ctx context.Context, entry *MessageAudit) error {
+	if entry.Replicas == nil {
+		entry.Replicas = []string{}
+	}
+	// the body column only takes json, keep anything else as a json string
+	if !json.Valid(entry.Body) {
+		raw, err := json.Marshal(string(entry.Body))
+		if err != nil {
+			return err
+		}
+		entry.Body = raw
+	}
+	entry.CreatedAt = time.Now()
+
+	if _, err := db.NewInsert().Model(entry).Exec(ctx); err != nil {
+		return fmt.Errorf("error recording message audit: %v", err)
+	}
+	return nil
+}
+
+// SearchMessageAudit lists audited messages matching the filter, newest first.
+func SearchMessageAudit(ctx context.Context, filter MessageAuditFilter) ([]MessageAudit, error) {
+	var entries []MessageAudit
+	query := db.NewSelect().Model(&entries).Order("id DESC")
+
+	if filter.Direction != "" {
+		query = query.Where("direction = ?", filter.Direction)
+	}
+	if filter.Name != "" {
+		query = query.Where("name = ?", filter.Name)
+	}
+	if filter.Instance != "" {
+		query = query.Where("instance = ?", filter.Instance)
+	}
+	if filter.Outcome != "" {
+		query = query.Where("outcome = ?", filter.Outcome)
+	}
+	if filter.Replica != "" {
+		query = query.Where("replicas @> ?", pgdialect.Array([]string{filter.Replica}))
+	}
+	if filter.From != nil {
+		query = query.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("created_at < ?", *filter.To)
+	}
+	if filter.BeforeId > 0 {
+		query = query.Where("id < ?", filter.BeforeId)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error searching message audit: %v", err)
+	}
+	return entries, nil
+}
+
+func GetMessageAuditById(ctx context.Context, id int64) (*MessageAudit, error) {
+	var entry MessageAudit
+	if err := db.NewSelect().Model(&entry).Where("id = ?", id).Scan(ctx); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
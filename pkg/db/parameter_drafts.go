@@ -0,0 +1,354 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// a set of Prequal parameters waiting for review, it only reaches the proxy once a second
+// user approved it and someone applied it
+type ParameterDraft struct {
+	bun.BaseModel `bun:"table:parameter_drafts"`
+
+	Id                int64   `json:"id" bun:"id,pk,autoincrement"`
+	PoolId            *int64  `json:"pool_id,omitempty" bun:"pool_id"`
+	MaxLifeTime       int     `json:"max_life_time" bun:"max_life_time,notnull"`
+	PoolSize          int     `json:"pool_size" bun:"pool_size,notnull"`
+	ProbeFactor       float64 `json:"probe_factor" bun:"probe_factor,notnull"`
+	ProbeRemoveFactor int     `json:"probe_remove_factor" bun:"probe_remove_factor,notnull"`
+	Mu                int     `json:"mu" bun:"mu,notnull"`
+	Status            string  `json:"status" bun:"status,notnull"`
+	Comment           string  `json:"comment" bun:"comment,notnull"`
+	CreatedBy         string  `json:"created_by" bun:"created_by,notnull"`
+	ReviewedBy        string  `json:"reviewed_by,omitempty" bun:"reviewed_by,notnull"`
+	AppliedBy         string  `json:"applied_by,omitempty" bun:"applied_by,notnull"`
+	// the parameter set stored when the draft was applied
+	ParametersId *int64    `json:"parameters_id,omitempty" bun:"parameters_id"`
+	ExpiresAt    time.Time `json:"expires_at" bun:"expires_at,notnull"`
+	CreatedAt    time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
+	UpdatedAt    time.Time `json:"updated_at" bun:"updated_at,default:current_timestamp"`
+}
+
+// one step of the review of a draft
+type ParameterDraftEvent struct {
+	bun.BaseModel `bun:"table:parameter_draft_events"`
+
+	Id        int64     `json:"id" bun:"id,pk,autoincrement"`
+	DraftId   int64     `json:"draft_id" bun:"draft_id,notnull"`
+	Action    string    `json:"action" bun:"action,notnull"`
+	Actor     string    `json:"actor" bun:"actor,notnull"`
+	Comment   string    `json:"comment" bun:"comment,notnull"`
+	CreatedAt time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
+}
+
+// states of a draft, only pending and approved drafts can still move on
+const (
+	DRAFT_PENDING   = "pending"
+	DRAFT_APPROVED  = "approved"
+	DRAFT_REJECTED  = "rejected"
+	DRAFT_WITHDRAWN = "withdrawn"
+	DRAFT_APPLIED   = "applied"
+	DRAFT_EXPIRED   = "expired"
+)
+
+// steps recorded for a draft
+const (
+	DRAFT_CREATED      = "created"
+	DRAFT_APPROVE      = "approve"
+	DRAFT_REJECT       = "reject"
+	DRAFT_WITHDRAW     = "withdraw"
+	DRAFT_APPLY        = "apply"
+	DRAFT_APPLY_FAILED = "apply_failed"
+	DRAFT_EXPIRE       = "expire"
+	DRAFT_SYSTEM_ACTOR = "system"
+	// a rollout of the draft was created, the draft is applied once the rollout is promoted,
+	// and can be used again once it is rolled back or cancelled
+	DRAFT_SCHEDULE   = "schedule"
+	DRAFT_UNSCHEDULE = "unschedule"
+)
+
+const DEFAULT_PARAMETER_DRAFT_TTL = 72 * time.Hour
+
+var ErrDraftStateChanged = errors.New("parameter draft is no longer in the expected state")
+
+// status a draft ends up in after each step
+var draftTransitions = map[string]string{
+	DRAFT_APPROVE:      DRAFT_APPROVED,
+	DRAFT_REJECT:       DRAFT_REJECTED,
+	DRAFT_WITHDRAW:     DRAFT_WITHDRAWN,
+	DRAFT_APPLY:        DRAFT_APPLIED,
+	DRAFT_APPLY_FAILED: DRAFT_APPROVED,
+	DRAFT_SCHEDULE:     DRAFT_APPROVED,
+	DRAFT_UNSCHEDULE:   DRAFT_APPROVED,
+	DRAFT_EXPIRE:       DRAFT_EXPIRED,
+}
+
+// ParameterDraftTTL is how long a draft can wait for approval and to be applied, configured
+// with PARAMETER_DRAFT_TTL (e.g. 24h, 168h).
+func ParameterDraftTTL() time.Duration {
+	raw := os.Getenv("PARAMETER_DRAFT_TTL")
+	if raw == "" {
+		return DEFAULT_PARAMETER_DRAFT_TTL
+	}
+
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid PARAMETER_DRAFT_TTL %q, using %s", raw, DEFAULT_PARAMETER_DRAFT_TTL)
+		return DEFAULT_PARAMETER_DRAFT_TTL
+	}
+	return ttl
+}
+
+// ParameterApprovalRequired reports whether parameters may only change through approved
+// drafts. They do unless PARAMETER_APPROVAL_REQUIRED=false allows direct changes. On a fresh
+// install the first user to register becomes admin (see HasAdmin) and can make approvers.
+func ParameterApprovalRequired() bool {
+	raw := os.Getenv("PARAMETER_APPROVAL_REQUIRED")
+	if raw == "" {
+		return true
+	}
+
+	required, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("Invalid PARAMETER_APPROVAL_REQUIRED %q, using true", raw)
+		return true
+	}
+	return required
+}
+
+func (d *ParameterDraft) Open() bool {
+	return d.Status == DRAFT_PENDING || d.Status == DRAFT_APPROVED
+}
+
+func (d *ParameterDraft) Expired(now time.Time) bool {
+	return d.Open() && !now.Before(d.ExpiresAt)
+}
+
+// the parameters of the draft, ready to be stored as the active ones
+func (d *ParameterDraft) Parameters() AddPrequalParametersType {
+	return AddPrequalParametersType{
+		MaxLifeTime:       d.MaxLifeTime,
+		PoolSize:          d.PoolSize,
+		ProbeFactor:       d.ProbeFactor,
+		ProbeRemoveFactor: d.ProbeRemoveFactor,
+		Mu:                d.Mu,
+		Status:            PARAMETERS_ACTIVE,
+		PoolId:            d.PoolId,
+	}
+}
+
+func draftActivityMessage(draft *ParameterDraft, action, actor, comment string) string {
+	var message string
+	switch action {
+	case DRAFT_CREATED:
+		message = fmt.Sprintf("Parameter draft #%d created by %s", draft.Id, actor)
+	case DRAFT_APPROVE:
+		message = fmt.Sprintf("Parameter draft #%d approved by %s", draft.Id, actor)
+	case DRAFT_REJECT:
+		message = fmt.Sprintf("Parameter draft #%d rejected by %s", draft.Id, actor)
+	case DRAFT_WITHDRAW:
+		message = fmt.Sprintf("Parameter draft #%d withdrawn by %s", draft.Id, actor)
+	case DRAFT_APPLY:
+		message = fmt.Sprintf("Parameter draft #%d applied by %s", draft.Id, actor)
+	case DRAFT_APPLY_FAILED:
+		message = fmt.Sprintf("Parameter draft #%d failed to apply for %s", draft.Id, actor)
+	case DRAFT_SCHEDULE:
+		message = fmt.Sprintf("Parameter draft #%d scheduled for rollout by %s", draft.Id, actor)
+	case DRAFT_UNSCHEDULE:
+		message = fmt.Sprintf("Parameter draft #%d is no longer rolled out, by %s", draft.Id, actor)
+	case DRAFT_EXPIRE:
+		message = fmt.Sprintf("Parameter draft #%d expired", draft.Id)
+	default:
+		message = fmt.Sprintf("Parameter draft #%d: %s by %s", draft.Id, action, actor)
+	}
+	if comment != "" {
+		message += ": " + comment
+	}
+	return message
+}
+
+func addDraftEvent(ctx context.Context, tx bun.IDB, draftId int64, action, actor, comment string) error {
+	event := &ParameterDraftEvent{
+		DraftId:   draftId,
+		Action:    action,
+		Actor:     actor,
+		Comment:   comment,
+		CreatedAt: time.Now(),
+	}
+	_, err := tx.NewInsert().Model(event).Exec(ctx)
+	return err
+}
+
+// stores a new pending draft, its comment is recorded as the first step
+func CreateParameterDraft(ctx context.Context, draft *ParameterDraft) error {
+	draft.Status = DRAFT_PENDING
+	draft.CreatedAt = time.Now()
+	draft.UpdatedAt = time.Now()
+
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(draft).Exec(ctx); err != nil {
+			return err
+		}
+		return addDraftEvent(ctx, tx, draft.Id, DRAFT_CREATED, draft.CreatedBy, draft.Comment)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating parameter draft: %v", err)
+	}
+
+	if err := LogActivity(ctx, "success", draftActivityMessage(draft, DRAFT_CREATED, draft.CreatedBy, draft.Comment), nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// drafts newest first, optionally only those in status
+func GetParameterDrafts(ctx context.Context, status string) ([]ParameterDraft, error) {
+	var drafts []ParameterDraft
+	query := db.NewSelect().Model(&drafts).Order("created_at DESC", "id DESC")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching parameter drafts: %v", err)
+	}
+	return drafts, nil
+}
+
+func GetParameterDraftById(ctx context.Context, id int64) (*ParameterDraft, error) {
+	var draft ParameterDraft
+	err := db.NewSelect().Model(&draft).Where("id = ?", id).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &draft, nil
+}
+
+// every step of the draft, oldest first
+func GetParameterDraftEvents(ctx context.Context, draftId int64) ([]ParameterDraftEvent, error) {
+	var events []ParameterDraftEvent
+	err := db.NewSelect().Model(&events).Where("draft_id = ?", draftId).Order("created_at ASC", "id ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching parameter draft events: %v", err)
+	}
+	return events, nil
+}
+
+// TransitionParameterDraft moves the draft on by action, provided it is still in status
+// from. The draft is updated in place and the step recorded with actor and comment.
+// ErrDraftStateChanged means someone else moved it first.
+func TransitionParameterDraft(ctx context.Context, draft *ParameterDraft, from, action, actor, comment string) error {
+	to, ok := draftTransitions[action]
+	if !ok {
+		return fmt.Errorf("unknown parameter draft action %q", action)
+	}
+
+	now := time.Now()
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		query := tx.NewUpdate().
+			Model((*ParameterDraft)(nil)).
+			Set("status = ?", to).
+			Set("updated_at = ?", now).
+			Where("id = ?", draft.Id).
+			Where("status = ?", from)
+		switch action {
+		case DRAFT_APPROVE, DRAFT_REJECT:
+			query = query.Set("reviewed_by = ?", actor)
+		case DRAFT_APPLY:
+			query = query.Set("applied_by = ?", actor)
+		case DRAFT_APPLY_FAILED:
+			query = query.Set("applied_by = ''").Set("parameters_id = NULL")
+		}
+
+		result, err := query.Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return ErrDraftStateChanged
+		}
+		return addDraftEvent(ctx, tx, draft.Id, action, actor, comment)
+	})
+	if errors.Is(err, ErrDraftStateChanged) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error updating parameter draft: %v", err)
+	}
+
+	draft.Status = to
+	draft.UpdatedAt = now
+	switch action {
+	case DRAFT_APPROVE, DRAFT_REJECT:
+		draft.ReviewedBy = actor
+	case DRAFT_APPLY:
+		draft.AppliedBy = actor
+	case DRAFT_APPLY_FAILED:
+		draft.AppliedBy = ""
+		draft.ParametersId = nil
+	}
+
+	activityType := "success"
+	if action == DRAFT_REJECT || action == DRAFT_APPLY_FAILED || action == DRAFT_EXPIRE || action == DRAFT_UNSCHEDULE {
+		activityType = "warning"
+	}
+	if err := LogActivity(ctx, activityType, draftActivityMessage(draft, action, actor, comment), nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// links an applied draft to the parameter set it was stored as
+func SetParameterDraftParameters(ctx context.Context, draft *ParameterDraft, parametersId int64) error {
+	_, err := db.NewUpdate().
+		Model((*ParameterDraft)(nil)).
+		Set("parameters_id = ?", parametersId).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", draft.Id).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error updating parameter draft: %v", err)
+	}
+	draft.ParametersId = &parametersId
+	return nil
+}
+
+// ExpireParameterDrafts expires the pending and approved drafts past their expiry and
+// returns how many it expired. Drafts waiting in a scheduled or running rollout are left to it.
+func ExpireParameterDrafts(ctx context.Context, now time.Time) (int, error) {
+	var stale []ParameterDraft
+	err := db.NewSelect().
+		Model(&stale).
+		Where("status IN (?)", bun.In([]string{DRAFT_PENDING, DRAFT_APPROVED})).
+		Where("expires_at <= ?", now).
+		Where("id NOT IN (SELECT draft_id FROM parameter_rollouts WHERE draft_id IS NOT NULL AND status IN (?))",
+			bun.In([]string{ROLLOUT_SCHEDULED, ROLLOUT_CANARY})).
+		Scan(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching stale parameter drafts: %v", err)
+	}
+
+	expired := 0
+	for i := range stale {
+		draft := &stale[i]
+		comment := fmt.Sprintf("not applied by %s", draft.ExpiresAt.Format(time.RFC3339))
+		err := TransitionParameterDraft(ctx, draft, draft.Status, DRAFT_EXPIRE, DRAFT_SYSTEM_ACTOR, comment)
+		if errors.Is(err, ErrDraftStateChanged) {
+			continue
+		}
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// new Prequal parameters for the pool (or globally without one) that go live at StartsAt,
+// first only on the canary instances and pools when there are any. The canary is watched
+// for ObserveSeconds before the parameters are promoted to every proxy or rolled back.
+type ParameterRollout struct {
+	bun.BaseModel `bun:"table:parameter_rollouts"`
+
+	Id                int64   `json:"id" bun:"id,pk,autoincrement"`
+	PoolId            *int64  `json:"pool_id,omitempty" bun:"pool_id"`
+	DraftId           *int64  `json:"draft_id,omitempty" bun:"draft_id"`
+	MaxLifeTime       int     `json:"max_life_time" bun:"max_life_time,notnull"`
+	PoolSize          int     `json:"pool_size" bun:"pool_size,notnull"`
+	ProbeFactor       float64 `json:"probe_factor" bun:"probe_factor,notnull"`
+	ProbeRemoveFactor int     `json:"probe_remove_factor" bun:"probe_remove_factor,notnull"`
+	Mu                int     `json:"mu" bun:"mu,notnull"`
+	Status            string  `json:"status" bun:"status,notnull"`
+
+	StartsAt        time.Time `json:"starts_at" bun:"starts_at,notnull"`
+	CanaryInstances []string  `json:"canary_instances" bun:"canary_instances,type:jsonb,notnull"`
+	CanaryPoolIds   []int64   `json:"canary_pool_ids" bun:"canary_pool_ids,type:jsonb,notnull"`
+	ObserveSeconds  int       `json:"observe_seconds" bun:"observe_seconds,notnull"`
+	// the canary is judged once it served MinRequests, it fails above MaxErrorRate or
+	// MaxErrorRateIncrease over the error rate before it started, whichever are set
+	MinRequests          int64    `json:"min_requests" bun:"min_requests,notnull"`
+	MaxErrorRate         *float64 `json:"max_error_rate,omitempty" bun:"max_error_rate"`
+	MaxErrorRateIncrease *float64 `json:"max_error_rate_increase,omitempty" bun:"max_error_rate_increase"`
+
+	// request counters of the watched replicas when the canary started, by url
+	Baseline   map[string]RequestCounts `json:"baseline" bun:"baseline,type:jsonb,notnull"`
+	Evaluation *RolloutEvaluation       `json:"evaluation,omitempty" bun:"evaluation,type:jsonb"`
+	Reason     string                   `json:"reason,omitempty" bun:"reason,notnull"`
+	Comment    string                   `json:"comment" bun:"comment,notnull"`
+	// the parameter set stored when the rollout was promoted
+	ParametersId    *int64     `json:"parameters_id,omitempty" bun:"parameters_id"`
+	CreatedBy       string     `json:"created_by" bun:"created_by,notnull"`
+	CanaryStartedAt *time.Time `json:"canary_started_at,omitempty" bun:"canary_started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty" bun:"finished_at"`
+	CreatedAt       time.Time  `json:"created_at" bun:"created_at,default:current_timestamp"`
+	UpdatedAt       time.Time  `json:"updated_at" bun:"updated_at,default:current_timestamp"`
+}
+
+type RequestCounts struct {
+	Successful int64 `json:"successful"`
+	Failed     int64 `json:"failed"`
+}
+
+// the latest judgement of a canary, with the numbers it is based on
+type RolloutEvaluation struct {
+	EvaluatedAt       time.Time `json:"evaluated_at"`
+	Requests          int64     `json:"requests"`
+	FailedRequests    int64     `json:"failed_requests"`
+	ErrorRate         float64   `json:"error_rate"`
+	BaselineRequests  int64     `json:"baseline_requests"`
+	BaselineErrorRate float64   `json:"baseline_error_rate"`
+	Verdict           string    `json:"verdict"`
+	Detail            string    `json:"detail"`
+}
+
+// states of a rollout, only scheduled rollouts and running canaries are still open
+const (
+	ROLLOUT_SCHEDULED   = "scheduled"
+	ROLLOUT_CANARY      = "canary"
+	ROLLOUT_PROMOTED    = "promoted"
+	ROLLOUT_ROLLED_BACK = "rolled_back"
+	ROLLOUT_CANCELLED   = "cancelled"
+)
+
+// verdicts of an evaluation
+const (
+	ROLLOUT_OBSERVE  = "observe"
+	ROLLOUT_PROMOTE  = "promote"
+	ROLLOUT_ROLLBACK = "rollback"
+)
+
+// actor of the steps the rollout controller takes on its own
+const ROLLOUT_SYSTEM_ACTOR = "system"
+
+var ErrRolloutStateChanged = errors.New("parameter rollout is no longer in the expected state")
+
+func (r *ParameterRollout) Open() bool {
+	return r.Status == ROLLOUT_SCHEDULED || r.Status == ROLLOUT_CANARY
+}
+
+func (r *ParameterRollout) HasCanary() bool {
+	return len(r.CanaryInstances) > 0 || len(r.CanaryPoolIds) > 0
+}
+
+func (r *ParameterRollout) ObserveDuration() time.Duration {
+	return time.Duration(r.ObserveSeconds) * time.Second
+}
+
+// the parameters rolled out, as they are stored once promoted
+func (r *ParameterRollout) Parameters() AddPrequalParametersType {
+	return AddPrequalParametersType{
+		MaxLifeTime:       r.MaxLifeTime,
+		PoolSize:          r.PoolSize,
+		ProbeFactor:       r.ProbeFactor,
+		ProbeRemoveFactor: r.ProbeRemoveFactor,
+		Mu:                r.Mu,
+		Status:            PARAMETERS_ACTIVE,
+		PoolId:            r.PoolId,
+	}
+}
+
+func CreateParameterRollout(ctx context.Context, rollout *ParameterRollout) error {
+	rollout.Status = ROLLOUT_SCHEDULED
+	if rollout.CanaryInstances == nil {
+		rollout.CanaryInstances = []string{}
+	}
+	if rollout.CanaryPoolIds == nil {
+		rollout.CanaryPoolIds = []int64{}
+	}
+	if rollout.Baseline == nil {
+		rollout.Baseline = map[string]RequestCounts{}
+	}
+	rollout.CreatedAt = time.Now()
+	rollout.UpdatedAt = time.Now()
+
+	if _, err := db.NewInsert().Model(rollout).Exec(ctx); err != nil {
+		return fmt.Errorf("error creating parameter rollout: %v", err)
+	}
+
+	message := fmt.Sprintf("Parameter rollout #%d scheduled for %s by %s", rollout.Id, rollout.StartsAt.Format(time.RFC3339), rollout.CreatedBy)
+	if rollout.Comment != "" {
+		message += ": " + rollout.Comment
+	}
+	if err := LogActivity(ctx, "success", message, nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// rollouts newest first, optionally only those in status
+func GetParameterRollouts(ctx context.Context, status string) ([]ParameterRollout, error) {
+	var rollouts []ParameterRollout
+	query := db.NewSelect().Model(&rollouts).Order("created_at DESC", "id DESC")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching parameter rollouts: %v", err)
+	}
+	return rollouts, nil
+}
+
+func GetParameterRolloutById(ctx context.Context, id int64) (*ParameterRollout, error) {
+	var rollout ParameterRollout
+	err := db.NewSelect().Model(&rollout).Where("id = ?", id).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// scheduled rollouts and running canaries, oldest first
+func GetOpenParameterRollouts(ctx context.Context) ([]ParameterRollout, error) {
+	var rollouts []ParameterRollout
+	err := db.NewSelect().
+		Model(&rollouts).
+		Where("status IN (?)", bun.In([]string{ROLLOUT_SCHEDULED, ROLLOUT_CANARY})).
+		Order("starts_at ASC", "id ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching open parameter rollouts: %v", err)
+	}
+	return rollouts, nil
+}
+
+// the open rollout of the pool's parameters, or of the global ones without a pool
+func GetOpenParameterRollout(ctx context.Context, poolId *int64) (*ParameterRollout, error) {
+	var rollout ParameterRollout
+	query := db.NewSelect().
+		Model(&rollout).
+		Where("status IN (?)", bun.In([]string{ROLLOUT_SCHEDULED, ROLLOUT_CANARY})).
+		Limit(1)
+	if poolId != nil {
+		query = query.Where("pool_id = ?", *poolId)
+	} else {
+		query = query.Where("pool_id IS NULL")
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// the scheduled or running rollout of the draft
+func GetOpenParameterRolloutOfDraft(ctx context.Context, draftId int64) (*ParameterRollout, error) {
+	var rollout ParameterRollout
+	err := db.NewSelect().
+		Model(&rollout).
+		Where("draft_id = ?", draftId).
+		Where("status IN (?)", bun.In([]string{ROLLOUT_SCHEDULED, ROLLOUT_CANARY})).
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// UpdateParameterRollout saves the progress of the rollout, provided it is still in status
+// from. ErrRolloutStateChanged means someone else moved it first.
+func UpdateParameterRollout(ctx context.Context, rollout *ParameterRollout, from string) error {
+	rollout.UpdatedAt = time.Now()
+	result, err := db.NewUpdate().
+		Model(rollout).
+		Column("status", "baseline", "evaluation", "reason", "parameters_id", "canary_started_at", "finished_at", "updated_at").
+		WherePK().
+		Where("status = ?", from).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error updating parameter rollout: %v", err)
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error updating parameter rollout: %v", err)
+	} else if affected == 0 {
+		return ErrRolloutStateChanged
+	}
+	return nil
+}
+
+// request counters of every replica with statistics, by url
+func GetRequestCounts(ctx context.Context) (map[string]RequestCounts, error) {
+	var stats []Statistics
+	if err := db.NewSelect().Model(&stats).Column("url", "successful_requests", "failed_requests").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching statistics: %v", err)
+	}
+
+	counts := make(map[string]RequestCounts, len(stats))
+	for _, stat := range stats {
+		counts[stat.URL] = RequestCounts{Successful: stat.SuccessfulRequests, Failed: stat.FailedRequests}
+	}
+	return counts, nil
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type Pool struct {
+	bun.BaseModel `bun:"table:pools"`
+
+	Id                  int64     `json:"id" bun:"id,pk,autoincrement"`
+	Name                string    `json:"name" bun:"name,unique,notnull"`
+	Description         string    `json:"description" bun:"description,notnull"`
+	HealthCheckEndpoint string    `json:"health_check_endpoint" bun:"health_check_endpoint,notnull"`
+	HealthCheckInterval int       `json:"health_check_interval_seconds" bun:"health_check_interval_seconds,notnull"`
+	CreatedAt           time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
+	UpdatedAt           time.Time `json:"updated_at" bun:"updated_at,default:current_timestamp"`
+
+	Replicas []Replica `json:"replicas,omitempty" bun:"rel:has-many,join:id=pool_id"`
+}
+
+var ErrPoolConflict = errors.New("pool with the same name already exists")
+
+func CreatePool(ctx context.Context, pool *Pool) error {
+	exists, err := db.NewSelect().Model((*Pool)(nil)).Where("name = ?", pool.Name).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking pool name: %v", err)
+	}
+	if exists {
+		return ErrPoolConflict
+	}
+
+	pool.CreatedAt = time.Now()
+	pool.UpdatedAt = time.Now()
+	if _, err := db.NewInsert().Model(pool).Exec(ctx); err != nil {
+		return fmt.Errorf("error creating pool: %v", err)
+	}
+
+	if err := LogActivity(ctx, "success", fmt.Sprintf("Pool '%s' is created", pool.Name), nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+func GetPools(ctx context.Context) ([]Pool, error) {
+	var pools []Pool
+	err := db.NewSelect().Model(&pools).Relation("Replicas").Order("id ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching pools: %v", err)
+	}
+	return pools, nil
+}
+
+// find a pool by id together with its members
+func GetPoolById(ctx context.Context, id int64) (*Pool, error) {
+	var pool Pool
+	err := db.NewSelect().Model(&pool).Relation("Replicas").Where("pool.id = ?", id).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+func GetPoolByName(ctx context.Context, name string) (*Pool, error) {
+	var pool Pool
+	err := db.NewSelect().Model(&pool).Where("name = ?", name).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+// name of the pool a replica belongs to, empty for replicas outside of any pool
+func GetPoolName(ctx context.Context, poolId *int64) (string, error) {
+	if poolId == nil {
+		return "", nil
+	}
+
+	var name string
+	err := db.NewSelect().Model((*Pool)(nil)).Column("name").Where("id = ?", *poolId).Scan(ctx, &name)
+	if err != nil {
+		return "", fmt.Errorf("error fetching pool name: %v", err)
+	}
+	return name, nil
+}
+
+func UpdatePool(ctx context.Context, pool *Pool) error {
+	exists, err := db.NewSelect().
+		Model((*Pool)(nil)).
+		Where("name = ?", pool.Name).
+		Where("id != ?", pool.Id).
+		Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking pool name: %v", err)
+	}
+	if exists {
+		return ErrPoolConflict
+	}
+
+	pool.UpdatedAt = time.Now()
+	_, err = db.NewUpdate().
+		Model(pool).
+		Column("name", "description", "health_check_endpoint", "health_check_interval_seconds", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error updating pool: %v", err)
+	}
+
+	if err := LogActivity(ctx, "success", fmt.Sprintf("Pool '%s' is updated", pool.Name), nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// deletes a pool, its members stay registered but no longer belong to any pool
+func DeletePool(ctx context.Context, id int64) error {
+	pool, err := GetPoolById(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewUpdate().Model((*Replica)(nil)).Set("pool_id = NULL").Where("pool_id = ?", id).Exec(ctx); err != nil {
+			return err
+		}
+		_, err := tx.NewDelete().Model((*Pool)(nil)).Where("id = ?", id).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting pool: %v", err)
+	}
+
+	if err := LogActivity(ctx, "warning", fmt.Sprintf("Pool '%s' is deleted", pool.Name), nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// AddPoolMembers moves the replicas into the pool in one transaction, a failure leaves every
+// replica in the pool it was in.
+func AddPoolMembers(ctx context.Context, poolId int64, replicaIds []int64) error {
+	name, err := GetPoolName(ctx, &poolId)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int64, 0, len(replicaIds))
+	for _, id := range replicaIds {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	var replicas []Replica
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().
+			Model((*Replica)(nil)).
+			Set("pool_id = ?", poolId).
+			Set("updated_at = ?", time.Now()).
+			Where("id IN (?)", bun.In(ids)).
+			Returning("id, name").
+			Exec(ctx, &replicas)
+		if err != nil {
+			return err
+		}
+		if len(replicas) != len(ids) {
+			return fmt.Errorf("%d of %d replicas found", len(replicas), len(ids))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error adding replicas to pool: %v", err)
+	}
+
+	for _, replica := range replicas {
+		message := fmt.Sprintf("Replica '%s' is added to pool '%s'", replica.Name, name)
+		if err := LogActivity(ctx, "success", message, &replica.Id); err != nil {
+			return fmt.Errorf("error logging activity: %v", err)
+		}
+	}
+	return nil
+}
+
+// moves a replica into a pool, a nil pool removes it from its current pool
+func SetReplicaPool(ctx context.Context, replicaId int64, poolId *int64) error {
+	replica, err := GetReplicaById(ctx, replicaId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.NewUpdate().
+		Model((*Replica)(nil)).
+		Set("pool_id = ?", poolId).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", replicaId).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error changing replica pool: %v", err)
+	}
+
+	message := fmt.Sprintf("Replica '%s' is removed from its pool", replica.Name)
+	if poolId != nil {
+		name, err := GetPoolName(ctx, poolId)
+		if err != nil {
+			return err
+		}
+		message = fmt.Sprintf("Replica '%s' is added to pool '%s'", replica.Name, name)
+	}
+
+	if err := LogActivity(ctx, "success", message, &replica.Id); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+func GetPoolReplicas(ctx context.Context, poolId int64) ([]Replica, error) {
+	var replicas []Replica
+	err := db.NewSelect().Model(&replicas).Where("pool_id = ?", poolId).Order("id ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching pool replicas: %v", err)
+	}
+	return replicas, nil
+}
+
+// latest active parameters of a pool, falling back to the global parameters
+// when the pool has none of its own
+func GetPoolPrequalParameters(ctx context.Context, poolId int64) (PrequalParametersResponse, error) {
+	var response PrequalParametersResponse
+	err := db.NewSelect().
+		Model(&response).
+		Where("pool_id = ?", poolId).
+		Where("status = ?", "active").
+		Order("created_at DESC").
+		Limit(1).
+		Scan(ctx)
+	if err == sql.ErrNoRows {
+		return GetPrequalParametersResponse(ctx)
+	}
+	if err != nil {
+		return response, fmt.Errorf("error fetching pool parameters: %v", err)
+	}
+	return response, nil
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+)
+
+const (
+	PARAMETERS_ACTIVE   = "active"
+	PARAMETERS_INACTIVE = "inactive"
+)
+
+const (
+	PARAMETER_INTEGER = "integer"
+	PARAMETER_NUMBER  = "number"
+)
+
+// limits of one Prequal parameter, Min and Max are inclusive unless exclusive
+type ParameterConstraint struct {
+	Field        string   `json:"field"`
+	Type         string   `json:"type"`
+	Min          *float64 `json:"min,omitempty"`
+	ExclusiveMin bool     `json:"exclusive_min,omitempty"`
+	Max          *float64 `json:"max,omitempty"`
+	Description  string   `json:"description"`
+}
+
+// a relation between two parameters: Field Operator Other, e.g. probe_remove_factor <= pool_size
+type ParameterRule struct {
+	Field    string `json:"field"`
+	Operator string `json:"operator"`
+	Other    string `json:"other"`
+}
+
+type ParameterSchema struct {
+	Fields   []ParameterConstraint `json:"fields"`
+	Rules    []ParameterRule       `json:"rules"`
+	Statuses []string              `json:"statuses"`
+}
+
+// a limit overridden through PREQUAL_PARAMETER_LIMITS
+type parameterLimit struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+type ParameterViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (v ParameterViolation) String() string {
+	return v.Field + ": " + v.Message
+}
+
+func limit(value float64) *float64 {
+	return &value
+}
+
+func defaultParameterSchema() ParameterSchema {
+	return ParameterSchema{
+		Fields: []ParameterConstraint{
+			{Field: "max_life_time", Type: PARAMETER_INTEGER, Min: limit(1), Max: limit(3600), Description: "seconds a probe result stays usable"},
+			{Field: "pool_size", Type: PARAMETER_INTEGER, Min: limit(11), Max: limit(1000), Description: "probe results kept at most"},
+			{Field: "probe_factor", Type: PARAMETER_NUMBER, Min: limit(0), ExclusiveMin: true, Max: limit(100), Description: "probes sent per request"},
+			{Field: "probe_remove_factor", Type: PARAMETER_INTEGER, Min: limit(1), Max: limit(1000), Description: "probe results dropped per request"},
+			{Field: "mu", Type: PARAMETER_INTEGER, Min: limit(1), Max: limit(1000), Description: "times a probe result may be used"},
+		},
+		Rules: []ParameterRule{
+			{Field: "probe_remove_factor", Operator: "<=", Other: "pool_size"},
+		},
+		Statuses: []string{PARAMETERS_ACTIVE, PARAMETERS_INACTIVE},
+	}
+}
+
+// PrequalParameterSchema returns the constraints of the Prequal parameters. Limits can be
+// overridden per environment with PREQUAL_PARAMETER_LIMITS, a JSON object of field to
+// {"min": .., "max": ..}, e.g. {"pool_size": {"min": 16, "max": 64}}.
+func PrequalParameterSchema() ParameterSchema {
+	schema := defaultParameterSchema()
+
+	raw := os.Getenv("PREQUAL_PARAMETER_LIMITS")
+	if raw == "" {
+		return schema
+	}
+
+	var overrides map[string]parameterLimit
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Printf("Invalid PREQUAL_PARAMETER_LIMITS %q, using the default limits: %v", raw, err)
+		return schema
+	}
+	for field, override := range overrides {
+		found := false
+		for i := range schema.Fields {
+			constraint := &schema.Fields[i]
+			if constraint.Field != field {
+				continue
+			}
+			found = true
+			if override.Min != nil {
+				constraint.Min = override.Min
+				constraint.ExclusiveMin = false
+			}
+			if override.Max != nil {
+				constraint.Max = override.Max
+			}
+		}
+		if !found {
+			log.Printf("Ignoring PREQUAL_PARAMETER_LIMITS for unknown parameter %q", field)
+		}
+	}
+	return schema
+}
+
+func parameterValuesByField(parameters AddPrequalParametersType) map[string]float64 {
+	return map[string]float64{
+		"max_life_time":       float64(parameters.MaxLifeTime),
+		"pool_size":           float64(parameters.PoolSize),
+		"probe_factor":        parameters.ProbeFactor,
+		"probe_remove_factor": float64(parameters.ProbeRemoveFactor),
+		"mu":                  float64(parameters.Mu),
+	}
+}
+
+// CheckParameterTypes reports fields of a decoded JSON payload that are missing or of the
+// wrong type, before it is decoded into AddPrequalParametersType.
+func CheckParameterTypes(schema ParameterSchema, payload map[string]interface{}) []ParameterViolation {
+	var violations []ParameterViolation
+	for _, constraint := range schema.Fields {
+		value, ok := payload[constraint.Field]
+		if !ok {
+			violations = append(violations, ParameterViolation{constraint.Field, "is required"})
+			continue
+		}
+		number, ok := value.(float64)
+		if !ok {
+			violations = append(violations, ParameterViolation{constraint.Field, "must be a number"})
+			continue
+		}
+		if constraint.Type == PARAMETER_INTEGER && number != math.Trunc(number) {
+			violations = append(violations, ParameterViolation{constraint.Field, "must be an integer"})
+		}
+	}
+
+	if status, ok := payload["status"]; ok {
+		if _, isString := status.(string); !isString {
+			violations = append(violations, ParameterViolation{"status", "must be a string"})
+		}
+	}
+	return violations
+}
+
+// ValidatePrequalParameters checks the parameters against the limits and rules of the
+// schema, and reports every violation by field.
+func ValidatePrequalParameters(schema ParameterSchema, parameters AddPrequalParametersType) []ParameterViolation {
+	var violations []ParameterViolation
+	values := parameterValuesByField(parameters)
+
+	for _, constraint := range schema.Fields {
+		value := values[constraint.Field]
+		if constraint.Min != nil {
+			if constraint.ExclusiveMin && value <= *constraint.Min {
+				violations = append(violations, ParameterViolation{constraint.Field, fmt.Sprintf("must be greater than %v", *constraint.Min)})
+			} else if !constraint.ExclusiveMin && value < *constraint.Min {
+				violations = append(violations, ParameterViolation{constraint.Field, fmt.Sprintf("must be at least %v", *constraint.Min)})
+			}
+		}
+		if constraint.Max != nil && value > *constraint.Max {
+			violations = append(violations, ParameterViolation{constraint.Field, fmt.Sprintf("must be at most %v", *constraint.Max)})
+		}
+	}
+
+	for _, rule := range schema.Rules {
+		left, right := values[rule.Field], values[rule.Other]
+		var holds bool
+		switch rule.Operator {
+		case "<":
+			holds = left < right
+		case "<=":
+			holds = left <= right
+		case ">":
+			holds = left > right
+		case ">=":
+			holds = left >= right
+		default:
+			log.Printf("Unknown operator %q in parameter rule", rule.Operator)
+			continue
+		}
+		if !holds {
+			violations = append(violations, ParameterViolation{rule.Field, fmt.Sprintf("must be %s %s (%v)", rule.Operator, rule.Other, right)})
+		}
+	}
+
+	if parameters.Status != "" && parameters.Status != PARAMETERS_ACTIVE && parameters.Status != PARAMETERS_INACTIVE {
+		violations = append(violations, ParameterViolation{"status", fmt.Sprintf("must be one of %v", schema.Statuses)})
+	}
+	return violations
+}
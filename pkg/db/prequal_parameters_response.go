@@ -21,6 +21,7 @@ type PrequalParametersResponse struct {
 	CreatedAt         time.Time `bun:"created_at,default:current_timestamp" json:"created_at"`
 	UpdatedAt         time.Time `bun:"updated_at,default:current_timestamp" json:"updated_at"`
 	Status            string    `bun:"status,default:inactive" json:"status"`
+	PoolId            *int64    `bun:"pool_id" json:"pool_id,omitempty"`
 }
 
 // Fetch latest created row
@@ -28,6 +29,7 @@ func GetPrequalParametersResponse(ctx context.Context) (PrequalParametersRespons
 	var response PrequalParametersResponse
 	err := db.NewSelect().
 		Model(&response).
+		Where("pool_id IS NULL").
 		Order("created_at DESC").
 		Limit(1).
 		Scan(ctx)
@@ -40,6 +42,7 @@ func GetPrequalParametersResponse(ctx context.Context) (PrequalParametersRespons
 		var lastActive PrequalParametersResponse
 		err := db.NewSelect().
 			Model(&lastActive).
+			Where("pool_id IS NULL").
 			Where("status = ?", "active").
 			Order("created_at DESC").
 			Limit(1).
@@ -55,23 +58,30 @@ func GetPrequalParametersResponse(ctx context.Context) (PrequalParametersRespons
 }
 
 type AddPrequalParametersType struct {
-	MaxLifeTime       int     `json:"max_life_time"`
-	PoolSize          int     `json:"pool_size"`
-	ProbeFactor       float64 `json:"probe_factor"`
-	ProbeRemoveFactor int     `json:"probe_remove_factor"`
-	Mu                int     `json:"mu"`
-	Status            string  `json:"status"`
+	MaxLifeTime       int     `json:"max_life_time" yaml:"max_life_time"`
+	PoolSize          int     `json:"pool_size" yaml:"pool_size"`
+	ProbeFactor       float64 `json:"probe_factor" yaml:"probe_factor"`
+	ProbeRemoveFactor int     `json:"probe_remove_factor" yaml:"probe_remove_factor"`
+	Mu                int     `json:"mu" yaml:"mu"`
+	Status            string  `json:"status" yaml:"status,omitempty"`
+	PoolId            *int64  `json:"-" yaml:"-"`
 }
 
-// Insert new row
+// Insert new row, active unless the status says otherwise
 func AddPrequalParametersResponse(ctx context.Context, response AddPrequalParametersType) (*PrequalParametersResponse, error) {
+	status := response.Status
+	if status == "" {
+		status = PARAMETERS_ACTIVE
+	}
+
 	payload := &PrequalParametersResponse{
 		MaxLifeTime:       response.MaxLifeTime,
 		PoolSize:          response.PoolSize,
 		ProbeFactor:       response.ProbeFactor,
 		ProbeRemoveFactor: response.ProbeRemoveFactor,
 		Mu:                response.Mu,
-		Status:            "active",
+		Status:            status,
+		PoolId:            response.PoolId,
 		CreatedAt:         time.Now(),
 		UpdatedAt:         time.Now(),
 	}
@@ -88,3 +98,21 @@ func AddPrequalParametersResponse(ctx context.Context, response AddPrequalParame
 
 	return payload, nil
 }
+
+// every parameter set stored for the pool, or the global ones without a pool, newest first
+func GetPrequalParametersHistory(ctx context.Context, poolId *int64, limit int) ([]PrequalParametersResponse, error) {
+	var history []PrequalParametersResponse
+	query := db.NewSelect().Model(&history).Order("created_at DESC", "id DESC")
+	if poolId != nil {
+		query = query.Where("pool_id = ?", *poolId)
+	} else {
+		query = query.Where("pool_id IS NULL")
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching prequal parameters history: %v", err)
+	}
+	return history, nil
+}
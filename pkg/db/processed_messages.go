@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// an inbound message that was handled successfully, kept until it expires so
+// redeliveries of it are recognized
+type ProcessedMessage struct {
+	bun.BaseModel `bun:"table:processed_messages"`
+
+	MessageId   string    `json:"message_id" bun:"message_id,pk"`
+	Name        string    `json:"name" bun:"name,notnull"`
+	ProcessedAt time.Time `json:"processed_at" bun:"processed_at,default:current_timestamp"`
+	ExpiresAt   time.Time `json:"expires_at" bun:"expires_at,notnull"`
+}
+
+// IsMessageProcessed reports whether the message was handled and has not expired yet.
+func IsMessageProcessed(ctx context.Context, messageId string) (bool, error) {
+	exists, err := db.NewSelect().
+		Model((*ProcessedMessage)(nil)).
+		Where("message_id = ?", messageId).
+		Where("expires_at > ?", time.Now()).
+		Exists(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error checking processed message: %v", err)
+	}
+	return exists, nil
+}
+
+// MarkMessageProcessed remembers the message for ttl, refreshing an expired entry.
+func MarkMessageProcessed(ctx context.Context, messageId, name string, ttl time.Duration) error {
+	now := time.Now()
+	message := &ProcessedMessage{
+		MessageId:   messageId,
+		Name:        name,
+		ProcessedAt: now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	_, err := db.NewInsert().
+		Model(message).
+		On("CONFLICT (message_id) DO UPDATE").
+		Set("processed_at = EXCLUDED.processed_at").
+		Set("expires_at = EXCLUDED.expires_at").
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error marking message processed: %v", err)
+	}
+	return nil
+}
+
+// DeleteExpiredProcessedMessages forgets messages past their ttl, returns how many.
+func DeleteExpiredProcessedMessages(ctx context.Context) (int64, error) {
+	result, err := db.NewDelete().
+		Model((*ProcessedMessage)(nil)).
+		Where("expires_at <= ?", time.Now()).
+		Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired processed messages: %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// a reverse proxy instance with its own command queue
+type ProxyInstance struct {
+	bun.BaseModel `bun:"table:proxy_instances"`
+
+	Id           int64     `json:"id" bun:"id,pk,autoincrement"`
+	InstanceId   string    `json:"instance_id" bun:"instance_id,unique,notnull"`
+	Hostname     string    `json:"hostname" bun:"hostname,notnull"`
+	Version      string    `json:"version" bun:"version,notnull"`
+	Queue        string    `json:"queue" bun:"queue,notnull"`
+	RegisteredAt time.Time `json:"registered_at" bun:"registered_at,default:current_timestamp"`
+	LastSeenAt   time.Time `json:"last_seen_at" bun:"last_seen_at,default:current_timestamp"`
+
+	// from the latest heartbeat, stale is set once heartbeats stop arriving
+	LastHeartbeatAt   *time.Time `json:"last_heartbeat_at" bun:"last_heartbeat_at"`
+	UptimeSeconds     *int64     `json:"uptime_seconds" bun:"uptime_seconds"`
+	ParametersVersion *int       `json:"parameters_version" bun:"parameters_version"`
+	ReplicaCount      *int       `json:"replica_count" bun:"replica_count"`
+	Stale             bool       `json:"stale" bun:"stale,notnull"`
+}
+
+// the status of a replica as one proxy instance sees it
+type ProxyReplicaState struct {
+	bun.BaseModel `bun:"table:proxy_replica_states"`
+
+	ProxyId   int64     `json:"proxy_id" bun:"proxy_id,pk"`
+	ReplicaId int64     `json:"replica_id" bun:"replica_id,pk"`
+	Status    string    `json:"status" bun:"status,notnull"`
+	InFlight  *int      `json:"in_flight,omitempty" bun:"in_flight"`
+	UpdatedAt time.Time `json:"updated_at" bun:"updated_at,default:current_timestamp"`
+
+	Proxy   *ProxyInstance `json:"proxy,omitempty" bun:"rel:belongs-to,join:proxy_id=id"`
+	Replica *Replica       `json:"replica,omitempty" bun:"rel:belongs-to,join:replica_id=id"`
+}
+
+// an event a proxy instance sent in response to a command
+type ProxyAcknowledgement struct {
+	bun.BaseModel `bun:"table:proxy_acknowledgements"`
+
+	Id        int64     `json:"id" bun:"id,pk,autoincrement"`
+	ProxyId   int64     `json:"proxy_id" bun:"proxy_id,notnull"`
+	Event     string    `json:"event" bun:"event,notnull"`
+	Subject   string    `json:"subject" bun:"subject,notnull"`
+	Success   bool      `json:"success" bun:"success,notnull"`
+	Detail    string    `json:"detail" bun:"detail,notnull"`
+	MessageId string    `json:"message_id,omitempty" bun:"message_id,notnull"`
+	CreatedAt time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
+}
+
+// RegisterProxyInstance stores the instance or refreshes the one with the same instance id.
+// Reports whether the instance was new.
+func RegisterProxyInstance(ctx context.Context, instance *ProxyInstance) (bool, error) {
+	existing, err := GetProxyInstance(ctx, instance.InstanceId)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	now := time.Now()
+	instance.LastSeenAt = now
+	if existing == nil {
+		instance.RegisteredAt = now
+		if _, err := db.NewInsert().Model(instance).Exec(ctx); err != nil {
+			return false, fmt.Errorf("error registering proxy instance: %v", err)
+		}
+		return true, nil
+	}
+
+	instance.Id = existing.Id
+	instance.RegisteredAt = existing.RegisteredAt
+	_, err = db.NewUpdate().
+		Model(instance).
+		Column("hostname", "version", "queue", "last_seen_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error updating proxy instance: %v", err)
+	}
+	return false, nil
+}
+
+// TouchProxyInstance marks the instance as seen, registering it with the given queue
+// when it never registered itself.
+func TouchProxyInstance(ctx context.Context, instanceId, queue string) (*ProxyInstance, error) {
+	var instance ProxyInstance
+	err := db.NewUpdate().
+		Model(&instance).
+		Set("last_seen_at = ?", time.Now()).
+		Where("instance_id = ?", instanceId).
+		Returning("*").
+		Scan(ctx)
+	if err == nil {
+		return &instance, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error updating proxy instance: %v", err)
+	}
+
+	instance = ProxyInstance{InstanceId: instanceId, Queue: queue}
+	if _, err := RegisterProxyInstance(ctx, &instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// RecordProxyHeartbeat stores the latest heartbeat of the instance and clears its stale
+// flag. Reports whether the instance was stale before.
+func RecordProxyHeartbeat(ctx context.Context, instance *ProxyInstance) (bool, error) {
+	wasStale := instance.Stale
+	now := time.Now()
+	instance.LastHeartbeatAt = &now
+	instance.LastSeenAt = now
+	instance.Stale = false
+
+	_, err := db.NewUpdate().
+		Model(instance).
+		Column("version", "last_seen_at", "last_heartbeat_at", "uptime_seconds", "parameters_version", "replica_count", "stale").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error recording proxy heartbeat: %v", err)
+	}
+	return wasStale, nil
+}
+
+// MarkStaleProxies flags the instances without a heartbeat since the given time, falling
+// back to the last message for instances that never sent one, and returns those newly flagged.
+func MarkStaleProxies(ctx context.Context, before time.Time) ([]ProxyInstance, error) {
+	var instances []ProxyInstance
+	_, err := db.NewUpdate().
+		Model((*ProxyInstance)(nil)).
+		Set("stale = TRUE").
+		Where("stale = FALSE").
+		Where("COALESCE(last_heartbeat_at, last_seen_at) < ?", before).
+		Returning("*").
+		Exec(ctx, &instances)
+	if err != nil {
+		return nil, fmt.Errorf("error marking stale proxies: %v", err)
+	}
+	return instances, nil
+}
+
+func GetProxyInstances(ctx context.Context) ([]ProxyInstance, error) {
+	var instances []ProxyInstance
+	if err := db.NewSelect().Model(&instances).Order("instance_id ASC").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching proxy instances: %v", err)
+	}
+	return instances, nil
+}
+
+func GetProxyInstance(ctx context.Context, instanceId string) (*ProxyInstance, error) {
+	var instance ProxyInstance
+	err := db.NewSelect().Model(&instance).Where("instance_id = ?", instanceId).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// removes the instance together with its replica states and acknowledgements
+func DeleteProxyInstance(ctx context.Context, instance *ProxyInstance) error {
+	if _, err := db.NewDelete().Model(instance).WherePK().Exec(ctx); err != nil {
+		return fmt.Errorf("error deleting proxy instance: %v", err)
+	}
+	return nil
+}
+
+// SetProxyReplicaState records the status a proxy instance reported for a replica,
+// inFlight is only kept while the replica is draining.
+func SetProxyReplicaState(ctx context.Context, proxyId, replicaId int64, status string, inFlight *int) error {
+	if status != DRAINING {
+		inFlight = nil
+	}
+	state := &ProxyReplicaState{
+		ProxyId:   proxyId,
+		ReplicaId: replicaId,
+		Status:    status,
+		InFlight:  inFlight,
+		UpdatedAt: time.Now(),
+	}
+	_, err := db.NewInsert().
+		Model(state).
+		On("CONFLICT (proxy_id, replica_id) DO UPDATE").
+		Set("status = EXCLUDED.status").
+		Set("in_flight = EXCLUDED.in_flight").
+		Set("updated_at = EXCLUDED.updated_at").
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error saving proxy replica state: %v", err)
+	}
+	return nil
+}
+
+// replica states reported by one proxy instance, by replica name
+func GetProxyReplicaStates(ctx context.Context, proxyId int64) ([]ProxyReplicaState, error) {
+	var states []ProxyReplicaState
+	err := db.NewSelect().
+		Model(&states).
+		Relation("Replica").
+		Where("proxy_replica_state.proxy_id = ?", proxyId).
+		Order("replica.name ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching proxy replica states: %v", err)
+	}
+	return states, nil
+}
+
+// how every proxy instance sees one replica, by instance id
+func GetReplicaProxyStates(ctx context.Context, replicaId int64) ([]ProxyReplicaState, error) {
+	var states []ProxyReplicaState
+	err := db.NewSelect().
+		Model(&states).
+		Relation("Proxy").
+		Where("proxy_replica_state.replica_id = ?", replicaId).
+		Order("proxy.instance_id ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching replica proxy states: %v", err)
+	}
+	return states, nil
+}
+
+// number of replicas in each status, per proxy id
+func GetProxyReplicaStatusCounts(ctx context.Context) (map[int64]map[string]int, error) {
+	var rows []struct {
+		ProxyId int64  `bun:"proxy_id"`
+		Status  string `bun:"status"`
+		Count   int    `bun:"count"`
+	}
+	err := db.NewSelect().
+		Model((*ProxyReplicaState)(nil)).
+		Column("proxy_id", "status").
+		ColumnExpr("COUNT(*) AS count").
+		Group("proxy_id", "status").
+		Scan(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("error counting proxy replica states: %v", err)
+	}
+
+	counts := map[int64]map[string]int{}
+	for _, row := range rows {
+		if counts[row.ProxyId] == nil {
+			counts[row.ProxyId] = map[string]int{}
+		}
+		counts[row.ProxyId][row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// CountOtherProxiesWithReplicaStatus counts the instances other than proxyId that were
+// seen since the given time and report the replica in the given status.
+func CountOtherProxiesWithReplicaStatus(ctx context.Context, replicaId, proxyId int64, status string, seenSince time.Time) (int, error) {
+	count, err := db.NewSelect().
+		Model((*ProxyReplicaState)(nil)).
+		Join("JOIN proxy_instances AS proxy ON proxy.id = proxy_replica_state.proxy_id").
+		Where("proxy_replica_state.replica_id = ?", replicaId).
+		Where("proxy_replica_state.proxy_id != ?", proxyId).
+		Where("proxy_replica_state.status = ?", status).
+		Where("proxy.last_seen_at >= ?", seenSince).
+		Count(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error counting proxy replica states: %v", err)
+	}
+	return count, nil
+}
+
+// SumProxyInFlight adds up the in-flight requests that instances seen since the given time
+// reported for a draining replica. Reports false when no instance reported progress.
+func SumProxyInFlight(ctx context.Context, replicaId int64, drainStartedAt, seenSince time.Time) (int, bool, error) {
+	var row struct {
+		Total   sql.NullInt64 `bun:"total"`
+		Reports int           `bun:"reports"`
+	}
+	err := db.NewSelect().
+		Model((*ProxyReplicaState)(nil)).
+		ColumnExpr("SUM(proxy_replica_state.in_flight) AS total").
+		ColumnExpr("COUNT(*) AS reports").
+		Join("JOIN proxy_instances AS proxy ON proxy.id = proxy_replica_state.proxy_id").
+		Where("proxy_replica_state.replica_id = ?", replicaId).
+		Where("proxy_replica_state.status = ?", DRAINING).
+		Where("proxy_replica_state.updated_at >= ?", drainStartedAt).
+		Where("proxy.last_seen_at >= ?", seenSince).
+		Scan(ctx, &row)
+	if err != nil {
+		return 0, false, fmt.Errorf("error summing proxy in-flight requests: %v", err)
+	}
+	return int(row.Total.Int64), row.Reports > 0, nil
+}
+
+// RecordProxyAcknowledgement stores the acknowledgement once per message, a redelivered
+// or replayed message does not add it again.
+func RecordProxyAcknowledgement(ctx context.Context, ack *ProxyAcknowledgement) error {
+	ack.CreatedAt = time.Now()
+	query := db.NewInsert().Model(ack)
+	if ack.MessageId != "" {
+		query = query.On("CONFLICT (proxy_id, event, subject, message_id) WHERE message_id <> '' DO NOTHING")
+	}
+	if _, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("error recording proxy acknowledgement: %v", err)
+	}
+	return nil
+}
+
+// acknowledgements of one proxy instance, newest first
+func GetProxyAcknowledgements(ctx context.Context, proxyId int64, limit int) ([]ProxyAcknowledgement, error) {
+	var acks []ProxyAcknowledgement
+	query := db.NewSelect().Model(&acks).Where("proxy_id = ?", proxyId).Order("id DESC")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching proxy acknowledgements: %v", err)
+	}
+	return acks, nil
+}
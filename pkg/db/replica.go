@@ -3,38 +3,121 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/uptrace/bun"
 )
 
 type Replica struct {
 	bun.BaseModel `bun:"table:replicas"`
 
-	Id                  int64     `json:"id" bun:"id,pk,autoincrement"`
-	Name                string    `json:"name" bun:"name,unique,notnull"`
-	URL                 string    `json:"url" bun:"url,unique,notnull"`
-	Status              string    `json:"status" bun:"status,notnull"`
-	HealthCheckEndpoint string    `json:"health_check_point" bun:"health_check_endpoint,notnull"`
-	CreatedAt           time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
-	UpdatedAt           time.Time `json:"updated_at" bun:"updated_at,default:current_timestamp"`
+	Id                  int64             `json:"id" bun:"id,pk,autoincrement"`
+	Name                string            `json:"name" bun:"name,unique,notnull"`
+	URL                 string            `json:"url" bun:"url,unique,notnull"`
+	Status              string            `json:"status" bun:"status,notnull"`
+	HealthCheckEndpoint string            `json:"health_check_point" bun:"health_check_endpoint,notnull"`
+	Weight              int               `json:"weight" bun:"weight,notnull"`
+	Metadata            map[string]string `json:"metadata" bun:"metadata,type:jsonb,notnull"`
+	MaxConcurrent       int               `json:"max_concurrent_requests" bun:"max_concurrent_requests,notnull"`
+	CapacityClass       string            `json:"capacity_class" bun:"capacity_class,notnull"`
+	PoolId              *int64            `json:"pool_id" bun:"pool_id"`
+	Labels              map[string]string `json:"labels" bun:"labels,type:jsonb,notnull"`
+	DrainStartedAt      *time.Time        `json:"drain_started_at,omitempty" bun:"drain_started_at"`
+	DrainDeadline       *time.Time        `json:"drain_deadline,omitempty" bun:"drain_deadline"`
+	InFlight            *int              `json:"in_flight,omitempty" bun:"in_flight"`
+	CreatedAt           time.Time         `json:"created_at" bun:"created_at,default:current_timestamp"`
+	UpdatedAt           time.Time         `json:"updated_at" bun:"updated_at,default:current_timestamp"`
 }
 
 const (
 	INACTIVE = "inactive"
 	ACTIVE   = "active"
 	DISABLED = "disabled"
+	DRAINING = "draining"
 )
 
-func AddReplica(ctx context.Context, name, url, healthCheckEndpoint string) error {
+// capacity classes, a rough hint about the hardware a replica runs on
+const (
+	CAPACITY_SMALL    = "small"
+	CAPACITY_STANDARD = "standard"
+	CAPACITY_LARGE    = "large"
+)
+
+const DEFAULT_WEIGHT = 1
+const MAX_WEIGHT = 1000
+
+var CapacityClasses = []string{CAPACITY_SMALL, CAPACITY_STANDARD, CAPACITY_LARGE}
+
+// how much traffic a replica can take, MaxConcurrent of 0 means unlimited
+type ReplicaCapacity struct {
+	Weight        int
+	MaxConcurrent int
+	CapacityClass string
+}
+
+// fills in the defaults for fields that were not provided
+func (c ReplicaCapacity) WithDefaults() ReplicaCapacity {
+	if c.Weight == 0 {
+		c.Weight = DEFAULT_WEIGHT
+	}
+	if c.CapacityClass == "" {
+		c.CapacityClass = CAPACITY_STANDARD
+	}
+	return c
+}
+
+func (r *Replica) Capacity() ReplicaCapacity {
+	return ReplicaCapacity{
+		Weight:        r.Weight,
+		MaxConcurrent: r.MaxConcurrent,
+		CapacityClass: r.CapacityClass,
+	}
+}
+
+var ErrReplicaConflict = errors.New("replica with the same name or url already exists")
+
+// the drain of a replica waits on requests to its url, so the url stays until it ends
+var ErrReplicaDraining = errors.New("replica is draining")
+
+// postgres error code of a unique constraint violation
+const uniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
+
+type NewReplica struct {
+	Name                string
+	URL                 string
+	HealthCheckEndpoint string
+	Capacity            ReplicaCapacity
+	Labels              map[string]string
+	PoolId              *int64
+	// DISABLED keeps a replica that is re-added in its current status, it is re-activated otherwise
+	Status string
+}
+
+// registers a replica, or re-adds it when a replica with the same name and url exists.
+// Either way it is queued for activation until the proxy confirms it. A re-added replica keeps
+// its pool and labels unless the spec has them, and is returned as it was before.
+func AddReplica(ctx context.Context, spec NewReplica) (*Replica, error) {
+	capacity := spec.Capacity.WithDefaults()
 	replica := &Replica{
-		Name:                name,
-		URL:                 url,
+		Name:                spec.Name,
+		URL:                 spec.URL,
 		Status:              INACTIVE,
-		HealthCheckEndpoint: healthCheckEndpoint,
+		HealthCheckEndpoint: spec.HealthCheckEndpoint,
+		Weight:              capacity.Weight,
+		MaxConcurrent:       capacity.MaxConcurrent,
+		CapacityClass:       capacity.CapacityClass,
+		Metadata:            map[string]string{},
+		Labels:              spec.Labels,
+		PoolId:              spec.PoolId,
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
@@ -42,44 +125,69 @@ func AddReplica(ctx context.Context, name, url, healthCheckEndpoint string) erro
 	var findReplica Replica
 	err := db.NewSelect().
 		Model(&findReplica).
-		Where("url = ?", url).
-		Where("name = ?", name).
+		Where("url = ?", spec.URL).
+		Where("name = ?", spec.Name).
 		Scan(ctx)
 
 	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("error occurred: %v", err)
+		return nil, fmt.Errorf("error occurred: %v", err)
 	}
 
 	if err == nil {
-		// Update the replica's status to active
-		_, updateErr := db.NewUpdate().
+		before := findReplica
+		query := db.NewUpdate().
 			Model(&findReplica).
-			Set("status = ?", ACTIVE).
 			Set("updated_at = ?", time.Now()).
 			Set("health_check_endpoint = ?", replica.HealthCheckEndpoint).
-			Where("url = ?", url).
-			Exec(ctx)
-		if updateErr != nil {
-			return fmt.Errorf("error updating replica: %v", updateErr)
+			Set("weight = ?", replica.Weight).
+			Set("max_concurrent_requests = ?", replica.MaxConcurrent).
+			Set("capacity_class = ?", replica.CapacityClass).
+			Where("url = ?", spec.URL)
+		if spec.Labels != nil {
+			query = query.Set("labels = ?", replica.Labels)
+			findReplica.Labels = replica.Labels
 		}
-		replica = &findReplica
-	} else {
-		// Insert new replica
-		_, err = db.NewInsert().Model(replica).Exec(ctx)
+		if spec.PoolId != nil {
+			query = query.Set("pool_id = ?", replica.PoolId)
+			findReplica.PoolId = replica.PoolId
+		}
+		if _, updateErr := query.Exec(ctx); updateErr != nil {
+			return nil, fmt.Errorf("error updating replica: %v", updateErr)
+		}
+
+		findReplica.HealthCheckEndpoint = replica.HealthCheckEndpoint
+		findReplica.Weight = replica.Weight
+		findReplica.MaxConcurrent = replica.MaxConcurrent
+		findReplica.CapacityClass = replica.CapacityClass
+
+		if spec.Status == DISABLED {
+			return &before, nil
+		}
+		target, err := ResolveAdminTarget(findReplica.Status, ACTIVE, false)
 		if err != nil {
-			return fmt.Errorf("error adding replica: %v", err)
+			return nil, err
 		}
+		return &before, TransitionReplica(ctx, &findReplica, target, SOURCE_ADMIN, TransitionOptions{Detail: "replica re-added"})
 	}
 
-	// Log activity
-	if err = LogActivity(ctx, "success", fmt.Sprintf("Replica '%s' is ready to be active", name), &replica.Id); err != nil {
-		return fmt.Errorf("error logging activity: %v", err)
+	if replica.Labels == nil {
+		replica.Labels = map[string]string{}
 	}
 
-	return nil
+	// Insert new replica
+	_, err = db.NewInsert().Model(replica).Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error adding replica: %v", err)
+	}
+
+	transition, err := findTransition("", INACTIVE, SOURCE_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	return nil, runTransitionEffects(ctx, replica, "", transition, SOURCE_ADMIN, "")
 }
 
-// remove replica by id
+// disable replica by id or url
 func RemoveReplica(ctx context.Context, id *int64, url *string) error {
 	var replica *Replica
 	var err error
@@ -99,89 +207,22 @@ func RemoveReplica(ctx context.Context, id *int64, url *string) error {
 		return fmt.Errorf("error fetching replica: %v", err)
 	}
 
-	// Set status to disabled
-	query := db.NewUpdate().
-		Model((*Replica)(nil)).
-		Set("status = ?", "disabled")
-
-	if id != nil {
-		query.Where("id = ?", *id)
-	} else if url != nil {
-		query.Where("url = ?", *url)
-	}
-
-	_, err = query.Exec(ctx)
-	if err != nil {
-		return fmt.Errorf("error disabling replica: %v", err)
+	if err := TransitionReplica(ctx, replica, DISABLED, SOURCE_ADMIN, TransitionOptions{}); err != nil {
+		return err
 	}
 	log.Printf("Successfully disabled replica with ID: %d", replica.Id)
 
-	// Delete the replica from the database
-	// _, err = db.NewDelete().Model((*Replica)(nil)).Where("id = ?", id).Exec(ctx)
-	// if err != nil {
-	//     log.Printf("Error deleting replica with ID: %d, error: %v", id, err)
-	//     return fmt.Errorf("error removing replica: %v", err)
-	// }
-
-	// log.Printf("Successfully deleted replica with ID: %d", id)
-
-	// Log the activity
-	if err := LogActivity(ctx, "warning", fmt.Sprintf("Replica '%s' is disabled", replica.Name), &replica.Id); err != nil {
-		log.Printf("Error logging activity for replica '%s': %v", replica.Name, err)
-	}
-
 	return nil
 }
 
-// Change status of a replica to active, inactive, or disabled
+// Change status of a replica as an admin, see replicaTransitions for what is allowed
 func UpdateStatus(ctx context.Context, id int64, newStatus string) error {
 	replica, err := GetReplicaById(ctx, id)
 	if err != nil {
 		return fmt.Errorf("error fetching replica: %v", err)
 	}
 
-	if newStatus != ACTIVE && newStatus != INACTIVE && newStatus != DISABLED {
-		return fmt.Errorf("invalid status: %s. Allowed values are 'active', 'inactive', or 'disabled'", newStatus)
-	}
-
-	// Check if the status has changed and set the new status
-	oldStatus := replica.Status
-
-	_, err = db.NewUpdate().
-		Model((*Replica)(nil)).
-		Set("status = ?", newStatus).
-		Set("updated_at = ?", time.Now()).
-		Where("id = ?", id).
-		Exec(ctx)
-	if err != nil {
-		return fmt.Errorf("error changing replica status: %v", err)
-	}
-
-	// Log the status change
-	if oldStatus != newStatus {
-
-		// Deactivated status
-		if oldStatus == ACTIVE && newStatus == DISABLED {
-			if err := LogActivity(ctx, "warning", fmt.Sprintf("Replica '%s' is deactivated", replica.Name), &id); err != nil {
-				return fmt.Errorf("error logging activity: %v", err)
-			}
-		}
-
-		// Activated status
-		if oldStatus == DISABLED && newStatus == ACTIVE {
-			if err := LogActivity(ctx, "success", fmt.Sprintf("Replica '%s' is queued for activation", replica.Name), &id); err != nil {
-				return fmt.Errorf("error logging activity: %v", err)
-			}
-		}
-
-		if oldStatus == INACTIVE && newStatus == ACTIVE {
-			if err := LogActivity(ctx, "success", fmt.Sprintf("Replica '%s' is activated and running", replica.Name), &id); err != nil {
-				return fmt.Errorf("error logging activity: %v", err)
-			}
-		}
-	}
-
-	return nil
+	return TransitionReplica(ctx, replica, newStatus, SOURCE_ADMIN, TransitionOptions{})
 }
 
 // find a replica by id
@@ -215,6 +256,16 @@ func GetReplicas(ctx context.Context) ([]Replica, error) {
 	return replicas, nil
 }
 
+// replicas whose labels match the selector
+func GetReplicasBySelector(ctx context.Context, selector Selector) ([]Replica, error) {
+	var replicas []Replica
+	err := selector.Apply(db.NewSelect().Model(&replicas), "replica.labels").Order("id ASC").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching replicas: %v", err)
+	}
+	return replicas, nil
+}
+
 func GetReplicaByName(ctx context.Context, name string) (*Replica, error) {
 	var replica Replica
 	err := db.NewSelect().
@@ -227,19 +278,101 @@ func GetReplicaByName(ctx context.Context, name string) (*Replica, error) {
 	return &replica, nil
 }
 
+// Change status of a replica as reported by the proxy
 func UpdateStatusByUrl(url string, newStatus string) error {
-	var ctx = context.Background()
-	_, err := db.NewUpdate().
+	_, err := TransitionReplicaByUrl(context.Background(), url, newStatus, SOURCE_PROXY, TransitionOptions{})
+	return err
+}
+
+type ReplicaUpdate struct {
+	Name                *string
+	URL                 *string
+	HealthCheckEndpoint *string
+	Weight              *int
+	MaxConcurrent       *int
+	CapacityClass       *string
+	Metadata            map[string]string
+	Labels              map[string]string
+}
+
+// applies the given changes to a replica and returns it as it was before and after the update
+func UpdateReplica(ctx context.Context, id int64, update ReplicaUpdate) (*Replica, *Replica, error) {
+	before, err := GetReplicaById(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	after := *before
+	if update.Name != nil {
+		after.Name = *update.Name
+	}
+	if update.URL != nil {
+		after.URL = *update.URL
+	}
+	if update.HealthCheckEndpoint != nil {
+		after.HealthCheckEndpoint = *update.HealthCheckEndpoint
+	}
+	if update.Weight != nil {
+		after.Weight = *update.Weight
+	}
+	if update.MaxConcurrent != nil {
+		after.MaxConcurrent = *update.MaxConcurrent
+	}
+	if update.CapacityClass != nil {
+		after.CapacityClass = *update.CapacityClass
+	}
+	if update.Metadata != nil {
+		after.Metadata = update.Metadata
+	}
+	if update.Labels != nil {
+		after.Labels = update.Labels
+	}
+	after.UpdatedAt = time.Now()
+
+	if after.URL != before.URL && before.Status == DRAINING {
+		return nil, nil, ErrReplicaDraining
+	}
+
+	// name and url must stay unique across replicas
+	conflicts, err := db.NewSelect().
 		Model((*Replica)(nil)).
-		Set("status = ?", newStatus).
-		Set("updated_at = ?", time.Now()).
-		Where("url = ?", url).
-		Returning("id").
-		Exec(ctx)
+		Where("id != ?", id).
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("name = ?", after.Name).WhereOr("url = ?", after.URL)
+		}).
+		Count(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error checking replica uniqueness: %v", err)
+	}
+	if conflicts > 0 {
+		return nil, nil, ErrReplicaConflict
+	}
 
+	query := db.NewUpdate().
+		Model(&after).
+		Column("name", "url", "health_check_endpoint", "weight", "max_concurrent_requests", "capacity_class", "metadata", "labels", "updated_at").
+		WherePK()
+	// a drain can start between the read and the write
+	if after.URL != before.URL {
+		query = query.Where("status != ?", DRAINING)
+	}
+	result, err := query.Exec(ctx)
+	// a concurrent update can take the name or url between the check and the write
+	if isUniqueViolation(err) {
+		return nil, nil, ErrReplicaConflict
+	}
 	if err != nil {
-		return fmt.Errorf("error updating replica status: %v", err)
+		return nil, nil, fmt.Errorf("error updating replica: %v", err)
+	}
+	if after.URL != before.URL {
+		if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+			return nil, nil, ErrReplicaDraining
+		}
 	}
 
-	return nil
+	if err := LogActivity(ctx, "success", fmt.Sprintf("Replica '%s' is updated", after.Name), &after.Id); err != nil {
+		return nil, nil, fmt.Errorf("error logging activity: %v", err)
+	}
+
+	return before, &after, nil
 }
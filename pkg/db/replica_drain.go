@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// puts a replica into draining, it keeps serving in-flight requests but gets no new work
+func StartDrain(ctx context.Context, replica *Replica, timeout time.Duration, actor string) error {
+	now := time.Now()
+	deadline := now.Add(timeout)
+
+	// set before the transition so the proxy command carries the timeout
+	replica.DrainStartedAt = &now
+	replica.DrainDeadline = &deadline
+	replica.InFlight = nil
+
+	return TransitionReplica(ctx, replica, DRAINING, actor, TransitionOptions{
+		Detail: fmt.Sprintf("disabled by %s at the latest", deadline.Format(time.RFC3339)),
+		Set: func(q *bun.UpdateQuery) *bun.UpdateQuery {
+			return q.Set("drain_started_at = ?", now).
+				Set("drain_deadline = ?", deadline).
+				Set("in_flight = NULL")
+		},
+	})
+}
+
+// stores the number of requests a draining replica is still serving. Reports come with
+// every proxy update, so they are not logged as activity, the drain starting and ending is.
+// A replica that is no longer draining is left alone.
+func UpdateDrainProgress(ctx context.Context, replica *Replica, inFlight int) error {
+	result, err := db.NewUpdate().
+		Model((*Replica)(nil)).
+		Set("in_flight = ?", inFlight).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", replica.Id).
+		Where("status = ?", DRAINING).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error updating drain progress: %v", err)
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error updating drain progress: %v", err)
+	} else if affected == 0 {
+		return nil
+	}
+
+	replica.InFlight = &inFlight
+	return nil
+}
+
+// disables a drained replica
+func FinalizeDrain(ctx context.Context, replica *Replica, reason string) error {
+	return TransitionReplica(ctx, replica, DISABLED, SOURCE_ADMIN, TransitionOptions{Detail: reason})
+}
+
+// draining replicas whose drain deadline has passed
+func GetExpiredDrains(ctx context.Context) ([]Replica, error) {
+	var replicas []Replica
+	err := db.NewSelect().
+		Model(&replicas).
+		Where("status = ?", DRAINING).
+		Where("drain_deadline < ?", time.Now()).
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching expired drains: %v", err)
+	}
+	return replicas, nil
+}
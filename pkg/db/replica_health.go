@@ -0,0 +1,234 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type ReplicaHealthEvent struct {
+	bun.BaseModel `bun:"table:replica_health_events"`
+
+	Id         int64     `json:"id" bun:"id,pk,autoincrement"`
+	ReplicaId  int64     `json:"replica_id" bun:"replica_id,notnull"`
+	Kind       string    `json:"kind" bun:"kind,notnull"`
+	FromStatus string    `json:"from_status,omitempty" bun:"from_status,nullzero"`
+	ToStatus   string    `json:"to_status,omitempty" bun:"to_status,nullzero"`
+	Healthy    *bool     `json:"healthy,omitempty" bun:"healthy"`
+	LatencyMs  *int64    `json:"latency_ms,omitempty" bun:"latency_ms"`
+	Source     string    `json:"source" bun:"source,notnull"`
+	Detail     string    `json:"detail,omitempty" bun:"detail,nullzero"`
+	CreatedAt  time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
+}
+
+// kinds of health events
+const (
+	HEALTH_TRANSITION = "transition"
+	HEALTH_PROBE      = "probe"
+)
+
+// who caused a health event
+const (
+	SOURCE_ADMIN        = "admin"
+	SOURCE_PROXY        = "proxy"
+	SOURCE_HEALTH_CHECK = "health-check"
+	SOURCE_SCHEDULER    = "scheduler"
+)
+
+// records a status change of a replica, no-op when the status did not change
+func RecordStatusTransition(ctx context.Context, replicaId int64, fromStatus, toStatus, source, detail string) error {
+	if fromStatus == toStatus {
+		return nil
+	}
+
+	event := &ReplicaHealthEvent{
+		ReplicaId:  replicaId,
+		Kind:       HEALTH_TRANSITION,
+		FromStatus: fromStatus,
+		ToStatus:   toStatus,
+		Source:     source,
+		Detail:     detail,
+		CreatedAt:  time.Now(),
+	}
+
+	if _, err := db.NewInsert().Model(event).Exec(ctx); err != nil {
+		return fmt.Errorf("error recording status transition: %v", err)
+	}
+	return nil
+}
+
+// records the outcome of a single health check against a replica
+func RecordHealthProbe(ctx context.Context, replicaId int64, healthy bool, latency time.Duration, detail string) error {
+	latencyMs := latency.Milliseconds()
+	event := &ReplicaHealthEvent{
+		ReplicaId: replicaId,
+		Kind:      HEALTH_PROBE,
+		Healthy:   &healthy,
+		LatencyMs: &latencyMs,
+		Source:    SOURCE_HEALTH_CHECK,
+		Detail:    detail,
+		CreatedAt: time.Now(),
+	}
+
+	if _, err := db.NewInsert().Model(event).Exec(ctx); err != nil {
+		return fmt.Errorf("error recording health probe: %v", err)
+	}
+	return nil
+}
+
+// retrieves the health events of a replica within the window, oldest first
+func GetReplicaHealthHistory(ctx context.Context, replicaId int64, from, to time.Time) ([]ReplicaHealthEvent, error) {
+	var events []ReplicaHealthEvent
+	err := db.NewSelect().
+		Model(&events).
+		Where("replica_id = ?", replicaId).
+		Where("created_at >= ?", from).
+		Where("created_at <= ?", to).
+		Order("created_at ASC", "id ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching replica health history: %v", err)
+	}
+	return events, nil
+}
+
+type ReplicaUptime struct {
+	ReplicaId       int64     `json:"replica_id"`
+	Name            string    `json:"name"`
+	From            time.Time `json:"from"`
+	To              time.Time `json:"to"`
+	ActiveSeconds   float64   `json:"active_seconds"`
+	InactiveSeconds float64   `json:"inactive_seconds"`
+	DisabledSeconds float64   `json:"disabled_seconds"`
+	UptimePercent   *float64  `json:"uptime_percent"`
+	Failures        int       `json:"failures"`
+	Recoveries      int       `json:"recoveries"`
+	MTBFSeconds     *float64  `json:"mtbf_seconds"`
+	MTTRSeconds     *float64  `json:"mttr_seconds"`
+	Transitions     int       `json:"transitions"`
+}
+
+// computes uptime, MTBF and MTTR of a replica over the window
+func GetReplicaUptime(ctx context.Context, replica *Replica, from, to time.Time) (*ReplicaUptime, error) {
+	start := from
+	if replica.CreatedAt.After(start) {
+		start = replica.CreatedAt
+	}
+	if start.After(to) {
+		start = to
+	}
+
+	// status at the start of the window is the target of the last transition before it
+	var previous ReplicaHealthEvent
+	initial := ""
+	err := db.NewSelect().
+		Model(&previous).
+		Where("replica_id = ?", replica.Id).
+		Where("kind = ?", HEALTH_TRANSITION).
+		Where("created_at < ?", start).
+		Order("created_at DESC", "id DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error fetching previous transition: %v", err)
+	}
+	if err == nil {
+		initial = previous.ToStatus
+	}
+
+	var transitions []ReplicaHealthEvent
+	err = db.NewSelect().
+		Model(&transitions).
+		Where("replica_id = ?", replica.Id).
+		Where("kind = ?", HEALTH_TRANSITION).
+		Where("created_at >= ?", start).
+		Where("created_at <= ?", to).
+		Order("created_at ASC", "id ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching transitions: %v", err)
+	}
+
+	// without any history the replica has been in its current status all along
+	if initial == "" && len(transitions) == 0 {
+		initial = replica.Status
+	}
+
+	uptime := ComputeUptime(initial, start, to, transitions)
+	uptime.ReplicaId = replica.Id
+	uptime.Name = replica.Name
+	uptime.From = from
+	return &uptime, nil
+}
+
+// walks the transitions and accumulates time spent in each status.
+// Disabled time is excluded from the uptime percentage since it is planned downtime, draining
+// time counts as up since the replica still serves its in-flight requests.
+func ComputeUptime(initial string, start, end time.Time, transitions []ReplicaHealthEvent) ReplicaUptime {
+	uptime := ReplicaUptime{From: start, To: end}
+
+	status := initial
+	since := start
+	var outageStart *time.Time
+	if status == INACTIVE {
+		outageStart = &start
+	}
+	var repairSeconds float64
+
+	accumulate := func(until time.Time) {
+		seconds := until.Sub(since).Seconds()
+		if seconds < 0 {
+			seconds = 0
+		}
+		switch status {
+		case ACTIVE, DRAINING:
+			uptime.ActiveSeconds += seconds
+		case INACTIVE:
+			uptime.InactiveSeconds += seconds
+		case DISABLED:
+			uptime.DisabledSeconds += seconds
+		}
+	}
+
+	for _, t := range transitions {
+		accumulate(t.CreatedAt)
+		uptime.Transitions++
+
+		if (t.FromStatus == ACTIVE || t.FromStatus == DRAINING) && t.ToStatus == INACTIVE {
+			uptime.Failures++
+		}
+		if t.ToStatus == INACTIVE {
+			at := t.CreatedAt
+			outageStart = &at
+		}
+		if t.ToStatus == ACTIVE && outageStart != nil {
+			uptime.Recoveries++
+			repairSeconds += t.CreatedAt.Sub(*outageStart).Seconds()
+		}
+		if t.ToStatus != INACTIVE {
+			outageStart = nil
+		}
+
+		status = t.ToStatus
+		since = t.CreatedAt
+	}
+	accumulate(end)
+
+	if observed := uptime.ActiveSeconds + uptime.InactiveSeconds; observed > 0 {
+		percent := uptime.ActiveSeconds / observed * 100
+		uptime.UptimePercent = &percent
+	}
+	if uptime.Failures > 0 {
+		mtbf := uptime.ActiveSeconds / float64(uptime.Failures)
+		uptime.MTBFSeconds = &mtbf
+	}
+	if uptime.Recoveries > 0 {
+		mttr := repairSeconds / float64(uptime.Recoveries)
+		uptime.MTTRSeconds = &mttr
+	}
+
+	return uptime
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+var (
+	ErrIllegalTransition = errors.New("illegal replica status transition")
+	ErrInvalidStatus     = errors.New("invalid replica status")
+	ErrProxyNotify       = errors.New("failed to notify the proxy")
+)
+
+var ReplicaStatuses = []string{ACTIVE, INACTIVE, DRAINING, DISABLED}
+
+// what the proxy has to be told after a transition
+type ProxyCommand string
+
+const (
+	PROXY_NONE   ProxyCommand = ""
+	PROXY_ADD    ProxyCommand = "add"
+	PROXY_REMOVE ProxyCommand = "remove"
+	PROXY_DRAIN  ProxyCommand = "drain"
+)
+
+type ReplicaTransition struct {
+	From    string       `json:"from"`
+	To      string       `json:"to"`
+	Actors  []string     `json:"actors"`
+	Command ProxyCommand `json:"command,omitempty"`
+	LogType string       `json:"log_type"`
+	Message string       `json:"message"`
+}
+
+// every legal status change of a replica. A new replica starts from the empty status.
+// Replicas are never activated directly by an admin, they are queued as inactive
+// and become active once the proxy reports them added.
+var replicaTransitions = []ReplicaTransition{
+	{From: "", To: INACTIVE, Actors: []string{SOURCE_ADMIN}, Command: PROXY_ADD, LogType: "success", Message: "Replica '%s' is ready to be active"},
+	{From: DISABLED, To: INACTIVE, Actors: []string{SOURCE_ADMIN, SOURCE_SCHEDULER}, Command: PROXY_ADD, LogType: "success", Message: "Replica '%s' is queued for activation"},
+	{From: INACTIVE, To: INACTIVE, Actors: []string{SOURCE_ADMIN}, Command: PROXY_ADD, LogType: "success", Message: "Replica '%s' is queued for activation"},
+	{From: INACTIVE, To: ACTIVE, Actors: []string{SOURCE_PROXY, SOURCE_HEALTH_CHECK}, LogType: "success", Message: "Replica '%s' is now active"},
+	{From: ACTIVE, To: INACTIVE, Actors: []string{SOURCE_PROXY, SOURCE_HEALTH_CHECK}, LogType: "error", Message: "Replica '%s' is unavailable and set to inactive"},
+	{From: ACTIVE, To: DRAINING, Actors: []string{SOURCE_ADMIN, SOURCE_SCHEDULER}, Command: PROXY_DRAIN, LogType: "warning", Message: "Replica '%s' is draining"},
+	{From: DRAINING, To: ACTIVE, Actors: []string{SOURCE_ADMIN, SOURCE_SCHEDULER}, Command: PROXY_ADD, LogType: "success", Message: "Replica '%s' is no longer draining"},
+	{From: DRAINING, To: INACTIVE, Actors: []string{SOURCE_PROXY, SOURCE_HEALTH_CHECK}, LogType: "error", Message: "Replica '%s' failed while draining and is set to inactive"},
+	{From: DRAINING, To: DISABLED, Actors: []string{SOURCE_ADMIN, SOURCE_PROXY, SOURCE_SCHEDULER}, Command: PROXY_REMOVE, LogType: "warning", Message: "Replica '%s' is drained and disabled"},
+	{From: ACTIVE, To: DISABLED, Actors: []string{SOURCE_ADMIN, SOURCE_PROXY, SOURCE_SCHEDULER}, Command: PROXY_REMOVE, LogType: "warning", Message: "Replica '%s' is disabled"},
+	{From: INACTIVE, To: DISABLED, Actors: []string{SOURCE_ADMIN, SOURCE_PROXY, SOURCE_SCHEDULER}, Command: PROXY_REMOVE, LogType: "warning", Message: "Replica '%s' is disabled"},
+}
+
+var proxyNotifier func(ctx context.Context, command ProxyCommand, replica *Replica) error
+
+// SetProxyNotifier registers how proxy commands are delivered, the messaging package
+// does this so the state machine can stay free of any transport.
+func SetProxyNotifier(notifier func(ctx context.Context, command ProxyCommand, replica *Replica) error) {
+	proxyNotifier = notifier
+}
+
+func ReplicaTransitions() []ReplicaTransition {
+	return replicaTransitions
+}
+
+func findTransition(from, to, actor string) (ReplicaTransition, error) {
+	if !slices.Contains(ReplicaStatuses, to) {
+		return ReplicaTransition{}, fmt.Errorf("%w: %s", ErrInvalidStatus, to)
+	}
+
+	for _, transition := range replicaTransitions {
+		if transition.From != from || transition.To != to {
+			continue
+		}
+		if !slices.Contains(transition.Actors, actor) {
+			return transition, fmt.Errorf("%w: %s may not move a replica from %s to %s", ErrIllegalTransition, actor, from, to)
+		}
+		return transition, nil
+	}
+
+	return ReplicaTransition{}, fmt.Errorf("%w: from %s to %s", ErrIllegalTransition, from, to)
+}
+
+type TransitionOptions struct {
+	// why the transition happened, added to the activity log and health history
+	Detail string
+	// extra columns to update together with the status
+	Set func(q *bun.UpdateQuery) *bun.UpdateQuery
+}
+
+// TransitionReplica moves a replica to a new status if the actor is allowed to, and runs the
+// side effects of the transition: health history, activity log and proxy command.
+// Moving a replica to the status it already has is a no-op unless a transition allows it.
+func TransitionReplica(ctx context.Context, replica *Replica, to, actor string, options TransitionOptions) error {
+	from := replica.Status
+
+	transition, err := findTransition(from, to, actor)
+	if err != nil {
+		if from == to && errors.Is(err, ErrIllegalTransition) {
+			return nil
+		}
+		return err
+	}
+
+	now := time.Now()
+	query := db.NewUpdate().
+		Model((*Replica)(nil)).
+		Set("status = ?", to).
+		Set("updated_at = ?", now).
+		Where("id = ?", replica.Id).
+		Where("status = ?", from)
+
+	if from == DRAINING && to != DRAINING {
+		query = query.Set("drain_started_at = NULL").Set("drain_deadline = NULL").Set("in_flight = NULL")
+		replica.DrainStartedAt, replica.DrainDeadline, replica.InFlight = nil, nil, nil
+	}
+	if options.Set != nil {
+		query = options.Set(query)
+	}
+
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error changing replica status: %v", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: replica '%s' is no longer %s", ErrIllegalTransition, replica.Name, from)
+	}
+
+	replica.Status = to
+	replica.UpdatedAt = now
+	return runTransitionEffects(ctx, replica, from, transition, actor, options.Detail)
+}
+
+// TransitionReplicaByUrl is TransitionReplica for callers that only know the replica's url.
+func TransitionReplicaByUrl(ctx context.Context, url, to, actor string, options TransitionOptions) (*Replica, error) {
+	replica, err := GetReplicaByUrl(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return replica, TransitionReplica(ctx, replica, to, actor, options)
+}
+
+func runTransitionEffects(ctx context.Context, replica *Replica, from string, transition ReplicaTransition, actor, detail string) error {
+	if err := RecordStatusTransition(ctx, replica.Id, from, replica.Status, actor, detail); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf(transition.Message, replica.Name)
+	if detail != "" {
+		message = fmt.Sprintf("%s (%s)", message, detail)
+	}
+	if err := LogActivity(ctx, transition.LogType, message, &replica.Id); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+
+	// changes reported by the proxy are not echoed back to it
+	if transition.Command == PROXY_NONE || actor == SOURCE_PROXY || proxyNotifier == nil {
+		return nil
+	}
+	if err := proxyNotifier(ctx, transition.Command, replica); err != nil {
+		return fmt.Errorf("%w: %v", ErrProxyNotify, err)
+	}
+	return nil
+}
+
+// ResolveAdminTarget turns the status an admin asks for into the transition that gets there:
+// activation queues the replica until the proxy confirms it, disabling an active replica
+// drains it first unless forced.
+func ResolveAdminTarget(current, desired string, force bool) (string, error) {
+	switch desired {
+	case ACTIVE:
+		if current == ACTIVE || current == DRAINING {
+			return ACTIVE, nil
+		}
+		return INACTIVE, nil
+	case DISABLED:
+		if (current == ACTIVE || current == DRAINING) && !force {
+			return DRAINING, nil
+		}
+		return DISABLED, nil
+	case DRAINING, INACTIVE:
+		return desired, nil
+	}
+	return "", fmt.Errorf("%w: %s. Allowed values are 'active', 'inactive', 'draining' or 'disabled'", ErrInvalidStatus, desired)
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/uptrace/bun"
+)
+
+var (
+	labelKeyRegex   = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/-]{0,61}[a-zA-Z0-9])?$`)
+	labelValueRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9._-]{0,61}[a-zA-Z0-9])?)?$`)
+)
+
+// selector operators
+const (
+	SELECTOR_EQUALS     = "="
+	SELECTOR_NOT_EQUALS = "!="
+	SELECTOR_EXISTS     = "exists"
+	SELECTOR_NOT_EXISTS = "!exists"
+)
+
+type Requirement struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value,omitempty"`
+}
+
+// label selector such as zone=a,version!=1.3,canary,!deprecated.
+// All requirements must hold, an empty selector matches everything.
+type Selector []Requirement
+
+func ValidateLabels(labels map[string]string) []string {
+	var validationErrors []string
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) {
+			validationErrors = append(validationErrors, fmt.Sprintf("Invalid label key '%s'", key))
+		}
+		if !labelValueRegex.MatchString(value) {
+			validationErrors = append(validationErrors, fmt.Sprintf("Invalid value '%s' for label '%s'", value, key))
+		}
+	}
+	return validationErrors
+}
+
+func ParseSelector(raw string) (Selector, error) {
+	var selector Selector
+	if strings.TrimSpace(raw) == "" {
+		return selector, nil
+	}
+
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		var requirement Requirement
+
+		switch {
+		case strings.HasPrefix(part, "!") && !strings.Contains(part, "="):
+			requirement = Requirement{Key: strings.TrimSpace(part[1:]), Operator: SELECTOR_NOT_EXISTS}
+		case strings.Contains(part, "!="):
+			key, value, _ := strings.Cut(part, "!=")
+			requirement = Requirement{Key: strings.TrimSpace(key), Operator: SELECTOR_NOT_EQUALS, Value: strings.TrimSpace(value)}
+		case strings.Contains(part, "=="):
+			key, value, _ := strings.Cut(part, "==")
+			requirement = Requirement{Key: strings.TrimSpace(key), Operator: SELECTOR_EQUALS, Value: strings.TrimSpace(value)}
+		case strings.Contains(part, "="):
+			key, value, _ := strings.Cut(part, "=")
+			requirement = Requirement{Key: strings.TrimSpace(key), Operator: SELECTOR_EQUALS, Value: strings.TrimSpace(value)}
+		default:
+			requirement = Requirement{Key: part, Operator: SELECTOR_EXISTS}
+		}
+
+		if !labelKeyRegex.MatchString(requirement.Key) {
+			return nil, fmt.Errorf("invalid label key in selector: '%s'", part)
+		}
+		if !labelValueRegex.MatchString(requirement.Value) {
+			return nil, fmt.Errorf("invalid label value in selector: '%s'", part)
+		}
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		value, ok := labels[requirement.Key]
+		switch requirement.Operator {
+		case SELECTOR_EQUALS:
+			if !ok || value != requirement.Value {
+				return false
+			}
+		case SELECTOR_NOT_EQUALS:
+			if ok && value == requirement.Value {
+				return false
+			}
+		case SELECTOR_EXISTS:
+			if !ok {
+				return false
+			}
+		case SELECTOR_NOT_EXISTS:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, requirement := range s {
+		switch requirement.Operator {
+		case SELECTOR_EXISTS:
+			parts = append(parts, requirement.Key)
+		case SELECTOR_NOT_EXISTS:
+			parts = append(parts, "!"+requirement.Key)
+		default:
+			parts = append(parts, requirement.Key+requirement.Operator+requirement.Value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// adds the selector as where clauses on the given jsonb labels column
+func (s Selector) Apply(q *bun.SelectQuery, column string) *bun.SelectQuery {
+	for _, requirement := range s {
+		switch requirement.Operator {
+		case SELECTOR_EQUALS:
+			q = q.Where("? ->> ? = ?", bun.Ident(column), requirement.Key, requirement.Value)
+		case SELECTOR_NOT_EQUALS:
+			q = q.Where("? ->> ? IS DISTINCT FROM ?", bun.Ident(column), requirement.Key, requirement.Value)
+		case SELECTOR_EXISTS:
+			q = q.Where("? ->> ? IS NOT NULL", bun.Ident(column), requirement.Key)
+		case SELECTOR_NOT_EXISTS:
+			q = q.Where("? ->> ? IS NULL", bun.Ident(column), requirement.Key)
+		}
+	}
+	return q
+}
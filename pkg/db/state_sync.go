@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// a published desired state, the version only changes when the content does
+type StateSnapshot struct {
+	bun.BaseModel `bun:"table:state_snapshots"`
+
+	Version   int64           `json:"version" bun:"version,pk,autoincrement"`
+	Checksum  string          `json:"checksum" bun:"checksum,notnull"`
+	Snapshot  json.RawMessage `json:"snapshot" bun:"snapshot,type:jsonb,notnull"`
+	CreatedAt time.Time       `json:"created_at" bun:"created_at,default:current_timestamp"`
+}
+
+// a difference between the desired state and the state the proxy reported
+type StateDrift struct {
+	Kind    string      `json:"kind"`
+	Name    string      `json:"name"`
+	Fields  []string    `json:"fields,omitempty"`
+	Desired interface{} `json:"desired,omitempty"`
+	Actual  interface{} `json:"actual,omitempty"`
+}
+
+// an actual state report of the proxy and how it compared to the desired state
+type StateReport struct {
+	bun.BaseModel `bun:"table:state_reports"`
+
+	Id              int64        `json:"id" bun:"id,pk,autoincrement"`
+	ProxyId         *int64       `json:"proxy_id" bun:"proxy_id"`
+	DesiredVersion  *int64       `json:"desired_version" bun:"desired_version"`
+	ReportedVersion int64        `json:"reported_version" bun:"reported_version,notnull"`
+	InSync          bool         `json:"in_sync" bun:"in_sync,notnull"`
+	Drift           []StateDrift `json:"drift" bun:"drift,type:jsonb,notnull"`
+	Corrected       bool         `json:"corrected" bun:"corrected,notnull"`
+	CreatedAt       time.Time    `json:"created_at" bun:"created_at,default:current_timestamp"`
+}
+
+func GetLatestStateSnapshot(ctx context.Context) (*StateSnapshot, error) {
+	var snapshot StateSnapshot
+	err := db.NewSelect().Model(&snapshot).Order("version DESC").Limit(1).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// SaveStateSnapshot stores the snapshot under a new version unless the latest one has the
+// same checksum, in which case that one is returned. Reports whether a version was created.
+func SaveStateSnapshot(ctx context.Context, checksum string, body json.RawMessage) (*StateSnapshot, bool, error) {
+	latest, err := GetLatestStateSnapshot(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("error fetching latest state snapshot: %v", err)
+	}
+	if latest != nil && latest.Checksum == checksum {
+		return latest, false, nil
+	}
+
+	snapshot := &StateSnapshot{Checksum: checksum, Snapshot: body, CreatedAt: time.Now()}
+	if _, err := db.NewInsert().Model(snapshot).Exec(ctx); err != nil {
+		return nil, false, fmt.Errorf("error saving state snapshot: %v", err)
+	}
+	return snapshot, true, nil
+}
+
+func RecordStateReport(ctx context.Context, report *StateReport) error {
+	if report.Drift == nil {
+		report.Drift = []StateDrift{}
+	}
+	report.CreatedAt = time.Now()
+	if _, err := db.NewInsert().Model(report).Exec(ctx); err != nil {
+		return fmt.Errorf("error recording state report: %v", err)
+	}
+	return nil
+}
+
+// the latest state reports, newest first, only those of one proxy instance when proxyId is set
+func GetStateReports(ctx context.Context, proxyId *int64, driftOnly bool, limit int) ([]StateReport, error) {
+	var reports []StateReport
+	query := db.NewSelect().Model(&reports).Order("id DESC")
+	if proxyId != nil {
+		query = query.Where("proxy_id = ?", *proxyId)
+	}
+	if driftOnly {
+		query = query.Where("in_sync = FALSE")
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching state reports: %v", err)
+	}
+	return reports, nil
+}
@@ -82,3 +82,24 @@ func GetStatistics(ctx context.Context) ([]Statistics, error) {
 	}
 	return stats, nil
 }
+
+func GetPoolStatistics(ctx context.Context, poolId int64) ([]Statistics, error) {
+	var stats []Statistics
+	err := db.NewSelect().Model(&stats).Relation("Replica").Where("replica.pool_id = ?", poolId).Scan(ctx)
+	if err != nil {
+		log.Printf("Error fetching pool statistics: %v", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+// statistics of the replicas whose labels match the selector
+func GetStatisticsBySelector(ctx context.Context, selector Selector) ([]Statistics, error) {
+	var stats []Statistics
+	err := selector.Apply(db.NewSelect().Model(&stats).Relation("Replica"), "replica.labels").Scan(ctx)
+	if err != nil {
+		log.Printf("Error fetching statistics: %v", err)
+		return nil, err
+	}
+	return stats, nil
+}
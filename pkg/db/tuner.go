@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// how the auto-tuner adjusts the global Prequal parameters. It only touches parameters that
+// have bounds, and keeps them within those bounds.
+type TunerSettings struct {
+	bun.BaseModel `bun:"table:tuner_settings"`
+
+	Id      int64  `json:"-" bun:"id,pk"`
+	Enabled bool   `json:"enabled" bun:"enabled,notnull"`
+	Mode    string `json:"mode" bun:"mode,notnull"`
+	// error ratios are measured over WindowSeconds, a decision is followed by CooldownSeconds
+	// without another one
+	WindowSeconds   int                        `json:"window_seconds" bun:"window_seconds,notnull"`
+	CooldownSeconds int                        `json:"cooldown_seconds" bun:"cooldown_seconds,notnull"`
+	MinRequests     int64                      `json:"min_requests" bun:"min_requests,notnull"`
+	HighErrorRatio  float64                    `json:"high_error_ratio" bun:"high_error_ratio,notnull"`
+	LowErrorRatio   float64                    `json:"low_error_ratio" bun:"low_error_ratio,notnull"`
+	ProbeFactorStep float64                    `json:"probe_factor_step" bun:"probe_factor_step,notnull"`
+	Bounds          map[string]ParameterBounds `json:"bounds" bun:"bounds,type:jsonb,notnull"`
+	UpdatedBy       string                     `json:"updated_by" bun:"updated_by,notnull"`
+	CreatedAt       time.Time                  `json:"created_at" bun:"created_at,default:current_timestamp"`
+	UpdatedAt       time.Time                  `json:"updated_at" bun:"updated_at,default:current_timestamp"`
+}
+
+// inclusive range the auto-tuner may move a parameter in
+type ParameterBounds struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// request counters of every replica at one point in time, statistics themselves only keep
+// the latest counters
+type StatisticsSample struct {
+	bun.BaseModel `bun:"table:statistics_samples"`
+
+	Id        int64                    `json:"id" bun:"id,pk,autoincrement"`
+	SampledAt time.Time                `json:"sampled_at" bun:"sampled_at,notnull"`
+	Counts    map[string]RequestCounts `json:"counts" bun:"counts,type:jsonb,notnull"`
+}
+
+// one change the auto-tuner made or proposed, with the metrics and the rule behind it
+type TunerDecision struct {
+	bun.BaseModel `bun:"table:tuner_decisions"`
+
+	Id                 int64                    `json:"id" bun:"id,pk,autoincrement"`
+	Rule               string                   `json:"rule" bun:"rule,notnull"`
+	Status             string                   `json:"status" bun:"status,notnull"`
+	Metrics            TunerMetrics             `json:"metrics" bun:"metrics,type:jsonb,notnull"`
+	CurrentParameters  AddPrequalParametersType `json:"current_parameters" bun:"current_parameters,type:jsonb,notnull"`
+	ProposedParameters AddPrequalParametersType `json:"proposed_parameters" bun:"proposed_parameters,type:jsonb,notnull"`
+	Changes            []TunerChange            `json:"changes" bun:"changes,type:jsonb,notnull"`
+	Explanation        string                   `json:"explanation" bun:"explanation,notnull"`
+	// the draft a proposal waits in, or the parameter set an applied decision stored
+	DraftId      *int64    `json:"draft_id,omitempty" bun:"draft_id"`
+	ParametersId *int64    `json:"parameters_id,omitempty" bun:"parameters_id"`
+	CreatedAt    time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
+}
+
+// requests served by the replicas the global parameters apply to, over the window ending
+// at To and the window before it when samples go back that far
+type TunerMetrics struct {
+	From                   time.Time `json:"from"`
+	To                     time.Time `json:"to"`
+	Replicas               int       `json:"replicas"`
+	Requests               int64     `json:"requests"`
+	FailedRequests         int64     `json:"failed_requests"`
+	ErrorRatio             float64   `json:"error_ratio"`
+	PreviousRequests       *int64    `json:"previous_requests,omitempty"`
+	PreviousFailedRequests *int64    `json:"previous_failed_requests,omitempty"`
+	PreviousErrorRatio     *float64  `json:"previous_error_ratio,omitempty"`
+}
+
+type TunerChange struct {
+	Field string  `json:"field"`
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// what the auto-tuner does with its decisions
+const (
+	TUNER_PROPOSE = "propose"
+	TUNER_APPLY   = "apply"
+)
+
+var TunerModes = []string{TUNER_PROPOSE, TUNER_APPLY}
+
+// outcomes of a decision
+const (
+	TUNER_PROPOSED = "proposed"
+	TUNER_APPLIED  = "applied"
+	TUNER_FAILED   = "failed"
+)
+
+// author of the drafts the auto-tuner proposes
+const TUNER_ACTOR = "tuner"
+
+// the only settings row
+const tunerSettingsId = 1
+
+func (s *TunerSettings) Window() time.Duration {
+	return time.Duration(s.WindowSeconds) * time.Second
+}
+
+func (s *TunerSettings) Cooldown() time.Duration {
+	return time.Duration(s.CooldownSeconds) * time.Second
+}
+
+func GetTunerSettings(ctx context.Context) (*TunerSettings, error) {
+	var settings TunerSettings
+	if err := db.NewSelect().Model(&settings).Where("id = ?", tunerSettingsId).Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching tuner settings: %v", err)
+	}
+	if settings.Bounds == nil {
+		settings.Bounds = map[string]ParameterBounds{}
+	}
+	return &settings, nil
+}
+
+func UpdateTunerSettings(ctx context.Context, settings *TunerSettings) error {
+	settings.Id = tunerSettingsId
+	settings.UpdatedAt = time.Now()
+	_, err := db.NewUpdate().
+		Model(settings).
+		Column("enabled", "mode", "window_seconds", "cooldown_seconds", "min_requests", "high_error_ratio",
+			"low_error_ratio", "probe_factor_step", "bounds", "updated_by", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error updating tuner settings: %v", err)
+	}
+
+	state := "disabled"
+	if settings.Enabled {
+		state = "enabled in " + settings.Mode + " mode"
+	}
+	if err := LogActivity(ctx, "success", fmt.Sprintf("Auto-tuner settings updated by %s, %s", settings.UpdatedBy, state), nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// DisableTuner turns the auto-tuner off without touching its other settings, it makes no
+// decision from its next check on
+func DisableTuner(ctx context.Context, actor string) error {
+	_, err := db.NewUpdate().
+		Model((*TunerSettings)(nil)).
+		Set("enabled = ?", false).
+		Set("updated_by = ?", actor).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", tunerSettingsId).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("error disabling tuner: %v", err)
+	}
+
+	if err := LogActivity(ctx, "warning", "Auto-tuner disabled by "+actor, nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+func AddStatisticsSample(ctx context.Context, sample *StatisticsSample) error {
+	if _, err := db.NewInsert().Model(sample).Exec(ctx); err != nil {
+		return fmt.Errorf("error adding statistics sample: %v", err)
+	}
+	return nil
+}
+
+// the latest sample taken at or before t
+func GetStatisticsSampleAt(ctx context.Context, t time.Time) (*StatisticsSample, error) {
+	var sample StatisticsSample
+	err := db.NewSelect().
+		Model(&sample).
+		Where("sampled_at <= ?", t).
+		Order("sampled_at DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sample, nil
+}
+
+// removes the samples taken before t, returns how many
+func DeleteStatisticsSamplesBefore(ctx context.Context, t time.Time) (int64, error) {
+	result, err := db.NewDelete().Model((*StatisticsSample)(nil)).Where("sampled_at < ?", t).Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting statistics samples: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func CreateTunerDecision(ctx context.Context, decision *TunerDecision) error {
+	if decision.Changes == nil {
+		decision.Changes = []TunerChange{}
+	}
+	decision.CreatedAt = time.Now()
+
+	if _, err := db.NewInsert().Model(decision).Exec(ctx); err != nil {
+		return fmt.Errorf("error creating tuner decision: %v", err)
+	}
+
+	var message string
+	level := "success"
+	switch decision.Status {
+	case TUNER_APPLIED:
+		message = fmt.Sprintf("Auto-tuner applied decision #%d (%s): %s", decision.Id, decision.Rule, decision.Explanation)
+	case TUNER_PROPOSED:
+		message = fmt.Sprintf("Auto-tuner proposed decision #%d (%s) as parameter draft #%d: %s", decision.Id, decision.Rule, *decision.DraftId, decision.Explanation)
+	default:
+		level = "warning"
+		message = fmt.Sprintf("Auto-tuner decision #%d (%s) failed: %s", decision.Id, decision.Rule, decision.Explanation)
+	}
+	if err := LogActivity(ctx, level, message, nil); err != nil {
+		return fmt.Errorf("error logging activity: %v", err)
+	}
+	return nil
+}
+
+// decisions newest first, at most limit unless it is 0
+func GetTunerDecisions(ctx context.Context, limit int) ([]TunerDecision, error) {
+	var decisions []TunerDecision
+	query := db.NewSelect().Model(&decisions).Order("created_at DESC", "id DESC")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching tuner decisions: %v", err)
+	}
+	return decisions, nil
+}
+
+func GetTunerDecisionById(ctx context.Context, id int64) (*TunerDecision, error) {
+	var decision TunerDecision
+	if err := db.NewSelect().Model(&decision).Where("id = ?", id).Scan(ctx); err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
+
+func GetLatestTunerDecision(ctx context.Context) (*TunerDecision, error) {
+	var decision TunerDecision
+	if err := db.NewSelect().Model(&decision).Order("created_at DESC", "id DESC").Limit(1).Scan(ctx); err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
@@ -20,18 +20,36 @@ type User struct {
 	Username             string    `json:"username" bun:"username,unique,notnull"`
 	Email                string    `json:"email" bun:"email,unique,notnull"`
 	Password             string    `json:"password" bun:"password,notnull"`
+	Role                 string    `json:"role" bun:"role,notnull"`
 	CreatedAt            time.Time `json:"created_at" bun:"created_at,default:current_timestamp"`
 	UpdatedAt            time.Time `json:"updated_at" bun:"updated_at,default:current_timestamp"`
 	Password_Reset_Token string    `json:"-" bun:"password_reset_token"`
 	Token_expires_at     time.Time `json:"-" bun:"token_expires_at"`
 }
 
+// roles of a user, approvers review the changes of others
+const (
+	ROLE_OPERATOR = "operator"
+	ROLE_APPROVER = "approver"
+	ROLE_ADMIN    = "admin"
+)
+
+var UserRoles = []string{ROLE_OPERATOR, ROLE_APPROVER, ROLE_ADMIN}
+
+// reports whether the user may approve changes made by others
+func (u *User) CanApprove() bool {
+	return u.Role == ROLE_APPROVER || u.Role == ROLE_ADMIN
+}
+
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
 func InsertUser(user User) error {
+	if user.Role == "" {
+		user.Role = ROLE_OPERATOR
+	}
 	_, err := db.NewInsert().Model(&user).Exec(ctx)
 	if err != nil {
 		log.Printf("Error inserting user: %v", err)
@@ -40,6 +58,12 @@ func InsertUser(user User) error {
 	return nil
 }
 
+// HasAdmin reports whether any user is an admin yet. Until one is, the next user to register
+// becomes admin, someone has to be able to hand out roles.
+func HasAdmin() (bool, error) {
+	return db.NewSelect().Model((*User)(nil)).Where("role = ?", ROLE_ADMIN).Exists(ctx)
+}
+
 func GetUsersinfo() ([]User, error) {
 	var users []User
 	err := db.NewSelect().Model(&users).Order("id ASC").Scan(ctx)
@@ -147,3 +171,16 @@ func SetPasswordResetOtp(email string) (string, error) {
 	}
 	return otp, nil
 }
+
+func UpdateUserRole(id int64, role string) error {
+	_, err := db.NewUpdate().
+		Model(&User{}).
+		Set("role = ?", role).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", id).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to update user role: %w", err)
+	}
+	return nil
+}
@@ -2,13 +2,37 @@ package handlers
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
 	"github.com/AshimKoirala/load-balancer-admin/utils"
 )
 
+// lists activity logs, newest first. ?after_id only returns logs newer than the given one
+// and ?limit caps how many are returned, which together allow following the log.
 func GetActivityLogs(w http.ResponseWriter, r *http.Request) {
-	logs, err := db.FetchActivityLogs(r.Context()) // Fetch logs from the database
+	query := r.URL.Query()
+
+	var logs []db.ActivityLog
+	var err error
+	if query.Has("after_id") || query.Has("limit") {
+		afterId, limit := int64(0), 0
+		if raw := query.Get("after_id"); raw != "" {
+			if afterId, err = strconv.ParseInt(raw, 10, 64); err != nil || afterId < 0 {
+				utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid after_id"})
+				return
+			}
+		}
+		if raw := query.Get("limit"); raw != "" {
+			if limit, err = strconv.Atoi(raw); err != nil || limit < 0 {
+				utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid limit"})
+				return
+			}
+		}
+		logs, err = db.FetchActivityLogsAfter(r.Context(), afterId, limit)
+	} else {
+		logs, err = db.FetchActivityLogs(r.Context()) // Fetch logs from the database
+	}
 	if err != nil {
 		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch activity logs"})
 		return
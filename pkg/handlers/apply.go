@@ -0,0 +1,564 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// the whole load balancer configuration as kept in version control
+type desiredState struct {
+	Parameters *db.AddPrequalParametersType `json:"parameters" yaml:"parameters"`
+	Pools      []desiredPool                `json:"pools" yaml:"pools"`
+	Replicas   []desiredReplica             `json:"replicas" yaml:"replicas"`
+}
+
+type desiredPool struct {
+	Name                string                       `json:"name" yaml:"name"`
+	Description         string                       `json:"description" yaml:"description"`
+	HealthCheckEndpoint string                       `json:"health_check_endpoint" yaml:"health_check_endpoint"`
+	HealthCheckInterval int                          `json:"health_check_interval_seconds" yaml:"health_check_interval_seconds"`
+	Parameters          *db.AddPrequalParametersType `json:"parameters" yaml:"parameters"`
+}
+
+// a replica record, with the status it should be in active unless disabled
+type desiredReplica struct {
+	replicaRecord `yaml:",inline"`
+}
+
+// kinds of things a plan changes
+const (
+	PLAN_REPLICA    = "replica"
+	PLAN_POOL       = "pool"
+	PLAN_PARAMETERS = "parameters"
+)
+
+// what a plan does to them
+const (
+	PLAN_CREATE  = "create"
+	PLAN_UPDATE  = "update"
+	PLAN_ENABLE  = "enable"
+	PLAN_DISABLE = "disable"
+	PLAN_PRUNE   = "prune"
+)
+
+// progress of a planned change
+const (
+	PLAN_PENDING = "pending"
+	PLAN_APPLIED = "applied"
+	PLAN_FAILED  = "failed"
+	PLAN_SKIPPED = "skipped"
+)
+
+type fieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type planChange struct {
+	Kind    string        `json:"kind"`
+	Action  string        `json:"action"`
+	Name    string        `json:"name"`
+	Changes []fieldChange `json:"changes,omitempty"`
+	Status  string        `json:"status"`
+	Error   string        `json:"error,omitempty"`
+
+	execute func(ctx context.Context) error
+}
+
+type applyResult struct {
+	DryRun  bool         `json:"dry_run"`
+	Prune   bool         `json:"prune"`
+	Plan    []planChange `json:"plan"`
+	Applied int          `json:"applied"`
+	Failed  int          `json:"failed"`
+}
+
+func addFieldChange[T comparable](changes []fieldChange, field string, from, to T) []fieldChange {
+	if from == to {
+		return changes
+	}
+	return append(changes, fieldChange{Field: field, From: from, To: to})
+}
+
+// parameter fields that differ between the active parameters and the desired ones
+func parameterChanges(current *db.PrequalParametersResponse, desired db.AddPrequalParametersType) []fieldChange {
+	if current == nil {
+		current = &db.PrequalParametersResponse{}
+	}
+	var changes []fieldChange
+	changes = addFieldChange(changes, "max_life_time", current.MaxLifeTime, desired.MaxLifeTime)
+	changes = addFieldChange(changes, "pool_size", current.PoolSize, desired.PoolSize)
+	changes = addFieldChange(changes, "probe_factor", current.ProbeFactor, desired.ProbeFactor)
+	changes = addFieldChange(changes, "probe_remove_factor", current.ProbeRemoveFactor, desired.ProbeRemoveFactor)
+	changes = addFieldChange(changes, "mu", current.Mu, desired.Mu)
+	return changes
+}
+
+// stores new parameters for the pool (or globally without one) and sends them to the proxy
+func applyParameters(ctx context.Context, poolName string, parameters db.AddPrequalParametersType) (*db.PrequalParametersResponse, error) {
+	if poolName != "" {
+		pool, err := db.GetPoolByName(ctx, poolName)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching pool: %v", err)
+		}
+		parameters.PoolId = &pool.Id
+	}
+
+	saved, err := db.AddPrequalParametersResponse(ctx, parameters)
+	if err != nil {
+		return nil, err
+	}
+	// inactive parameters are only stored
+	if saved.Status != db.PARAMETERS_ACTIVE {
+		return saved, nil
+	}
+
+	message := &messaging.Message{
+		Name: messaging.NEW_PARAMETERS,
+		Body: messaging.ParametersBody{
+			Pool:       poolName,
+			Parameters: *saved,
+		},
+	}
+	if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
+		log.Printf("Failed to publish change parameters message: %v", err)
+	}
+	return saved, nil
+}
+
+// buildPlan compares the desired state with the tables and returns the changes needed to
+// reach it, in the order they have to be executed. Validation errors stop planning.
+func buildPlan(ctx context.Context, desired desiredState, prune bool) ([]planChange, []string, error) {
+	var plan []planChange
+	var validationErrors []string
+
+	// pools first, replicas and pool parameters refer to them by name
+	poolNames := map[string]bool{}
+	poolHealthChecks := map[string]string{}
+	for i, desiredPool := range desired.Pools {
+		if poolNames[desiredPool.Name] {
+			validationErrors = append(validationErrors, fmt.Sprintf("pools[%d]: duplicate pool '%s'", i, desiredPool.Name))
+			continue
+		}
+		poolNames[desiredPool.Name] = true
+		poolHealthChecks[desiredPool.Name] = desiredPool.HealthCheckEndpoint
+
+		current, err := db.GetPoolByName(ctx, desiredPool.Name)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+
+		pool := db.Pool{}
+		if current != nil {
+			pool = *current
+		}
+		payload := poolPayload{
+			Name:                &desiredPool.Name,
+			Description:         &desiredPool.Description,
+			HealthCheckEndpoint: &desiredPool.HealthCheckEndpoint,
+			HealthCheckInterval: &desiredPool.HealthCheckInterval,
+		}
+		if errs := payload.apply(&pool); len(errs) > 0 {
+			for _, e := range errs {
+				validationErrors = append(validationErrors, fmt.Sprintf("pools[%d]: %s", i, e))
+			}
+			continue
+		}
+
+		if current == nil {
+			plan = append(plan, planChange{Kind: PLAN_POOL, Action: PLAN_CREATE, Name: pool.Name, execute: func(ctx context.Context) error {
+				if err := db.CreatePool(ctx, &pool); err != nil {
+					return err
+				}
+				publishPool(&pool)
+				return nil
+			}})
+		} else {
+			var changes []fieldChange
+			changes = addFieldChange(changes, "description", current.Description, pool.Description)
+			changes = addFieldChange(changes, "health_check_endpoint", current.HealthCheckEndpoint, pool.HealthCheckEndpoint)
+			changes = addFieldChange(changes, "health_check_interval_seconds", current.HealthCheckInterval, pool.HealthCheckInterval)
+			if len(changes) > 0 {
+				plan = append(plan, planChange{Kind: PLAN_POOL, Action: PLAN_UPDATE, Name: pool.Name, Changes: changes, execute: func(ctx context.Context) error {
+					if err := db.UpdatePool(ctx, &pool); err != nil {
+						return err
+					}
+					publishPool(&pool)
+					return nil
+				}})
+			}
+		}
+	}
+
+	// global parameters, then the parameters of each pool
+	if desired.Parameters != nil {
+		parameters := *desired.Parameters
+		if errs := validatePrequalParameters(parameters); len(errs) > 0 {
+			for _, err := range errs {
+				validationErrors = append(validationErrors, "parameters: "+err)
+			}
+		} else {
+			var current *db.PrequalParametersResponse
+			if active, err := db.GetPrequalParametersResponse(ctx); err == nil {
+				current = &active
+			}
+			if changes := parameterChanges(current, parameters); len(changes) > 0 && db.ParameterApprovalRequired() {
+				validationErrors = append(validationErrors, "parameters: changes need approval, create a draft")
+			} else if len(changes) > 0 {
+				plan = append(plan, planChange{Kind: PLAN_PARAMETERS, Action: PLAN_UPDATE, Name: "global", Changes: changes, execute: func(ctx context.Context) error {
+					_, err := applyParameters(ctx, "", parameters)
+					return err
+				}})
+			}
+		}
+	}
+	for i, desiredPool := range desired.Pools {
+		if desiredPool.Parameters == nil {
+			continue
+		}
+		poolName := desiredPool.Name
+		parameters := *desiredPool.Parameters
+		if errs := validatePrequalParameters(parameters); len(errs) > 0 {
+			for _, err := range errs {
+				validationErrors = append(validationErrors, fmt.Sprintf("pools[%d].parameters: %s", i, err))
+			}
+			continue
+		}
+
+		// a pool without parameters of its own falls back to the global ones
+		var current *db.PrequalParametersResponse
+		if pool, err := db.GetPoolByName(ctx, poolName); err == nil {
+			if active, err := db.GetPoolPrequalParameters(ctx, pool.Id); err == nil && active.PoolId != nil {
+				current = &active
+			}
+		}
+		if changes := parameterChanges(current, parameters); len(changes) > 0 && db.ParameterApprovalRequired() {
+			validationErrors = append(validationErrors, fmt.Sprintf("pools[%d].parameters: changes need approval, create a draft", i))
+		} else if len(changes) > 0 {
+			plan = append(plan, planChange{Kind: PLAN_PARAMETERS, Action: PLAN_UPDATE, Name: poolName, Changes: changes, execute: func(ctx context.Context) error {
+				_, err := applyParameters(ctx, poolName, parameters)
+				return err
+			}})
+		}
+	}
+
+	existing, err := db.GetReplicas(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	byName := map[string]*db.Replica{}
+	byUrl := map[string]*db.Replica{}
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+		byUrl[existing[i].URL] = &existing[i]
+	}
+	pools, err := db.GetPools(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	poolsByName := map[string]*db.Pool{}
+	poolIds := map[int64]string{}
+	for i := range pools {
+		poolsByName[pools[i].Name] = &pools[i]
+		poolIds[pools[i].Id] = pools[i].Name
+	}
+
+	var disables []planChange
+	listed := map[string]bool{}
+	listedUrls := map[string]bool{}
+	for i, desiredReplica := range desired.Replicas {
+		record := desiredReplica.replicaRecord
+		prefix := fmt.Sprintf("replicas[%d]", i)
+
+		if listed[record.Name] {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s: duplicate replica '%s'", prefix, record.Name))
+			continue
+		}
+		if listedUrls[record.URL] {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s: duplicate url '%s'", prefix, record.URL))
+			continue
+		}
+		listed[record.Name] = true
+		listedUrls[record.URL] = true
+
+		status := desiredReplica.Status
+		if status == "" {
+			status = db.ACTIVE
+		}
+		if status != db.ACTIVE && status != db.DISABLED {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s: status must be 'active' or 'disabled'", prefix))
+			continue
+		}
+
+		if record.Pool != "" {
+			pool := poolsByName[record.Pool]
+			if pool == nil && !poolNames[record.Pool] {
+				validationErrors = append(validationErrors, fmt.Sprintf("%s: pool '%s' not found", prefix, record.Pool))
+				continue
+			}
+			if record.HealthCheckEndpoint == "" {
+				if pool != nil {
+					record.HealthCheckEndpoint = pool.HealthCheckEndpoint
+				} else {
+					record.HealthCheckEndpoint = poolHealthChecks[record.Pool]
+				}
+			}
+		}
+
+		capacity := db.ReplicaCapacity{
+			Weight:        record.Weight,
+			MaxConcurrent: record.MaxConcurrentRequests,
+			CapacityClass: record.CapacityClass,
+		}.WithDefaults()
+		if record.Labels == nil {
+			record.Labels = map[string]string{}
+		}
+
+		parsedUrl, errs := validateReplica(record.Name, record.URL, record.HealthCheckEndpoint)
+		errs = append(errs, validateCapacity(capacity)...)
+		errs = append(errs, db.ValidateLabels(record.Labels)...)
+		if owner := byUrl[record.URL]; owner != nil && owner.Name != record.Name {
+			errs = append(errs, fmt.Sprintf("url is already used by replica '%s'", owner.Name))
+		}
+		if len(errs) > 0 {
+			for _, e := range errs {
+				validationErrors = append(validationErrors, fmt.Sprintf("%s: %s", prefix, e))
+			}
+			continue
+		}
+
+		current := byName[record.Name]
+		if current == nil {
+			// new replicas have to pass the healthcheck like any other added replica
+			if status == db.ACTIVE {
+				if probe := probeReplica(parsedUrl, record.HealthCheckEndpoint); probe.Err != nil {
+					validationErrors = append(validationErrors, fmt.Sprintf("%s: replica did not pass the healthcheck", prefix))
+					continue
+				}
+			}
+			spec := db.NewReplica{
+				Name:                record.Name,
+				URL:                 record.URL,
+				HealthCheckEndpoint: record.HealthCheckEndpoint,
+				Capacity:            capacity,
+				Labels:              record.Labels,
+			}
+			poolName := record.Pool
+			plan = append(plan, planChange{Kind: PLAN_REPLICA, Action: PLAN_CREATE, Name: record.Name, execute: func(ctx context.Context) error {
+				if poolName != "" {
+					pool, err := db.GetPoolByName(ctx, poolName)
+					if err != nil {
+						return fmt.Errorf("error fetching pool: %v", err)
+					}
+					spec.PoolId = &pool.Id
+				}
+				if _, err := db.AddReplica(ctx, spec); err != nil {
+					return err
+				}
+				if status == db.DISABLED {
+					replica, err := db.GetReplicaByName(ctx, spec.Name)
+					if err != nil {
+						return err
+					}
+					return changeReplicaStatus(ctx, replica, db.DISABLED, drainOptions{})
+				}
+				return nil
+			}})
+			continue
+		}
+
+		var changes []fieldChange
+		changes = addFieldChange(changes, "url", current.URL, record.URL)
+		changes = addFieldChange(changes, "health_check_endpoint", current.HealthCheckEndpoint, record.HealthCheckEndpoint)
+		changes = addFieldChange(changes, "weight", current.Weight, capacity.Weight)
+		changes = addFieldChange(changes, "max_concurrent_requests", current.MaxConcurrent, capacity.MaxConcurrent)
+		changes = addFieldChange(changes, "capacity_class", current.CapacityClass, capacity.CapacityClass)
+		if !maps.Equal(current.Labels, record.Labels) {
+			changes = append(changes, fieldChange{Field: "labels", From: current.Labels, To: record.Labels})
+		}
+		currentPool := ""
+		if current.PoolId != nil {
+			currentPool = poolIds[*current.PoolId]
+		}
+		poolChanged := currentPool != record.Pool
+		changes = addFieldChange(changes, "pool", currentPool, record.Pool)
+
+		if current.URL != record.URL && current.Status == db.DRAINING {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s: the url of a draining replica cannot change until its drain ends", prefix))
+			continue
+		}
+		if current.URL != record.URL || current.HealthCheckEndpoint != record.HealthCheckEndpoint {
+			if probe := probeReplica(parsedUrl, record.HealthCheckEndpoint); probe.Err != nil && status == db.ACTIVE {
+				validationErrors = append(validationErrors, fmt.Sprintf("%s: replica did not pass the healthcheck", prefix))
+				continue
+			}
+		}
+
+		if len(changes) > 0 {
+			id := current.Id
+			poolName := record.Pool
+			update := db.ReplicaUpdate{
+				URL:                 &record.URL,
+				HealthCheckEndpoint: &record.HealthCheckEndpoint,
+				Weight:              &capacity.Weight,
+				MaxConcurrent:       &capacity.MaxConcurrent,
+				CapacityClass:       &capacity.CapacityClass,
+				Labels:              record.Labels,
+			}
+			plan = append(plan, planChange{Kind: PLAN_REPLICA, Action: PLAN_UPDATE, Name: record.Name, Changes: changes, execute: func(ctx context.Context) error {
+				before, after, err := db.UpdateReplica(ctx, id, update)
+				if err != nil {
+					return err
+				}
+				if poolChanged {
+					var poolId *int64
+					if poolName != "" {
+						pool, err := db.GetPoolByName(ctx, poolName)
+						if err != nil {
+							return fmt.Errorf("error fetching pool: %v", err)
+						}
+						poolId = &pool.Id
+					}
+					if err := db.SetReplicaPool(ctx, id, poolId); err != nil {
+						return err
+					}
+					after.PoolId = poolId
+				}
+				return syncUpdatedReplica(ctx, before, after)
+			}})
+		}
+
+		id := current.Id
+		switch {
+		case status == db.ACTIVE && current.Status == db.DISABLED:
+			plan = append(plan, planChange{Kind: PLAN_REPLICA, Action: PLAN_ENABLE, Name: record.Name,
+				Changes: []fieldChange{{Field: "status", From: current.Status, To: db.ACTIVE}},
+				execute: func(ctx context.Context) error { return setReplicaStatus(ctx, id, db.ACTIVE) }})
+		case status == db.DISABLED && current.Status != db.DISABLED:
+			disables = append(disables, planChange{Kind: PLAN_REPLICA, Action: PLAN_DISABLE, Name: record.Name,
+				Changes: []fieldChange{{Field: "status", From: current.Status, To: db.DISABLED}},
+				execute: func(ctx context.Context) error { return setReplicaStatus(ctx, id, db.DISABLED) }})
+		}
+	}
+
+	// replicas missing from the document are only disabled when pruning
+	if prune {
+		for i := range existing {
+			replica := &existing[i]
+			if listed[replica.Name] || replica.Status == db.DISABLED {
+				continue
+			}
+			id := replica.Id
+			disables = append(disables, planChange{Kind: PLAN_REPLICA, Action: PLAN_PRUNE, Name: replica.Name,
+				Changes: []fieldChange{{Field: "status", From: replica.Status, To: db.DISABLED}},
+				execute: func(ctx context.Context) error { return setReplicaStatus(ctx, id, db.DISABLED) }})
+		}
+	}
+
+	// traffic is taken away last, once everything new is in place
+	plan = append(plan, disables...)
+	for i := range plan {
+		plan[i].Status = PLAN_PENDING
+	}
+	return plan, validationErrors, nil
+}
+
+// changes the status of a replica as an admin would, active replicas are drained before disabling
+func setReplicaStatus(ctx context.Context, id int64, status string) error {
+	replica, err := db.GetReplicaById(ctx, id)
+	if err != nil {
+		return err
+	}
+	return changeReplicaStatus(ctx, replica, status, drainOptions{})
+}
+
+// ApplyDesiredState reads a YAML (or JSON) document with the desired pools, replicas and
+// parameters, plans the changes needed to reach it and executes them. With ?dry_run=true only
+// the plan is returned, ?prune=true disables registered replicas the document does not list.
+func ApplyDesiredState(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	prune, _ := strconv.ParseBool(r.URL.Query().Get("prune"))
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Request body is too large or unreadable"})
+		return
+	}
+
+	// JSON is valid YAML, so both are read the same way
+	var desired desiredState
+	decoder := yaml.NewDecoder(bytes.NewReader(body))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&desired); err != nil && !errors.Is(err, io.EOF) {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{fmt.Sprintf("Invalid desired state: %v", err)})
+		return
+	}
+
+	plan, validationErrors, err := buildPlan(r.Context(), desired, prune)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to plan changes"})
+		return
+	}
+	if len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	result := applyResult{DryRun: dryRun, Prune: prune, Plan: plan}
+	if dryRun || len(plan) == 0 {
+		utils.NewSuccessResponse(w, result)
+		return
+	}
+
+	// later changes depend on earlier ones, so the first failure stops the apply
+	failed := false
+	for i := range result.Plan {
+		change := &result.Plan[i]
+		if failed {
+			change.Status = PLAN_SKIPPED
+			continue
+		}
+
+		err := change.execute(r.Context())
+		if err != nil && !errors.Is(err, db.ErrProxyNotify) {
+			log.Printf("Failed to apply %s %s '%s': %v", change.Action, change.Kind, change.Name, err)
+			change.Status = PLAN_FAILED
+			change.Error = err.Error()
+			result.Failed++
+			failed = true
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to publish message: %v", err)
+			change.Error = "applied but the proxy could not be notified"
+		}
+		change.Status = PLAN_APPLIED
+		result.Applied++
+	}
+
+	message := fmt.Sprintf("Desired state applied, %d of %d changes made", result.Applied, len(result.Plan))
+	logType := "success"
+	if failed {
+		logType = "error"
+	}
+	if err := db.LogActivity(r.Context(), logType, message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+
+	utils.NewSuccessResponse(w, result)
+}
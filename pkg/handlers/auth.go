@@ -3,9 +3,11 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -102,6 +104,17 @@ func AuthRegister(w http.ResponseWriter, r *http.Request) {
 	// Save user with hashed password
 	user.Password = hashedPassword
 	user.Email = strings.ToLower(user.Email)
+	// roles are only handed out by admins, the first user of a fresh install becomes one
+	user.Role = db.ROLE_OPERATOR
+	hasAdmin, err := db.HasAdmin()
+	if err != nil {
+		log.Print(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Something went wrong"})
+		return
+	}
+	if !hasAdmin {
+		user.Role = db.ROLE_ADMIN
+	}
 
 	// Insert the user into the database
 	if err := db.InsertUser(user); err != nil {
@@ -285,6 +298,72 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	utils.NewSuccessResponse(w, "User information updated successfully")
 }
 
+// the user making the request, as authenticated by the middleware
+func currentUser(r *http.Request) (*db.User, error) {
+	username, _ := r.Context().Value("username").(string)
+
+	var user db.User
+	if err := db.GetUserByUsername(username, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// hands a role to a user, only admins can
+func UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Role string `json:"role"`
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid user ID"})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+	if !slices.Contains(db.UserRoles, payload.Role) {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"role must be one of " + strings.Join(db.UserRoles, ", ")})
+		return
+	}
+
+	admin, err := currentUser(r)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Error fetching user"})
+		return
+	}
+	if admin.Role != db.ROLE_ADMIN {
+		utils.NewErrorResponse(w, http.StatusForbidden, []string{"Only admins can change roles"})
+		return
+	}
+
+	user, err := db.GetUserById(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			utils.NewErrorResponse(w, http.StatusNotFound, []string{"User not found"})
+			return
+		}
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Error fetching user"})
+		return
+	}
+
+	if err := db.UpdateUserRole(id, payload.Role); err != nil {
+		log.Print(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Error updating user"})
+		return
+	}
+
+	message := fmt.Sprintf("User %s is now %s, changed by %s", user.Username, payload.Role, admin.Username)
+	if err := db.LogActivity(r.Context(), "success", message, nil); err != nil {
+		log.Print(err)
+	}
+
+	utils.NewSuccessResponse(w, "User role updated successfully")
+}
+
 func ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	var getEmail struct {
 		Email string `json:"email"`
@@ -23,6 +23,7 @@ func Handler() {
 	mux.Handle("GET /admin/protected", middleware.AuthMiddleware(http.HandlerFunc(ProtectedRoute)))
 	mux.Handle("GET /admin/users", middleware.AuthMiddleware(http.HandlerFunc(GetUsers)))
 	mux.Handle("PATCH /admin/update/{id}", middleware.AuthMiddleware(http.HandlerFunc(UpdateUser)))
+	mux.Handle("PATCH /admin/users/{id}/role", middleware.AuthMiddleware(http.HandlerFunc(UpdateUserRole)))
 	mux.HandleFunc("/admin/forgot-password", ForgotPassword)
 	mux.HandleFunc("/admin/reset-password", ResetPassword)
 	mux.Handle("POST /admin/add-replica", middleware.AuthMiddleware(http.HandlerFunc(AddReplica)))
@@ -33,6 +34,76 @@ func Handler() {
 	mux.Handle("POST /admin/update-prequal-parameters", middleware.AuthMiddleware(http.HandlerFunc(AddPrequalParameters)))
 	mux.Handle("GET /admin/get-prequal-parameters", middleware.AuthMiddleware(http.HandlerFunc(GetPrequalParameters)))
 	mux.Handle("GET /admin/get-statistics", middleware.AuthMiddleware(http.HandlerFunc(GetStatistics)))
+	mux.Handle("POST /admin/pools", middleware.AuthMiddleware(http.HandlerFunc(CreatePool)))
+	mux.Handle("GET /admin/pools", middleware.AuthMiddleware(http.HandlerFunc(GetPools)))
+	mux.Handle("GET /admin/pools/{id}", middleware.AuthMiddleware(http.HandlerFunc(GetPool)))
+	mux.Handle("PATCH /admin/pools/{id}", middleware.AuthMiddleware(http.HandlerFunc(UpdatePool)))
+	mux.Handle("DELETE /admin/pools/{id}", middleware.AuthMiddleware(http.HandlerFunc(DeletePool)))
+	mux.Handle("POST /admin/pools/{id}/members", middleware.AuthMiddleware(http.HandlerFunc(AddPoolMembers)))
+	mux.Handle("DELETE /admin/pools/{id}/members/{replica_id}", middleware.AuthMiddleware(http.HandlerFunc(RemovePoolMember)))
+	mux.Handle("GET /admin/pools/{id}/replicas", middleware.AuthMiddleware(http.HandlerFunc(GetPoolReplicas)))
+	mux.Handle("POST /admin/pools/{id}/replicas", middleware.AuthMiddleware(http.HandlerFunc(AddPoolReplica)))
+	mux.Handle("GET /admin/pools/{id}/statistics", middleware.AuthMiddleware(http.HandlerFunc(GetPoolStatistics)))
+	mux.Handle("GET /admin/pools/{id}/prequal-parameters", middleware.AuthMiddleware(http.HandlerFunc(GetPoolPrequalParameters)))
+	mux.Handle("POST /admin/pools/{id}/prequal-parameters", middleware.AuthMiddleware(http.HandlerFunc(AddPoolPrequalParameters)))
+	mux.Handle("GET /admin/pools/{id}/prequal-parameters/history", middleware.AuthMiddleware(http.HandlerFunc(GetPoolPrequalParametersHistory)))
+	mux.Handle("GET /admin/prequal-parameters/history", middleware.AuthMiddleware(http.HandlerFunc(GetPrequalParametersHistory)))
+	mux.Handle("GET /admin/prequal-parameters/schema", middleware.AuthMiddleware(http.HandlerFunc(GetPrequalParameterSchema)))
+	mux.Handle("POST /admin/prequal-parameters/simulate", middleware.AuthMiddleware(http.HandlerFunc(SimulatePrequalParameters)))
+	mux.Handle("POST /admin/prequal-parameters/drafts", middleware.AuthMiddleware(http.HandlerFunc(CreateParameterDraft)))
+	mux.Handle("GET /admin/prequal-parameters/drafts", middleware.AuthMiddleware(http.HandlerFunc(GetParameterDrafts)))
+	mux.Handle("GET /admin/prequal-parameters/drafts/{id}", middleware.AuthMiddleware(http.HandlerFunc(GetParameterDraft)))
+	mux.Handle("POST /admin/prequal-parameters/drafts/{id}/approve", middleware.AuthMiddleware(http.HandlerFunc(ApproveParameterDraft)))
+	mux.Handle("POST /admin/prequal-parameters/drafts/{id}/reject", middleware.AuthMiddleware(http.HandlerFunc(RejectParameterDraft)))
+	mux.Handle("POST /admin/prequal-parameters/drafts/{id}/withdraw", middleware.AuthMiddleware(http.HandlerFunc(WithdrawParameterDraft)))
+	mux.Handle("POST /admin/prequal-parameters/drafts/{id}/apply", middleware.AuthMiddleware(http.HandlerFunc(ApplyParameterDraft)))
+	mux.Handle("POST /admin/prequal-parameters/rollouts", middleware.AuthMiddleware(http.HandlerFunc(CreateParameterRollout)))
+	mux.Handle("GET /admin/prequal-parameters/rollouts", middleware.AuthMiddleware(http.HandlerFunc(GetParameterRollouts)))
+	mux.Handle("GET /admin/prequal-parameters/rollouts/{id}", middleware.AuthMiddleware(http.HandlerFunc(GetParameterRollout)))
+	mux.Handle("POST /admin/prequal-parameters/rollouts/{id}/promote", middleware.AuthMiddleware(http.HandlerFunc(PromoteParameterRollout)))
+	mux.Handle("POST /admin/prequal-parameters/rollouts/{id}/rollback", middleware.AuthMiddleware(http.HandlerFunc(RollbackParameterRollout)))
+	mux.Handle("GET /admin/tuner", middleware.AuthMiddleware(http.HandlerFunc(GetTunerSettings)))
+	mux.Handle("PATCH /admin/tuner", middleware.AuthMiddleware(http.HandlerFunc(UpdateTunerSettings)))
+	mux.Handle("POST /admin/tuner/disable", middleware.AuthMiddleware(http.HandlerFunc(DisableTuner)))
+	mux.Handle("GET /admin/tuner/decisions", middleware.AuthMiddleware(http.HandlerFunc(GetTunerDecisions)))
+	mux.Handle("GET /admin/tuner/decisions/{id}", middleware.AuthMiddleware(http.HandlerFunc(GetTunerDecision)))
+	mux.Handle("PATCH /admin/replicas/{id}", middleware.AuthMiddleware(http.HandlerFunc(UpdateReplica)))
+	mux.Handle("GET /admin/statistics/aggregate", middleware.AuthMiddleware(http.HandlerFunc(GetStatisticsAggregate)))
+	mux.Handle("GET /admin/replicas/transitions", middleware.AuthMiddleware(http.HandlerFunc(GetReplicaTransitions)))
+	mux.Handle("PATCH /admin/replicas/status", middleware.AuthMiddleware(http.HandlerFunc(BulkChangeStatus)))
+	mux.Handle("POST /admin/replicas/import", middleware.AuthMiddleware(http.HandlerFunc(ImportReplicas)))
+	mux.Handle("GET /admin/replicas/export", middleware.AuthMiddleware(http.HandlerFunc(ExportReplicas)))
+	mux.Handle("POST /admin/apply", middleware.AuthMiddleware(http.HandlerFunc(ApplyDesiredState)))
+	mux.Handle("GET /admin/replicas/uptime", middleware.AuthMiddleware(http.HandlerFunc(GetReplicasUptime)))
+	mux.Handle("GET /admin/replicas/{id}/uptime", middleware.AuthMiddleware(http.HandlerFunc(GetReplicaUptime)))
+	mux.Handle("GET /admin/replicas/{id}/health-history", middleware.AuthMiddleware(http.HandlerFunc(GetReplicaHealthHistory)))
+	mux.Handle("POST /admin/maintenance-windows", middleware.AuthMiddleware(http.HandlerFunc(CreateMaintenanceWindow)))
+	mux.Handle("GET /admin/maintenance-windows", middleware.AuthMiddleware(http.HandlerFunc(GetMaintenanceWindows)))
+	mux.Handle("GET /admin/maintenance-windows/upcoming", middleware.AuthMiddleware(http.HandlerFunc(GetUpcomingMaintenance)))
+	mux.Handle("GET /admin/maintenance-windows/{id}", middleware.AuthMiddleware(http.HandlerFunc(GetMaintenanceWindow)))
+	mux.Handle("PATCH /admin/maintenance-windows/{id}", middleware.AuthMiddleware(http.HandlerFunc(UpdateMaintenanceWindow)))
+	mux.Handle("DELETE /admin/maintenance-windows/{id}", middleware.AuthMiddleware(http.HandlerFunc(DeleteMaintenanceWindow)))
+	mux.Handle("GET /admin/maintenance-windows/{id}/runs", middleware.AuthMiddleware(http.HandlerFunc(GetMaintenanceRuns)))
+	mux.Handle("GET /admin/sync/snapshot", middleware.AuthMiddleware(http.HandlerFunc(GetStateSnapshot)))
+	mux.Handle("POST /admin/sync/publish", middleware.AuthMiddleware(http.HandlerFunc(PublishStateSnapshot)))
+	mux.Handle("GET /admin/sync/reports", middleware.AuthMiddleware(http.HandlerFunc(GetStateReports)))
+	mux.Handle("GET /admin/sync/status", middleware.AuthMiddleware(http.HandlerFunc(GetSyncStatus)))
+	mux.Handle("GET /admin/proxies", middleware.AuthMiddleware(http.HandlerFunc(GetProxies)))
+	mux.Handle("GET /admin/proxies/liveness", middleware.AuthMiddleware(http.HandlerFunc(GetProxyLiveness)))
+	mux.Handle("GET /admin/proxies/{instance_id}", middleware.AuthMiddleware(http.HandlerFunc(GetProxy)))
+	mux.Handle("DELETE /admin/proxies/{instance_id}", middleware.AuthMiddleware(http.HandlerFunc(DeleteProxy)))
+	mux.Handle("GET /admin/proxies/{instance_id}/acknowledgements", middleware.AuthMiddleware(http.HandlerFunc(GetProxyAcknowledgements)))
+	mux.Handle("GET /admin/replicas/{id}/proxies", middleware.AuthMiddleware(http.HandlerFunc(GetReplicaProxies)))
+	mux.Handle("GET /admin/messages", middleware.AuthMiddleware(http.HandlerFunc(GetMessages)))
+	mux.Handle("POST /admin/messages/replay", middleware.AuthMiddleware(http.HandlerFunc(ReplayMessages)))
+	mux.Handle("GET /admin/messages/{id}", middleware.AuthMiddleware(http.HandlerFunc(GetMessage)))
+	mux.Handle("POST /admin/messages/{id}/replay", middleware.AuthMiddleware(http.HandlerFunc(ReplayMessage)))
+	mux.Handle("GET /admin/messaging/metrics", middleware.AuthMiddleware(http.HandlerFunc(GetMessagingMetrics)))
+	mux.Handle("GET /admin/messaging/schemas", middleware.AuthMiddleware(http.HandlerFunc(GetMessageSchemas)))
+	mux.Handle("GET /admin/messaging/schemas/{name}", middleware.AuthMiddleware(http.HandlerFunc(GetMessageSchema)))
+	mux.Handle("POST /admin/messaging/validate", middleware.AuthMiddleware(http.HandlerFunc(ValidateMessage)))
+	mux.Handle("GET /proxy/commands", middleware.ProxyAuthMiddleware(http.HandlerFunc(PollProxyCommands)))
+	mux.Handle("POST /proxy/messages", middleware.ProxyAuthMiddleware(http.HandlerFunc(PostProxyMessage)))
 
 	// Wrap the entire mux with CORS
 	// handlerWithCORS := middleware.CORS(mux)
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/schedule"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultUpcomingWindow = 7 * 24 * time.Hour
+
+type maintenanceWindowPayload struct {
+	Name            *string    `json:"name"`
+	Description     *string    `json:"description"`
+	ReplicaId       *int64     `json:"replica_id"`
+	Selector        *string    `json:"selector"`
+	PoolId          *int64     `json:"pool_id"`
+	StartsAt        *time.Time `json:"starts_at"`
+	DurationSeconds *int       `json:"duration_seconds"`
+	Schedule        *string    `json:"schedule"`
+	RecurrenceUntil *time.Time `json:"recurrence_until"`
+	Enabled         *bool      `json:"enabled"`
+}
+
+// overlays the payload onto the window and validates the result.
+// Giving any of replica_id, selector or pool_id replaces the target of the window.
+func (p maintenanceWindowPayload) apply(ctx context.Context, window *db.MaintenanceWindow) []string {
+	if p.Name != nil {
+		window.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.Description != nil {
+		window.Description = *p.Description
+	}
+	if p.StartsAt != nil {
+		window.StartsAt = *p.StartsAt
+	}
+	if p.DurationSeconds != nil {
+		window.DurationSeconds = *p.DurationSeconds
+	}
+	if p.Schedule != nil {
+		window.Schedule = strings.TrimSpace(*p.Schedule)
+	}
+	if p.RecurrenceUntil != nil {
+		window.RecurrenceUntil = p.RecurrenceUntil
+	}
+	if p.Enabled != nil {
+		window.Enabled = *p.Enabled
+	}
+
+	var validationErrors []string
+
+	targets := 0
+	for _, given := range []bool{p.ReplicaId != nil, p.Selector != nil, p.PoolId != nil} {
+		if given {
+			targets++
+		}
+	}
+	if targets > 1 {
+		validationErrors = append(validationErrors, "Only one of replica_id, selector or pool_id can be given")
+	} else if targets == 1 {
+		window.ReplicaId, window.PoolId, window.Selector = nil, nil, ""
+		switch {
+		case p.ReplicaId != nil:
+			window.TargetType = db.MAINTENANCE_TARGET_REPLICA
+			window.ReplicaId = p.ReplicaId
+			if _, err := db.GetReplicaById(ctx, *p.ReplicaId); err != nil {
+				validationErrors = append(validationErrors, "Replica not found")
+			}
+		case p.PoolId != nil:
+			window.TargetType = db.MAINTENANCE_TARGET_POOL
+			window.PoolId = p.PoolId
+			if _, err := db.GetPoolById(ctx, *p.PoolId); err != nil {
+				validationErrors = append(validationErrors, "Pool not found")
+			}
+		default:
+			window.TargetType = db.MAINTENANCE_TARGET_SELECTOR
+			window.Selector = strings.TrimSpace(*p.Selector)
+			if window.Selector == "" {
+				validationErrors = append(validationErrors, "Selector must not be empty")
+			} else if _, err := db.ParseSelector(window.Selector); err != nil {
+				validationErrors = append(validationErrors, err.Error())
+			}
+		}
+	}
+	if window.TargetType == "" {
+		validationErrors = append(validationErrors, "One of replica_id, selector or pool_id is required")
+	}
+
+	if window.Name == "" {
+		validationErrors = append(validationErrors, "Name is required")
+	}
+	if window.StartsAt.IsZero() {
+		validationErrors = append(validationErrors, "starts_at is required")
+	}
+	if window.DurationSeconds <= 0 {
+		validationErrors = append(validationErrors, "duration_seconds must be greater than 0")
+	}
+
+	if window.Recurring() {
+		if _, err := schedule.ParseCron(window.Schedule); err != nil {
+			validationErrors = append(validationErrors, "Invalid schedule: "+err.Error())
+		}
+		if window.RecurrenceUntil != nil && !window.RecurrenceUntil.After(window.StartsAt) {
+			validationErrors = append(validationErrors, "recurrence_until must be after starts_at")
+		}
+	} else if window.RecurrenceUntil != nil {
+		validationErrors = append(validationErrors, "recurrence_until requires a schedule")
+	}
+
+	return validationErrors
+}
+
+func maintenanceWindowFromPath(w http.ResponseWriter, r *http.Request) (*db.MaintenanceWindow, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid maintenance window ID"})
+		return nil, false
+	}
+
+	window, err := db.GetMaintenanceWindowById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Maintenance window not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch maintenance window"})
+		return nil, false
+	}
+	return window, true
+}
+
+// responds with 409 when the window overlaps another one, reports whether it did
+func rejectMaintenanceConflicts(w http.ResponseWriter, r *http.Request, window *db.MaintenanceWindow) bool {
+	if !window.Enabled {
+		return false
+	}
+
+	conflicts, err := db.FindMaintenanceConflicts(r.Context(), window)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to check for overlapping maintenance windows"})
+		return true
+	}
+	if len(conflicts) == 0 {
+		return false
+	}
+
+	messages := make([]string, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		messages = append(messages, fmt.Sprintf("Overlaps maintenance window '%s' (id %d) at %s for %d replicas",
+			conflict.WindowName, conflict.WindowId, conflict.StartsAt.Format(time.RFC3339), len(conflict.ReplicaIds)))
+	}
+	utils.NewErrorResponse(w, http.StatusConflict, messages)
+	return true
+}
+
+func CreateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var payload maintenanceWindowPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	window := &db.MaintenanceWindow{Enabled: true}
+	if validationErrors := payload.apply(r.Context(), window); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	if !window.Recurring() && !window.StartsAt.Add(window.Duration()).After(time.Now()) {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Maintenance window ends in the past"})
+		return
+	}
+
+	if rejectMaintenanceConflicts(w, r, window) {
+		return
+	}
+
+	if err := db.CreateMaintenanceWindow(r.Context(), window); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to create maintenance window"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, window)
+}
+
+func GetMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	windows, err := db.GetMaintenanceWindows(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch maintenance windows"})
+		return
+	}
+
+	if len(windows) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, windows)
+}
+
+func GetMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, ok := maintenanceWindowFromPath(w, r)
+	if !ok {
+		return
+	}
+	utils.NewSuccessResponse(w, window)
+}
+
+func UpdateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, ok := maintenanceWindowFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload maintenanceWindowPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	if validationErrors := payload.apply(r.Context(), window); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	if rejectMaintenanceConflicts(w, r, window) {
+		return
+	}
+
+	if err := db.UpdateMaintenanceWindow(r.Context(), window); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to update maintenance window"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, window)
+}
+
+func DeleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, ok := maintenanceWindowFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteMaintenanceWindow(r.Context(), window); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to delete maintenance window"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, "Maintenance window deleted successfully")
+}
+
+func GetMaintenanceRuns(w http.ResponseWriter, r *http.Request) {
+	window, ok := maintenanceWindowFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	runs, err := db.GetMaintenanceRuns(r.Context(), window.Id)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch maintenance runs"})
+		return
+	}
+
+	if len(runs) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, runs)
+}
+
+// occurrences of enabled windows within ?window (default 7d) from now
+func GetUpcomingMaintenance(w http.ResponseWriter, r *http.Request) {
+	window := defaultUpcomingWindow
+	if raw := r.URL.Query().Get("window"); raw != "" {
+		parsed, err := parseWindowDuration(raw)
+		if err != nil || parsed <= 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"invalid window, expected a duration such as 24h or 7d"})
+			return
+		}
+		window = parsed
+	}
+
+	from := time.Now()
+	occurrences, err := db.GetUpcomingMaintenance(r.Context(), from, from.Add(window))
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch upcoming maintenance"})
+		return
+	}
+
+	if len(occurrences) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, occurrences)
+}
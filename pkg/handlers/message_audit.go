@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultMessageAuditLimit = 100
+const maxMessageAuditLimit = 1000
+const maxMessageReplayBatch = 100
+
+type replayPayload struct {
+	Ids   []int64 `json:"ids"`
+	Force bool    `json:"force"`
+}
+
+type replayResult struct {
+	Id     int64            `json:"id"`
+	Replay *db.MessageAudit `json:"replay,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// reads the search filter from the query, replica takes an id, a name or a url
+func parseMessageAuditFilter(r *http.Request) (db.MessageAuditFilter, []string) {
+	query := r.URL.Query()
+	filter := db.MessageAuditFilter{
+		Direction: query.Get("direction"),
+		Name:      query.Get("name"),
+		Instance:  query.Get("instance"),
+		Outcome:   query.Get("outcome"),
+		Limit:     defaultMessageAuditLimit,
+	}
+	var validationErrors []string
+
+	if filter.Direction != "" && filter.Direction != db.MESSAGE_INBOUND && filter.Direction != db.MESSAGE_OUTBOUND {
+		validationErrors = append(validationErrors, "direction must be inbound or outbound")
+	}
+
+	if raw := strings.TrimSpace(query.Get("replica")); raw != "" {
+		filter.Replica = raw
+		var replica *db.Replica
+		if id, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			replica, _ = db.GetReplicaById(r.Context(), id)
+		} else if !strings.Contains(raw, "://") {
+			replica, _ = db.GetReplicaByName(r.Context(), raw)
+		}
+		if replica != nil {
+			filter.Replica = replica.URL
+		} else if !strings.Contains(raw, "://") {
+			validationErrors = append(validationErrors, "Replica not found")
+		}
+	}
+
+	if raw := query.Get("window"); raw != "" {
+		window, err := parseWindowDuration(raw)
+		if err != nil || window <= 0 {
+			validationErrors = append(validationErrors, "invalid window, expected a duration such as 24h or 7d")
+		} else {
+			from := time.Now().Add(-window)
+			filter.From = &from
+		}
+	}
+	for _, bound := range []struct {
+		name   string
+		target **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		raw := query.Get(bound.name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("invalid %s, expected RFC3339 timestamp", bound.name))
+			continue
+		}
+		*bound.target = &parsed
+	}
+
+	if raw := query.Get("before_id"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			validationErrors = append(validationErrors, "Invalid before_id")
+		}
+		filter.BeforeId = id
+	}
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxMessageAuditLimit {
+			validationErrors = append(validationErrors, fmt.Sprintf("limit must be between 1 and %d", maxMessageAuditLimit))
+		}
+		filter.Limit = n
+	}
+
+	return filter, validationErrors
+}
+
+// searches exchanged messages, newest first, by direction, name, instance, outcome, replica
+// and time (from/to or window). ?before_id pages through older messages.
+func GetMessages(w http.ResponseWriter, r *http.Request) {
+	filter, validationErrors := parseMessageAuditFilter(r)
+	if len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	entries, err := db.SearchMessageAudit(r.Context(), filter)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch messages"})
+		return
+	}
+
+	if len(entries) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, entries)
+}
+
+func messageFromPath(w http.ResponseWriter, r *http.Request) (*db.MessageAudit, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid message ID"})
+		return nil, false
+	}
+
+	entry, err := db.GetMessageAuditById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Message not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch message"})
+		return nil, false
+	}
+	return entry, true
+}
+
+func GetMessage(w http.ResponseWriter, r *http.Request) {
+	entry, ok := messageFromPath(w, r)
+	if !ok {
+		return
+	}
+	utils.NewSuccessResponse(w, entry)
+}
+
+func logReplay(r *http.Request, entries []*db.MessageAudit) {
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, strconv.FormatInt(entry.Id, 10))
+	}
+
+	username, _ := r.Context().Value("username").(string)
+	message := fmt.Sprintf("Messages %s replayed by %s", strings.Join(ids, ", "), username)
+	if err := db.LogActivity(r.Context(), "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+}
+
+// runs an inbound message through the handlers again or re-sends an outbound command.
+// Inbound messages that were already processed are skipped unless ?force=true.
+func ReplayMessage(w http.ResponseWriter, r *http.Request) {
+	entry, ok := messageFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	force := false
+	if raw := r.URL.Query().Get("force"); raw != "" {
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid force"})
+			return
+		}
+		force = parsed
+	}
+
+	replay, err := messaging.ReplayMessage(entry, force)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to replay message: " + err.Error()})
+		return
+	}
+	logReplay(r, []*db.MessageAudit{entry})
+
+	utils.NewSuccessResponse(w, replay)
+}
+
+// replays the given messages in the order of their ids, reporting the outcome of each
+func ReplayMessages(w http.ResponseWriter, r *http.Request) {
+	var payload replayPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+	if len(payload.Ids) == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"ids is required"})
+		return
+	}
+	if len(payload.Ids) > maxMessageReplayBatch {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{fmt.Sprintf("At most %d messages can be replayed at once", maxMessageReplayBatch)})
+		return
+	}
+
+	entries := make([]*db.MessageAudit, 0, len(payload.Ids))
+	var missing []string
+	for _, id := range payload.Ids {
+		entry, err := db.GetMessageAuditById(r.Context(), id)
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("Message %d not found", id))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(missing) > 0 {
+		utils.NewErrorResponse(w, http.StatusNotFound, missing)
+		return
+	}
+
+	// messages are replayed in the order they were exchanged
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Id < entries[j].Id })
+
+	results := make([]replayResult, 0, len(entries))
+	for _, entry := range entries {
+		result := replayResult{Id: entry.Id}
+		replay, err := messaging.ReplayMessage(entry, payload.Force)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Replay = replay
+		}
+		results = append(results, result)
+	}
+	logReplay(r, entries)
+
+	utils.NewSuccessResponse(w, results)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultCommandPollWait = 30 * time.Second
+const maxCommandPollWait = 60 * time.Second
+const defaultCommandPollLimit = 100
+const maxProxyMessageBytes = 10 << 20
+
+type commandPollResponse struct {
+	Messages []messaging.OutboxMessage `json:"messages"`
+	// seq to poll after next, acknowledging these messages
+	Next int64 `json:"next"`
+}
+
+// reports the consumer's queue depths per worker and handler latencies per message name
+func GetMessagingMetrics(w http.ResponseWriter, r *http.Request) {
+	utils.NewSuccessResponse(w, messaging.ConsumerMetrics())
+}
+
+// lists the JSON Schema of every message exchanged with the proxy
+func GetMessageSchemas(w http.ResponseWriter, r *http.Request) {
+	utils.NewSuccessResponse(w, messaging.MessageSchemas())
+}
+
+// serves the schema of one message as is, for validators to load
+func GetMessageSchema(w http.ResponseWriter, r *http.Request) {
+	schema, ok := messaging.GetMessageSchema(r.PathValue("name"))
+	if !ok {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Unknown message"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schema.Schema)
+}
+
+// checks a message against the schema of its name without handling it
+func ValidateMessage(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProxyMessageBytes))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"could not read message"})
+		return
+	}
+
+	name, violations, err := messaging.ValidateMessage(body)
+	if err != nil {
+		log.Print(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to load message schemas"})
+		return
+	}
+	if len(violations) > 0 {
+		utils.NewErrorResponse(w, http.StatusUnprocessableEntity, violations)
+		return
+	}
+	if _, ok := messaging.GetMessageSchema(name); !ok {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{fmt.Sprintf("Unknown message %q", name)})
+		return
+	}
+	utils.NewSuccessResponse(w, map[string]string{"name": name})
+}
+
+func requireHttpTransport(w http.ResponseWriter) bool {
+	if messaging.Transport() != messaging.TRANSPORT_HTTP {
+		utils.NewErrorResponse(w, http.StatusServiceUnavailable, []string{"http transport is not enabled"})
+		return false
+	}
+	return true
+}
+
+// long-polls the commands of a proxy instance, or of the shared queue without an instance.
+// The proxy passes the seq of the last command it handled as after.
+func PollProxyCommands(w http.ResponseWriter, r *http.Request) {
+	if !requireHttpTransport(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	queueName := messaging.PUBLISHING_QUEUE
+	if instance := query.Get("instance"); instance != "" {
+		queueName = messaging.ProxyQueueName(instance)
+	}
+
+	var after int64
+	if raw := query.Get("after"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed < 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"after must be a non-negative integer"})
+			return
+		}
+		after = parsed
+	}
+
+	wait := defaultCommandPollWait
+	if raw := query.Get("wait"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < 0 || parsed > maxCommandPollWait {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{fmt.Sprintf("wait must be a duration up to %s", maxCommandPollWait)})
+			return
+		}
+		wait = parsed
+	}
+
+	limit := defaultCommandPollLimit
+	if raw := query.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"limit must be a positive integer"})
+			return
+		}
+		limit = parsed
+	}
+
+	messages, err := messaging.PollCommands(r.Context(), queueName, after, wait, limit)
+	if errors.Is(err, messaging.ErrUnknownQueue) {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"unknown proxy instance, register it first"})
+		return
+	}
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{err.Error()})
+		return
+	}
+
+	next := after
+	if len(messages) > 0 {
+		next = messages[len(messages)-1].Seq
+	}
+	utils.NewSuccessResponse(w, commandPollResponse{Messages: messages, Next: next})
+}
+
+// takes a message from the proxy, the same envelope it would publish to RabbitMQ, and
+// returns its audited outcome. The id comes from the Message-Id header or the envelope.
+func PostProxyMessage(w http.ResponseWriter, r *http.Request) {
+	if !requireHttpTransport(w) {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProxyMessageBytes))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"could not read message"})
+		return
+	}
+
+	entry, err := messaging.HandleProxyMessage(body, r.Header.Get("Message-Id"))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusServiceUnavailable, []string{err.Error()})
+		return
+	}
+	utils.NewSuccessResponse(w, entry)
+}
@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+// parameters for the pool, or the global ones without a pool, and why they should change
+type parameterDraftPayload struct {
+	Pool       string          `json:"pool"`
+	Comment    string          `json:"comment"`
+	Parameters json.RawMessage `json:"parameters"`
+}
+
+type parameterDraftReview struct {
+	Comment string `json:"comment"`
+}
+
+// a draft with what it would change on the parameters in use and its review so far
+type parameterDraftDetail struct {
+	*db.ParameterDraft
+	Pool    string                   `json:"pool,omitempty"`
+	Changes []fieldChange            `json:"changes"`
+	Events  []db.ParameterDraftEvent `json:"events"`
+}
+
+var draftStatuses = []string{db.DRAFT_PENDING, db.DRAFT_APPROVED, db.DRAFT_REJECTED, db.DRAFT_WITHDRAWN, db.DRAFT_APPLIED, db.DRAFT_EXPIRED}
+
+func parameterDraftFromPath(w http.ResponseWriter, r *http.Request) (*db.ParameterDraft, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid parameter draft ID"})
+		return nil, false
+	}
+
+	draft, err := db.GetParameterDraftById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Parameter draft not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter draft"})
+		return nil, false
+	}
+	return draft, true
+}
+
+// decodes the optional comment of a review step, an empty body has none
+func decodeDraftReview(w http.ResponseWriter, r *http.Request) (parameterDraftReview, bool) {
+	var review parameterDraftReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil && !errors.Is(err, io.EOF) {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return review, false
+	}
+	review.Comment = strings.TrimSpace(review.Comment)
+	return review, true
+}
+
+// responds with 409 unless the draft is in status, still within its ttl and not in a rollout,
+// a draft found past its ttl is expired right away
+func requireDraftStatus(w http.ResponseWriter, r *http.Request, draft *db.ParameterDraft, status string) bool {
+	if !requireDraftNotInRollout(w, r, draft) {
+		return false
+	}
+	if draft.Expired(time.Now()) {
+		comment := "not applied by " + draft.ExpiresAt.Format(time.RFC3339)
+		if err := db.TransitionParameterDraft(r.Context(), draft, draft.Status, db.DRAFT_EXPIRE, db.DRAFT_SYSTEM_ACTOR, comment); err != nil && !errors.Is(err, db.ErrDraftStateChanged) {
+			log.Println(err)
+		}
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Parameter draft has expired"})
+		return false
+	}
+	if draft.Status != status {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Parameter draft is " + draft.Status + ", not " + status})
+		return false
+	}
+	return true
+}
+
+// responds with 409 while the draft waits in a scheduled or running rollout, which applies it
+// once promoted
+func requireDraftNotInRollout(w http.ResponseWriter, r *http.Request, draft *db.ParameterDraft) bool {
+	rollout, err := db.GetOpenParameterRolloutOfDraft(r.Context(), draft.Id)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter rollouts"})
+		return false
+	}
+	utils.NewErrorResponse(w, http.StatusConflict, []string{fmt.Sprintf("Parameter draft is in rollout #%d, which is still %s", rollout.Id, rollout.Status)})
+	return false
+}
+
+// moves the draft on and responds with it, 409 when someone else moved it first
+func transitionDraft(w http.ResponseWriter, r *http.Request, draft *db.ParameterDraft, from, action, actor, comment string) bool {
+	err := db.TransitionParameterDraft(r.Context(), draft, from, action, actor, comment)
+	if errors.Is(err, db.ErrDraftStateChanged) {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{err.Error()})
+		return false
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to update parameter draft"})
+		return false
+	}
+	return true
+}
+
+// saves parameters as a pending draft, they change nothing until approved and applied
+func CreateParameterDraft(w http.ResponseWriter, r *http.Request) {
+	var payload parameterDraftPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+	if len(payload.Parameters) == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"parameters: is required"})
+		return
+	}
+
+	parameters, validationErrors := parsePrequalParameters(payload.Parameters)
+	if len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+	if parameters.Status == db.PARAMETERS_INACTIVE {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"status: drafts are applied as active"})
+		return
+	}
+
+	draft := &db.ParameterDraft{
+		MaxLifeTime:       parameters.MaxLifeTime,
+		PoolSize:          parameters.PoolSize,
+		ProbeFactor:       parameters.ProbeFactor,
+		ProbeRemoveFactor: parameters.ProbeRemoveFactor,
+		Mu:                parameters.Mu,
+		Comment:           strings.TrimSpace(payload.Comment),
+		ExpiresAt:         time.Now().Add(db.ParameterDraftTTL()),
+	}
+	draft.CreatedBy, _ = r.Context().Value("username").(string)
+
+	if payload.Pool != "" {
+		pool, err := db.GetPoolByName(r.Context(), payload.Pool)
+		if err == sql.ErrNoRows {
+			utils.NewErrorResponse(w, http.StatusNotFound, []string{"Pool not found"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch pool"})
+			return
+		}
+		draft.PoolId = &pool.Id
+	}
+
+	if err := db.CreateParameterDraft(r.Context(), draft); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to create parameter draft"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, draft)
+}
+
+// lists the drafts newest first, optionally only those with ?status
+func GetParameterDrafts(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !slices.Contains(draftStatuses, status) {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"status must be one of " + strings.Join(draftStatuses, ", ")})
+		return
+	}
+
+	drafts, err := db.GetParameterDrafts(r.Context(), status)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter drafts"})
+		return
+	}
+
+	if len(drafts) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, drafts)
+}
+
+// shows a draft with the changes it makes to the parameters in use, for its reviewer
+func GetParameterDraft(w http.ResponseWriter, r *http.Request) {
+	draft, ok := parameterDraftFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	poolName, err := db.GetPoolName(r.Context(), draft.PoolId)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch pool"})
+		return
+	}
+
+	var current *db.PrequalParametersResponse
+	if draft.PoolId != nil {
+		if active, err := db.GetPoolPrequalParameters(r.Context(), *draft.PoolId); err == nil {
+			current = &active
+		}
+	} else if active, err := db.GetPrequalParametersResponse(r.Context()); err == nil {
+		current = &active
+	}
+
+	events, err := db.GetParameterDraftEvents(r.Context(), draft.Id)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter draft events"})
+		return
+	}
+
+	detail := parameterDraftDetail{
+		ParameterDraft: draft,
+		Pool:           poolName,
+		Changes:        parameterChanges(current, draft.Parameters()),
+		Events:         events,
+	}
+	if detail.Changes == nil {
+		detail.Changes = []fieldChange{}
+	}
+	utils.NewSuccessResponse(w, detail)
+}
+
+// approves a pending draft, only an approver other than its author can
+func ApproveParameterDraft(w http.ResponseWriter, r *http.Request) {
+	reviewDraft(w, r, db.DRAFT_APPROVE)
+}
+
+// rejects a pending draft with a comment saying why, only an approver other than its author can
+func RejectParameterDraft(w http.ResponseWriter, r *http.Request) {
+	reviewDraft(w, r, db.DRAFT_REJECT)
+}
+
+func reviewDraft(w http.ResponseWriter, r *http.Request, action string) {
+	draft, ok := parameterDraftFromPath(w, r)
+	if !ok {
+		return
+	}
+	review, ok := decodeDraftReview(w, r)
+	if !ok {
+		return
+	}
+	if action == db.DRAFT_REJECT && review.Comment == "" {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"comment: is required to reject a draft"})
+		return
+	}
+
+	reviewer, err := currentUser(r)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Error fetching user"})
+		return
+	}
+	if !reviewer.CanApprove() {
+		utils.NewErrorResponse(w, http.StatusForbidden, []string{"Only approvers can review parameter drafts"})
+		return
+	}
+	if strings.EqualFold(reviewer.Username, draft.CreatedBy) {
+		utils.NewErrorResponse(w, http.StatusForbidden, []string{"Parameter drafts have to be reviewed by someone other than their author"})
+		return
+	}
+
+	if !requireDraftStatus(w, r, draft, db.DRAFT_PENDING) {
+		return
+	}
+	if !transitionDraft(w, r, draft, db.DRAFT_PENDING, action, reviewer.Username, review.Comment) {
+		return
+	}
+
+	utils.NewSuccessResponse(w, draft)
+}
+
+// withdraws a draft that is no longer wanted, only its author can
+func WithdrawParameterDraft(w http.ResponseWriter, r *http.Request) {
+	draft, ok := parameterDraftFromPath(w, r)
+	if !ok {
+		return
+	}
+	review, ok := decodeDraftReview(w, r)
+	if !ok {
+		return
+	}
+
+	username, _ := r.Context().Value("username").(string)
+	if !strings.EqualFold(username, draft.CreatedBy) {
+		utils.NewErrorResponse(w, http.StatusForbidden, []string{"Only the author can withdraw a parameter draft"})
+		return
+	}
+	if !draft.Open() {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Parameter draft is " + draft.Status})
+		return
+	}
+	if !requireDraftNotInRollout(w, r, draft) {
+		return
+	}
+
+	if !transitionDraft(w, r, draft, draft.Status, db.DRAFT_WITHDRAW, username, review.Comment) {
+		return
+	}
+
+	utils.NewSuccessResponse(w, draft)
+}
+
+// applies an approved draft: stores its parameters as the active ones and sends them to
+// the proxy. Its author or any approver can.
+func ApplyParameterDraft(w http.ResponseWriter, r *http.Request) {
+	draft, ok := parameterDraftFromPath(w, r)
+	if !ok {
+		return
+	}
+	review, ok := decodeDraftReview(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := currentUser(r)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Error fetching user"})
+		return
+	}
+	if !user.CanApprove() && !strings.EqualFold(user.Username, draft.CreatedBy) {
+		utils.NewErrorResponse(w, http.StatusForbidden, []string{"Only the author or an approver can apply a parameter draft"})
+		return
+	}
+
+	if !requireDraftStatus(w, r, draft, db.DRAFT_APPROVED) {
+		return
+	}
+
+	// limits may have been tightened since the draft was approved
+	if validationErrors := validatePrequalParameters(draft.Parameters()); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusUnprocessableEntity, validationErrors)
+		return
+	}
+
+	poolName, err := db.GetPoolName(r.Context(), draft.PoolId)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch pool"})
+		return
+	}
+
+	// claimed first, so a draft is never applied twice
+	if !transitionDraft(w, r, draft, db.DRAFT_APPROVED, db.DRAFT_APPLY, user.Username, review.Comment) {
+		return
+	}
+
+	saved, err := applyParameters(r.Context(), poolName, draft.Parameters())
+	if err != nil {
+		log.Println(err)
+		if err := db.TransitionParameterDraft(r.Context(), draft, db.DRAFT_APPLIED, db.DRAFT_APPLY_FAILED, user.Username, err.Error()); err != nil {
+			log.Println(err)
+		}
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to apply parameter draft"})
+		return
+	}
+
+	if err := db.SetParameterDraftParameters(r.Context(), draft, int64(saved.Id)); err != nil {
+		log.Println(err)
+	}
+
+	utils.NewSuccessResponse(w, draft)
+}
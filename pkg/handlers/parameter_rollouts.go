@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultRolloutObserveSeconds = 600
+const defaultRolloutMinRequests = 100
+const defaultRolloutMaxErrorRateIncrease = 0.05
+
+// parameters for the pool, or the global ones without a pool, given as is or as an
+// approved draft. Without canary instances or pools they go live everywhere at starts_at.
+type parameterRolloutPayload struct {
+	Pool                 string          `json:"pool"`
+	DraftId              *int64          `json:"draft_id"`
+	Parameters           json.RawMessage `json:"parameters"`
+	StartsAt             *time.Time      `json:"starts_at"`
+	CanaryInstances      []string        `json:"canary_instances"`
+	CanaryPools          []string        `json:"canary_pools"`
+	ObserveSeconds       *int            `json:"observe_seconds"`
+	MinRequests          *int64          `json:"min_requests"`
+	MaxErrorRate         *float64        `json:"max_error_rate"`
+	MaxErrorRateIncrease *float64        `json:"max_error_rate_increase"`
+	Comment              string          `json:"comment"`
+}
+
+var rolloutStatuses = []string{db.ROLLOUT_SCHEDULED, db.ROLLOUT_CANARY, db.ROLLOUT_PROMOTED, db.ROLLOUT_ROLLED_BACK, db.ROLLOUT_CANCELLED}
+
+func parameterRolloutFromPath(w http.ResponseWriter, r *http.Request) (*db.ParameterRollout, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid parameter rollout ID"})
+		return nil, false
+	}
+
+	rollout, err := db.GetParameterRolloutById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Parameter rollout not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter rollout"})
+		return nil, false
+	}
+	return rollout, true
+}
+
+// overlays the canary settings onto the rollout and validates them
+func (p parameterRolloutPayload) applyCanary(r *http.Request, rollout *db.ParameterRollout) []string {
+	var validationErrors []string
+
+	for _, instance := range p.CanaryInstances {
+		if _, err := db.GetProxyInstance(r.Context(), instance); err != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("canary_instances: proxy '%s' not found", instance))
+			continue
+		}
+		if !slices.Contains(rollout.CanaryInstances, instance) {
+			rollout.CanaryInstances = append(rollout.CanaryInstances, instance)
+		}
+	}
+
+	if len(p.CanaryPools) > 0 && rollout.PoolId != nil {
+		validationErrors = append(validationErrors, "canary_pools: only global parameters can be rolled out to a subset of pools")
+	}
+	for _, name := range p.CanaryPools {
+		if rollout.PoolId != nil {
+			break
+		}
+		pool, err := db.GetPoolByName(r.Context(), name)
+		if err != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("canary_pools: pool '%s' not found", name))
+			continue
+		}
+		// pools with parameters of their own don't use the global ones
+		if current, err := db.GetPoolPrequalParameters(r.Context(), pool.Id); err == nil && current.PoolId != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("canary_pools: pool '%s' has parameters of its own", name))
+			continue
+		}
+		if !slices.Contains(rollout.CanaryPoolIds, pool.Id) {
+			rollout.CanaryPoolIds = append(rollout.CanaryPoolIds, pool.Id)
+		}
+	}
+
+	if !rollout.HasCanary() {
+		return validationErrors
+	}
+
+	rollout.ObserveSeconds = defaultRolloutObserveSeconds
+	if p.ObserveSeconds != nil {
+		rollout.ObserveSeconds = *p.ObserveSeconds
+	}
+	if rollout.ObserveSeconds <= 0 {
+		validationErrors = append(validationErrors, "observe_seconds: must be greater than 0")
+	}
+
+	rollout.MinRequests = defaultRolloutMinRequests
+	if p.MinRequests != nil {
+		rollout.MinRequests = *p.MinRequests
+	}
+	if rollout.MinRequests < 0 {
+		validationErrors = append(validationErrors, "min_requests: must be at least 0")
+	}
+
+	rollout.MaxErrorRate = p.MaxErrorRate
+	rollout.MaxErrorRateIncrease = p.MaxErrorRateIncrease
+	if rollout.MaxErrorRate == nil && rollout.MaxErrorRateIncrease == nil {
+		increase := defaultRolloutMaxErrorRateIncrease
+		rollout.MaxErrorRateIncrease = &increase
+	}
+	if rollout.MaxErrorRate != nil && (*rollout.MaxErrorRate < 0 || *rollout.MaxErrorRate > 1) {
+		validationErrors = append(validationErrors, "max_error_rate: must be between 0 and 1")
+	}
+	if rollout.MaxErrorRateIncrease != nil && (*rollout.MaxErrorRateIncrease < 0 || *rollout.MaxErrorRateIncrease > 1) {
+		validationErrors = append(validationErrors, "max_error_rate_increase: must be between 0 and 1")
+	}
+	return validationErrors
+}
+
+// schedules new parameters, on a canary first when canary instances or pools are given
+func CreateParameterRollout(w http.ResponseWriter, r *http.Request) {
+	var payload parameterRolloutPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	username, _ := r.Context().Value("username").(string)
+	rollout := &db.ParameterRollout{
+		CreatedBy: username,
+		Comment:   strings.TrimSpace(payload.Comment),
+		StartsAt:  time.Now(),
+	}
+	if payload.StartsAt != nil {
+		rollout.StartsAt = *payload.StartsAt
+	}
+
+	var draft *db.ParameterDraft
+	var parameters db.AddPrequalParametersType
+	switch {
+	case payload.DraftId != nil && len(payload.Parameters) > 0:
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Only one of draft_id or parameters can be given"})
+		return
+	case payload.DraftId != nil:
+		found, err := db.GetParameterDraftById(r.Context(), *payload.DraftId)
+		if err == sql.ErrNoRows {
+			utils.NewErrorResponse(w, http.StatusNotFound, []string{"Parameter draft not found"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter draft"})
+			return
+		}
+		// rolling a draft out applies it, which its author or any approver can
+		user, err := currentUser(r)
+		if err != nil {
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Error fetching user"})
+			return
+		}
+		if !user.CanApprove() && !strings.EqualFold(user.Username, found.CreatedBy) {
+			utils.NewErrorResponse(w, http.StatusForbidden, []string{"Only the author or an approver can roll out a parameter draft"})
+			return
+		}
+		if payload.Pool != "" {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"pool: comes from the draft"})
+			return
+		}
+		if !requireDraftStatus(w, r, found, db.DRAFT_APPROVED) {
+			return
+		}
+		draft = found
+		parameters = draft.Parameters()
+		rollout.DraftId = &draft.Id
+		rollout.PoolId = draft.PoolId
+	case len(payload.Parameters) > 0:
+		if !requireDirectParameterChanges(w) {
+			return
+		}
+		var validationErrors []string
+		if parameters, validationErrors = parsePrequalParameters(payload.Parameters); len(validationErrors) > 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+			return
+		}
+		if parameters.Status == db.PARAMETERS_INACTIVE {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"status: rollouts are applied as active"})
+			return
+		}
+		if payload.Pool != "" {
+			pool, err := db.GetPoolByName(r.Context(), payload.Pool)
+			if err != nil {
+				utils.NewErrorResponse(w, http.StatusNotFound, []string{"Pool not found"})
+				return
+			}
+			rollout.PoolId = &pool.Id
+		}
+	default:
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"One of draft_id or parameters is required"})
+		return
+	}
+
+	// the limits may have changed since the draft was approved
+	if validationErrors := validatePrequalParameters(parameters); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusUnprocessableEntity, validationErrors)
+		return
+	}
+	rollout.MaxLifeTime = parameters.MaxLifeTime
+	rollout.PoolSize = parameters.PoolSize
+	rollout.ProbeFactor = parameters.ProbeFactor
+	rollout.ProbeRemoveFactor = parameters.ProbeRemoveFactor
+	rollout.Mu = parameters.Mu
+
+	if validationErrors := payload.applyCanary(r, rollout); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	open, err := db.GetOpenParameterRollout(r.Context(), rollout.PoolId)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter rollouts"})
+		return
+	}
+	if err == nil {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{fmt.Sprintf("Parameter rollout #%d of these parameters is still %s", open.Id, open.Status)})
+		return
+	}
+
+	// the draft stays approved until the rollout is promoted, and can be used again when it
+	// is rolled back or cancelled
+	if draft != nil {
+		comment := "rolled out from " + rollout.StartsAt.Format(time.RFC3339)
+		if !transitionDraft(w, r, draft, db.DRAFT_APPROVED, db.DRAFT_SCHEDULE, username, comment) {
+			return
+		}
+	}
+
+	if err := db.CreateParameterRollout(r.Context(), rollout); err != nil {
+		log.Println(err)
+		if draft != nil {
+			if err := db.TransitionParameterDraft(r.Context(), draft, db.DRAFT_APPROVED, db.DRAFT_UNSCHEDULE, username, "failed to create the rollout"); err != nil {
+				log.Println(err)
+			}
+		}
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to create parameter rollout"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, rollout)
+}
+
+// lists the rollouts newest first, optionally only those with ?status
+func GetParameterRollouts(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !slices.Contains(rolloutStatuses, status) {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"status must be one of " + strings.Join(rolloutStatuses, ", ")})
+		return
+	}
+
+	rollouts, err := db.GetParameterRollouts(r.Context(), status)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameter rollouts"})
+		return
+	}
+
+	if len(rollouts) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, rollouts)
+}
+
+// shows a rollout, a running canary with its current evaluation
+func GetParameterRollout(w http.ResponseWriter, r *http.Request) {
+	rollout, ok := parameterRolloutFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if rollout.Status == db.ROLLOUT_CANARY {
+		counts, err := db.GetRequestCounts(r.Context())
+		if err != nil {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch statistics"})
+			return
+		}
+		evaluation := messaging.EvaluateCanary(rollout, counts, time.Now())
+		rollout.Evaluation = &evaluation
+	}
+
+	utils.NewSuccessResponse(w, rollout)
+}
+
+// promotes a rollout to every proxy now, without waiting for its schedule or canary
+func PromoteParameterRollout(w http.ResponseWriter, r *http.Request) {
+	finishRollout(w, r, messaging.PromoteParameterRollout)
+}
+
+// rolls a running canary back, or cancels a rollout that has not started
+func RollbackParameterRollout(w http.ResponseWriter, r *http.Request) {
+	finishRollout(w, r, messaging.RollbackParameterRollout)
+}
+
+func finishRollout(w http.ResponseWriter, r *http.Request, finish func(ctx context.Context, rollout *db.ParameterRollout, actor, reason string) error) {
+	rollout, ok := parameterRolloutFromPath(w, r)
+	if !ok {
+		return
+	}
+	review, ok := decodeDraftReview(w, r)
+	if !ok {
+		return
+	}
+	if !rollout.Open() {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Parameter rollout is " + rollout.Status})
+		return
+	}
+
+	username, _ := r.Context().Value("username").(string)
+	err := finish(r.Context(), rollout, username, review.Comment)
+	if errors.Is(err, db.ErrRolloutStateChanged) {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to update parameter rollout"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, rollout)
+}
@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+var poolNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type poolPayload struct {
+	Name                *string `json:"name"`
+	Description         *string `json:"description"`
+	HealthCheckEndpoint *string `json:"health_check_endpoint"`
+	HealthCheckInterval *int    `json:"health_check_interval_seconds"`
+}
+
+// overlays the payload onto the pool and validates the result
+func (p poolPayload) apply(pool *db.Pool) []string {
+	if p.Name != nil {
+		pool.Name = *p.Name
+	}
+	if p.Description != nil {
+		pool.Description = *p.Description
+	}
+	if p.HealthCheckEndpoint != nil {
+		pool.HealthCheckEndpoint = *p.HealthCheckEndpoint
+	}
+	if p.HealthCheckInterval != nil {
+		pool.HealthCheckInterval = *p.HealthCheckInterval
+	}
+
+	var validationErrors []string
+	if !poolNameRegex.MatchString(pool.Name) {
+		validationErrors = append(validationErrors, "Pool name must contain only alphanumeric characters, underscores (_), or hyphens (-)")
+	}
+	if pool.HealthCheckEndpoint != "" && !poolNameRegex.MatchString(pool.HealthCheckEndpoint) {
+		validationErrors = append(validationErrors, "Health Check Endpoint must contain only alphanumeric characters, underscores (_), or hyphens (-)")
+	}
+	if pool.HealthCheckInterval < 0 {
+		validationErrors = append(validationErrors, "Health check interval must be 0 or greater")
+	}
+	return validationErrors
+}
+
+func poolFromPath(w http.ResponseWriter, r *http.Request) (*db.Pool, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid pool ID"})
+		return nil, false
+	}
+
+	pool, err := db.GetPoolById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Pool not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch pool"})
+		return nil, false
+	}
+	return pool, true
+}
+
+func publishPool(pool *db.Pool) {
+	message := &messaging.Message{
+		Name: messaging.UPDATE_POOL,
+		Body: messaging.NewPoolBody(pool),
+	}
+	if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
+		log.Printf("Failed to publish message: %v", err)
+	}
+}
+
+func CreatePool(w http.ResponseWriter, r *http.Request) {
+	var payload poolPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	pool := &db.Pool{}
+	if validationErrors := payload.apply(pool); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	err := db.CreatePool(r.Context(), pool)
+	if errors.Is(err, db.ErrPoolConflict) {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Pool with the same name already exists"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to create pool"})
+		return
+	}
+
+	publishPool(pool)
+	utils.NewSuccessResponse(w, pool)
+}
+
+func GetPools(w http.ResponseWriter, r *http.Request) {
+	pools, err := db.GetPools(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch pools"})
+		return
+	}
+
+	if len(pools) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, pools)
+}
+
+func GetPool(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+	utils.NewSuccessResponse(w, pool)
+}
+
+func UpdatePool(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+	oldName := pool.Name
+
+	var payload poolPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	if validationErrors := payload.apply(pool); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	err := db.UpdatePool(r.Context(), pool)
+	if errors.Is(err, db.ErrPoolConflict) {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Pool with the same name already exists"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to update pool"})
+		return
+	}
+
+	// a renamed pool is a different pool to the proxy
+	if oldName != pool.Name {
+		removePoolFromProxy(oldName)
+		publishPool(pool)
+		publishPoolMembers(r.Context(), pool.Replicas)
+	} else {
+		publishPool(pool)
+	}
+
+	utils.NewSuccessResponse(w, pool)
+}
+
+func removePoolFromProxy(name string) {
+	message := &messaging.Message{
+		Name: messaging.REMOVE_POOL,
+		Body: map[string]string{"name": name},
+	}
+	if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
+		log.Printf("Failed to publish message: %v", err)
+	}
+}
+
+// tells the proxy which pool each of the replicas now belongs to
+func publishPoolMembers(ctx context.Context, replicas []db.Replica) {
+	for i := range replicas {
+		if replicas[i].Status == db.DISABLED {
+			continue
+		}
+		if err := publishReplicaUpdate(ctx, &replicas[i]); err != nil {
+			log.Printf("Failed to publish message: %v", err)
+		}
+	}
+}
+
+func DeletePool(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.DeletePool(r.Context(), pool.Id); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to delete pool"})
+		return
+	}
+
+	removePoolFromProxy(pool.Name)
+	for i := range pool.Replicas {
+		pool.Replicas[i].PoolId = nil
+	}
+	publishPoolMembers(r.Context(), pool.Replicas)
+
+	utils.NewSuccessResponse(w, "Pool deleted successfully")
+}
+
+func AddPoolMembers(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		ReplicaIds []int64 `json:"replica_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || len(payload.ReplicaIds) == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid or missing replica_ids in request payload"})
+		return
+	}
+
+	// make sure every replica exists before moving any of them
+	replicas := make([]*db.Replica, 0, len(payload.ReplicaIds))
+	for _, id := range payload.ReplicaIds {
+		replica, err := db.GetReplicaById(r.Context(), id)
+		if err != nil {
+			utils.NewErrorResponse(w, http.StatusNotFound, []string{"Replica not found: " + strconv.FormatInt(id, 10)})
+			return
+		}
+		replicas = append(replicas, replica)
+	}
+
+	// all replicas move or none does
+	if err := db.AddPoolMembers(r.Context(), pool.Id, payload.ReplicaIds); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to add replicas to pool"})
+		return
+	}
+
+	for _, replica := range replicas {
+		replica.PoolId = &pool.Id
+		if replica.Status != db.DISABLED {
+			if err := publishReplicaUpdate(r.Context(), replica); err != nil {
+				log.Printf("Failed to publish message: %v", err)
+			}
+		}
+	}
+
+	utils.NewSuccessResponse(w, "Replicas added to pool successfully")
+}
+
+func RemovePoolMember(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	replicaId, err := strconv.ParseInt(r.PathValue("replica_id"), 10, 64)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid replica ID"})
+		return
+	}
+
+	replica, err := db.GetReplicaById(r.Context(), replicaId)
+	if err != nil || replica.PoolId == nil || *replica.PoolId != pool.Id {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Replica is not a member of this pool"})
+		return
+	}
+
+	if err := db.SetReplicaPool(r.Context(), replica.Id, nil); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to remove replica from pool"})
+		return
+	}
+
+	replica.PoolId = nil
+	if replica.Status != db.DISABLED {
+		if err := publishReplicaUpdate(r.Context(), replica); err != nil {
+			log.Printf("Failed to publish message: %v", err)
+		}
+	}
+
+	utils.NewSuccessResponse(w, "Replica removed from pool successfully")
+}
+
+func GetPoolReplicas(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	replicas, err := db.GetPoolReplicas(r.Context(), pool.Id)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch replicas"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, replicas)
+}
+
+func AddPoolReplica(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+	addReplica(w, r, pool)
+}
+
+func GetPoolStatistics(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	stats, err := db.GetPoolStatistics(r.Context(), pool.Id)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch statistics"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, stats)
+}
+
+func GetPoolPrequalParameters(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	response, err := db.GetPoolPrequalParameters(r.Context(), pool.Id)
+	if err != nil {
+		log.Printf("Error fetching pool prequal parameters: %v", err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch the latest entry"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, response)
+}
+
+func AddPoolPrequalParameters(w http.ResponseWriter, r *http.Request) {
+	if !requireDirectParameterChanges(w) {
+		return
+	}
+
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	payload, ok := decodePrequalParameters(w, r)
+	if !ok {
+		return
+	}
+
+	payload.PoolId = &pool.Id
+	parameters, err := db.AddPrequalParametersResponse(r.Context(), payload)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to create or activate entry"})
+		return
+	}
+
+	// inactive parameters are only stored
+	if parameters.Status == db.PARAMETERS_ACTIVE {
+		message := &messaging.Message{
+			Name: messaging.NEW_PARAMETERS,
+			Body: messaging.ParametersBody{
+				Pool:       pool.Name,
+				Parameters: *parameters,
+			},
+		}
+		if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
+			log.Printf("Failed to publish change parameters message: %v", err)
+		}
+	}
+
+	utils.NewSuccessResponse(w, parameters)
+}
+
+func GetPoolPrequalParametersHistory(w http.ResponseWriter, r *http.Request) {
+	pool, ok := poolFromPath(w, r)
+	if !ok {
+		return
+	}
+	prequalParametersHistory(w, r, &pool.Id)
+}
@@ -3,8 +3,10 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
 	"github.com/AshimKoirala/load-balancer-admin/utils"
@@ -34,15 +36,12 @@ func AddPrequalParameters(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var payload db.AddPrequalParametersType
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		fmt.Printf("Error decoding request payload: %v", err)
-		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+	if !requireDirectParameterChanges(w) {
 		return
 	}
 
-	if payload.MaxLifeTime <= 0 || payload.ProbeRemoveFactor <= 0 || payload.PoolSize <= 10 || payload.Mu <= 0 || payload.ProbeFactor <= 0 {
-		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid probe parameters. Ensure that max_life_time, probe_factor, probe_remove_factor and mu are greater than 0 and Pool size is greater than 10"})
+	payload, ok := decodePrequalParameters(w, r)
+	if !ok {
 		return
 	}
 
@@ -55,6 +54,9 @@ func AddPrequalParameters(w http.ResponseWriter, r *http.Request) {
 	}
 
 	message := "Prequal Parameter added successfully"
+	if payload.Status == db.PARAMETERS_INACTIVE {
+		message += " as inactive"
+	}
 	// if data.Id != nil {
 	// 	message += fmt.Sprintf(" and entry with ID %d was activated", *payload.ActivateId)
 	// }
@@ -77,3 +79,98 @@ func AddPrequalParameters(w http.ResponseWriter, r *http.Request) {
 
 	utils.NewSuccessResponse(w, message)
 }
+
+// lists every stored parameter set, newest first, optionally capped with ?limit
+func GetPrequalParametersHistory(w http.ResponseWriter, r *http.Request) {
+	prequalParametersHistory(w, r, nil)
+}
+
+func prequalParametersHistory(w http.ResponseWriter, r *http.Request, poolId *int64) {
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	history, err := db.GetPrequalParametersHistory(r.Context(), poolId, limit)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch parameters history"})
+		return
+	}
+
+	if len(history) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, history)
+}
+
+// serves the constraints of the parameters with this environment's limits, for forms
+func GetPrequalParameterSchema(w http.ResponseWriter, r *http.Request) {
+	utils.NewSuccessResponse(w, db.PrequalParameterSchema())
+}
+
+// checks the parameters, one "field: problem" message per violation
+func validatePrequalParameters(payload db.AddPrequalParametersType) []string {
+	var validationErrors []string
+	for _, violation := range db.ValidatePrequalParameters(db.PrequalParameterSchema(), payload) {
+		validationErrors = append(validationErrors, violation.String())
+	}
+	return validationErrors
+}
+
+// decodes and validates the parameters of the request, writes the error response when
+// they are invalid
+func decodePrequalParameters(w http.ResponseWriter, r *http.Request) (db.AddPrequalParametersType, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return db.AddPrequalParametersType{}, false
+	}
+
+	payload, validationErrors := parsePrequalParameters(body)
+	if len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return payload, false
+	}
+	return payload, true
+}
+
+// decodes and validates parameters. Types are checked before decoding so they are
+// reported per field.
+func parsePrequalParameters(body []byte) (db.AddPrequalParametersType, []string) {
+	var payload db.AddPrequalParametersType
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		fmt.Printf("Error decoding request payload: %v", err)
+		return payload, []string{"Invalid request payload"}
+	}
+	if violations := db.CheckParameterTypes(db.PrequalParameterSchema(), fields); len(violations) > 0 {
+		var validationErrors []string
+		for _, violation := range violations {
+			validationErrors = append(validationErrors, violation.String())
+		}
+		return payload, validationErrors
+	}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return payload, []string{"Invalid request payload"}
+	}
+	return payload, validatePrequalParameters(payload)
+}
+
+// refuses direct parameter changes while they have to go through approved drafts
+func requireDirectParameterChanges(w http.ResponseWriter) bool {
+	if db.ParameterApprovalRequired() {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Parameter changes need approval, create a draft at /admin/prequal-parameters/drafts"})
+		return false
+	}
+	return true
+}
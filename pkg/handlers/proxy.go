@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultProxyAcknowledgementLimit = 20
+
+// overall liveness of the proxy fleet
+const (
+	proxyLivenessAlive    = "alive"
+	proxyLivenessDegraded = "degraded"
+	proxyLivenessDown     = "down"
+	proxyLivenessUnknown  = "unknown"
+)
+
+type proxyResponse struct {
+	db.ProxyInstance
+	Online   bool           `json:"online"`
+	Replicas map[string]int `json:"replicas"`
+}
+
+type proxyLivenessResponse struct {
+	Status                  string          `json:"status"`
+	Total                   int             `json:"total"`
+	Alive                   int             `json:"alive"`
+	Stale                   int             `json:"stale"`
+	HeartbeatTimeoutSeconds int             `json:"heartbeat_timeout_seconds"`
+	ParametersVersion       *int            `json:"parameters_version"`
+	Proxies                 []proxyLiveness `json:"proxies"`
+}
+
+type proxyLiveness struct {
+	InstanceId        string     `json:"instance_id"`
+	Version           string     `json:"version"`
+	Stale             bool       `json:"stale"`
+	LastHeartbeatAt   *time.Time `json:"last_heartbeat_at"`
+	SecondsSinceSeen  int        `json:"seconds_since_seen"`
+	UptimeSeconds     *int64     `json:"uptime_seconds"`
+	ReplicaCount      *int       `json:"replica_count"`
+	ParametersVersion *int       `json:"parameters_version"`
+	ParametersCurrent bool       `json:"parameters_current"`
+}
+
+type proxyDetailResponse struct {
+	proxyResponse
+	ReplicaStates    []db.ProxyReplicaState    `json:"replica_states"`
+	Acknowledgements []db.ProxyAcknowledgement `json:"acknowledgements"`
+}
+
+func newProxyResponse(proxy db.ProxyInstance, counts map[string]int) proxyResponse {
+	if counts == nil {
+		counts = map[string]int{}
+	}
+	return proxyResponse{
+		ProxyInstance: proxy,
+		Online:        !proxy.Stale && time.Since(proxy.LastSeenAt) <= messaging.ProxyHeartbeatTimeout(),
+		Replicas:      counts,
+	}
+}
+
+func proxyFromPath(w http.ResponseWriter, r *http.Request) (*db.ProxyInstance, bool) {
+	proxy, err := db.GetProxyInstance(r.Context(), r.PathValue("instance_id"))
+	if err == sql.ErrNoRows {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Proxy instance not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy instance"})
+		return nil, false
+	}
+	return proxy, true
+}
+
+// the inventory of proxy instances with how many replicas each one has in every status
+func GetProxies(w http.ResponseWriter, r *http.Request) {
+	proxies, err := db.GetProxyInstances(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy instances"})
+		return
+	}
+
+	if len(proxies) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	counts, err := db.GetProxyReplicaStatusCounts(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy replica states"})
+		return
+	}
+
+	response := make([]proxyResponse, 0, len(proxies))
+	for _, proxy := range proxies {
+		response = append(response, newProxyResponse(proxy, counts[proxy.Id]))
+	}
+	utils.NewSuccessResponse(w, response)
+}
+
+// whether the proxies are alive, from their latest heartbeats. A fleet that never sent
+// anything is unknown rather than alive.
+func GetProxyLiveness(w http.ResponseWriter, r *http.Request) {
+	proxies, err := db.GetProxyInstances(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy instances"})
+		return
+	}
+
+	timeout := messaging.ProxyHeartbeatTimeout()
+	response := proxyLivenessResponse{
+		Status:                  proxyLivenessUnknown,
+		Total:                   len(proxies),
+		HeartbeatTimeoutSeconds: int(timeout.Seconds()),
+		Proxies:                 []proxyLiveness{},
+	}
+	if parameters, err := db.GetPrequalParametersResponse(r.Context()); err == nil {
+		response.ParametersVersion = &parameters.Id
+	}
+
+	for _, proxy := range proxies {
+		stale := proxy.Stale || time.Since(proxy.LastSeenAt) > timeout
+		if stale {
+			response.Stale++
+		} else {
+			response.Alive++
+		}
+		response.Proxies = append(response.Proxies, proxyLiveness{
+			InstanceId:        proxy.InstanceId,
+			Version:           proxy.Version,
+			Stale:             stale,
+			LastHeartbeatAt:   proxy.LastHeartbeatAt,
+			SecondsSinceSeen:  int(time.Since(proxy.LastSeenAt).Seconds()),
+			UptimeSeconds:     proxy.UptimeSeconds,
+			ReplicaCount:      proxy.ReplicaCount,
+			ParametersVersion: proxy.ParametersVersion,
+			ParametersCurrent: proxy.ParametersVersion != nil && response.ParametersVersion != nil &&
+				*proxy.ParametersVersion == *response.ParametersVersion,
+		})
+	}
+
+	switch {
+	case response.Total == 0:
+		response.Status = proxyLivenessUnknown
+	case response.Stale == 0:
+		response.Status = proxyLivenessAlive
+	case response.Alive == 0:
+		response.Status = proxyLivenessDown
+	default:
+		response.Status = proxyLivenessDegraded
+	}
+
+	utils.NewSuccessResponse(w, response)
+}
+
+// one proxy instance with the status of every replica it reported and its latest acknowledgements
+func GetProxy(w http.ResponseWriter, r *http.Request) {
+	proxy, ok := proxyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	states, err := db.GetProxyReplicaStates(r.Context(), proxy.Id)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy replica states"})
+		return
+	}
+	acks, err := db.GetProxyAcknowledgements(r.Context(), proxy.Id, defaultProxyAcknowledgementLimit)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy acknowledgements"})
+		return
+	}
+
+	counts := map[string]int{}
+	for _, state := range states {
+		counts[state.Status]++
+	}
+	if states == nil {
+		states = []db.ProxyReplicaState{}
+	}
+	if acks == nil {
+		acks = []db.ProxyAcknowledgement{}
+	}
+
+	utils.NewSuccessResponse(w, proxyDetailResponse{
+		proxyResponse:    newProxyResponse(*proxy, counts),
+		ReplicaStates:    states,
+		Acknowledgements: acks,
+	})
+}
+
+// acknowledgements of one proxy instance, newest first, capped with ?limit
+func GetProxyAcknowledgements(w http.ResponseWriter, r *http.Request) {
+	proxy, ok := proxyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	acks, err := db.GetProxyAcknowledgements(r.Context(), proxy.Id, limit)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy acknowledgements"})
+		return
+	}
+
+	if len(acks) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, acks)
+}
+
+// forgets an instance that left for good and deletes its command queue
+func DeleteProxy(w http.ResponseWriter, r *http.Request) {
+	proxy, ok := proxyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := messaging.DeregisterProxy(r.Context(), proxy); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to deregister proxy instance"})
+		return
+	}
+
+	username, _ := r.Context().Value("username").(string)
+	message := fmt.Sprintf("Proxy %s deregistered by %s", proxy.InstanceId, username)
+	if err := db.LogActivity(r.Context(), "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+
+	utils.NewSuccessResponse(w, "Proxy instance deregistered successfully")
+}
+
+// how every proxy instance sees one replica
+func GetReplicaProxies(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid replica ID"})
+		return
+	}
+
+	if _, err := db.GetReplicaById(r.Context(), id); err != nil {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Replica not found"})
+		return
+	}
+
+	states, err := db.GetReplicaProxyStates(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch replica proxy states"})
+		return
+	}
+
+	if len(states) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, states)
+}
@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/AshimKoirala/load-balancer-admin/messaging"
 	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
@@ -18,10 +23,19 @@ func AddReplica(w http.ResponseWriter, r *http.Request) {
 		utils.NewErrorResponse(w, http.StatusMethodNotAllowed, []string{"Method not allowed"})
 		return
 	}
+	addReplica(w, r, nil)
+}
+
+// adds a replica, optionally straight into a pool whose healthcheck defaults then apply
+func addReplica(w http.ResponseWriter, r *http.Request, pool *db.Pool) {
 	var payload struct {
-		Name                string `json:"name"`
-		URL                 string `json:"url"`
-		HealthCheckEndpoint string `json:"health_check_endpoint"`
+		Name                  string            `json:"name"`
+		URL                   string            `json:"url"`
+		HealthCheckEndpoint   string            `json:"health_check_endpoint"`
+		Weight                int               `json:"weight"`
+		MaxConcurrentRequests int               `json:"max_concurrent_requests"`
+		CapacityClass         string            `json:"capacity_class"`
+		Labels                map[string]string `json:"labels"`
 	}
 
 	// Decode request body
@@ -30,41 +44,53 @@ func AddReplica(w http.ResponseWriter, r *http.Request) {
 		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
 		return
 	}
-	if payload.Name == "" || payload.URL == "" || payload.HealthCheckEndpoint == "" {
-		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"All fields (name, URL, healthcheck_endpoint) must be provided"})
-		return
+	if pool != nil && payload.HealthCheckEndpoint == "" {
+		payload.HealthCheckEndpoint = pool.HealthCheckEndpoint
 	}
 
-	matched, err := regexp.MatchString(`^[a-zA-Z0-9_-]+$`, payload.HealthCheckEndpoint)
-	if err != nil || !matched {
-		log.Print(err)
-		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Health Check Endpoint must contain only alphanumeric characters, underscores (_), or hyphens (-)"})
+	capacity := db.ReplicaCapacity{
+		Weight:        payload.Weight,
+		MaxConcurrent: payload.MaxConcurrentRequests,
+		CapacityClass: payload.CapacityClass,
+	}.WithDefaults()
+
+	url, validationErrors := validateReplica(payload.Name, payload.URL, payload.HealthCheckEndpoint)
+	validationErrors = append(validationErrors, validateCapacity(capacity)...)
+	validationErrors = append(validationErrors, db.ValidateLabels(payload.Labels)...)
+	if len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
 		return
 	}
 
-	url, err := url.Parse(payload.URL)
+	probe := probeReplica(url, payload.HealthCheckEndpoint)
 
-	if err != nil {
-		log.Print(err)
-		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Malformed url"})
+	if probe.Err != nil {
+		log.Print(probe.Err)
+		if existing, findErr := db.GetReplicaByUrl(r.Context(), payload.URL); findErr == nil {
+			recordProbe(r.Context(), existing.Id, probe)
+		}
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Replica did not pass the healthcheck"})
 		return
 	}
 
-	resp, err := http.Get(fmt.Sprintf("%s://%s/%s", url.Scheme, url.Host, payload.HealthCheckEndpoint))
+	spec := db.NewReplica{
+		Name:                payload.Name,
+		URL:                 payload.URL,
+		HealthCheckEndpoint: payload.HealthCheckEndpoint,
+		Capacity:            capacity,
+		Labels:              payload.Labels,
+	}
+	if pool != nil {
+		spec.PoolId = &pool.Id
+	}
 
-	if err != nil {
-		log.Print(err)
-		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Replica did not pass the healthcheck"})
+	// queues the replica and asks the proxy to add it
+	before, err := db.AddReplica(r.Context(), spec)
+	if errors.Is(err, db.ErrProxyNotify) {
+		log.Printf("Failed to publish message: %v", err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to publish message"})
 		return
 	}
-
-	// if resp.StatusCode != http.StatusOK || err != nil {
-	// 	// log.Printf("received non-200 response: %d", resp.StatusCode)
-
-	// }
-	defer resp.Body.Close()
-
-	err = db.AddReplica(r.Context(), payload.Name, payload.URL, payload.HealthCheckEndpoint)
 	if err != nil {
 		log.Print(err)
 		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{err.Error()})
@@ -78,24 +104,56 @@ func AddReplica(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Publish message to RabbitMQ
-	message := &messaging.Message{
-		Name: messaging.ADD_REPLICA,
-		Body: map[string]string{
-			"name": payload.Name,
-			"url":  payload.URL,
-		},
-	}
+	recordProbe(r.Context(), replica.Id, probe)
 
-	if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
+	if err := syncReaddedReplica(r.Context(), before, replica); err != nil {
 		log.Printf("Failed to publish message: %v", err)
 		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to publish message"})
-		// return
+		return
 	}
 
 	utils.NewSuccessResponse(w, replica)
 }
 
+// validates the fields every replica needs, shared by adding and editing replicas
+func validateReplica(name, rawUrl, healthCheckEndpoint string) (*url.URL, []string) {
+	if name == "" || rawUrl == "" || healthCheckEndpoint == "" {
+		return nil, []string{"All fields (name, URL, healthcheck_endpoint) must be provided"}
+	}
+
+	matched, err := regexp.MatchString(`^[a-zA-Z0-9_-]+$`, healthCheckEndpoint)
+	if err != nil || !matched {
+		log.Print(err)
+		return nil, []string{"Health Check Endpoint must contain only alphanumeric characters, underscores (_), or hyphens (-)"}
+	}
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		log.Print(err)
+		return nil, []string{"Malformed url"}
+	}
+
+	return parsed, nil
+}
+
+func validateCapacity(capacity db.ReplicaCapacity) []string {
+	var validationErrors []string
+
+	if capacity.Weight < 1 || capacity.Weight > db.MAX_WEIGHT {
+		validationErrors = append(validationErrors, fmt.Sprintf("Weight must be between 1 and %d", db.MAX_WEIGHT))
+	}
+
+	if capacity.MaxConcurrent < 0 {
+		validationErrors = append(validationErrors, "Max concurrent requests must be 0 (unlimited) or greater")
+	}
+
+	if !slices.Contains(db.CapacityClasses, capacity.CapacityClass) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Capacity class must be one of %s", strings.Join(db.CapacityClasses, ", ")))
+	}
+
+	return validationErrors
+}
+
 func Status(w http.ResponseWriter, r *http.Request) {
 	log.Println("Replica status checking..")
 }
@@ -105,7 +163,13 @@ func GetReplicas(w http.ResponseWriter, r *http.Request) {
 		utils.NewErrorResponse(w, http.StatusMethodNotAllowed, []string{"Method not allowed"})
 		return
 	}
-	replicas, err := db.GetReplicas(r.Context())
+	selector, err := db.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+
+	replicas, err := db.GetReplicasBySelector(r.Context(), selector)
 	if err != nil {
 		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch replicas"})
 		return
@@ -118,6 +182,7 @@ func RemoveReplica(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Id  *int64  `json:"id,omitempty"`
 		Url *string `json:"url,omitempty"`
+		drainOptions
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || (payload.Id == nil && payload.Url == nil) {
@@ -139,27 +204,16 @@ func RemoveReplica(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Remove replica from the database
-	err = db.RemoveReplica(r.Context(), payload.Id, payload.Url)
-	if err != nil {
+	// active replicas finish their in-flight requests before they are disabled
+	if err := changeReplicaStatus(r.Context(), replica, db.DISABLED, payload.drainOptions); err != nil {
 		log.Printf("Error disabling replica: %v", err)
-		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to disable replica"})
+		statusChangeError(w, err)
 		return
 	}
 
-	message := &messaging.Message{
-		//Name: "replica-removed",
-		Name: messaging.REMOVE_REPLICA,
-		Body: map[string]string{
-			"name": replica.Name,
-			"url":  replica.URL,
-		},
-	}
-
-	if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
-		log.Printf("Failed to publish message: %v", err)
-		// utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to publish message"})
-		// return
+	if replica.Status == db.DRAINING {
+		utils.NewSuccessResponse(w, "Replica is draining and will be disabled once idle")
+		return
 	}
 
 	//utils.NewSuccessResponse(w, "Replica removed successfully")
@@ -174,6 +228,7 @@ func ChangeStatus(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Id     int64  `json:"id"`
 		Status string `json:"status"`
+		drainOptions
 	}
 
 	// Decode request body
@@ -191,54 +246,287 @@ func ChangeStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if payload.Status == "disabled" {
-		message := &messaging.Message{
-			Name: messaging.REMOVE_REPLICA,
-			Body: map[string]string{
-				"name": replica.Name,
-				"url":  replica.URL,
-			},
+	if err := changeReplicaStatus(r.Context(), replica, payload.Status, payload.drainOptions); err != nil {
+		log.Println(err)
+		statusChangeError(w, err)
+		return
+	}
+
+	utils.NewSuccessResponse(w, "Replica status updated successfully")
+}
+
+// lists the legal replica status transitions and who may trigger them
+func GetReplicaTransitions(w http.ResponseWriter, r *http.Request) {
+	utils.NewSuccessResponse(w, db.ReplicaTransitions())
+}
+
+// how a replica is taken out of rotation, by default active replicas drain first
+type drainOptions struct {
+	Force               bool `json:"force,omitempty"`
+	DrainTimeoutSeconds int  `json:"drain_timeout_seconds,omitempty"`
+}
+
+func (o drainOptions) timeout() time.Duration {
+	if o.DrainTimeoutSeconds > 0 {
+		return time.Duration(o.DrainTimeoutSeconds) * time.Second
+	}
+	return messaging.DrainTimeout()
+}
+
+// moves a replica towards the status an admin asked for through the replica state machine
+func changeReplicaStatus(ctx context.Context, replica *db.Replica, status string, drain drainOptions) error {
+	target, err := db.ResolveAdminTarget(replica.Status, status, drain.Force)
+	if err != nil {
+		return err
+	}
+
+	if target == db.DRAINING && replica.Status != db.DRAINING {
+		return db.StartDrain(ctx, replica, drain.timeout(), db.SOURCE_ADMIN)
+	}
+
+	detail := ""
+	if replica.Status == db.DRAINING && target == db.DISABLED {
+		detail = "drain cut short by admin"
+	}
+	return db.TransitionReplica(ctx, replica, target, db.SOURCE_ADMIN, db.TransitionOptions{Detail: detail})
+}
+
+func statusChangeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrInvalidStatus):
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+	case errors.Is(err, db.ErrIllegalTransition):
+		utils.NewErrorResponse(w, http.StatusConflict, []string{err.Error()})
+	case errors.Is(err, db.ErrProxyNotify):
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Replica status changed but failed to notify the proxy"})
+	default:
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to change replica status"})
+	}
+}
+
+type bulkStatusResult struct {
+	Id      int64  `json:"id"`
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// changes the status of every replica matching a label selector
+func BulkChangeStatus(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Selector string `json:"selector"`
+		Status   string `json:"status"`
+		drainOptions
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	if payload.Status != db.ACTIVE && payload.Status != db.DISABLED {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Status must be either 'active' or 'disabled'"})
+		return
+	}
+
+	// an empty selector would match every replica
+	selector, err := db.ParseSelector(payload.Selector)
+	if err != nil || len(selector) == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"A valid, non-empty selector must be provided"})
+		return
+	}
+
+	replicas, err := db.GetReplicasBySelector(r.Context(), selector)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch replicas"})
+		return
+	}
+
+	results := make([]bulkStatusResult, 0, len(replicas))
+	for i := range replicas {
+		result := bulkStatusResult{Id: replicas[i].Id, Name: replicas[i].Name, Success: true}
+		if err := changeReplicaStatus(r.Context(), &replicas[i], payload.Status, payload.drainOptions); err != nil {
+			log.Println(err)
+			result.Success = false
+			result.Error = err.Error()
 		}
+		results = append(results, result)
+	}
+
+	utils.NewSuccessResponse(w, results)
+}
+
+func UpdateReplica(w http.ResponseWriter, r *http.Request) {
+	current, ok := replicaFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Name                *string           `json:"name"`
+		URL                 *string           `json:"url"`
+		HealthCheckEndpoint *string           `json:"health_check_endpoint"`
+		Weight              *int              `json:"weight"`
+		MaxConcurrent       *int              `json:"max_concurrent_requests"`
+		CapacityClass       *string           `json:"capacity_class"`
+		Metadata            map[string]string `json:"metadata"`
+		Labels              map[string]string `json:"labels"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Print(err)
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	// validate the replica as it will look after the update
+	name, rawUrl, healthCheckEndpoint := current.Name, current.URL, current.HealthCheckEndpoint
+	if payload.Name != nil {
+		name = *payload.Name
+	}
+	if payload.URL != nil {
+		rawUrl = *payload.URL
+	}
+	if payload.HealthCheckEndpoint != nil {
+		healthCheckEndpoint = *payload.HealthCheckEndpoint
+	}
+
+	capacity := current.Capacity()
+	if payload.Weight != nil {
+		capacity.Weight = *payload.Weight
+	}
+	if payload.MaxConcurrent != nil {
+		capacity.MaxConcurrent = *payload.MaxConcurrent
+	}
+	if payload.CapacityClass != nil {
+		capacity.CapacityClass = *payload.CapacityClass
+	}
+
+	parsedUrl, validationErrors := validateReplica(name, rawUrl, healthCheckEndpoint)
+	validationErrors = append(validationErrors, validateCapacity(capacity)...)
+	validationErrors = append(validationErrors, db.ValidateLabels(payload.Labels)...)
+	if len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
 
-		if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
-			log.Printf("Failed to publish message: %v", err)
-			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to disable replica"})
+	// a new address or endpoint has to pass the healthcheck before it is stored
+	if rawUrl != current.URL || healthCheckEndpoint != current.HealthCheckEndpoint {
+		probe := probeReplica(parsedUrl, healthCheckEndpoint)
+		recordProbe(r.Context(), current.Id, probe)
+		if probe.Err != nil {
+			log.Print(probe.Err)
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Replica did not pass the healthcheck"})
 			return
 		}
+	}
 
-		err = db.LogActivity(r.Context(), "warning", fmt.Sprintf("Replica '%v' is being disabled", replica.Name), &replica.Id)
+	before, after, err := db.UpdateReplica(r.Context(), current.Id, db.ReplicaUpdate{
+		Name:                payload.Name,
+		URL:                 payload.URL,
+		HealthCheckEndpoint: payload.HealthCheckEndpoint,
+		Weight:              payload.Weight,
+		MaxConcurrent:       payload.MaxConcurrent,
+		CapacityClass:       payload.CapacityClass,
+		Metadata:            payload.Metadata,
+		Labels:              payload.Labels,
+	})
+	if errors.Is(err, db.ErrReplicaConflict) {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"Replica with the same name or url already exists"})
+		return
+	}
+	if errors.Is(err, db.ErrReplicaDraining) {
+		utils.NewErrorResponse(w, http.StatusConflict, []string{"The url of a draining replica cannot change until its drain ends"})
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to update replica"})
+		return
 	}
 
-	if payload.Status == "active" {
-		message := &messaging.Message{
-			Name: messaging.ADD_REPLICA,
+	if err := syncUpdatedReplica(r.Context(), before, after); err != nil {
+		log.Printf("Failed to publish message: %v", err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Replica updated but failed to notify the proxy"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, after)
+}
+
+// tells the proxy about an edited replica. A new url means a different backend, so the
+// old one is removed and the new one added, renames, pool moves and capacity changes are
+// applied live.
+// Draining replicas keep their url, db.UpdateReplica refuses to change it.
+func syncUpdatedReplica(ctx context.Context, before, after *db.Replica) error {
+	// the proxy does not know about disabled replicas
+	if after.Status == db.DISABLED {
+		return nil
+	}
+
+	if before.URL != after.URL {
+		remove := &messaging.Message{
+			Name: messaging.REMOVE_REPLICA,
 			Body: map[string]string{
-				"name": replica.Name,
-				"url":  replica.URL,
+				"name": before.Name,
+				"url":  before.URL,
 			},
 		}
+		if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, remove); err != nil {
+			return err
+		}
 
-		if err := messaging.PublishMessage(messaging.PUBLISHING_QUEUE, message); err != nil {
-			log.Printf("Failed to publish message: %v", err)
-			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to enable replica"})
-			return
+		add := &messaging.Message{
+			Name: messaging.ADD_REPLICA,
+			Body: messaging.NewReplicaBody(ctx, after),
 		}
+		return messaging.PublishMessage(messaging.PUBLISHING_QUEUE, add)
+	}
 
-		err = db.LogActivity(r.Context(), "warning", fmt.Sprintf("Replica '%v' is being activated", replica.Name), &replica.Id)
+	if before.Name != after.Name || !samePool(before.PoolId, after.PoolId) {
+		if err := publishReplicaUpdate(ctx, after); err != nil {
+			return err
+		}
 	}
 
-	if err != nil {
-		log.Println(err)
-		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to log activity"})
+	if before.Capacity() != after.Capacity() {
+		update := &messaging.Message{
+			Name: messaging.UPDATE_REPLICA_CAPACITY,
+			Body: messaging.NewReplicaBody(ctx, after),
+		}
+		return messaging.PublishMessage(messaging.PUBLISHING_QUEUE, update)
 	}
 
-	// Change status of the replica
-	// err = db.UpdateStatus(r.Context(), payload.Id, payload.Status)
-	// if err != nil {
-	// 	log.Println(err)
-	// 	utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to change replica status"})
-	// 	return
-	// }
+	return nil
+}
 
-	utils.NewSuccessResponse(w, "Replica status updated successfully")
+// a re-added replica that was and stays active goes through no transition, so the proxy is
+// told about its changes like after an edit
+func syncReaddedReplica(ctx context.Context, before, after *db.Replica) error {
+	if before == nil || before.Status != db.ACTIVE || after.Status != db.ACTIVE {
+		return nil
+	}
+	return syncUpdatedReplica(ctx, before, after)
+}
+
+// sends the identity of a replica (name and pool) to the proxy
+func publishReplicaUpdate(ctx context.Context, replica *db.Replica) error {
+	body := messaging.NewReplicaBody(ctx, replica)
+	update := &messaging.Message{
+		Name: messaging.UPDATE_REPLICA,
+		Body: map[string]string{
+			"name": body.Name,
+			"url":  body.URL,
+			"pool": body.Pool,
+		},
+	}
+	return messaging.PublishMessage(messaging.PUBLISHING_QUEUE, update)
+}
+
+func samePool(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
 }
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultHealthWindow = 7 * 24 * time.Hour
+const healthCheckTimeout = 5 * time.Second
+
+var healthCheckClient = &http.Client{Timeout: healthCheckTimeout}
+
+type healthProbe struct {
+	Healthy bool
+	Latency time.Duration
+	Detail  string
+	Err     error
+}
+
+// runs a health check against the replica, a probe is healthy when the endpoint answers with
+// a 2xx status within healthCheckTimeout
+func probeReplica(replicaUrl *url.URL, healthCheckEndpoint string) healthProbe {
+	started := time.Now()
+	resp, err := healthCheckClient.Get(fmt.Sprintf("%s://%s/%s", replicaUrl.Scheme, replicaUrl.Host, healthCheckEndpoint))
+	probe := healthProbe{Latency: time.Since(started), Err: err}
+
+	if err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	defer resp.Body.Close()
+
+	probe.Healthy = resp.StatusCode >= 200 && resp.StatusCode < 300
+	probe.Detail = resp.Status
+	if !probe.Healthy {
+		probe.Err = fmt.Errorf("health check of %s returned %s", replicaUrl.Host, resp.Status)
+	}
+	return probe
+}
+
+func recordProbe(ctx context.Context, replicaId int64, probe healthProbe) {
+	if err := db.RecordHealthProbe(ctx, replicaId, probe.Healthy, probe.Latency, probe.Detail); err != nil {
+		log.Printf("Failed to record health probe: %v", err)
+	}
+}
+
+// reads the reporting window from either from/to (RFC3339) or window (e.g. 24h, 7d)
+func parseWindow(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now()
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to, expected RFC3339 timestamp")
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultHealthWindow)
+	if raw := r.URL.Query().Get("window"); raw != "" {
+		window, err := parseWindowDuration(raw)
+		if err != nil || window <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid window, expected a duration such as 24h or 7d")
+		}
+		from = to.Add(-window)
+	}
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from, expected RFC3339 timestamp")
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// like time.ParseDuration but also accepts whole days, e.g. 7d
+func parseWindowDuration(raw string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(raw, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+func replicaFromPath(w http.ResponseWriter, r *http.Request) (*db.Replica, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid replica ID"})
+		return nil, false
+	}
+
+	replica, err := db.GetReplicaById(r.Context(), id)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Replica not found"})
+		return nil, false
+	}
+	return replica, true
+}
+
+func GetReplicaHealthHistory(w http.ResponseWriter, r *http.Request) {
+	replica, ok := replicaFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, err := parseWindow(r)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+
+	events, err := db.GetReplicaHealthHistory(r.Context(), replica.Id, from, to)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch health history"})
+		return
+	}
+
+	if len(events) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, events)
+}
+
+func GetReplicaUptime(w http.ResponseWriter, r *http.Request) {
+	replica, ok := replicaFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, err := parseWindow(r)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+
+	uptime, err := db.GetReplicaUptime(r.Context(), replica, from, to)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to compute uptime"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, uptime)
+}
+
+func GetReplicasUptime(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseWindow(r)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+
+	replicas, err := db.GetReplicas(r.Context())
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch replicas"})
+		return
+	}
+
+	report := make([]*db.ReplicaUptime, 0, len(replicas))
+	for i := range replicas {
+		uptime, err := db.GetReplicaUptime(r.Context(), &replicas[i], from, to)
+		if err != nil {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to compute uptime"})
+			return
+		}
+		report = append(report, uptime)
+	}
+
+	utils.NewSuccessResponse(w, report)
+}
@@ -0,0 +1,596 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// formats replicas can be imported from and exported to
+const (
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_CSV  = "csv"
+)
+
+const (
+	maxImportRows        = 500
+	maxImportBytes       = 5 << 20
+	defaultImportWorkers = 8
+	maxImportWorkers     = 32
+)
+
+// outcome of a single imported row
+const (
+	IMPORT_CREATED   = "created"
+	IMPORT_UPDATED   = "updated"
+	IMPORT_VALID     = "valid"
+	IMPORT_INVALID   = "invalid"
+	IMPORT_UNHEALTHY = "unhealthy"
+	IMPORT_FAILED    = "failed"
+)
+
+// a replica as it is imported and exported, the pool is referenced by name
+type replicaRecord struct {
+	Name                  string            `json:"name" yaml:"name"`
+	URL                   string            `json:"url" yaml:"url"`
+	HealthCheckEndpoint   string            `json:"health_check_endpoint" yaml:"health_check_endpoint"`
+	Weight                int               `json:"weight,omitempty" yaml:"weight,omitempty"`
+	MaxConcurrentRequests int               `json:"max_concurrent_requests,omitempty" yaml:"max_concurrent_requests,omitempty"`
+	CapacityClass         string            `json:"capacity_class,omitempty" yaml:"capacity_class,omitempty"`
+	Pool                  string            `json:"pool,omitempty" yaml:"pool,omitempty"`
+	Labels                map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// active or disabled, draining replicas are exported as disabled
+	Status string `json:"status,omitempty" yaml:"status,omitempty"`
+}
+
+var replicaRecordColumns = []string{"name", "url", "health_check_endpoint", "weight", "max_concurrent_requests", "capacity_class", "pool", "labels", "status"}
+
+type importResult struct {
+	Row       int      `json:"row"`
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Status    string   `json:"status"`
+	Action    string   `json:"action,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+	Healthy   *bool    `json:"healthy,omitempty"`
+	LatencyMs *int64   `json:"latency_ms,omitempty"`
+}
+
+type importSummary struct {
+	DryRun    bool           `json:"dry_run"`
+	Total     int            `json:"total"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []importResult `json:"results"`
+}
+
+// a validated row waiting to be saved
+type importRow struct {
+	record  replicaRecord
+	result  *importResult
+	spec    db.NewReplica
+	probe   healthProbe
+	updates bool
+}
+
+// picks the format from ?format, falling back to the given content type, then JSON
+func requestFormat(r *http.Request, contentType string) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" && contentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		switch {
+		case strings.HasSuffix(mediaType, "yaml"):
+			format = FORMAT_YAML
+		case mediaType == "text/csv":
+			format = FORMAT_CSV
+		}
+	}
+	switch format {
+	case "":
+		return FORMAT_JSON, nil
+	case "yml":
+		return FORMAT_YAML, nil
+	case FORMAT_JSON, FORMAT_YAML, FORMAT_CSV:
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported format '%s', expected json, yaml or csv", format)
+}
+
+// decodes replica records, rows that could not be read keep their errors in rowErrors
+func decodeReplicaRecords(format string, body []byte) ([]replicaRecord, map[int][]string, error) {
+	var wrapped struct {
+		Replicas []replicaRecord `json:"replicas" yaml:"replicas"`
+	}
+
+	switch format {
+	case FORMAT_JSON:
+		trimmed := bytes.TrimSpace(body)
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			var records []replicaRecord
+			err := json.Unmarshal(trimmed, &records)
+			return records, nil, err
+		}
+		err := json.Unmarshal(trimmed, &wrapped)
+		return wrapped.Replicas, nil, err
+	case FORMAT_YAML:
+		var records []replicaRecord
+		if err := yaml.Unmarshal(body, &records); err == nil {
+			return records, nil, nil
+		}
+		err := yaml.Unmarshal(body, &wrapped)
+		return wrapped.Replicas, nil, err
+	}
+	return decodeReplicaCSV(body)
+}
+
+func decodeReplicaCSV(body []byte) ([]replicaRecord, map[int][]string, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("missing csv header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !slices.Contains(replicaRecordColumns, column) {
+			return nil, nil, fmt.Errorf("unknown csv column '%s', expected %s", column, strings.Join(replicaRecordColumns, ", "))
+		}
+		columns[column] = i
+	}
+	for _, required := range []string{"name", "url"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, fmt.Errorf("csv header must contain a '%s' column", required)
+		}
+	}
+
+	var records []replicaRecord
+	rowErrors := map[int][]string{}
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed csv: %v", err)
+		}
+
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
+		}
+		row := len(records)
+		number := func(column string) int {
+			raw := value(column)
+			if raw == "" {
+				return 0
+			}
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				rowErrors[row] = append(rowErrors[row], fmt.Sprintf("%s must be a whole number", column))
+			}
+			return n
+		}
+
+		record := replicaRecord{
+			Name:                  value("name"),
+			URL:                   value("url"),
+			HealthCheckEndpoint:   value("health_check_endpoint"),
+			Weight:                number("weight"),
+			MaxConcurrentRequests: number("max_concurrent_requests"),
+			CapacityClass:         value("capacity_class"),
+			Pool:                  value("pool"),
+			Status:                value("status"),
+		}
+		if raw := value("labels"); raw != "" {
+			labels, err := parseLabelList(raw)
+			if err != nil {
+				rowErrors[row] = append(rowErrors[row], err.Error())
+			}
+			record.Labels = labels
+		}
+		records = append(records, record)
+	}
+	return records, rowErrors, nil
+}
+
+// labels in a csv cell are written as key=value;key=value
+func parseLabelList(raw string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(raw, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label '%s', expected key=value", pair)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+func formatLabelList(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ";")
+}
+
+// validates a row against the fields and the replicas that already exist, then probes it
+func validateImportRow(ctx context.Context, row *importRow, pools map[string]*db.Pool) {
+	record := row.record
+	result := row.result
+
+	if record.Status == "" {
+		record.Status = db.ACTIVE
+		row.record.Status = db.ACTIVE
+	}
+	if record.Status != db.ACTIVE && record.Status != db.DISABLED {
+		result.Errors = append(result.Errors, "Status must be 'active' or 'disabled'")
+	}
+
+	var pool *db.Pool
+	if record.Pool != "" {
+		pool = pools[record.Pool]
+		if pool == nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("Pool '%s' not found", record.Pool))
+		}
+	}
+	if pool != nil && record.HealthCheckEndpoint == "" {
+		record.HealthCheckEndpoint = pool.HealthCheckEndpoint
+	}
+
+	capacity := db.ReplicaCapacity{
+		Weight:        record.Weight,
+		MaxConcurrent: record.MaxConcurrentRequests,
+		CapacityClass: record.CapacityClass,
+	}.WithDefaults()
+
+	url, validationErrors := validateReplica(record.Name, record.URL, record.HealthCheckEndpoint)
+	result.Errors = append(result.Errors, validationErrors...)
+	result.Errors = append(result.Errors, validateCapacity(capacity)...)
+	result.Errors = append(result.Errors, db.ValidateLabels(record.Labels)...)
+
+	// re-importing a replica updates it, but names and urls may not be taken over
+	if existing, err := db.GetReplicaByName(ctx, record.Name); err == nil {
+		if existing.URL != record.URL {
+			result.Errors = append(result.Errors, fmt.Sprintf("Name is already used by replica with url %s", existing.URL))
+		}
+		row.updates = true
+	}
+	if existing, err := db.GetReplicaByUrl(ctx, record.URL); err == nil && existing.Name != record.Name {
+		result.Errors = append(result.Errors, fmt.Sprintf("URL is already used by replica '%s'", existing.Name))
+	}
+
+	if len(result.Errors) > 0 {
+		result.Status = IMPORT_INVALID
+		return
+	}
+
+	row.spec = db.NewReplica{
+		Name:                record.Name,
+		URL:                 record.URL,
+		HealthCheckEndpoint: record.HealthCheckEndpoint,
+		Capacity:            capacity,
+		Labels:              record.Labels,
+		Status:              record.Status,
+	}
+	if pool != nil {
+		row.spec.PoolId = &pool.Id
+	}
+
+	row.probe = probeReplica(url, record.HealthCheckEndpoint)
+	latency := row.probe.Latency.Milliseconds()
+	result.Healthy = &row.probe.Healthy
+	result.LatencyMs = &latency
+	// only replicas that are to serve have to pass the healthcheck
+	if row.probe.Err != nil && record.Status == db.ACTIVE {
+		result.Status = IMPORT_UNHEALTHY
+		result.Errors = append(result.Errors, "Replica did not pass the healthcheck")
+		return
+	}
+
+	result.Status = IMPORT_VALID
+	result.Action = "create"
+	if row.updates {
+		result.Action = "update"
+	}
+}
+
+// ImportReplicas adds or updates many replicas at once. Rows are validated and health checked
+// concurrently, valid rows are then saved one by one. With ?dry_run=true nothing is saved.
+func ImportReplicas(w http.ResponseWriter, r *http.Request) {
+	format, err := requestFormat(r, r.Header.Get("Content-Type"))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	workers := defaultImportWorkers
+	if raw := r.URL.Query().Get("concurrency"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxImportWorkers {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{fmt.Sprintf("concurrency must be between 1 and %d", maxImportWorkers)})
+			return
+		}
+		workers = n
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Request body is too large or unreadable"})
+		return
+	}
+
+	records, rowErrors, err := decodeReplicaRecords(format, body)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{fmt.Sprintf("Invalid %s payload: %v", format, err)})
+		return
+	}
+	if len(records) == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"No replicas to import"})
+		return
+	}
+	if len(records) > maxImportRows {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{fmt.Sprintf("At most %d replicas can be imported at once", maxImportRows)})
+		return
+	}
+
+	pools := map[string]*db.Pool{}
+	for _, record := range records {
+		if record.Pool == "" || pools[record.Pool] != nil {
+			continue
+		}
+		pool, err := db.GetPoolByName(r.Context(), record.Pool)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch pools"})
+			return
+		}
+		if err == nil {
+			pools[record.Pool] = pool
+		}
+	}
+
+	summary := importSummary{DryRun: dryRun, Total: len(records), Results: make([]importResult, len(records))}
+	rows := make([]*importRow, len(records))
+	seenNames, seenUrls := map[string]int{}, map[string]int{}
+	for i, record := range records {
+		summary.Results[i] = importResult{Row: i + 1, Name: record.Name, URL: record.URL}
+		rows[i] = &importRow{record: record, result: &summary.Results[i]}
+
+		result := rows[i].result
+		result.Errors = append(result.Errors, rowErrors[i]...)
+		if first, ok := seenNames[record.Name]; ok && record.Name != "" {
+			result.Errors = append(result.Errors, fmt.Sprintf("Duplicate name, already used in row %d", first))
+		}
+		if first, ok := seenUrls[record.URL]; ok && record.URL != "" {
+			result.Errors = append(result.Errors, fmt.Sprintf("Duplicate url, already used in row %d", first))
+		}
+		if _, ok := seenNames[record.Name]; !ok {
+			seenNames[record.Name] = i + 1
+		}
+		if _, ok := seenUrls[record.URL]; !ok {
+			seenUrls[record.URL] = i + 1
+		}
+		if len(result.Errors) > 0 {
+			result.Status = IMPORT_INVALID
+		}
+	}
+
+	jobs := make(chan *importRow)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range jobs {
+				validateImportRow(r.Context(), row, pools)
+			}
+		}()
+	}
+	for _, row := range rows {
+		if row.result.Status == "" {
+			jobs <- row
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// saved one at a time so the uniqueness checks above still hold
+	for _, row := range rows {
+		result := row.result
+		if result.Status != IMPORT_VALID || dryRun {
+			continue
+		}
+
+		before, err := db.AddReplica(r.Context(), row.spec)
+		if err != nil && !errors.Is(err, db.ErrProxyNotify) {
+			log.Print(err)
+			result.Status = IMPORT_FAILED
+			result.Errors = append(result.Errors, "Failed to save replica")
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to publish message: %v", err)
+			result.Errors = append(result.Errors, "Replica is saved but the proxy could not be notified")
+		}
+
+		result.Status = IMPORT_CREATED
+		if row.updates {
+			result.Status = IMPORT_UPDATED
+		}
+		replica, err := db.GetReplicaByName(r.Context(), row.spec.Name)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		recordProbe(r.Context(), replica.Id, row.probe)
+		if row.spec.Status != db.DISABLED {
+			if err := syncReaddedReplica(r.Context(), before, replica); err != nil {
+				log.Printf("Failed to publish message: %v", err)
+				result.Errors = append(result.Errors, "Replica is saved but the proxy could not be notified")
+			}
+		}
+
+		// a disabled replica stays down, a draining one keeps draining
+		if row.spec.Status == db.DISABLED {
+			if err := changeReplicaStatus(r.Context(), replica, db.DISABLED, drainOptions{}); err != nil {
+				log.Print(err)
+				result.Errors = append(result.Errors, "Replica is saved but could not be disabled")
+			}
+		}
+	}
+
+	for _, result := range summary.Results {
+		switch result.Status {
+		case IMPORT_CREATED, IMPORT_UPDATED, IMPORT_VALID:
+			summary.Succeeded++
+		default:
+			summary.Failed++
+		}
+	}
+
+	if !dryRun && summary.Succeeded > 0 {
+		message := fmt.Sprintf("Imported %d replicas, %d rows failed", summary.Succeeded, summary.Failed)
+		if err := db.LogActivity(r.Context(), "success", message, nil); err != nil {
+			log.Printf("Failed to log activity: %v", err)
+		}
+	}
+
+	utils.NewSuccessResponse(w, summary)
+}
+
+// ExportReplicas writes the replicas matching ?selector in the format ImportReplicas reads.
+func ExportReplicas(w http.ResponseWriter, r *http.Request) {
+	format, err := requestFormat(r, "")
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+
+	selector, err := db.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+
+	replicas, err := db.GetReplicasBySelector(r.Context(), selector)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch replicas"})
+		return
+	}
+	pools, err := db.GetPools(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch pools"})
+		return
+	}
+	poolNames := map[int64]string{}
+	for _, pool := range pools {
+		poolNames[pool.Id] = pool.Name
+	}
+
+	records := make([]replicaRecord, 0, len(replicas))
+	for _, replica := range replicas {
+		record := replicaRecord{
+			Name:                  replica.Name,
+			URL:                   replica.URL,
+			HealthCheckEndpoint:   replica.HealthCheckEndpoint,
+			Weight:                replica.Weight,
+			MaxConcurrentRequests: replica.MaxConcurrent,
+			CapacityClass:         replica.CapacityClass,
+			Labels:                replica.Labels,
+			Status:                db.ACTIVE,
+		}
+		if replica.Status == db.DRAINING || replica.Status == db.DISABLED {
+			record.Status = db.DISABLED
+		}
+		if replica.PoolId != nil {
+			record.Pool = poolNames[*replica.PoolId]
+		}
+		records = append(records, record)
+	}
+
+	var buf bytes.Buffer
+	contentType := "application/json"
+	switch format {
+	case FORMAT_JSON:
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(records)
+	case FORMAT_YAML:
+		contentType = "application/yaml"
+		err = yaml.NewEncoder(&buf).Encode(records)
+	case FORMAT_CSV:
+		contentType = "text/csv"
+		err = encodeReplicaCSV(&buf, records)
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to export replicas"})
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=replicas.%s", format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func encodeReplicaCSV(w io.Writer, records []replicaRecord) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(replicaRecordColumns); err != nil {
+		return err
+	}
+	for _, record := range records {
+		err := writer.Write([]string{
+			record.Name,
+			record.URL,
+			record.HealthCheckEndpoint,
+			strconv.Itoa(record.Weight),
+			strconv.Itoa(record.MaxConcurrentRequests),
+			record.CapacityClass,
+			record.Pool,
+			formatLabelList(record.Labels),
+			record.Status,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
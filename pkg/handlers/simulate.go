@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/simulator"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultSimulatedMedianLatencyMs = 20
+const defaultSimulatedP99LatencyMs = 100
+
+// replicas come from the workload, from the active replicas (of pool) with their recorded
+// error rates when from_statistics is set, or both, workload replicas overriding by name.
+// Recorded statistics have no latencies, derived replicas take median_latency_ms and
+// p99_latency_ms.
+type simulatePayload struct {
+	Parameters      db.AddPrequalParametersType `json:"parameters"`
+	Pool            string                      `json:"pool"`
+	Workload        simulator.Workload          `json:"workload"`
+	FromStatistics  bool                        `json:"from_statistics"`
+	MedianLatencyMs float64                     `json:"median_latency_ms"`
+	P99LatencyMs    float64                     `json:"p99_latency_ms"`
+	// also simulate the parameters in use, for comparison
+	CompareCurrent bool `json:"compare_current"`
+}
+
+type simulateResponse struct {
+	Parameters        simulator.Parameters  `json:"parameters"`
+	Workload          simulator.Workload    `json:"workload"`
+	Result            simulator.Result      `json:"result"`
+	CurrentParameters *simulator.Parameters `json:"current_parameters,omitempty"`
+	Current           *simulator.Result     `json:"current,omitempty"`
+}
+
+func simulatorParameters(parameters db.PrequalParametersResponse) simulator.Parameters {
+	return simulator.Parameters{
+		MaxLifeTime:       parameters.MaxLifeTime,
+		PoolSize:          parameters.PoolSize,
+		ProbeFactor:       parameters.ProbeFactor,
+		ProbeRemoveFactor: parameters.ProbeRemoveFactor,
+		Mu:                parameters.Mu,
+	}
+}
+
+// the active replicas of the pool (every pool without one) with their recorded error rates
+func replicasFromStatistics(ctx context.Context, pool *db.Pool, medianMs, p99Ms float64) ([]simulator.Replica, error) {
+	var replicas []db.Replica
+	var stats []db.Statistics
+	var err error
+	if pool != nil {
+		if replicas, err = db.GetPoolReplicas(ctx, pool.Id); err != nil {
+			return nil, err
+		}
+		stats, err = db.GetPoolStatistics(ctx, pool.Id)
+	} else {
+		if replicas, err = db.GetReplicas(ctx); err != nil {
+			return nil, err
+		}
+		stats, err = db.GetStatistics(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	errorRates := map[string]float64{}
+	for _, stat := range stats {
+		if total := stat.SuccessfulRequests + stat.FailedRequests; total > 0 {
+			errorRates[stat.URL] = float64(stat.FailedRequests) / float64(total)
+		}
+	}
+
+	derived := []simulator.Replica{}
+	for _, replica := range replicas {
+		if replica.Status != db.ACTIVE {
+			continue
+		}
+		derived = append(derived, simulator.Replica{
+			Name:                  replica.Name,
+			URL:                   replica.URL,
+			MedianLatencyMs:       medianMs,
+			P99LatencyMs:          p99Ms,
+			ErrorRate:             errorRates[replica.URL],
+			MaxConcurrentRequests: replica.MaxConcurrent,
+		})
+	}
+	return derived, nil
+}
+
+// runs the candidate parameters (and optionally the current ones) against a workload model
+// and returns the predicted latencies, error rate and load per replica
+func SimulatePrequalParameters(w http.ResponseWriter, r *http.Request) {
+	var payload simulatePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	if validationErrors := validatePrequalParameters(payload.Parameters); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	var pool *db.Pool
+	if payload.Pool != "" {
+		found, err := db.GetPoolByName(r.Context(), payload.Pool)
+		if err != nil {
+			utils.NewErrorResponse(w, http.StatusNotFound, []string{"Pool not found"})
+			return
+		}
+		pool = found
+	}
+
+	workload := payload.Workload
+	if payload.FromStatistics {
+		if payload.MedianLatencyMs == 0 {
+			payload.MedianLatencyMs = defaultSimulatedMedianLatencyMs
+		}
+		if payload.P99LatencyMs == 0 {
+			payload.P99LatencyMs = max(defaultSimulatedP99LatencyMs, payload.MedianLatencyMs)
+		}
+
+		derived, err := replicasFromStatistics(r.Context(), pool, payload.MedianLatencyMs, payload.P99LatencyMs)
+		if err != nil {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch replica statistics"})
+			return
+		}
+
+		overrides := map[string]simulator.Replica{}
+		for _, replica := range workload.Replicas {
+			overrides[replica.Name] = replica
+		}
+		replicas := []simulator.Replica{}
+		for _, replica := range derived {
+			if override, ok := overrides[replica.Name]; ok {
+				replica = override
+				delete(overrides, replica.Name)
+			}
+			replicas = append(replicas, replica)
+		}
+		for _, replica := range workload.Replicas {
+			if _, ok := overrides[replica.Name]; ok {
+				replicas = append(replicas, replica)
+			}
+		}
+		workload.Replicas = replicas
+	}
+
+	workload.Defaults()
+	if problems := workload.Validate(); len(problems) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, problems)
+		return
+	}
+
+	candidate := simulator.Parameters{
+		MaxLifeTime:       payload.Parameters.MaxLifeTime,
+		PoolSize:          payload.Parameters.PoolSize,
+		ProbeFactor:       payload.Parameters.ProbeFactor,
+		ProbeRemoveFactor: payload.Parameters.ProbeRemoveFactor,
+		Mu:                payload.Parameters.Mu,
+	}
+	response := simulateResponse{
+		Parameters: candidate,
+		Workload:   workload,
+		Result:     simulator.Run(candidate, workload),
+	}
+
+	if payload.CompareCurrent {
+		var current db.PrequalParametersResponse
+		var err error
+		if pool != nil {
+			current, err = db.GetPoolPrequalParameters(r.Context(), pool.Id)
+		} else {
+			current, err = db.GetPrequalParametersResponse(r.Context())
+		}
+		if err != nil {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch the current parameters"})
+			return
+		}
+
+		parameters := simulatorParameters(current)
+		result := simulator.Run(parameters, workload)
+		response.CurrentParameters = &parameters
+		response.Current = &result
+	}
+
+	utils.NewSuccessResponse(w, response)
+}
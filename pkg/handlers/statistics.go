@@ -28,7 +28,13 @@ func GetStatistics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats, err := db.GetStatistics(r.Context())
+	selector, err := db.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+
+	stats, err := db.GetStatisticsBySelector(r.Context(), selector)
 
 	if err != nil {
 		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch statistics"})
@@ -37,3 +43,69 @@ func GetStatistics(w http.ResponseWriter, r *http.Request) {
 
 	utils.NewSuccessResponse(w, stats)
 }
+
+type StatisticsGroup struct {
+	Value              string `json:"value"`
+	Replicas           int    `json:"replicas"`
+	SuccessfulRequests int64  `json:"successful_requests"`
+	FailedRequests     int64  `json:"failed_requests"`
+}
+
+type StatisticsAggregate struct {
+	Selector           string            `json:"selector"`
+	GroupBy            string            `json:"group_by,omitempty"`
+	Replicas           int               `json:"replicas"`
+	SuccessfulRequests int64             `json:"successful_requests"`
+	FailedRequests     int64             `json:"failed_requests"`
+	Groups             []StatisticsGroup `json:"groups,omitempty"`
+}
+
+// sums the statistics of the replicas matching a selector, optionally grouped by a label
+func GetStatisticsAggregate(w http.ResponseWriter, r *http.Request) {
+	selector, err := db.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	groupBy := r.URL.Query().Get("group_by")
+
+	stats, err := db.GetStatisticsBySelector(r.Context(), selector)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch statistics"})
+		return
+	}
+
+	aggregate := StatisticsAggregate{Selector: selector.String(), GroupBy: groupBy}
+	groups := map[string]*StatisticsGroup{}
+	var order []string
+
+	for _, stat := range stats {
+		aggregate.Replicas++
+		aggregate.SuccessfulRequests += stat.SuccessfulRequests
+		aggregate.FailedRequests += stat.FailedRequests
+
+		if groupBy == "" {
+			continue
+		}
+
+		value := ""
+		if stat.Replica != nil {
+			value = stat.Replica.Labels[groupBy]
+		}
+		group, ok := groups[value]
+		if !ok {
+			group = &StatisticsGroup{Value: value}
+			groups[value] = group
+			order = append(order, value)
+		}
+		group.Replicas++
+		group.SuccessfulRequests += stat.SuccessfulRequests
+		group.FailedRequests += stat.FailedRequests
+	}
+
+	for _, value := range order {
+		aggregate.Groups = append(aggregate.Groups, *groups[value])
+	}
+
+	utils.NewSuccessResponse(w, aggregate)
+}
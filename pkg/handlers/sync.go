@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const defaultStateReportLimit = 50
+
+type proxySyncStatus struct {
+	InstanceId string          `json:"instance_id"`
+	LastReport *db.StateReport `json:"last_report"`
+	InSync     bool            `json:"in_sync"`
+}
+
+type syncStatusResponse struct {
+	DesiredVersion  int64             `json:"desired_version"`
+	LastReport      *db.StateReport   `json:"last_report"`
+	InSync          bool              `json:"in_sync"`
+	AutoCorrect     bool              `json:"auto_correct"`
+	IntervalSeconds int               `json:"interval_seconds"`
+	Proxies         []proxySyncStatus `json:"proxies"`
+}
+
+// whether the report matched the given desired version
+func reportInSync(report *db.StateReport, version int64) bool {
+	return report != nil && report.InSync && report.DesiredVersion != nil && *report.DesiredVersion == version
+}
+
+// the desired state as it would be sent to the proxy now
+func GetStateSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := messaging.CurrentStateSnapshot(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to build state snapshot"})
+		return
+	}
+	utils.NewSuccessResponse(w, snapshot)
+}
+
+// sends the desired state to the proxy without waiting for the next sync
+func PublishStateSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := messaging.PublishStateSnapshot(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to publish state snapshot"})
+		return
+	}
+
+	username, _ := r.Context().Value("username").(string)
+	message := "State snapshot version " + strconv.FormatInt(snapshot.Version, 10) + " published by " + username
+	if err := db.LogActivity(r.Context(), "success", message, nil); err != nil {
+		log.Printf("Failed to log activity: %v", err)
+	}
+
+	utils.NewSuccessResponse(w, snapshot)
+}
+
+// lists state reports from the proxy, newest first. ?proxy only lists those of one instance,
+// ?drift_only=true skips reports that were in sync and ?limit caps how many are returned (default 50)
+func GetStateReports(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var proxyId *int64
+	if instanceId := query.Get("proxy"); instanceId != "" {
+		proxy, err := db.GetProxyInstance(r.Context(), instanceId)
+		if err != nil {
+			utils.NewErrorResponse(w, http.StatusNotFound, []string{"Proxy instance not found"})
+			return
+		}
+		proxyId = &proxy.Id
+	}
+
+	driftOnly := false
+	if raw := query.Get("drift_only"); raw != "" {
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid drift_only"})
+			return
+		}
+		driftOnly = parsed
+	}
+
+	limit := defaultStateReportLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	reports, err := db.GetStateReports(r.Context(), proxyId, driftOnly, limit)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch state reports"})
+		return
+	}
+
+	if len(reports) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, reports)
+}
+
+// whether the last report from the proxy matched the desired state
+func GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := messaging.CurrentStateSnapshot(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to build state snapshot"})
+		return
+	}
+
+	reports, err := db.GetStateReports(r.Context(), nil, false, 1)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch state reports"})
+		return
+	}
+
+	status := syncStatusResponse{
+		DesiredVersion:  snapshot.Version,
+		AutoCorrect:     messaging.AutoCorrectDrift(),
+		IntervalSeconds: int(messaging.StateSyncInterval().Seconds()),
+		Proxies:         []proxySyncStatus{},
+	}
+	if len(reports) > 0 {
+		status.LastReport = &reports[0]
+		status.InSync = reportInSync(status.LastReport, snapshot.Version)
+	}
+
+	// with several instances the fleet is only in sync when every one of them is
+	proxies, err := db.GetProxyInstances(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch proxy instances"})
+		return
+	}
+	for i := range proxies {
+		proxyStatus := proxySyncStatus{InstanceId: proxies[i].InstanceId}
+		reports, err := db.GetStateReports(r.Context(), &proxies[i].Id, false, 1)
+		if err != nil {
+			log.Println(err)
+			utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch state reports"})
+			return
+		}
+		if len(reports) > 0 {
+			proxyStatus.LastReport = &reports[0]
+			proxyStatus.InSync = reportInSync(proxyStatus.LastReport, snapshot.Version)
+		}
+		status.Proxies = append(status.Proxies, proxyStatus)
+	}
+	if len(status.Proxies) > 0 {
+		status.InSync = true
+		for _, proxyStatus := range status.Proxies {
+			status.InSync = status.InSync && proxyStatus.InSync
+		}
+	}
+
+	utils.NewSuccessResponse(w, status)
+}
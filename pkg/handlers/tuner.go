@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/messaging"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+	"github.com/AshimKoirala/load-balancer-admin/pkg/tuner"
+	"github.com/AshimKoirala/load-balancer-admin/utils"
+)
+
+const maxTunerWindowSeconds = 12 * 60 * 60
+
+// settings to change, absent fields are kept. Bounds replace the current ones as a whole.
+type tunerSettingsPayload struct {
+	Enabled         *bool                          `json:"enabled"`
+	Mode            *string                        `json:"mode"`
+	WindowSeconds   *int                           `json:"window_seconds"`
+	CooldownSeconds *int                           `json:"cooldown_seconds"`
+	MinRequests     *int64                         `json:"min_requests"`
+	HighErrorRatio  *float64                       `json:"high_error_ratio"`
+	LowErrorRatio   *float64                       `json:"low_error_ratio"`
+	ProbeFactorStep *float64                       `json:"probe_factor_step"`
+	Bounds          map[string]*db.ParameterBounds `json:"bounds"`
+}
+
+// the settings with what the auto-tuner makes of the statistics right now
+type tunerStatus struct {
+	Settings   *db.TunerSettings          `json:"settings"`
+	Evaluation *messaging.TunerEvaluation `json:"evaluation"`
+}
+
+func (p tunerSettingsPayload) apply(settings *db.TunerSettings) []string {
+	var validationErrors []string
+
+	if p.Enabled != nil {
+		settings.Enabled = *p.Enabled
+	}
+	if p.Mode != nil {
+		if !slices.Contains(db.TunerModes, *p.Mode) {
+			validationErrors = append(validationErrors, "mode: must be one of "+strings.Join(db.TunerModes, ", "))
+		}
+		settings.Mode = *p.Mode
+	}
+	if p.WindowSeconds != nil {
+		if *p.WindowSeconds < int(messaging.TUNER_CHECK_INTERVAL.Seconds()) || *p.WindowSeconds > maxTunerWindowSeconds {
+			validationErrors = append(validationErrors, fmt.Sprintf("window_seconds: must be between %d and %d",
+				int(messaging.TUNER_CHECK_INTERVAL.Seconds()), maxTunerWindowSeconds))
+		}
+		settings.WindowSeconds = *p.WindowSeconds
+	}
+	if p.CooldownSeconds != nil {
+		if *p.CooldownSeconds < 0 {
+			validationErrors = append(validationErrors, "cooldown_seconds: must not be negative")
+		}
+		settings.CooldownSeconds = *p.CooldownSeconds
+	}
+	if p.MinRequests != nil {
+		if *p.MinRequests < 1 {
+			validationErrors = append(validationErrors, "min_requests: must be at least 1")
+		}
+		settings.MinRequests = *p.MinRequests
+	}
+	if p.HighErrorRatio != nil {
+		settings.HighErrorRatio = *p.HighErrorRatio
+	}
+	if p.LowErrorRatio != nil {
+		settings.LowErrorRatio = *p.LowErrorRatio
+	}
+	if settings.LowErrorRatio < 0 || settings.HighErrorRatio > 1 || settings.LowErrorRatio >= settings.HighErrorRatio {
+		validationErrors = append(validationErrors, "low_error_ratio, high_error_ratio: must satisfy 0 <= low_error_ratio < high_error_ratio <= 1")
+	}
+	if p.ProbeFactorStep != nil {
+		if *p.ProbeFactorStep <= 0 {
+			validationErrors = append(validationErrors, "probe_factor_step: must be greater than 0")
+		}
+		settings.ProbeFactorStep = *p.ProbeFactorStep
+	}
+
+	if p.Bounds != nil {
+		settings.Bounds = map[string]db.ParameterBounds{}
+		schema := db.PrequalParameterSchema()
+		for field, bounds := range p.Bounds {
+			if !slices.Contains(tuner.TunableFields, field) {
+				validationErrors = append(validationErrors, fmt.Sprintf("bounds: %s cannot be tuned, only %s", field, strings.Join(tuner.TunableFields, ", ")))
+				continue
+			}
+			// null leaves the parameter alone
+			if bounds == nil {
+				continue
+			}
+			if bounds.Min > bounds.Max {
+				validationErrors = append(validationErrors, fmt.Sprintf("bounds: %s min must not be above max", field))
+				continue
+			}
+			// bounds stay within the parameter limits, so every step is a valid value
+			for _, constraint := range schema.Fields {
+				if constraint.Field != field {
+					continue
+				}
+				if constraint.Min != nil && (bounds.Min < *constraint.Min || (constraint.ExclusiveMin && bounds.Min == *constraint.Min)) {
+					validationErrors = append(validationErrors, fmt.Sprintf("bounds: %s min is below the parameter limit", field))
+				}
+				if constraint.Max != nil && bounds.Max > *constraint.Max {
+					validationErrors = append(validationErrors, fmt.Sprintf("bounds: %s max is above the parameter limit of %g", field, *constraint.Max))
+				}
+			}
+			settings.Bounds[field] = *bounds
+		}
+	}
+
+	if settings.Enabled && len(settings.Bounds) == 0 {
+		validationErrors = append(validationErrors, "bounds: at least one parameter needs bounds to enable the auto-tuner")
+	}
+	return validationErrors
+}
+
+// evaluates the rules on the statistics as of now, without storing anything
+func evaluateTuner(r *http.Request, settings *db.TunerSettings) (*messaging.TunerEvaluation, error) {
+	sample, err := messaging.SampleStatistics(r.Context(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return messaging.EvaluateTuner(r.Context(), settings, sample)
+}
+
+// shows the settings of the auto-tuner and what its rules would decide right now
+func GetTunerSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := db.GetTunerSettings(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch tuner settings"})
+		return
+	}
+
+	evaluation, err := evaluateTuner(r, settings)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to evaluate tuner rules"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, tunerStatus{Settings: settings, Evaluation: evaluation})
+}
+
+// changes the settings of the auto-tuner, its bounds and whether it runs are up to admins
+func UpdateTunerSettings(w http.ResponseWriter, r *http.Request) {
+	var payload tunerSettingsPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid request payload"})
+		return
+	}
+
+	admin, err := currentUser(r)
+	if err != nil {
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Error fetching user"})
+		return
+	}
+	if admin.Role != db.ROLE_ADMIN {
+		utils.NewErrorResponse(w, http.StatusForbidden, []string{"Only admins can change the auto-tuner settings"})
+		return
+	}
+
+	settings, err := db.GetTunerSettings(r.Context())
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch tuner settings"})
+		return
+	}
+	if validationErrors := payload.apply(settings); len(validationErrors) > 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	settings.UpdatedBy = admin.Username
+	if err := db.UpdateTunerSettings(r.Context(), settings); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to update tuner settings"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, settings)
+}
+
+// turns the auto-tuner off right away, anyone signed in can pull this switch
+func DisableTuner(w http.ResponseWriter, r *http.Request) {
+	username, _ := r.Context().Value("username").(string)
+	if err := db.DisableTuner(r.Context(), username); err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to disable tuner"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, "Auto-tuner disabled")
+}
+
+// lists the decisions of the auto-tuner, newest first, optionally capped with ?limit
+func GetTunerDecisions(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	decisions, err := db.GetTunerDecisions(r.Context(), limit)
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch tuner decisions"})
+		return
+	}
+
+	if len(decisions) == 0 {
+		utils.NewSuccessResponse(w, []string{})
+		return
+	}
+
+	utils.NewSuccessResponse(w, decisions)
+}
+
+func GetTunerDecision(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		utils.NewErrorResponse(w, http.StatusBadRequest, []string{"Invalid tuner decision ID"})
+		return
+	}
+
+	decision, err := db.GetTunerDecisionById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		utils.NewErrorResponse(w, http.StatusNotFound, []string{"Tuner decision not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		utils.NewErrorResponse(w, http.StatusInternalServerError, []string{"Failed to fetch tuner decision"})
+		return
+	}
+
+	utils.NewSuccessResponse(w, decision)
+}
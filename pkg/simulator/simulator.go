@@ -0,0 +1,464 @@
+// Package simulator predicts how a set of Prequal parameters behaves under a workload with
+// a discrete-event simulation of one proxy probing and selecting replicas.
+package simulator
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const DEFAULT_DURATION_SECONDS = 60
+const MAX_DURATION_SECONDS = 600
+const DEFAULT_PROBE_LATENCY_MS = 1
+const MAX_SIMULATED_REQUESTS = 1000000
+
+// z-score of the 99th percentile, turns a median and p99 into a lognormal distribution
+const p99ZScore = 2.3263
+
+// weight of a completed request in the latency estimate a replica reports to probes
+const latencyEstimateWeight = 0.1
+
+// Parameters are the Prequal parameters under test, as the simulated proxy reads them:
+// probes are usable for MaxLifeTime seconds, at most PoolSize are kept, ProbeFactor probes
+// are sent per request (a fraction is sent with that probability), the ProbeRemoveFactor
+// hottest probes are dropped per request and a probe serves at most Mu selections.
+type Parameters struct {
+	MaxLifeTime       int     `json:"max_life_time"`
+	PoolSize          int     `json:"pool_size"`
+	ProbeFactor       float64 `json:"probe_factor"`
+	ProbeRemoveFactor int     `json:"probe_remove_factor"`
+	Mu                int     `json:"mu"`
+}
+
+// Replica is how a replica serves requests: latencies are lognormal with the given median
+// and 99th percentile, requests beyond MaxConcurrentRequests wait in line (0 is no limit)
+// and fail with probability ErrorRate.
+type Replica struct {
+	Name                  string  `json:"name"`
+	URL                   string  `json:"url,omitempty"`
+	MedianLatencyMs       float64 `json:"median_latency_ms"`
+	P99LatencyMs          float64 `json:"p99_latency_ms"`
+	ErrorRate             float64 `json:"error_rate"`
+	MaxConcurrentRequests int     `json:"max_concurrent_requests"`
+}
+
+// Workload is a Poisson stream of ArrivalRate requests per second for DurationSeconds. The
+// same seed gives the same run.
+type Workload struct {
+	ArrivalRate     float64   `json:"arrival_rate"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ProbeLatencyMs  float64   `json:"probe_latency_ms"`
+	Seed            int64     `json:"seed"`
+	Replicas        []Replica `json:"replicas"`
+}
+
+type LatencySummary struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+type ReplicaLoad struct {
+	Name         string         `json:"name"`
+	URL          string         `json:"url,omitempty"`
+	Requests     int            `json:"requests"`
+	Share        float64        `json:"share"`
+	Errors       int            `json:"errors"`
+	ErrorRate    float64        `json:"error_rate"`
+	LatencyMs    LatencySummary `json:"latency_ms"`
+	MeanInFlight float64        `json:"mean_in_flight"`
+	MaxInFlight  int            `json:"max_in_flight"`
+}
+
+type Result struct {
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	ErrorRate float64        `json:"error_rate"`
+	LatencyMs LatencySummary `json:"latency_ms"`
+	// time until the last request finished, longer than the workload when replicas fall behind
+	SimulatedMs float64 `json:"simulated_ms"`
+	ProbesSent  int     `json:"probes_sent"`
+	// requests sent to a random replica because no usable probe was left
+	UnprobedSelections int           `json:"unprobed_selections"`
+	Replicas           []ReplicaLoad `json:"replicas"`
+}
+
+// Defaults fills in the optional fields of the workload.
+func (w *Workload) Defaults() {
+	if w.DurationSeconds == 0 {
+		w.DurationSeconds = DEFAULT_DURATION_SECONDS
+	}
+	if w.ProbeLatencyMs == 0 {
+		w.ProbeLatencyMs = DEFAULT_PROBE_LATENCY_MS
+	}
+	for i := range w.Replicas {
+		if w.Replicas[i].P99LatencyMs == 0 {
+			w.Replicas[i].P99LatencyMs = w.Replicas[i].MedianLatencyMs
+		}
+	}
+}
+
+// Validate lists what is wrong with the workload.
+func (w Workload) Validate() []string {
+	var problems []string
+	if w.ArrivalRate <= 0 {
+		problems = append(problems, "arrival_rate must be greater than 0")
+	}
+	if w.DurationSeconds <= 0 || w.DurationSeconds > MAX_DURATION_SECONDS {
+		problems = append(problems, fmt.Sprintf("duration_seconds must be greater than 0 and at most %d", MAX_DURATION_SECONDS))
+	}
+	if w.ArrivalRate*w.DurationSeconds > MAX_SIMULATED_REQUESTS {
+		problems = append(problems, fmt.Sprintf("arrival_rate * duration_seconds must be at most %d requests", MAX_SIMULATED_REQUESTS))
+	}
+	if w.ProbeLatencyMs < 0 {
+		problems = append(problems, "probe_latency_ms must not be negative")
+	}
+	if len(w.Replicas) == 0 {
+		problems = append(problems, "at least one replica is required")
+	}
+	for i, replica := range w.Replicas {
+		name := replica.Name
+		if name == "" {
+			name = fmt.Sprintf("replicas[%d]", i)
+		}
+		if replica.MedianLatencyMs <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: median_latency_ms must be greater than 0", name))
+		}
+		if replica.P99LatencyMs < replica.MedianLatencyMs {
+			problems = append(problems, fmt.Sprintf("%s: p99_latency_ms must not be below median_latency_ms", name))
+		}
+		if replica.ErrorRate < 0 || replica.ErrorRate > 1 {
+			problems = append(problems, fmt.Sprintf("%s: error_rate must be between 0 and 1", name))
+		}
+		if replica.MaxConcurrentRequests < 0 {
+			problems = append(problems, fmt.Sprintf("%s: max_concurrent_requests must not be negative", name))
+		}
+	}
+	return problems
+}
+
+type eventKind int
+
+const (
+	arrivalEvent eventKind = iota
+	completionEvent
+	probeEvent
+)
+
+type event struct {
+	at      float64
+	seq     int
+	kind    eventKind
+	replica int
+	request *request
+}
+
+// events ordered by time, then by when they were scheduled
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type request struct {
+	arrivedAt float64
+	failed    bool
+}
+
+type replicaState struct {
+	Replica
+	mu, sigma float64
+
+	inFlight  int
+	busy      int
+	waiting   []*request
+	estimate  float64
+	latencies []float64
+	errors    int
+
+	maxInFlight  int
+	inFlightArea float64
+	changedAt    float64
+}
+
+// in-flight requests, integrated over time for the mean
+func (r *replicaState) setInFlight(now float64, inFlight int) {
+	r.inFlightArea += float64(r.inFlight) * (now - r.changedAt)
+	r.changedAt = now
+	r.inFlight = inFlight
+	r.maxInFlight = max(r.maxInFlight, inFlight)
+}
+
+// a probe is hot when its replica had no free concurrency, replicas without a limit never are
+func (r *replicaState) hot(inFlight int) bool {
+	return r.MaxConcurrentRequests > 0 && inFlight >= r.MaxConcurrentRequests
+}
+
+type probe struct {
+	replica    int
+	inFlight   int
+	latency    float64
+	receivedAt float64
+	uses       int
+}
+
+type simulation struct {
+	params   Parameters
+	workload Workload
+	rng      *rand.Rand
+	events   eventQueue
+	seq      int
+	replicas []*replicaState
+	pool     []*probe
+	result   Result
+}
+
+// Run simulates the workload against replicas selected with the parameters.
+func Run(params Parameters, workload Workload) Result {
+	s := &simulation{
+		params:   params,
+		workload: workload,
+		rng:      rand.New(rand.NewSource(workload.Seed)),
+	}
+	for _, replica := range workload.Replicas {
+		state := &replicaState{Replica: replica, mu: math.Log(replica.MedianLatencyMs), estimate: replica.MedianLatencyMs}
+		if replica.P99LatencyMs > replica.MedianLatencyMs {
+			state.sigma = math.Log(replica.P99LatencyMs/replica.MedianLatencyMs) / p99ZScore
+		}
+		s.replicas = append(s.replicas, state)
+	}
+
+	s.scheduleArrival(0)
+
+	now := 0.0
+	for s.events.Len() > 0 {
+		e := heap.Pop(&s.events).(*event)
+		now = e.at
+		switch e.kind {
+		case arrivalEvent:
+			s.arrive(now)
+		case completionEvent:
+			s.complete(now, e.replica, e.request)
+		case probeEvent:
+			s.receiveProbe(now, e.replica)
+		}
+	}
+
+	return s.summarize(now)
+}
+
+// arrivals are scheduled one at a time, until the workload ends
+func (s *simulation) scheduleArrival(after float64) {
+	at := after + s.rng.ExpFloat64()/s.workload.ArrivalRate*1000
+	if at < s.workload.DurationSeconds*1000 {
+		s.schedule(&event{at: at, kind: arrivalEvent})
+	}
+}
+
+func (s *simulation) schedule(e *event) {
+	s.seq++
+	e.seq = s.seq
+	heap.Push(&s.events, e)
+}
+
+func (s *simulation) arrive(now float64) {
+	s.scheduleArrival(now)
+
+	probes := int(s.params.ProbeFactor)
+	if s.rng.Float64() < s.params.ProbeFactor-float64(probes) {
+		probes++
+	}
+	for i := 0; i < probes; i++ {
+		s.schedule(&event{at: now + s.workload.ProbeLatencyMs, kind: probeEvent, replica: s.rng.Intn(len(s.replicas))})
+	}
+	s.result.ProbesSent += probes
+
+	chosen := s.selectReplica(now)
+	s.removeHottest(s.params.ProbeRemoveFactor)
+
+	replica := s.replicas[chosen]
+	req := &request{arrivedAt: now, failed: s.rng.Float64() < replica.ErrorRate}
+	replica.setInFlight(now, replica.inFlight+1)
+	if replica.MaxConcurrentRequests == 0 || replica.busy < replica.MaxConcurrentRequests {
+		s.startService(now, chosen, req)
+	} else {
+		replica.waiting = append(replica.waiting, req)
+	}
+}
+
+// picks a replica with the hot-cold rule: the cold probe with the lowest latency, or the
+// probe with the fewest requests in flight when all are hot
+func (s *simulation) selectReplica(now float64) int {
+	maxAge := float64(s.params.MaxLifeTime) * 1000
+	usable := s.pool[:0]
+	for _, p := range s.pool {
+		if now-p.receivedAt <= maxAge {
+			usable = append(usable, p)
+		}
+	}
+	s.pool = usable
+
+	if len(s.pool) == 0 {
+		s.result.UnprobedSelections++
+		return s.rng.Intn(len(s.replicas))
+	}
+
+	best := -1
+	for i, p := range s.pool {
+		if s.replicas[p.replica].hot(p.inFlight) {
+			continue
+		}
+		if best < 0 || p.latency < s.pool[best].latency {
+			best = i
+		}
+	}
+	if best < 0 {
+		for i, p := range s.pool {
+			if best < 0 || p.inFlight < s.pool[best].inFlight {
+				best = i
+			}
+		}
+	}
+
+	chosen := s.pool[best]
+	chosen.uses++
+	// the probe now also counts the request sent on its strength
+	chosen.inFlight++
+	if chosen.uses >= s.params.Mu {
+		s.pool = append(s.pool[:best], s.pool[best+1:]...)
+	}
+	return chosen.replica
+}
+
+func (s *simulation) removeHottest(n int) {
+	for ; n > 0 && len(s.pool) > 0; n-- {
+		hottest := 0
+		for i, p := range s.pool {
+			if p.inFlight > s.pool[hottest].inFlight {
+				hottest = i
+			}
+		}
+		s.pool = append(s.pool[:hottest], s.pool[hottest+1:]...)
+	}
+}
+
+func (s *simulation) receiveProbe(now float64, index int) {
+	replica := s.replicas[index]
+	s.pool = append(s.pool, &probe{
+		replica:    index,
+		inFlight:   replica.inFlight,
+		latency:    replica.estimate,
+		receivedAt: now,
+	})
+	// the oldest probe makes room
+	if len(s.pool) > s.params.PoolSize {
+		s.pool = s.pool[1:]
+	}
+}
+
+func (s *simulation) startService(now float64, index int, req *request) {
+	replica := s.replicas[index]
+	replica.busy++
+	service := math.Exp(replica.mu + replica.sigma*s.rng.NormFloat64())
+	s.schedule(&event{at: now + service, kind: completionEvent, replica: index, request: req})
+}
+
+func (s *simulation) complete(now float64, index int, req *request) {
+	replica := s.replicas[index]
+	replica.busy--
+	replica.setInFlight(now, replica.inFlight-1)
+
+	latency := now - req.arrivedAt
+	replica.latencies = append(replica.latencies, latency)
+	replica.estimate += latencyEstimateWeight * (latency - replica.estimate)
+	if req.failed {
+		replica.errors++
+	}
+
+	if len(replica.waiting) > 0 {
+		next := replica.waiting[0]
+		replica.waiting = replica.waiting[1:]
+		s.startService(now, index, next)
+	}
+}
+
+func (s *simulation) summarize(end float64) Result {
+	result := s.result
+	result.SimulatedMs = end
+	result.Replicas = []ReplicaLoad{}
+
+	var all []float64
+	for _, replica := range s.replicas {
+		replica.setInFlight(end, replica.inFlight)
+		all = append(all, replica.latencies...)
+		result.Errors += replica.errors
+
+		load := ReplicaLoad{
+			Name:        replica.Name,
+			URL:         replica.URL,
+			Requests:    len(replica.latencies),
+			Errors:      replica.errors,
+			LatencyMs:   summarizeLatencies(replica.latencies),
+			MaxInFlight: replica.maxInFlight,
+		}
+		if load.Requests > 0 {
+			load.ErrorRate = float64(load.Errors) / float64(load.Requests)
+		}
+		if end > 0 {
+			load.MeanInFlight = replica.inFlightArea / end
+		}
+		result.Replicas = append(result.Replicas, load)
+	}
+
+	result.Requests = len(all)
+	result.LatencyMs = summarizeLatencies(all)
+	if result.Requests > 0 {
+		result.ErrorRate = float64(result.Errors) / float64(result.Requests)
+		for i := range result.Replicas {
+			result.Replicas[i].Share = float64(result.Replicas[i].Requests) / float64(result.Requests)
+		}
+	}
+	return result
+}
+
+func summarizeLatencies(latencies []float64) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	sorted := append([]float64(nil), latencies...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, latency := range sorted {
+		sum += latency
+	}
+	quantile := func(q float64) float64 {
+		return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+	}
+	return LatencySummary{
+		Mean: sum / float64(len(sorted)),
+		P50:  quantile(0.5),
+		P90:  quantile(0.9),
+		P99:  quantile(0.99),
+		P999: quantile(0.999),
+		Max:  sorted[len(sorted)-1],
+	}
+}
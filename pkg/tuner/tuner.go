@@ -0,0 +1,169 @@
+// Package tuner holds the rules the auto-tuner adjusts the Prequal parameters by. Rules look
+// at the error ratio of a window of statistics samples and move one parameter a step within
+// the bounds an admin set, every decision says which rule fired on which numbers.
+package tuner
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/AshimKoirala/load-balancer-admin/pkg/db"
+)
+
+// the rules, tried in this order
+const (
+	// errors climb: probe more replicas per request to find the healthy ones
+	RULE_RAISE_PROBE_FACTOR = "raise_probe_factor_on_errors"
+	// errors climb and probe_factor is at its bound: reuse probe results less often
+	RULE_LOWER_MU = "lower_mu_on_errors"
+	// errors stay low: probe less to save the load probes put on replicas
+	RULE_LOWER_PROBE_FACTOR = "lower_probe_factor_when_healthy"
+)
+
+// fields the rules can move, bounds on other fields are refused
+var TunableFields = []string{"probe_factor", "mu"}
+
+// a change of the parameters and why
+type Proposal struct {
+	Rule        string                      `json:"rule"`
+	Explanation string                      `json:"explanation"`
+	Parameters  db.AddPrequalParametersType `json:"parameters"`
+	Changes     []db.TunerChange            `json:"changes"`
+}
+
+func errorRatio(requests, failed int64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(failed) / float64(requests)
+}
+
+// requests served by the replicas at urls between two samples. A counter below the one in
+// from was reset by the proxy and counts from zero.
+func delta(from, to *db.StatisticsSample, urls []string) (requests, failed int64) {
+	for _, url := range urls {
+		current := to.Counts[url]
+		base := from.Counts[url]
+		if current.Successful < base.Successful || current.Failed < base.Failed {
+			base = db.RequestCounts{}
+		}
+		requests += current.Successful - base.Successful + current.Failed - base.Failed
+		failed += current.Failed - base.Failed
+	}
+	return requests, failed
+}
+
+// Measure sums the requests of the replicas at urls from windowStart to current, and from
+// previousStart to windowStart when there is a sample that old.
+func Measure(current, windowStart, previousStart *db.StatisticsSample, urls []string) db.TunerMetrics {
+	metrics := db.TunerMetrics{From: windowStart.SampledAt, To: current.SampledAt, Replicas: len(urls)}
+	metrics.Requests, metrics.FailedRequests = delta(windowStart, current, urls)
+	metrics.ErrorRatio = errorRatio(metrics.Requests, metrics.FailedRequests)
+
+	if previousStart != nil {
+		requests, failed := delta(previousStart, windowStart, urls)
+		ratio := errorRatio(requests, failed)
+		metrics.PreviousRequests = &requests
+		metrics.PreviousFailedRequests = &failed
+		metrics.PreviousErrorRatio = &ratio
+	}
+	return metrics
+}
+
+func percent(ratio float64) string {
+	return fmt.Sprintf("%.2f%%", ratio*100)
+}
+
+func number(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func describeMetrics(metrics db.TunerMetrics) string {
+	return fmt.Sprintf("error ratio %s over %s (%d of %d requests failed on %d replicas)",
+		percent(metrics.ErrorRatio), metrics.To.Sub(metrics.From).Round(time.Second), metrics.FailedRequests, metrics.Requests, metrics.Replicas)
+}
+
+func describePrevious(metrics db.TunerMetrics) string {
+	if metrics.PreviousErrorRatio == nil {
+		return "no earlier window to compare with"
+	}
+	return percent(*metrics.PreviousErrorRatio) + " the window before"
+}
+
+// the target of the field moved by step, clamped to its bounds. ok is false when the field
+// has no bounds or cannot move that way.
+func step(settings *db.TunerSettings, field string, from, by float64) (db.TunerChange, bool) {
+	bounds, found := settings.Bounds[field]
+	if !found {
+		return db.TunerChange{}, false
+	}
+	to := math.Round((from+by)*1000) / 1000
+	to = math.Max(bounds.Min, math.Min(bounds.Max, to))
+	if (by > 0 && to <= from) || (by < 0 && to >= from) {
+		return db.TunerChange{}, false
+	}
+	return db.TunerChange{Field: field, From: from, To: to, Min: bounds.Min, Max: bounds.Max}, true
+}
+
+func propose(rule, reason string, current db.AddPrequalParametersType, change db.TunerChange) *Proposal {
+	parameters := current
+	parameters.Status = db.PARAMETERS_ACTIVE
+	switch change.Field {
+	case "probe_factor":
+		parameters.ProbeFactor = change.To
+	case "mu":
+		parameters.Mu = int(change.To)
+	}
+	return &Proposal{
+		Rule: rule,
+		Explanation: fmt.Sprintf("%s: %s %s -> %s (bounds %s to %s)",
+			reason, change.Field, number(change.From), number(change.To), number(change.Min), number(change.Max)),
+		Parameters: parameters,
+		Changes:    []db.TunerChange{change},
+	}
+}
+
+// Evaluate tries the rules on the metrics of the current parameters. It returns the change
+// of the first rule that fires, or nil and why none did.
+func Evaluate(settings *db.TunerSettings, metrics db.TunerMetrics, current db.AddPrequalParametersType) (*Proposal, string) {
+	measured := describeMetrics(metrics)
+	if metrics.Requests < settings.MinRequests {
+		return nil, fmt.Sprintf("%s, %d requests are needed to decide", measured, settings.MinRequests)
+	}
+
+	previous := metrics.PreviousErrorRatio
+	if metrics.ErrorRatio >= settings.HighErrorRatio {
+		if previous != nil && metrics.ErrorRatio < *previous {
+			return nil, fmt.Sprintf("%s is at or above %s but falling from %s", measured, percent(settings.HighErrorRatio), describePrevious(metrics))
+		}
+		reason := fmt.Sprintf("%s is at or above %s and not falling, %s", measured, percent(settings.HighErrorRatio), describePrevious(metrics))
+
+		if change, ok := step(settings, "probe_factor", current.ProbeFactor, settings.ProbeFactorStep); ok {
+			return propose(RULE_RAISE_PROBE_FACTOR, reason, current, change), ""
+		}
+		// mu is an integer, a bound between two integers stops at the one inside it
+		if change, ok := step(settings, "mu", float64(current.Mu), -1); ok {
+			change.To = math.Ceil(change.To)
+			if change.To < change.From {
+				return propose(RULE_LOWER_MU, reason, current, change), ""
+			}
+		}
+		return nil, reason + ", but probe_factor and mu are at their bounds"
+	}
+
+	if metrics.ErrorRatio <= settings.LowErrorRatio {
+		if previous != nil && *previous > settings.LowErrorRatio {
+			return nil, fmt.Sprintf("%s is at or below %s, but was %s the window before", measured, percent(settings.LowErrorRatio), percent(*previous))
+		}
+		reason := fmt.Sprintf("%s is at or below %s, %s", measured, percent(settings.LowErrorRatio), describePrevious(metrics))
+
+		if change, ok := step(settings, "probe_factor", current.ProbeFactor, -settings.ProbeFactorStep); ok {
+			return propose(RULE_LOWER_PROBE_FACTOR, reason, current, change), ""
+		}
+		return nil, reason + ", but probe_factor is at its lower bound"
+	}
+
+	return nil, fmt.Sprintf("%s is between %s and %s", measured, percent(settings.LowErrorRatio), percent(settings.HighErrorRatio))
+}